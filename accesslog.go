@@ -0,0 +1,144 @@
+package transocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// Names of fields in access logs.
+const (
+	AccessLogTime     = "time"
+	AccessLogClient   = "client"
+	AccessLogDest     = "dst"
+	AccessLogHost     = "host"
+	AccessLogSNI      = "sni"
+	AccessLogProtocol = "protocol"
+	AccessLogRule     = "rule"
+	AccessLogUpstream = "upstream"
+	AccessLogVerdict  = "verdict"
+	AccessLogBytes    = "bytes"
+	AccessLogDuration = "duration"
+	AccessLogError    = "error"
+)
+
+// DefaultAccessLogFields are the fields of access logs if
+// Config.AccessLogFields is empty.
+var DefaultAccessLogFields = []string{
+	AccessLogTime,
+	AccessLogClient,
+	AccessLogDest,
+	AccessLogHost,
+	AccessLogSNI,
+	AccessLogProtocol,
+	AccessLogRule,
+	AccessLogUpstream,
+	AccessLogVerdict,
+	AccessLogBytes,
+	AccessLogDuration,
+	AccessLogError,
+}
+
+func validateAccessLogFields(names []string) error {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		known := false
+		for _, f := range DefaultAccessLogFields {
+			if name == f {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown access log field: %s", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate access log field: %s", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// accessLogger writes a JSON object per line for each connection.
+type accessLogger struct {
+	fields []string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newAccessLogger(w io.Writer, fields []string) *accessLogger {
+	if w == nil {
+		return nil
+	}
+	if len(fields) == 0 {
+		fields = DefaultAccessLogFields
+	}
+	return &accessLogger{fields: fields, w: w}
+}
+
+// log writes fields of a connection accepted at start.  Fields that
+// are not found for the connection are omitted.  a may be nil.
+func (a *accessLogger) log(fields map[string]interface{}, start time.Time) {
+	if a == nil {
+		return
+	}
+	now := time.Now()
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte('{')
+	add := func(key string, value interface{}) {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(data)
+	}
+	addField := func(key, name string) {
+		if v, ok := fields[name]; ok {
+			add(key, v)
+		}
+	}
+	for _, name := range a.fields {
+		switch name {
+		case AccessLogTime:
+			add(name, now.UTC().Format(time.RFC3339Nano))
+		case AccessLogClient:
+			addField(name, "client_addr")
+		case AccessLogDest:
+			addField(name, "dest_addr")
+		case AccessLogHost:
+			addField(name, "dest_host")
+		case AccessLogSNI:
+			if fields["protocol"] == PeekTLS {
+				addField(name, "dest_host")
+			}
+		case AccessLogProtocol, AccessLogRule, AccessLogUpstream, AccessLogVerdict:
+			addField(name, name)
+		case AccessLogBytes:
+			addField("sent_bytes", "sent_bytes")
+			addField("received_bytes", "received_bytes")
+		case AccessLogDuration:
+			add(name, now.Sub(start).Seconds())
+		case AccessLogError:
+			addField(name, log.FnError)
+		}
+	}
+	buf.WriteString("}\n")
+
+	a.mu.Lock()
+	a.w.Write(buf.Bytes())
+	a.mu.Unlock()
+}
@@ -0,0 +1,81 @@
+package transocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+func TestValidateAccessLogFields(t *testing.T) {
+	t.Parallel()
+
+	if err := validateAccessLogFields(nil); err != nil {
+		t.Error(err)
+	}
+	if err := validateAccessLogFields(DefaultAccessLogFields); err != nil {
+		t.Error(err)
+	}
+	if err := validateAccessLogFields([]string{"client", "port"}); err == nil {
+		t.Error("unknown field should be rejected")
+	}
+	if err := validateAccessLogFields([]string{"client", "client"}); err == nil {
+		t.Error("duplicate field should be rejected")
+	}
+}
+
+func TestAccessLogger(t *testing.T) {
+	t.Parallel()
+
+	var nilLogger *accessLogger
+	nilLogger.log(nil, time.Now())
+	if newAccessLogger(nil, nil) != nil {
+		t.Error("access logger without writer should be nil")
+	}
+
+	buf := new(bytes.Buffer)
+	a := newAccessLogger(buf, []string{"upstream", "client", "sni", "rule", "bytes", "error", "duration"})
+	a.log(map[string]interface{}{
+		log.FnType:       "access",
+		"client_addr":    "10.0.0.1:54321",
+		"dest_addr":      "192.0.2.1:443",
+		"dest_host":      "www.example.com",
+		"protocol":       PeekTLS,
+		"upstream":       UpstreamDefault,
+		"sent_bytes":     int64(100),
+		"received_bytes": int64(2000),
+	}, time.Now().Add(-time.Second))
+	a.log(map[string]interface{}{
+		"client_addr": "10.0.0.2:54321",
+		"dest_host":   "www.example.com",
+		"protocol":    PeekHTTP,
+		"rule":        "web",
+		"upstream":    UpstreamDirect,
+	}, time.Now())
+
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) != 3 || len(lines[2]) != 0 {
+		t.Fatalf("unexpected access logs: %q", buf.String())
+	}
+	prefix := `{"upstream":"default","client":"10.0.0.1:54321","sni":"www.example.com","sent_bytes":100,"received_bytes":2000,"duration":`
+	if !strings.HasPrefix(lines[0], prefix) {
+		t.Error("unexpected access log:", lines[0])
+	}
+	prefix = `{"upstream":"DIRECT","client":"10.0.0.2:54321","rule":"web","duration":`
+	if !strings.HasPrefix(lines[1], prefix) {
+		t.Error("unexpected access log:", lines[1])
+	}
+
+	var record struct {
+		Duration float64 `json:"duration"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Duration < 1 {
+		t.Error("unexpected duration:", record.Duration)
+	}
+}
@@ -0,0 +1,156 @@
+package transocks
+
+import (
+	"net"
+	"time"
+)
+
+// This file implements access control of connections.
+
+// Values of the verdict field in access logs.
+const (
+	verdictAllow = "allow"
+	verdictDeny  = "deny"
+)
+
+// acl is the compiled access control lists of Config.
+type acl struct {
+	allowClients []*net.IPNet
+	denyClients  []*net.IPNet
+	allowPorts   []portRange
+	allowDomains domainSet
+	denyDomains  domainSet
+	schedule     schedule
+	feeds        *blocklists
+}
+
+// compileACL compiles access control lists of c.
+// If c has no lists, this returns nil.
+func compileACL(c *Config) (*acl, error) {
+	if len(c.AllowClients) == 0 && len(c.DenyClients) == 0 &&
+		len(c.AllowPorts) == 0 &&
+		len(c.AllowDomains) == 0 && len(c.DenyDomains) == 0 &&
+		len(c.BlocklistURLs) == 0 {
+		return nil, nil
+	}
+	a := new(acl)
+	for _, n := range c.AllowClients {
+		ipnet, err := parseNetwork(n)
+		if err != nil {
+			return nil, err
+		}
+		a.allowClients = append(a.allowClients, ipnet)
+	}
+	for _, n := range c.DenyClients {
+		ipnet, err := parseNetwork(n)
+		if err != nil {
+			return nil, err
+		}
+		a.denyClients = append(a.denyClients, ipnet)
+	}
+	for _, p := range c.AllowPorts {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		a.allowPorts = append(a.allowPorts, pr)
+	}
+	s, err := parseSchedule(c.DomainsSchedule)
+	if err != nil {
+		return nil, err
+	}
+	a.schedule = s
+	a.allowDomains, err = compileDomainSet(c.AllowDomains)
+	if err != nil {
+		return nil, err
+	}
+	a.denyDomains, err = compileDomainSet(c.DenyDomains)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.BlocklistURLs) > 0 {
+		feeds, err := newBlocklists(c.BlocklistURLs, c.BlocklistInterval)
+		if err != nil {
+			return nil, err
+		}
+		a.feeds = feeds
+	}
+	return a, nil
+}
+
+// needsHost returns true if a has conditions on host names.
+// a may be nil.
+func (a *acl) needsHost() bool {
+	return a != nil && (!a.allowDomains.empty() || !a.denyDomains.empty() || a.feeds != nil)
+}
+
+func matchNetworks(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsClient returns true if clients at ip may use transocks.
+// ip may be nil if not known.  a may be nil.
+//
+// DenyClients are evaluated first.  If AllowClients is not empty,
+// other clients, including those of unknown addresses, are denied.
+func (a *acl) allowsClient(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip != nil && matchNetworks(a.denyClients, ip) {
+		return false
+	}
+	if len(a.allowClients) > 0 {
+		return ip != nil && matchNetworks(a.allowClients, ip)
+	}
+	return true
+}
+
+func (a *acl) allowsPort(port int) bool {
+	if len(a.allowPorts) == 0 {
+		return true
+	}
+	for _, pr := range a.allowPorts {
+		if pr.begin <= port && port <= pr.end {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns true if a connection to host, ip, and port is allowed.
+// host may be empty and ip may be nil if not known.  a may be nil.
+//
+// If AllowPorts is not empty, connections to other ports are denied.
+// Connections to domains and addresses in blocklists are denied.
+// Domain lists are evaluated only during DomainsSchedule.
+// DenyDomains are evaluated before AllowDomains.  If AllowDomains is
+// not empty, connections to other hosts, including those without host
+// names, are denied.
+func (a *acl) allows(host string, ip net.IP, port int) bool {
+	if a == nil {
+		return true
+	}
+	if !a.allowsPort(port) {
+		return false
+	}
+	host = normalizeHost(host)
+	if a.feeds.denies(host, ip) {
+		return false
+	}
+	if !a.schedule.match(time.Now()) {
+		return true
+	}
+	if len(host) > 0 && a.denyDomains.match(host) {
+		return false
+	}
+	if !a.allowDomains.empty() {
+		return len(host) > 0 && a.allowDomains.match(host)
+	}
+	return true
+}
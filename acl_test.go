@@ -0,0 +1,143 @@
+package transocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACLDomains(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	a, err := compileACL(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != nil || !a.allows("www.example.com", nil, 443) || a.needsHost() {
+		t.Error("nil ACL should allow all")
+	}
+
+	c.AllowDomains = []string{"*.example.com", "example.org"}
+	c.DenyDomains = []string{".ads.example.com"}
+	a, err = compileACL(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.needsHost() {
+		t.Error("ACL with domains needs host names")
+	}
+
+	testCases := []struct {
+		host   string
+		expect bool
+	}{
+		{"www.example.com", true},
+		{"WWW.Example.COM.", true},
+		{"example.org", true},
+		{"ads.example.com", false},
+		{"x.ads.example.com", false},
+		{"example.com", false},
+		{"www.example.net", false},
+		{"", false},
+	}
+	for _, tc := range testCases {
+		if a.allows(tc.host, nil, 443) != tc.expect {
+			t.Errorf("unexpected verdict for %q", tc.host)
+		}
+	}
+
+	c.AllowDomains = nil
+	a, err = compileACL(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.allows("", nil, 443) || !a.allows("www.example.net", nil, 443) || a.allows("ads.example.com", nil, 443) {
+		t.Error("deny list should deny only matching hosts")
+	}
+
+	c.DenyDomains = []string{"*.*.example.com"}
+	if _, err := compileACL(c); err == nil {
+		t.Error("invalid pattern should be an error")
+	}
+}
+
+func TestACLClients(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.AllowClients = []string{"10.0.0.0/8", "2001:db8::/32"}
+	c.DenyClients = []string{"10.1.2.3"}
+	a, err := compileACL(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.needsHost() {
+		t.Error("client lists do not need host names")
+	}
+
+	testCases := []struct {
+		ip     string
+		expect bool
+	}{
+		{"10.0.0.1", true},
+		{"10.1.2.3", false},
+		{"2001:db8::1", true},
+		{"192.168.0.1", false},
+		{"", false},
+	}
+	for _, tc := range testCases {
+		if a.allowsClient(net.ParseIP(tc.ip)) != tc.expect {
+			t.Errorf("unexpected verdict for %q", tc.ip)
+		}
+	}
+
+	c.AllowClients = nil
+	a, err = compileACL(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.allowsClient(nil) || !a.allowsClient(net.ParseIP("10.0.0.1")) {
+		t.Error("deny list should deny only matching clients")
+	}
+
+	c.DenyClients = []string{"10.0.0.0/33"}
+	if _, err := compileACL(c); err == nil {
+		t.Error("invalid network should be an error")
+	}
+}
+
+func TestACLPorts(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.AllowPorts = []string{"22", "80", "8000-8999"}
+	a, err := compileACL(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.needsHost() {
+		t.Error("port lists do not need host names")
+	}
+
+	testCases := []struct {
+		port   int
+		expect bool
+	}{
+		{22, true},
+		{80, true},
+		{8000, true},
+		{8999, true},
+		{443, false},
+		{9000, false},
+	}
+	for _, tc := range testCases {
+		if a.allows("www.example.com", nil, tc.port) != tc.expect {
+			t.Errorf("unexpected verdict for %d", tc.port)
+		}
+	}
+
+	c.AllowPorts = []string{"https"}
+	if _, err := compileACL(c); err == nil {
+		t.Error("invalid port should be an error")
+	}
+}
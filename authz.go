@@ -0,0 +1,166 @@
+package transocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// This file asks an external HTTP endpoint whether connections are
+// allowed and which upstreams they use.
+
+const (
+	defaultAuthzTimeout  = 3 * time.Second
+	defaultAuthzCacheTTL = 1 * time.Minute
+
+	// authzCacheSize limits the number of cached decisions.
+	authzCacheSize = 4096
+
+	// maxAuthzResponse limits the size of response bodies.
+	maxAuthzResponse = 64 << 10
+)
+
+// authzRequest is the JSON body sent to Config.AuthzURL.
+type authzRequest struct {
+	Client   string   `json:"client"`
+	DestAddr string   `json:"dest_addr"`
+	DestHost string   `json:"dest_host,omitempty"`
+	Protocol string   `json:"protocol,omitempty"`
+	ALPN     []string `json:"alpn,omitempty"`
+	UID      *int     `json:"uid,omitempty"`
+}
+
+// authzResponse is the JSON body returned from Config.AuthzURL.
+type authzResponse struct {
+	// Verdict is "allow" or "deny".
+	Verdict string `json:"verdict"`
+
+	// Upstream overrides the upstream chosen by rules if not empty.
+	Upstream string `json:"upstream,omitempty"`
+}
+
+type authzEntry struct {
+	resp    *authzResponse
+	expires time.Time
+}
+
+type authorizer struct {
+	url      string
+	client   *http.Client
+	ttl      time.Duration
+	failOpen bool
+
+	mu    sync.Mutex
+	cache map[string]authzEntry
+}
+
+func newAuthorizer(u *url.URL, timeout, ttl time.Duration, failOpen bool) *authorizer {
+	if timeout == 0 {
+		timeout = defaultAuthzTimeout
+	}
+	if ttl == 0 {
+		ttl = defaultAuthzCacheTTL
+	}
+	return &authorizer{
+		url:      u.String(),
+		client:   &http.Client{Timeout: timeout},
+		ttl:      ttl,
+		failOpen: failOpen,
+		cache:    make(map[string]authzEntry),
+	}
+}
+
+// key returns the cache key of req.  Client ports are ignored, so that
+// connections from the same client share decisions.
+func (a *authorizer) key(req *authzRequest, clientIP string) string {
+	r := *req
+	r.Client = clientIP
+	b, _ := json.Marshal(&r)
+	return string(b)
+}
+
+func (a *authorizer) cached(key string, now time.Time) (*authzResponse, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e, ok := a.cache[key]
+	if !ok || now.After(e.expires) {
+		return nil, false
+	}
+	return e.resp, true
+}
+
+func (a *authorizer) store(key string, resp *authzResponse, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.cache) >= authzCacheSize {
+		for k, e := range a.cache {
+			if now.After(e.expires) {
+				delete(a.cache, k)
+			}
+		}
+	}
+	if len(a.cache) >= authzCacheSize {
+		a.cache = make(map[string]authzEntry)
+	}
+	a.cache[key] = authzEntry{resp, now.Add(a.ttl)}
+}
+
+func (a *authorizer) post(ctx context.Context, req *authzRequest) (*authzResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequest(http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	hresp, err := a.client.Do(hreq.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, io.LimitReader(hresp.Body, maxAuthzResponse))
+		hresp.Body.Close()
+	}()
+	if hresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("authorization endpoint returned %s", hresp.Status)
+	}
+
+	resp := new(authzResponse)
+	if err := json.NewDecoder(io.LimitReader(hresp.Body, maxAuthzResponse)).Decode(resp); err != nil {
+		return nil, err
+	}
+	switch resp.Verdict {
+	case verdictAllow, verdictDeny:
+	default:
+		return nil, fmt.Errorf("invalid verdict: %q", resp.Verdict)
+	}
+	return resp, nil
+}
+
+// authorize returns the decision for req from the cache or the
+// endpoint.  Errors are not cached, and the caller should apply
+// a.failOpen.
+func (a *authorizer) authorize(ctx context.Context, req *authzRequest, clientIP string) (*authzResponse, error) {
+	key := a.key(req, clientIP)
+	if resp, ok := a.cached(key, time.Now()); ok {
+		return resp, nil
+	}
+	resp, err := a.post(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	a.store(key, resp, time.Now())
+	return resp, nil
+}
@@ -0,0 +1,75 @@
+package transocks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthorizer(t *testing.T) {
+	t.Parallel()
+
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		var req authzRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch req.DestHost {
+		case "www.example.com":
+			w.Write([]byte(`{"verdict": "allow", "upstream": "office"}`))
+		case "ads.example.com":
+			w.Write([]byte(`{"verdict": "deny"}`))
+		case "error.example.com":
+			http.Error(w, "error", http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"verdict": "maybe"}`))
+		}
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	a := newAuthorizer(u, time.Second, time.Minute, false)
+	ctx := context.Background()
+
+	req := &authzRequest{Client: "10.1.2.3:54321", DestAddr: "192.0.2.1:443", DestHost: "www.example.com"}
+	resp, err := a.authorize(ctx, req, "10.1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Verdict != verdictAllow || resp.Upstream != "office" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	// the decision is cached regardless of client ports.
+	req = &authzRequest{Client: "10.1.2.3:54322", DestAddr: "192.0.2.1:443", DestHost: "www.example.com"}
+	if _, err := a.authorize(ctx, req, "10.1.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&count); n != 1 {
+		t.Error("decision should be cached:", n)
+	}
+
+	req = &authzRequest{Client: "10.1.2.3:54321", DestAddr: "192.0.2.2:443", DestHost: "ads.example.com"}
+	resp, err = a.authorize(ctx, req, "10.1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Verdict != verdictDeny {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	for _, h := range []string{"error.example.com", "unknown.example.com"} {
+		req = &authzRequest{Client: "10.1.2.3:54321", DestAddr: "192.0.2.3:443", DestHost: h}
+		if _, err := a.authorize(ctx, req, "10.1.2.3"); err == nil {
+			t.Error("authorization should fail for", h)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package transocks
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+// Actions for denied connections.
+const (
+	// BlockReset resets connections by TCP RST.
+	BlockReset = "reset"
+
+	// BlockDrop sends nothing and discards data from clients until
+	// they give up, or for 30 seconds at most.
+	BlockDrop = "drop"
+
+	// BlockHTTP responds with 403 Forbidden to HTTP requests.
+	// Other connections are closed.
+	BlockHTTP = "http403"
+
+	// BlockTLSAlert sends unrecognized_name alert to TLS clients.
+	// Other connections are closed.
+	BlockTLSAlert = "tls_alert"
+)
+
+const (
+	blockDropTimeout = 30 * time.Second
+
+	// blockLingerTimeout limits the time to read the rest of requests
+	// after responding, so that responses are not lost by RST.
+	blockLingerTimeout = 1 * time.Second
+
+	blockHTTPBody = "Forbidden by transocks\n"
+)
+
+var blockHTTPResponse = fmt.Sprintf("HTTP/1.1 403 Forbidden\r\n"+
+	"Content-Type: text/plain; charset=utf-8\r\n"+
+	"Content-Length: %d\r\n"+
+	"Connection: close\r\n\r\n%s", len(blockHTTPBody), blockHTTPBody)
+
+func validateBlockAction(a string) error {
+	switch a {
+	case "", BlockReset, BlockDrop, BlockHTTP, BlockTLSAlert:
+		return nil
+	}
+	return fmt.Errorf("invalid block action: %s", a)
+}
+
+// discard reads and discards data from tc until EOF or timeout.
+func discard(tc relayConn, timeout time.Duration) {
+	tc.SetReadDeadline(time.Now().Add(timeout))
+	io.Copy(ioutil.Discard, tc)
+}
+
+// allow records the verdict of an allowed connection, unless it has
+// been denied in audit-only mode.
+func allow(fields map[string]interface{}) {
+	if fields["verdict"] != verdictDeny {
+		fields["verdict"] = verdictAllow
+	}
+}
+
+// deny closes tc by action, or Config.BlockAction if action is empty,
+// and returns true.  In audit-only mode, deny only logs tc and returns
+// false, and the caller continues to relay tc.
+// protocol and peeked are those found in the client stream.
+func (s *Server) deny(tc relayConn, fields map[string]interface{}, msg, action, protocol string, peeked []byte) bool {
+	if len(action) == 0 {
+		action = s.blockAction
+	}
+	fields["verdict"] = verdictDeny
+	if len(action) > 0 {
+		fields["block_action"] = action
+	}
+	if s.audit {
+		fields["audit"] = true
+		s.logger.Warn(msg, fields)
+		return false
+	}
+	s.logger.Warn(msg, fields)
+	atomic.AddInt64(&s.metrics.denied, 1)
+
+	switch {
+	case action == BlockReset:
+		resetConn(tc)
+	case action == BlockDrop:
+		discard(tc, blockDropTimeout)
+	case action == BlockHTTP && isHTTPRequest(peeked):
+		io.WriteString(tc, blockHTTPResponse)
+		tc.CloseWrite()
+		discard(tc, blockLingerTimeout)
+	case action == BlockTLSAlert && protocol == PeekTLS:
+		writeTLSAlert(tc, tlsAlerts["unrecognized_name"])
+		tc.CloseWrite()
+		discard(tc, blockLingerTimeout)
+	case s.reset:
+		resetConn(tc)
+	}
+	return true
+}
+
+// denyPacket logs a UDP session or DNS query denied by access control
+// lists and returns true.  In audit-only mode, denyPacket only logs it
+// and returns false.
+func (s *Server) denyPacket(fields map[string]interface{}, msg string) bool {
+	fields["verdict"] = verdictDeny
+	if s.audit {
+		fields["audit"] = true
+		s.logger.Warn(msg, fields)
+		return false
+	}
+	s.logger.Warn(msg, fields)
+	atomic.AddInt64(&s.metrics.denied, 1)
+	return true
+}
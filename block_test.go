@@ -0,0 +1,110 @@
+package transocks
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockHTTP(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	c := NewConfig()
+	c.Mode = ModeProxyProtocol
+	c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1")
+	c.Rules = []*Rule{{Upstream: UpstreamBlock, BlockAction: BlockHTTP}}
+	l := serveOnce(t, c)
+	defer l.Close()
+
+	conn := dialOnce(t, l, echo)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("unexpected status:", resp.StatusCode)
+	}
+}
+
+func TestBlockTLSAlert(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	c := NewConfig()
+	c.Mode = ModeProxyProtocol
+	c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1")
+	c.Rules = []*Rule{
+		{Domains: []string{".example.com"}, Upstream: UpstreamBlock},
+		{Upstream: UpstreamDirect},
+	}
+	c.BlockAction = BlockTLSAlert
+	l := serveOnce(t, c)
+	defer l.Close()
+
+	conn := dialOnce(t, l, echo)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	err := tls.Client(conn, &tls.Config{ServerName: "www.example.com"}).Handshake()
+	if err == nil || !strings.Contains(err.Error(), "unrecognized name") {
+		t.Error("unexpected error:", err)
+	}
+
+	c = NewConfig()
+	c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1")
+	c.BlockAction = "close"
+	if err := c.Validate(); err == nil {
+		t.Error("unknown block action should be an error")
+	}
+}
+
+func TestBlockAuditOnly(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+	proxy := newConnectProxy(t)
+	defer proxy.Close()
+
+	c := NewConfig()
+	c.Mode = ModeProxyProtocol
+	c.ProxyURL, _ = url.Parse(proxy.URL)
+	c.Rules = []*Rule{
+		{Domains: []string{".example.com"}, Upstream: UpstreamBlock},
+		{Upstream: UpstreamDirect},
+	}
+	c.BlockAction = BlockHTTP
+	c.AuditOnly = true
+	l := serveOnce(t, c)
+	defer l.Close()
+
+	// The request is relayed to echo through the default upstream.
+	conn := dialOnce(t, l, echo)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	io.WriteString(conn, req)
+
+	buf := make([]byte, len(req))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != req {
+		t.Errorf("unexpected response: %q", buf)
+	}
+}
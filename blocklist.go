@@ -0,0 +1,304 @@
+package transocks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// This file fetches blocklists of domain names and IP addresses from
+// remote URLs to deny connections to them.
+
+const (
+	defaultBlocklistInterval = 1 * time.Hour
+	blocklistTimeout         = 1 * time.Minute
+
+	// maxBlocklistSize limits the size of a blocklist.
+	maxBlocklistSize = 64 << 20
+)
+
+// names in hosts files that are not blocked domains.
+var hostsFileNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+}
+
+// BlocklistStats is a snapshot of the state of a blocklist feed.
+type BlocklistStats struct {
+	// URL is the URL of the feed.
+	URL string
+
+	// Entries is the number of domains and networks in the feed.
+	Entries int
+
+	// Updated is the time when the feed was fetched successfully,
+	// or zero if it has never been fetched.
+	Updated time.Time
+
+	// Error is the error of the last fetch, or empty if it succeeded.
+	Error string
+}
+
+// blocklist is a set of domains and networks.  A domain matches itself
+// and its subdomains.
+type blocklist struct {
+	domains  map[string]bool
+	networks []*net.IPNet
+}
+
+func newBlocklist() *blocklist {
+	return &blocklist{domains: make(map[string]bool)}
+}
+
+func (b *blocklist) size() int {
+	return len(b.domains) + len(b.networks)
+}
+
+func (b *blocklist) addDomain(d string) {
+	d = normalizeHost(strings.TrimPrefix(strings.TrimPrefix(d, "*"), "."))
+	if len(d) == 0 || hostsFileNames[d] || strings.ContainsAny(d, "*/ ") {
+		return
+	}
+	b.domains[d] = true
+}
+
+// parseBlocklist reads a hosts file or a list of domain names, IP
+// addresses, and CIDR networks, one in a line.  Comments begin with #.
+func parseBlocklist(r io.Reader) (*blocklist, error) {
+	b := newBlocklist()
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+			// hosts file entries like "0.0.0.0 ads.example.com".
+			for _, d := range fields[1:] {
+				b.addDomain(d)
+			}
+		case len(fields) == 1:
+			if n, err := parseNetwork(fields[0]); err == nil {
+				b.networks = append(b.networks, n)
+				continue
+			}
+			b.addDomain(fields[0])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// merge adds entries of o to b.
+func (b *blocklist) merge(o *blocklist) {
+	for d := range o.domains {
+		b.domains[d] = true
+	}
+	b.networks = append(b.networks, o.networks...)
+}
+
+// matchHost returns true if host or its parent domain is in b.
+// host must be normalized by normalizeHost.
+func (b *blocklist) matchHost(host string) bool {
+	for len(host) > 0 {
+		if b.domains[host] {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return false
+}
+
+type blocklistFeed struct {
+	url string
+
+	mu      sync.Mutex
+	list    *blocklist
+	updated time.Time
+	err     error
+}
+
+// blocklists fetches blocklist feeds periodically and merges them.
+type blocklists struct {
+	feeds    []*blocklistFeed
+	interval time.Duration
+	client   *http.Client
+	logger   *log.Logger
+	done     chan struct{}
+
+	// current is the merged *blocklist.
+	current atomic.Value
+}
+
+func newBlocklists(urls []string, interval time.Duration) (*blocklists, error) {
+	if interval == 0 {
+		interval = defaultBlocklistInterval
+	}
+	bl := &blocklists{
+		interval: interval,
+		client:   &http.Client{Timeout: blocklistTimeout},
+		logger:   log.DefaultLogger(),
+		done:     make(chan struct{}),
+	}
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("unsupported blocklist URL: %s", s)
+		}
+		bl.feeds = append(bl.feeds, &blocklistFeed{url: s})
+	}
+	bl.current.Store(newBlocklist())
+	return bl, nil
+}
+
+func (bl *blocklists) fetch(ctx context.Context, f *blocklistFeed) (*blocklist, error) {
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := bl.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBlocklistSize))
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("blocklist returned %s", resp.Status)
+	}
+	return parseBlocklist(io.LimitReader(resp.Body, maxBlocklistSize))
+}
+
+// update fetches all feeds and replaces the merged list.
+// Feeds that fail keep their previous entries.
+func (bl *blocklists) update(ctx context.Context) {
+	merged := newBlocklist()
+	for _, f := range bl.feeds {
+		list, err := bl.fetch(ctx, f)
+
+		f.mu.Lock()
+		f.err = err
+		if err == nil {
+			f.list = list
+			f.updated = time.Now()
+		}
+		if f.list != nil {
+			merged.merge(f.list)
+		}
+		f.mu.Unlock()
+
+		if err != nil {
+			bl.logger.Error("failed to fetch blocklist", map[string]interface{}{
+				"url":       f.url,
+				log.FnError: err.Error(),
+			})
+			continue
+		}
+		bl.logger.Info("blocklist fetched", map[string]interface{}{
+			"url":     f.url,
+			"entries": list.size(),
+		})
+	}
+	bl.current.Store(merged)
+}
+
+func (bl *blocklists) run(ctx context.Context) {
+	bl.update(ctx)
+
+	ticker := time.NewTicker(bl.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-bl.done:
+			return
+		case <-ticker.C:
+		}
+		bl.update(ctx)
+	}
+}
+
+// stop stops run.
+func (bl *blocklists) stop() {
+	close(bl.done)
+}
+
+// sameAs returns true if bl and o fetch the same URLs at the same
+// interval.  bl and o may be nil.
+func (bl *blocklists) sameAs(o *blocklists) bool {
+	if bl == nil || o == nil {
+		return bl == o
+	}
+	if bl.interval != o.interval || len(bl.feeds) != len(o.feeds) {
+		return false
+	}
+	for i, f := range bl.feeds {
+		if f.url != o.feeds[i].url {
+			return false
+		}
+	}
+	return true
+}
+
+// denies returns true if host or ip is in blocklists.  host must be
+// normalized by normalizeHost, and may be empty.  ip may be nil.
+// bl may be nil.
+func (bl *blocklists) denies(host string, ip net.IP) bool {
+	if bl == nil {
+		return false
+	}
+	b := bl.current.Load().(*blocklist)
+	if len(host) > 0 && b.matchHost(host) {
+		return true
+	}
+	return ip != nil && matchNetworks(b.networks, ip)
+}
+
+func (bl *blocklists) stats() []BlocklistStats {
+	if bl == nil {
+		return nil
+	}
+	stats := make([]BlocklistStats, len(bl.feeds))
+	for i, f := range bl.feeds {
+		f.mu.Lock()
+		stats[i].URL = f.url
+		if f.list != nil {
+			stats[i].Entries = f.list.size()
+		}
+		stats[i].Updated = f.updated
+		if f.err != nil {
+			stats[i].Error = f.err.Error()
+		}
+		f.mu.Unlock()
+	}
+	return stats
+}
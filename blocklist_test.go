@@ -0,0 +1,130 @@
+package transocks
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+const testHostsFile = `# hosts file
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # trailing comment
+::1 ip6-localhost
+`
+
+const testPlainList = `
+*.malware.example
+.phishing.example
+192.0.2.0/24
+2001:db8::1
+`
+
+func TestParseBlocklist(t *testing.T) {
+	t.Parallel()
+
+	b, err := parseBlocklist(strings.NewReader(testHostsFile + testPlainList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.size() != 6 {
+		t.Error("unexpected entries:", b.domains, b.networks)
+	}
+
+	testCases := []struct {
+		host   string
+		expect bool
+	}{
+		{"ads.example.com", true},
+		{"x.ads.example.com", true},
+		{"tracker.example.com", true},
+		{"example.com", false},
+		{"localhost", false},
+		{"malware.example", true},
+		{"www.phishing.example", true},
+		{"badphishing.example", false},
+	}
+	for _, tc := range testCases {
+		if b.matchHost(tc.host) != tc.expect {
+			t.Errorf("matchHost(%q) should be %v", tc.host, tc.expect)
+		}
+	}
+	if !matchNetworks(b.networks, net.ParseIP("192.0.2.10")) ||
+		!matchNetworks(b.networks, net.ParseIP("2001:db8::1")) ||
+		matchNetworks(b.networks, net.ParseIP("2001:db8::2")) {
+		t.Error("unexpected networks:", b.networks)
+	}
+}
+
+func TestBlocklists(t *testing.T) {
+	t.Parallel()
+
+	var fail int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) != 0 {
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		switch r.URL.Path {
+		case "/hosts":
+			w.Write([]byte(testHostsFile))
+		case "/list":
+			w.Write([]byte(testPlainList))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	if _, err := newBlocklists([]string{"ftp://example.com/list"}, 0); err == nil {
+		t.Error("unsupported URL should be an error")
+	}
+
+	bl, err := newBlocklists([]string{ts.URL + "/hosts", ts.URL + "/list", ts.URL + "/none"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl.logger = log.NewLogger()
+	bl.logger.SetOutput(ioutil.Discard)
+	if bl.denies("ads.example.com", nil) {
+		t.Error("blocklists should be empty before fetching")
+	}
+
+	bl.update(context.Background())
+	if !bl.denies("ads.example.com", nil) || !bl.denies("", net.ParseIP("192.0.2.1")) {
+		t.Error("entries of blocklists should be denied")
+	}
+	if bl.denies("www.example.com", net.ParseIP("198.51.100.1")) {
+		t.Error("other destinations should not be denied")
+	}
+
+	stats := bl.stats()
+	if len(stats) != 3 {
+		t.Fatal("unexpected stats:", stats)
+	}
+	if stats[0].Entries != 2 || stats[0].Updated.IsZero() || len(stats[0].Error) > 0 {
+		t.Errorf("unexpected stats: %+v", stats[0])
+	}
+	if !stats[2].Updated.IsZero() || len(stats[2].Error) == 0 {
+		t.Errorf("unexpected stats: %+v", stats[2])
+	}
+
+	// failed feeds keep previous entries.
+	atomic.StoreInt32(&fail, 1)
+	bl.update(context.Background())
+	if !bl.denies("ads.example.com", nil) {
+		t.Error("previous entries should be kept")
+	}
+
+	var nilList *blocklists
+	if nilList.denies("ads.example.com", nil) || nilList.stats() != nil {
+		t.Error("nil blocklists should deny nothing")
+	}
+}
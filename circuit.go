@@ -0,0 +1,92 @@
+package transocks
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitBreaker stops using an upstream proxy after consecutive failures.
+//
+// Once the circuit is open, connections fail fast without dialing.
+// After timeout passes, the circuit becomes half-open and one connection
+// is let through as a trial.  The circuit is closed if the trial succeeds,
+// or opened again if it fails.
+//
+// The zero value is a disabled circuit breaker that is always closed.
+type circuitBreaker struct {
+	threshold int
+	timeout   time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+// isBlocked returns true if no connection can be attempted now.
+func (b *circuitBreaker) isBlocked() bool {
+	return b.isOpen() && (b.trial || time.Since(b.openedAt) < b.timeout)
+}
+
+// allow returns true if a connection can be attempted.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.isOpen() {
+		return true
+	}
+	if b.isBlocked() {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// blocked returns true if allow would return false.
+func (b *circuitBreaker) blocked() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.isBlocked()
+}
+
+// success records a successful connection and closes the circuit.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+}
+
+// failure records a failed connection.
+// It returns true if the circuit is opened by this failure.
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasOpen := b.isOpen()
+	b.failures++
+	if !b.isOpen() {
+		return false
+	}
+	b.openedAt = time.Now()
+	b.trial = false
+	return !wasOpen
+}
+
+// open returns true if the circuit is open or half-open.
+func (b *circuitBreaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.isOpen()
+}
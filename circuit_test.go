@@ -0,0 +1,55 @@
+package transocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	var disabled circuitBreaker
+	for i := 0; i < 10; i++ {
+		disabled.failure()
+	}
+	if !disabled.allow() || disabled.open() {
+		t.Error("disabled circuit breaker should be closed")
+	}
+
+	b := &circuitBreaker{threshold: 2, timeout: 50 * time.Millisecond}
+	if b.failure() {
+		t.Error("circuit should not be opened by the first failure")
+	}
+	if !b.failure() {
+		t.Error("circuit should be opened by the second failure")
+	}
+	if b.allow() || !b.blocked() {
+		t.Error("open circuit should not allow connections")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if b.blocked() {
+		t.Error("half-open circuit should not be blocked before a trial")
+	}
+	if !b.allow() {
+		t.Fatal("half-open circuit should allow a trial")
+	}
+	if b.allow() {
+		t.Error("half-open circuit should allow only one trial")
+	}
+	if b.failure() {
+		t.Error("failed trial should not be reported as newly opened")
+	}
+	if b.allow() {
+		t.Error("circuit should be opened again")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("half-open circuit should allow a trial")
+	}
+	b.success()
+	if !b.allow() || b.open() {
+		t.Error("circuit should be closed after a successful trial")
+	}
+}
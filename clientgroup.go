@@ -0,0 +1,158 @@
+package transocks
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// This file implements named groups of client addresses for rules.
+
+// ClientGroup is a named set of client addresses for Rule.ClientGroups.
+// Members are the union of Networks, Files, and IPSet.
+type ClientGroup struct {
+	// Networks is a list of CIDR networks or IP addresses.
+	Networks []string
+
+	// Files is a list of files of CIDR networks or IP addresses,
+	// one in a line.  Comments begin with #.
+	Files []string
+
+	// IPSet is the name of a Linux kernel ipset of hash:ip or hash:net
+	// type.  Members are read by "ipset" command.
+	IPSet string
+}
+
+// validateClientGroup checks g without reading files and ipsets.
+func validateClientGroup(name string, g *ClientGroup) error {
+	if g == nil || (len(g.Networks) == 0 && len(g.Files) == 0 && len(g.IPSet) == 0) {
+		return fmt.Errorf("empty client group: %s", name)
+	}
+	for _, n := range g.Networks {
+		if _, err := parseNetwork(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseNetworkList reads CIDR networks or IP addresses, one in a line.
+func parseNetworkList(r io.Reader) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		n, err := parseNetwork(line)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
+
+// parseIPSet reads the output of "ipset save NAME".  Members that are
+// not addresses or networks, such as those of hash:ip,port, are ignored.
+func parseIPSet(r io.Reader, name string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || fields[0] != "add" || fields[1] != name {
+			continue
+		}
+		if n, err := parseNetwork(fields[2]); err == nil {
+			networks = append(networks, n)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
+
+func readIPSet(name string) ([]*net.IPNet, error) {
+	out, err := exec.Command("ipset", "save", name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ipset %s: %v", name, err)
+	}
+	return parseIPSet(bytes.NewReader(out), name)
+}
+
+func readNetworkFile(name string) ([]*net.IPNet, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	networks, err := parseNetworkList(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return networks, nil
+}
+
+// compileClientGroups reads members of groups.
+func compileClientGroups(groups map[string]*ClientGroup) (map[string][]*net.IPNet, error) {
+	compiled := make(map[string][]*net.IPNet)
+	for name, g := range groups {
+		if err := validateClientGroup(name, g); err != nil {
+			return nil, err
+		}
+		var networks []*net.IPNet
+		for _, n := range g.Networks {
+			ipnet, err := parseNetwork(n)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, ipnet)
+		}
+		for _, file := range g.Files {
+			ns, err := readNetworkFile(file)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, ns...)
+		}
+		if len(g.IPSet) > 0 {
+			ns, err := readIPSet(g.IPSet)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, ns...)
+		}
+		compiled[name] = networks
+	}
+	return compiled, nil
+}
+
+// bindClientGroups sets networks of groups referred to by rules of p.
+func (p *listenProfile) bindClientGroups(groups map[string][]*net.IPNet) error {
+	for _, r := range p.rules {
+		r.clients = nil
+		for _, name := range r.groups {
+			networks, ok := groups[name]
+			if !ok {
+				return fmt.Errorf("unknown client group in rule: %s", name)
+			}
+			r.clients = append(r.clients, networks...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package transocks
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseIPSet(t *testing.T) {
+	t.Parallel()
+
+	out := `create iot hash:net family inet hashsize 1024 maxelem 65536
+add iot 192.168.10.0/24
+add iot 192.168.20.5
+add other 10.0.0.0/8
+add iot 192.168.30.1,tcp:80
+`
+	networks, err := parseIPSet(strings.NewReader(out), "iot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 2 {
+		t.Fatal("unexpected members:", networks)
+	}
+	if networks[0].String() != "192.168.10.0/24" || networks[1].String() != "192.168.20.5/32" {
+		t.Error("unexpected members:", networks)
+	}
+}
+
+func TestClientGroups(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "transocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "developers.txt")
+	err = ioutil.WriteFile(file, []byte("# developers\n10.2.0.0/16\n\n2001:db8::1 # laptop\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := compileClientGroups(map[string]*ClientGroup{
+		"developers": {Networks: []string{"10.1.0.0/16"}, Files: []string{file}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, _, err := newListenProfile(":1081", ModeNAT, nil, []*Rule{
+		{ClientGroups: []string{"developers"}, Upstream: UpstreamDirect},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.bindClientGroups(groups); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		client string
+		expect bool
+	}{
+		{"10.1.2.3", true},
+		{"10.2.3.4", true},
+		{"2001:db8::1", true},
+		{"10.3.0.1", false},
+		{"", false},
+	}
+	for _, tc := range testCases {
+		c := &connInfo{clientIP: net.ParseIP(tc.client), ip: net.ParseIP("192.0.2.1"), port: 443}
+		if (p.match(c) != nil) != tc.expect {
+			t.Errorf("match for client %q should be %v", tc.client, tc.expect)
+		}
+	}
+
+	p, _, err = newListenProfile(":1081", ModeNAT, nil, []*Rule{
+		{ClientGroups: []string{"iot"}, Upstream: UpstreamDirect},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.bindClientGroups(groups); err == nil {
+		t.Error("unknown group should be rejected")
+	}
+
+	if err := ioutil.WriteFile(file, []byte("not-a-network\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = compileClientGroups(map[string]*ClientGroup{"developers": {Files: []string{file}}})
+	if err == nil {
+		t.Error("invalid file should be rejected")
+	}
+	_, err = compileClientGroups(map[string]*ClientGroup{"empty": {}})
+	if err == nil {
+		t.Error("empty group should be rejected")
+	}
+
+	c := NewConfig()
+	c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1080")
+	c.Rules = []*Rule{{ClientGroups: []string{"iot"}, Upstream: UpstreamDirect}}
+	if err := c.Validate(); err == nil {
+		t.Error("rule with unknown group should be invalid")
+	}
+	c.ClientGroups = map[string]*ClientGroup{"iot": {Networks: []string{"192.168.10.0/24"}}}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
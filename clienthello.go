@@ -0,0 +1,192 @@
+package transocks
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file extracts details of TLS ClientHello for access logs.
+//
+// crypto/tls does not provide extension types in the order sent by
+// clients, which are needed for JA3 fingerprints, so ClientHello is
+// parsed from the raw bytes.  See https://github.com/salesforce/ja3
+
+// clientHelloDetails is a part of ClientHello fields.
+type clientHelloDetails struct {
+	version    uint16
+	ciphers    []uint16
+	extensions []uint16
+	curves     []uint16
+	points     []uint8
+	alpn       []string
+	versions   []uint16
+}
+
+// isGREASE returns true if v is a GREASE value of RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// parseClientHello parses a ClientHello handshake message.
+func parseClientHello(hello []byte) (*clientHelloDetails, error) {
+	d := new(clientHelloDetails)
+	r := &quicReader{b: hello}
+	if r.byte() != 1 { // client_hello
+		return nil, errors.New("not a ClientHello")
+	}
+	r.bytes(3) // length
+	d.version = r.uint16()
+	r.bytes(32) // random
+	r.bytes(int(r.byte()))
+	cs := &quicReader{b: r.bytes(int(r.uint16()))}
+	for len(cs.b) >= 2 {
+		d.ciphers = append(d.ciphers, cs.uint16())
+	}
+	r.bytes(int(r.byte()))
+	exts := &quicReader{b: r.bytes(int(r.uint16()))}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	for len(exts.b) > 0 {
+		typ := exts.uint16()
+		e := &quicReader{b: exts.bytes(int(exts.uint16()))}
+		if exts.err != nil {
+			return nil, exts.err
+		}
+		d.extensions = append(d.extensions, typ)
+
+		switch typ {
+		case 10: // supported_groups
+			l := &quicReader{b: e.bytes(int(e.uint16()))}
+			for len(l.b) >= 2 {
+				d.curves = append(d.curves, l.uint16())
+			}
+		case 11: // ec_point_formats
+			d.points = append(d.points, e.bytes(int(e.byte()))...)
+		case 16: // application_layer_protocol_negotiation
+			l := &quicReader{b: e.bytes(int(e.uint16()))}
+			for len(l.b) > 0 {
+				p := l.bytes(int(l.byte()))
+				if l.err != nil {
+					break
+				}
+				d.alpn = append(d.alpn, string(p))
+			}
+		case 43: // supported_versions
+			l := &quicReader{b: e.bytes(int(e.byte()))}
+			for len(l.b) >= 2 {
+				d.versions = append(d.versions, l.uint16())
+			}
+		}
+	}
+	return d, nil
+}
+
+// maxClientHelloSize limits the size of ClientHello reassembled from
+// TLS records.
+const maxClientHelloSize = 64 << 10
+
+// clientHelloMessage returns the ClientHello handshake message at the
+// beginning of data read from a client.  Clients may split the message
+// across multiple TLS records, so the fragments are reassembled.
+func clientHelloMessage(data []byte) ([]byte, error) {
+	var msg []byte
+	for {
+		// TLS record header: type, legacy_record_version, and length.
+		if len(data) < 5 || data[0] != 22 { // handshake
+			return nil, errors.New("not a TLS handshake record")
+		}
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+n {
+			return nil, errors.New("truncated TLS record")
+		}
+		msg = append(msg, data[5:5+n]...)
+		data = data[5+n:]
+
+		// handshake header: type and 24-bit length.
+		if len(msg) < 4 {
+			continue
+		}
+		l := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+		if l > maxClientHelloSize {
+			return nil, errors.New("too large ClientHello")
+		}
+		if len(msg) >= l {
+			return msg[:l], nil
+		}
+	}
+}
+
+// peekedClientHello parses ClientHello in data read from a client.
+func peekedClientHello(data []byte) (*clientHelloDetails, error) {
+	hello, err := clientHelloMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	return parseClientHello(hello)
+}
+
+func joinUint16(vs []uint16) string {
+	var s []string
+	for _, v := range vs {
+		if !isGREASE(v) {
+			s = append(s, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(s, "-")
+}
+
+// ja3 returns the JA3 fingerprint string.
+func (d *clientHelloDetails) ja3() string {
+	points := make([]string, len(d.points))
+	for i, p := range d.points {
+		points[i] = strconv.Itoa(int(p))
+	}
+	return fmt.Sprintf("%d,%s,%s,%s,%s", d.version, joinUint16(d.ciphers),
+		joinUint16(d.extensions), joinUint16(d.curves), strings.Join(points, "-"))
+}
+
+// ja3Hash returns the MD5 hash of the JA3 fingerprint string.
+func (d *clientHelloDetails) ja3Hash() string {
+	sum := md5.Sum([]byte(d.ja3()))
+	return hex.EncodeToString(sum[:])
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case 0x0301:
+		return "TLS1.0"
+	case 0x0302:
+		return "TLS1.1"
+	case 0x0303:
+		return "TLS1.2"
+	case 0x0304:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// addFields adds log fields for d.
+func (d *clientHelloDetails) addFields(fields map[string]interface{}) {
+	versions := d.versions
+	if len(versions) == 0 {
+		versions = []uint16{d.version}
+	}
+	var names []string
+	for _, v := range versions {
+		if !isGREASE(v) {
+			names = append(names, tlsVersionName(v))
+		}
+	}
+	fields["tls_versions"] = names
+	if len(d.alpn) > 0 {
+		fields["tls_alpn"] = d.alpn
+	}
+	fields["ja3"] = d.ja3Hash()
+}
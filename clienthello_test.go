@@ -0,0 +1,128 @@
+package transocks
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestPeekedClientHello(t *testing.T) {
+	t.Parallel()
+
+	c1, c2 := net.Pipe()
+	go func() {
+		tls.Client(c1, &tls.Config{
+			ServerName: "www.example.com",
+			NextProtos: []string{"h2", "http/1.1"},
+		}).Handshake()
+		c1.Close()
+	}()
+	buf := make([]byte, 4096)
+	n, err := c2.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.Close()
+
+	d, err := peekedClientHello(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.alpn, []string{"h2", "http/1.1"}) {
+		t.Error("unexpected ALPN:", d.alpn)
+	}
+	if len(d.ciphers) == 0 || len(d.extensions) == 0 {
+		t.Error("cipher suites and extensions should be found")
+	}
+
+	fields := make(map[string]interface{})
+	d.addFields(fields)
+	if len(fields["ja3"].(string)) != 32 {
+		t.Error("unexpected JA3 hash:", fields["ja3"])
+	}
+	if _, ok := fields["tls_versions"]; !ok {
+		t.Error("tls_versions should be logged")
+	}
+
+	if _, err := peekedClientHello([]byte("GET / HTTP/1.1\r\n")); err == nil {
+		t.Error("HTTP request is not a ClientHello")
+	}
+}
+
+func TestJA3(t *testing.T) {
+	t.Parallel()
+
+	d := &clientHelloDetails{
+		version:    0x0303,
+		ciphers:    []uint16{0x0a0a, 4865, 4866},
+		extensions: []uint16{0x1a1a, 0, 10, 11},
+		curves:     []uint16{0x2a2a, 29, 23},
+		points:     []uint8{0},
+	}
+	if s := d.ja3(); s != "771,4865-4866,0-10-11,29-23,0" {
+		t.Error("unexpected JA3 string:", s)
+	}
+	if !isGREASE(0xfafa) || isGREASE(0x0a1a) {
+		t.Error("wrong GREASE detection")
+	}
+	if h := d.ja3Hash(); len(h) != 32 || strings.ToLower(h) != h {
+		t.Error("unexpected JA3 hash:", h)
+	}
+}
+
+// fragmentRecord splits a TLS record into records of at most n bytes
+// of payload.
+func fragmentRecord(rec []byte, n int) []byte {
+	var b []byte
+	for payload := rec[5:]; len(payload) > 0; {
+		l := n
+		if len(payload) < l {
+			l = len(payload)
+		}
+		b = append(b, rec[0], rec[1], rec[2], byte(l>>8), byte(l))
+		b = append(b, payload[:l]...)
+		payload = payload[l:]
+	}
+	return b
+}
+
+func TestFragmentedClientHello(t *testing.T) {
+	t.Parallel()
+
+	hello := clientHello(t, "www.example.com")
+	fragmented := fragmentRecord(hello, 100)
+
+	d1, err := peekedClientHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := peekedClientHello(fragmented)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1.ja3() != d2.ja3() {
+		t.Error("fragmented ClientHello should have the same fingerprint")
+	}
+
+	// Records split into TCP segments.
+	host, _, r := peekHost(iotest.OneByteReader(bytes.NewReader(fragmented)), "")
+	if host != "www.example.com" {
+		t.Error("unexpected host:", host)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, fragmented) {
+		t.Error("peeked data are not reproduced")
+	}
+
+	if _, err := peekedClientHello(fragmented[:len(fragmented)-1]); err == nil {
+		t.Error("truncated ClientHello should be an error")
+	}
+}
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/cybozu-go/log"
@@ -13,40 +26,494 @@ import (
 )
 
 type tomlConfig struct {
-	Listen   string         `toml:"listen"`
-	ProxyURL string         `toml:"proxy_url"`
-	Log      well.LogConfig `toml:"log"`
+	Listen            string                    `toml:"listen"`
+	Mode              string                    `toml:"mode"`
+	UDP               bool                      `toml:"udp"`
+	UDPIdleTimeout    int                       `toml:"udp_idle_timeout"`
+	UDPSessionTimeout int                       `toml:"udp_session_timeout"`
+	UDPMaxSessions    int                       `toml:"udp_max_sessions"`
+	AutoSetup         string                    `toml:"auto_setup"`
+	InterceptUIDs     []int                     `toml:"intercept_uids"`
+	InterceptCgroups  []string                  `toml:"intercept_cgroups"`
+	ReusePort         bool                      `toml:"reuse_port"`
+	ReloadOnSIGHUP    bool                      `toml:"reload_on_sighup"`
+	ResetOnFailure    bool                      `toml:"reset_on_failure"`
+	ProcessInfo       bool                      `toml:"process_info"`
+	ConnectionRate    float64                   `toml:"connection_rate"`
+	ConnectionBurst   int                       `toml:"connection_burst"`
+	ConnectionQueue   int                       `toml:"connection_queue"`
+	MaxConnections    int                       `toml:"max_connections"`
+	MaxClientConns    int                       `toml:"max_client_connections"`
+	Quotas            []quotaConfig             `toml:"quotas"`
+	ClientGroups      map[string]groupConfig    `toml:"client_groups"`
+	MPTCP             bool                      `toml:"mptcp"`
+	Shards            int                       `toml:"shards"`
+	ProxyURL          string                    `toml:"proxy_url"`
+	ProxyFromEnv      bool                      `toml:"proxy_from_env"`
+	ProxyURLs         []string                  `toml:"proxy_urls"`
+	Balance           string                    `toml:"balance"`
+	FailbackInterval  int                       `toml:"failback_interval"`
+	DialRetries       int                       `toml:"dial_retries"`
+	CircuitBreaker    circuitBreakerConfig      `toml:"circuit_breaker"`
+	HealthCheck       healthCheckConfig         `toml:"health_check"`
+	KillSwitch        bool                      `toml:"kill_switch"`
+	MetricsListen     string                    `toml:"metrics_listen"`
+	TracingEndpoint   string                    `toml:"tracing_endpoint"`
+	DNS               dnsConfig                 `toml:"dns"`
+	ProxyChain        []string                  `toml:"proxy_chain"`
+	ProxyCredentials  string                    `toml:"proxy_credentials_file"`
+	ProxyTLS          tlsConfig                 `toml:"proxy_tls"`
+	Upstreams         map[string]upstreamConfig `toml:"upstreams"`
+	Bypass            []string                  `toml:"bypass"`
+	Include           []string                  `toml:"include"`
+	GeoIPDatabase     string                    `toml:"geoip_database"`
+	ASNDatabase       string                    `toml:"asn_database"`
+	Rules             []ruleConfig              `toml:"rules"`
+	RewriteDest       bool                      `toml:"rewrite_dest"`
+	HostMap           map[string]string         `toml:"host_map"`
+	ResolveLocally    bool                      `toml:"resolve_locally"`
+	Resolver          string                    `toml:"resolver"`
+	PlainHTTP         bool                      `toml:"plain_http"`
+	ForwardedHeaders  bool                      `toml:"forwarded_headers"`
+	ReverseDNS        bool                      `toml:"reverse_dns"`
+	PeekTimeout       int                       `toml:"peek_timeout"`
+	MaxPeekBytes      int                       `toml:"max_peek_bytes"`
+	NoPeekPorts       []string                  `toml:"no_peek_ports"`
+	PeekProtocols     map[string]string         `toml:"peek_protocols"`
+	ECHPublicName     bool                      `toml:"ech_public_name"`
+	AllowClients      []string                  `toml:"allow_clients"`
+	DenyClients       []string                  `toml:"deny_clients"`
+	AllowPorts        []string                  `toml:"allow_ports"`
+	AllowDomains      []string                  `toml:"allow_domains"`
+	DenyDomains       []string                  `toml:"deny_domains"`
+	DomainsSchedule   []string                  `toml:"domains_schedule"`
+	BlocklistURLs     []string                  `toml:"blocklist_urls"`
+	BlocklistInterval int                       `toml:"blocklist_interval"`
+	AuthzURL          string                    `toml:"authz_url"`
+	AuthzTimeout      int                       `toml:"authz_timeout"`
+	AuthzCacheTTL     int                       `toml:"authz_cache_ttl"`
+	AuthzFailOpen     bool                      `toml:"authz_fail_open"`
+	BlockAction       string                    `toml:"block_action"`
+	AuditOnly         bool                      `toml:"audit_only"`
+	RejectNoSNI       bool                      `toml:"reject_no_sni"`
+	DetectConnect     bool                      `toml:"detect_connect"`
+	NoSNIAlert        string                    `toml:"no_sni_alert"`
+	HostCheck         string                    `toml:"host_check"`
+	HostCheckResolver string                    `toml:"host_check_resolver"`
+	Listeners         []listenerConfig          `toml:"listeners"`
+	AccessLog         accessLogConfig           `toml:"access_log"`
+	Log               well.LogConfig            `toml:"log"`
+}
+
+// includeConfig is the content of files in include.
+type includeConfig struct {
+	Bypass       []string     `toml:"bypass"`
+	Rules        []ruleConfig `toml:"rules"`
+	AllowClients []string     `toml:"allow_clients"`
+	DenyClients  []string     `toml:"deny_clients"`
+	AllowDomains []string     `toml:"allow_domains"`
+	DenyDomains  []string     `toml:"deny_domains"`
+}
+
+// loadIncludes merges files matching patterns in tc.Include into tc.
+// Relative patterns are relative to dir.  A pattern matching
+// a directory includes *.toml files in it.  Files are merged in order
+// of patterns, then in lexical order of their names, and each file is
+// merged only once.
+func (tc *tomlConfig) loadIncludes(dir string) error {
+	seen := make(map[string]bool)
+	for _, pattern := range tc.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		names, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid include %q: %v", pattern, err)
+		}
+		var files []string
+		for _, name := range names {
+			fi, err := os.Stat(name)
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				files = append(files, name)
+				continue
+			}
+			inDir, err := filepath.Glob(filepath.Join(name, "*.toml"))
+			if err != nil {
+				return err
+			}
+			files = append(files, inDir...)
+		}
+		sort.Strings(files)
+
+		for _, name := range files {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			ic := new(includeConfig)
+			md, err := toml.DecodeFile(name, ic)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			if len(md.Undecoded()) > 0 {
+				return fmt.Errorf("undecoded key in %s: %v", name, md.Undecoded())
+			}
+			tc.Bypass = append(tc.Bypass, ic.Bypass...)
+			tc.Rules = append(tc.Rules, ic.Rules...)
+			tc.AllowClients = append(tc.AllowClients, ic.AllowClients...)
+			tc.DenyClients = append(tc.DenyClients, ic.DenyClients...)
+			tc.AllowDomains = append(tc.AllowDomains, ic.AllowDomains...)
+			tc.DenyDomains = append(tc.DenyDomains, ic.DenyDomains...)
+		}
+	}
+	return nil
+}
+
+type listenerConfig struct {
+	Listen string       `toml:"listen"`
+	Mode   string       `toml:"mode"`
+	Rules  []ruleConfig `toml:"rules"`
+}
+
+type upstreamConfig struct {
+	ProxyURLs []string `toml:"proxy_urls"`
+	Balance   string   `toml:"balance"`
+}
+
+type circuitBreakerConfig struct {
+	Threshold int `toml:"threshold"`
+	Timeout   int `toml:"timeout"`
+}
+
+type quotaConfig struct {
+	Clients   []string `toml:"clients"`
+	Daily     int64    `toml:"daily"`
+	Monthly   int64    `toml:"monthly"`
+	RateLimit int64    `toml:"rate_limit"`
+}
+
+type groupConfig struct {
+	Networks []string `toml:"networks"`
+	Files    []string `toml:"files"`
+	IPSet    string   `toml:"ipset"`
+}
+
+type healthCheckConfig struct {
+	Interval int    `toml:"interval"`
+	Addr     string `toml:"addr"`
+}
+
+type accessLogConfig struct {
+	Filename   string   `toml:"filename"`
+	Fields     []string `toml:"fields"`
+	MaxSize    int64    `toml:"max_size"`
+	Interval   int      `toml:"interval"`
+	MaxBackups int      `toml:"max_backups"`
+	Compress   bool     `toml:"compress"`
+}
+
+type dnsConfig struct {
+	Listen   string `toml:"listen"`
+	Upstream string `toml:"upstream"`
+	FakeIP   string `toml:"fake_ip"`
+}
+
+type ruleConfig struct {
+	Tag       string   `toml:"tag"`
+	Domains   []string `toml:"domains"`
+	Networks  []string `toml:"networks"`
+	Ports     []string `toml:"ports"`
+	Countries []string `toml:"countries"`
+	ASNs      []string `toml:"asns"`
+	ALPN      []string `toml:"alpn"`
+	Users     []string `toml:"users"`
+	MACs      []string `toml:"macs"`
+	Expr      string   `toml:"expr"`
+	Schedule  []string `toml:"schedule"`
+	Upstream  string   `toml:"upstream"`
+	Dest      string   `toml:"dest"`
+	Resolve   string   `toml:"resolve"`
+
+	ClientGroups []string `toml:"client_groups"`
+
+	RateLimit        int64 `toml:"rate_limit"`
+	RateLimitPrefix  int   `toml:"rate_limit_prefix"`
+	RateLimitPrefix6 int   `toml:"rate_limit_prefix6"`
+	MaxConnections   int   `toml:"max_connections"`
+
+	BlockAction string `toml:"block_action"`
+}
+
+type tlsConfig struct {
+	CAFile     string `toml:"ca_file"`
+	ServerName string `toml:"server_name"`
+	CertFile   string `toml:"cert_file"`
+	KeyFile    string `toml:"key_file"`
+}
+
+func (tc *tlsConfig) build() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName: tc.ServerName,
+	}
+
+	if len(tc.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", tc.CAFile)
+		}
+		c.RootCAs = pool
+	}
+
+	if len(tc.CertFile) > 0 || len(tc.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
 }
 
 const (
-	defaultAddr = "localhost:1081"
+	defaultAddr             = "localhost:1081"
+	defaultFailbackInterval = 60
 )
 
 var (
 	configFile = flag.String("f", "/etc/transocks.toml",
-		"TOML configuration file path")
+		"TOML configuration file path; empty to run without the file")
+	proxyFromEnv = flag.Bool("proxy-from-env", false,
+		"use http_proxy, https_proxy, and no_proxy environment variables")
+
+	// autoSetup is auto_setup in the configuration file.
+	autoSetup string
+
+	// reloadOnSIGHUP is reload_on_sighup in the configuration file.
+	reloadOnSIGHUP bool
 )
 
 func loadConfig() (*transocks.Config, error) {
 	tc := &tomlConfig{
-		Listen: defaultAddr,
+		Listen:           defaultAddr,
+		FailbackInterval: defaultFailbackInterval,
 	}
-	md, err := toml.DecodeFile(*configFile, tc)
-	if err != nil {
-		return nil, err
-	}
-	if len(md.Undecoded()) > 0 {
-		return nil, fmt.Errorf("undecoded key in TOML: %v", md.Undecoded())
+	if len(*configFile) > 0 {
+		md, err := toml.DecodeFile(*configFile, tc)
+		if err != nil {
+			return nil, err
+		}
+		if len(md.Undecoded()) > 0 {
+			return nil, fmt.Errorf("undecoded key in TOML: %v", md.Undecoded())
+		}
+		if err := tc.loadIncludes(filepath.Dir(*configFile)); err != nil {
+			return nil, err
+		}
 	}
 
 	c := transocks.NewConfig()
 	c.Addr = tc.Listen
+	if len(tc.Mode) > 0 {
+		c.Mode = transocks.Mode(tc.Mode)
+	}
+	c.UDP = tc.UDP
+	c.UDPIdleTimeout = time.Duration(tc.UDPIdleTimeout) * time.Second
+	c.UDPSessionTimeout = time.Duration(tc.UDPSessionTimeout) * time.Second
+	c.UDPMaxSessions = tc.UDPMaxSessions
+	c.ReusePort = tc.ReusePort
+	c.ResetOnFailure = tc.ResetOnFailure
+	c.ProcessInfo = tc.ProcessInfo
+	c.ConnectionRate = tc.ConnectionRate
+	c.ConnectionBurst = tc.ConnectionBurst
+	c.ConnectionQueue = time.Duration(tc.ConnectionQueue) * time.Millisecond
+	c.MaxConnections = tc.MaxConnections
+	c.MaxClientConnections = tc.MaxClientConns
+	for _, qc := range tc.Quotas {
+		c.Quotas = append(c.Quotas, &transocks.Quota{
+			Clients:   qc.Clients,
+			Daily:     qc.Daily,
+			Monthly:   qc.Monthly,
+			RateLimit: qc.RateLimit,
+		})
+	}
+	for name, gc := range tc.ClientGroups {
+		g := &transocks.ClientGroup{
+			Networks: gc.Networks,
+			IPSet:    gc.IPSet,
+		}
+		for _, f := range gc.Files {
+			if !filepath.IsAbs(f) && len(*configFile) > 0 {
+				f = filepath.Join(filepath.Dir(*configFile), f)
+			}
+			g.Files = append(g.Files, f)
+		}
+		if c.ClientGroups == nil {
+			c.ClientGroups = make(map[string]*transocks.ClientGroup)
+		}
+		c.ClientGroups[name] = g
+	}
+	c.MPTCP = tc.MPTCP
+	c.Shards = tc.Shards
+	autoSetup = tc.AutoSetup
+	reloadOnSIGHUP = tc.ReloadOnSIGHUP
+	c.InterceptUIDs = tc.InterceptUIDs
+	c.InterceptCgroups = tc.InterceptCgroups
 
-	u, err := url.Parse(tc.ProxyURL)
+	var err error
+	if tc.ProxyFromEnv || *proxyFromEnv {
+		if len(tc.ProxyURL) > 0 {
+			return nil, errors.New("proxy_url cannot be used with proxy_from_env")
+		}
+		err = c.LoadProxyEnvironment()
+	} else {
+		c.ProxyURL, err = parseProxyURL("proxy_url", tc.ProxyURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range tc.ProxyURLs {
+		u, err := parseProxyURL("proxy_urls", s)
+		if err != nil {
+			return nil, err
+		}
+		c.ProxyURLs = append(c.ProxyURLs, u)
+	}
+	if len(tc.Balance) > 0 {
+		c.Balance = transocks.BalanceMode(tc.Balance)
+	}
+	c.FailbackInterval = time.Duration(tc.FailbackInterval) * time.Second
+	c.DialRetries = tc.DialRetries
+	c.CircuitBreakerThreshold = tc.CircuitBreaker.Threshold
+	if tc.CircuitBreaker.Timeout > 0 {
+		c.CircuitBreakerTimeout = time.Duration(tc.CircuitBreaker.Timeout) * time.Second
+	}
+	c.HealthCheckInterval = time.Duration(tc.HealthCheck.Interval) * time.Second
+	c.HealthCheckAddr = tc.HealthCheck.Addr
+	c.KillSwitch = tc.KillSwitch
+	c.MetricsAddr = tc.MetricsListen
+	if tc.AccessLog.Filename == "-" {
+		c.AccessLog = os.Stdout
+	} else {
+		c.AccessLogFile = tc.AccessLog.Filename
+	}
+	c.AccessLogMaxSize = tc.AccessLog.MaxSize
+	c.AccessLogRotateInterval = time.Duration(tc.AccessLog.Interval) * time.Second
+	c.AccessLogMaxBackups = tc.AccessLog.MaxBackups
+	c.AccessLogCompress = tc.AccessLog.Compress
+	c.AccessLogFields = tc.AccessLog.Fields
+	if len(tc.TracingEndpoint) > 0 {
+		c.TracingEndpoint, err = url.Parse(tc.TracingEndpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.ProxyCredentialsFile = tc.ProxyCredentials
+	for _, s := range tc.ProxyChain {
+		u, err := parseProxyURL("proxy_chain", s)
+		if err != nil {
+			return nil, err
+		}
+		c.ProxyChain = append(c.ProxyChain, u)
+	}
+
+	c.ProxyTLSConfig, err = tc.ProxyTLS.build()
 	if err != nil {
 		return nil, err
 	}
-	c.ProxyURL = u
+
+	c.Upstreams = make(map[string]*transocks.Upstream)
+	for name, uc := range tc.Upstreams {
+		up := &transocks.Upstream{
+			Balance: transocks.BalanceMode(uc.Balance),
+		}
+		for _, s := range uc.ProxyURLs {
+			u, err := parseProxyURL("upstreams."+name+".proxy_urls", s)
+			if err != nil {
+				return nil, err
+			}
+			up.ProxyURLs = append(up.ProxyURLs, u)
+		}
+		c.Upstreams[name] = up
+	}
+	c.Bypass = append(c.Bypass, tc.Bypass...)
+
+	if len(tc.DNS.Listen) > 0 {
+		c.DNSAddr = tc.DNS.Listen
+		c.DNSFakeIPNetwork = tc.DNS.FakeIP
+		c.DNSUpstream, err = url.Parse(tc.DNS.Upstream)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.GeoIPDatabase = tc.GeoIPDatabase
+	c.ASNDatabase = tc.ASNDatabase
+	c.Rules = buildRules(tc.Rules)
+	c.RewriteDest = tc.RewriteDest
+	c.HostMap = tc.HostMap
+	c.ResolveLocally = tc.ResolveLocally
+	if len(tc.Resolver) > 0 {
+		c.Resolver, err = url.Parse(tc.Resolver)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.PlainHTTP = tc.PlainHTTP
+	c.ForwardedHeaders = tc.ForwardedHeaders
+	c.ReverseDNS = tc.ReverseDNS
+	c.PeekTimeout = time.Duration(tc.PeekTimeout) * time.Second
+	c.MaxPeekBytes = tc.MaxPeekBytes
+	c.NoPeekPorts = tc.NoPeekPorts
+	if len(tc.PeekProtocols) > 0 {
+		c.PeekProtocols = make(map[int]string)
+		for port, proto := range tc.PeekProtocols {
+			n, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port in peek_protocols: %s", port)
+			}
+			c.PeekProtocols[n] = proto
+		}
+	}
+	c.ECHPublicName = tc.ECHPublicName
+	c.AllowClients = tc.AllowClients
+	c.DenyClients = tc.DenyClients
+	c.AllowPorts = tc.AllowPorts
+	c.AllowDomains = tc.AllowDomains
+	c.DenyDomains = tc.DenyDomains
+	c.DomainsSchedule = tc.DomainsSchedule
+	c.BlocklistURLs = tc.BlocklistURLs
+	c.BlocklistInterval = time.Duration(tc.BlocklistInterval) * time.Second
+	if len(tc.AuthzURL) > 0 {
+		c.AuthzURL, err = url.Parse(tc.AuthzURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.AuthzTimeout = time.Duration(tc.AuthzTimeout) * time.Second
+	c.AuthzCacheTTL = time.Duration(tc.AuthzCacheTTL) * time.Second
+	c.AuthzFailOpen = tc.AuthzFailOpen
+	c.BlockAction = tc.BlockAction
+	c.AuditOnly = tc.AuditOnly
+	c.RejectNoSNI = tc.RejectNoSNI
+	c.DetectConnect = tc.DetectConnect
+	c.NoSNIAlert = tc.NoSNIAlert
+	c.HostCheck = transocks.HostCheckMode(tc.HostCheck)
+	c.HostCheckResolver = tc.HostCheckResolver
+	for _, lc := range tc.Listeners {
+		c.Listeners = append(c.Listeners, &transocks.ListenerConfig{
+			Addr:  lc.Listen,
+			Mode:  transocks.Mode(lc.Mode),
+			Rules: buildRules(lc.Rules),
+		})
+	}
 
 	err = tc.Log.Apply()
 	if err != nil {
@@ -56,6 +523,50 @@ func loadConfig() (*transocks.Config, error) {
 	return c, nil
 }
 
+func buildRules(rcs []ruleConfig) []*transocks.Rule {
+	var rules []*transocks.Rule
+	for _, rc := range rcs {
+		rules = append(rules, &transocks.Rule{
+			Tag:       rc.Tag,
+			Domains:   rc.Domains,
+			Networks:  rc.Networks,
+			Ports:     rc.Ports,
+			Countries: rc.Countries,
+			ASNs:      rc.ASNs,
+			ALPN:      rc.ALPN,
+			Users:     rc.Users,
+			MACs:      rc.MACs,
+			Expr:      rc.Expr,
+			Schedule:  rc.Schedule,
+			Upstream:  rc.Upstream,
+			Dest:      rc.Dest,
+			Resolve:   rc.Resolve,
+
+			ClientGroups: rc.ClientGroups,
+
+			RateLimit:        rc.RateLimit,
+			RateLimitPrefix:  rc.RateLimitPrefix,
+			RateLimitPrefix6: rc.RateLimitPrefix6,
+			MaxConnections:   rc.MaxConnections,
+
+			BlockAction: rc.BlockAction,
+		})
+	}
+	return rules
+}
+
+func parseProxyURL(key, s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		// url.Error contains the whole URL that may include a password.
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return nil, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return u, nil
+}
+
 func serve(lns []net.Listener, c *transocks.Config) {
 	s, err := transocks.NewServer(c)
 	if err != nil {
@@ -65,13 +576,191 @@ func serve(lns []net.Listener, c *transocks.Config) {
 	for _, ln := range lns {
 		s.Serve(ln)
 	}
+	if c.UDP {
+		conn, err := transocks.ListenUDP(c)
+		if err != nil {
+			log.ErrorExit(err)
+		}
+		s.ServeUDP(conn)
+	}
+	if len(c.DNSAddr) > 0 {
+		pc, ln, err := transocks.ListenDNS(c)
+		if err != nil {
+			log.ErrorExit(err)
+		}
+		if err := s.ServeDNS(pc, ln); err != nil {
+			log.ErrorExit(err)
+		}
+	}
+	if len(c.MetricsAddr) > 0 {
+		ln, err := transocks.ListenMetrics(c)
+		if err != nil {
+			log.ErrorExit(err)
+		}
+		s.ServeMetrics(ln)
+	}
+	if reloadOnSIGHUP {
+		well.Go(func(ctx context.Context) error {
+			reload(ctx, s)
+			return nil
+		})
+	}
 	err = well.Wait()
 	if err != nil && !well.IsSignaled(err) {
 		log.ErrorExit(err)
 	}
 }
 
+// reload applies rules in the configuration file to s on SIGHUP.
+func reload(ctx context.Context, s *transocks.Server) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+		}
+		c, err := loadConfig()
+		if err == nil {
+			err = s.Reload(c)
+		}
+		if err != nil {
+			log.Error("failed to reload rules", map[string]interface{}{
+				log.FnError: err.Error(),
+			})
+		}
+	}
+}
+
+// check validates the configuration and shows how to route connections
+// to transocks.
+func check(c *transocks.Config) {
+	if err := c.Validate(); err != nil {
+		log.ErrorExit(err)
+	}
+	fmt.Println("configuration is valid.")
+	fmt.Println()
+	fmt.Print(c.SetupGuide())
+}
+
+// nft installs or removes nftables rules, or shows them.
+func nft(c *transocks.Config, op string) {
+	if err := c.Validate(); err != nil {
+		log.ErrorExit(err)
+	}
+
+	var err error
+	switch op {
+	case "":
+		fmt.Print(c.NFTRuleset())
+	case "install":
+		err = c.InstallNFT()
+	case "remove":
+		err = c.RemoveNFT()
+	default:
+		err = errors.New("unknown nft command: " + op)
+	}
+	if err != nil {
+		log.ErrorExit(err)
+	}
+}
+
+// uidList is a flag.Value for repeated -uid options.
+type uidList []int
+
+func (l *uidList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *uidList) Set(s string) error {
+	uid, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, uid)
+	return nil
+}
+
+// stringList is a flag.Value for repeated string options.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// scope installs or removes firewall rules to route connections
+// made only by the given users or cgroups.
+func scope(c *transocks.Config, args []string) {
+	fs := flag.NewFlagSet("scope", flag.ExitOnError)
+	var uids uidList
+	var cgroups stringList
+	fs.Var(&uids, "uid", "route connections made by this `UID` (repeatable)")
+	fs.Var(&cgroups, "cgroup", "route connections made in this cgroup v2 `PATH` (repeatable)")
+	useIPTables := fs.Bool("iptables", false, "use iptables instead of nftables")
+	fs.Parse(args)
+
+	if len(uids) == 0 && len(cgroups) == 0 {
+		log.ErrorExit(errors.New("scope needs -uid or -cgroup"))
+	}
+	c.InterceptUIDs = uids
+	c.InterceptCgroups = cgroups
+	if err := c.Validate(); err != nil {
+		log.ErrorExit(err)
+	}
+
+	var err error
+	switch op := fs.Arg(0); {
+	case op == "" && *useIPTables:
+		err = errors.New("iptables rules cannot be shown; use nftables")
+	case op == "":
+		fmt.Print(c.NFTRuleset())
+	case op == "install" && *useIPTables:
+		err = c.InstallIPTables()
+	case op == "install":
+		err = c.InstallNFT()
+	case op == "remove" && *useIPTables:
+		err = c.RemoveIPTables()
+	case op == "remove":
+		err = c.RemoveNFT()
+	default:
+		err = errors.New("unknown scope command: " + op)
+	}
+	if err != nil {
+		log.ErrorExit(err)
+	}
+}
+
+// setupFirewall installs rules to route connections to transocks
+// as specified by auto_setup.  It returns a function to remove them.
+func setupFirewall(c *transocks.Config, kind string) (func() error, error) {
+	if len(kind) > 0 && c.Mode == transocks.ModeProxyProtocol {
+		return nil, errors.New("auto_setup cannot be used with proxy-protocol mode")
+	}
+
+	switch kind {
+	case "":
+		return func() error { return nil }, nil
+	case "nftables":
+		return c.RemoveNFT, c.InstallNFT()
+	case "iptables":
+		return c.RemoveIPTables, c.InstallIPTables()
+	}
+	return nil, errors.New("unknown auto_setup: " + kind)
+}
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPTIONS] [check | nft [install | remove] | scope [-uid UID] [-cgroup PATH] [-iptables] [install | remove]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	c, err := loadConfig()
@@ -79,17 +768,58 @@ func main() {
 		log.ErrorExit(err)
 	}
 
-	g := &well.Graceful{
-		Listen: func() ([]net.Listener, error) {
-			return transocks.Listeners(c)
-		},
-		Serve: func(lns []net.Listener) {
-			serve(lns, c)
-		},
+	switch flag.Arg(0) {
+	case "check":
+		check(c)
+		return
+	case "nft":
+		nft(c, flag.Arg(1))
+		return
+	case "scope":
+		scope(c, flag.Args()[1:])
+		return
+	}
+
+	// Listen is called only in the master process.
+	teardown := func() error { return nil }
+	listen := func() ([]net.Listener, error) {
+		lns, err := transocks.Listeners(c)
+		if err != nil {
+			return nil, err
+		}
+		teardown, err = setupFirewall(c, autoSetup)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		return lns, nil
+	}
+	if reloadOnSIGHUP {
+		// SIGHUP is for reloading, so the server runs in this process
+		// without graceful restart.
+		lns, err := listen()
+		if err != nil {
+			log.ErrorExit(err)
+		}
+		serve(lns, c)
+	} else {
+		g := &well.Graceful{
+			Listen: listen,
+			Serve: func(lns []net.Listener) {
+				serve(lns, c)
+			},
+		}
+		g.Run()
 	}
-	g.Run()
 
 	err = well.Wait()
+	if terr := teardown(); terr != nil {
+		log.Error("failed to remove firewall rules", map[string]interface{}{
+			log.FnError: terr.Error(),
+		})
+	}
 	if err != nil && !well.IsSignaled(err) {
 		log.ErrorExit(err)
 	}
@@ -0,0 +1,112 @@
+package transocks
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	maxPoolSize = 64
+
+	// poolMaxIdle is the time a pooled connection is kept unused.
+	// Proxies close idle connections without requests after a while.
+	poolMaxIdle = 30 * time.Second
+)
+
+// connPool keeps connections to an upstream proxy established in advance
+// so that only the proxy protocol handshake is needed per connection.
+//
+// The pool is refilled in background whenever a connection is taken.
+// No goroutine runs while the pool is full.
+type connPool struct {
+	forward proxy.Dialer
+	addr    string
+	conns   chan idleConn
+	filling int32
+	closed  int32
+}
+
+type idleConn struct {
+	net.Conn
+	since time.Time
+}
+
+// newConnPool creates a connPool of size connections to addr,
+// and starts filling it.
+func newConnPool(forward proxy.Dialer, addr string, size int) *connPool {
+	p := &connPool{
+		forward: forward,
+		addr:    addr,
+		conns:   make(chan idleConn, size),
+	}
+	p.fill()
+	return p
+}
+
+// get returns a pooled connection, or nil if none is available.
+func (p *connPool) get() net.Conn {
+	defer p.fill()
+
+	for {
+		select {
+		case ic := <-p.conns:
+			if time.Since(ic.since) < poolMaxIdle {
+				return ic.Conn
+			}
+			ic.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// close closes pooled connections and stops filling the pool.
+func (p *connPool) close() {
+	atomic.StoreInt32(&p.closed, 1)
+	p.drain()
+}
+
+func (p *connPool) drain() {
+	for {
+		select {
+		case ic := <-p.conns:
+			ic.Close()
+		default:
+			return
+		}
+	}
+}
+
+// fill starts a goroutine to make connections until the pool gets full.
+// The goroutine stops at the first failure; the pool is filled again
+// by the next call to get.
+func (p *connPool) fill() {
+	if !atomic.CompareAndSwapInt32(&p.filling, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&p.filling, 0)
+
+		for len(p.conns) < cap(p.conns) && atomic.LoadInt32(&p.closed) == 0 {
+			c, err := p.forward.Dial("tcp", p.addr)
+			if err != nil {
+				return
+			}
+			select {
+			case p.conns <- idleConn{c, time.Now()}:
+			default:
+				c.Close()
+				return
+			}
+			// close may have drained the pool before c was put.
+			if atomic.LoadInt32(&p.closed) != 0 {
+				p.drain()
+				return
+			}
+		}
+	}()
+}
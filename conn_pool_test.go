@@ -0,0 +1,85 @@
+package transocks
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConnPool(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// served receives the sequence number of the accepted connection
+	// on which a CONNECT request is served.
+	served := make(chan int, 10)
+	go func() {
+		for i := 0; ; i++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn, i int) {
+				defer c.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+					return
+				}
+				served <- i
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+			}(c, i)
+		}
+	}()
+
+	u, err := url.Parse("http://" + l.Addr().String() + "?pool=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := httpDialType(u, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := d.(*httpDialer).pool
+	for i := 0; len(p.conns) < 2; i++ {
+		if i == 100 {
+			t.Fatal("pool is not filled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := d.Dial("tcp", "www.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if i := <-served; i >= 2 {
+		t.Error("pooled connection was not used:", i)
+	}
+
+	d.(*httpDialer).Close()
+	if len(p.conns) != 0 {
+		t.Error("pooled connections should be closed")
+	}
+	if p.get() != nil {
+		t.Error("closed pool should not return connections")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(p.conns) != 0 {
+		t.Error("closed pool should not be filled")
+	}
+
+	for _, s := range []string{"0", "-1", "foo", "65"} {
+		u, _ := url.Parse("http://" + l.Addr().String() + "?pool=" + s)
+		if _, err := httpDialType(u, &net.Dialer{}); err == nil {
+			t.Error("pool size should be rejected:", s)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// +build linux
+
+package transocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// This file looks up original destinations in the conntrack table
+// through ctnetlink.  This is used when getsockopt(SO_ORIGINAL_DST)
+// fails with ENOENT, which happens under heavy conntrack table churn.
+//
+// Connections redirected to transocks have conntrack entries whose
+// reply tuple is from the local address to the client.  The original
+// destination is the destination of the original tuple.
+//
+// ctnetlink requires CAP_NET_ADMIN capability.
+
+const (
+	nfnlSubsysCTNetlink = 1
+	ipctnlMsgCTGet      = 1
+
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+
+	nlaFNested  = 0x8000
+	nlaTypeMask = 0x3fff
+
+	conntrackTimeout = 1 * time.Second
+)
+
+// netlinkAttr appends a netlink attribute to b.
+func netlinkAttr(b []byte, typ uint16, data []byte) []byte {
+	l := unix.SizeofNlAttr + len(data)
+	hdr := make([]byte, unix.SizeofNlAttr)
+	binary.LittleEndian.PutUint16(hdr[0:], uint16(l))
+	binary.LittleEndian.PutUint16(hdr[2:], typ)
+	b = append(b, hdr...)
+	b = append(b, data...)
+	for l%unix.NLA_ALIGNTO != 0 {
+		b = append(b, 0)
+		l++
+	}
+	return b
+}
+
+// netlinkAttrs parses netlink attributes in b.
+func netlinkAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= unix.SizeofNlAttr {
+		l := int(binary.LittleEndian.Uint16(b[0:]))
+		typ := binary.LittleEndian.Uint16(b[2:]) & nlaTypeMask
+		if l < unix.SizeofNlAttr || l > len(b) {
+			break
+		}
+		attrs[typ] = b[unix.SizeofNlAttr:l]
+		l = (l + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+		if l > len(b) {
+			break
+		}
+		b = b[l:]
+	}
+	return attrs
+}
+
+// conntrackRequest builds IPCTNL_MSG_CT_GET request for the entry
+// whose reply tuple is from local to remote.
+func conntrackRequest(seq uint32, local, remote *net.TCPAddr) []byte {
+	family := byte(unix.AF_INET)
+	srcType, dstType := uint16(ctaIPv4Src), uint16(ctaIPv4Dst)
+	src, dst := local.IP.To4(), remote.IP.To4()
+	if src == nil || dst == nil {
+		family = unix.AF_INET6
+		srcType, dstType = ctaIPv6Src, ctaIPv6Dst
+		src, dst = local.IP.To16(), remote.IP.To16()
+	}
+
+	var ip, proto, tuple []byte
+	ip = netlinkAttr(ip, srcType, src)
+	ip = netlinkAttr(ip, dstType, dst)
+	port := make([]byte, 2)
+	proto = netlinkAttr(proto, ctaProtoNum, []byte{unix.IPPROTO_TCP})
+	binary.BigEndian.PutUint16(port, uint16(local.Port))
+	proto = netlinkAttr(proto, ctaProtoSrcPort, port)
+	binary.BigEndian.PutUint16(port, uint16(remote.Port))
+	proto = netlinkAttr(proto, ctaProtoDstPort, port)
+	tuple = netlinkAttr(tuple, ctaTupleIP|nlaFNested, ip)
+	tuple = netlinkAttr(tuple, ctaTupleProto|nlaFNested, proto)
+
+	// struct nfgenmsg: family, version, and resource ID.
+	body := []byte{family, unix.NFNETLINK_V0, 0, 0}
+	body = netlinkAttr(body, ctaTupleReply|nlaFNested, tuple)
+
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+	binary.LittleEndian.PutUint32(msg[0:], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.LittleEndian.PutUint16(msg[4:], nfnlSubsysCTNetlink<<8|ipctnlMsgCTGet)
+	binary.LittleEndian.PutUint16(msg[6:], unix.NLM_F_REQUEST)
+	binary.LittleEndian.PutUint32(msg[8:], seq)
+	return append(msg, body...)
+}
+
+// parseConntrackEntry returns the destination of the original tuple
+// in a conntrack entry message without the netlink header.
+func parseConntrackEntry(b []byte) (*net.TCPAddr, error) {
+	if len(b) < 4 {
+		return nil, errors.New("short conntrack message")
+	}
+	tuple := netlinkAttrs(netlinkAttrs(b[4:])[ctaTupleOrig])
+	ip := netlinkAttrs(tuple[ctaTupleIP])
+	proto := netlinkAttrs(tuple[ctaTupleProto])
+
+	dst, ok := ip[ctaIPv4Dst]
+	if !ok {
+		dst = ip[ctaIPv6Dst]
+	}
+	port := proto[ctaProtoDstPort]
+	if (len(dst) != net.IPv4len && len(dst) != net.IPv6len) || len(port) != 2 {
+		return nil, errors.New("no original destination in conntrack entry")
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), dst...)),
+		Port: int(binary.BigEndian.Uint16(port)),
+	}, nil
+}
+
+// conntrackOriginalDST looks up the original destination of a
+// connection redirected to local from remote.
+func conntrackOriginalDST(local, remote *net.TCPAddr) (*net.TCPAddr, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	defer unix.Close(fd)
+
+	tv := unix.NsecToTimeval(int64(conntrackTimeout))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	seq := uint32(time.Now().UnixNano())
+	req := conntrackRequest(seq, local, remote)
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			if m.Header.Type == unix.NLMSG_ERROR {
+				if len(m.Data) >= 4 {
+					if errno := int32(binary.LittleEndian.Uint32(m.Data)); errno != 0 {
+						return nil, os.NewSyscallError("ctnetlink", unix.Errno(-errno))
+					}
+				}
+				return nil, errors.New("no conntrack entry")
+			}
+			return parseConntrackEntry(m.Data)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// +build linux
+
+package transocks
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestConntrackRequest(t *testing.T) {
+	t.Parallel()
+
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1081}
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321}
+	msg := conntrackRequest(10, local, remote)
+
+	if int(binary.LittleEndian.Uint32(msg)) != len(msg) {
+		t.Error("wrong message length")
+	}
+	if typ := binary.LittleEndian.Uint16(msg[4:]); typ != 0x0101 {
+		t.Errorf("wrong message type: %#x", typ)
+	}
+	body := msg[unix.SizeofNlMsghdr:]
+	if body[0] != unix.AF_INET {
+		t.Error("wrong family", body[0])
+	}
+
+	tuple := netlinkAttrs(netlinkAttrs(body[4:])[ctaTupleReply])
+	ip := netlinkAttrs(tuple[ctaTupleIP])
+	proto := netlinkAttrs(tuple[ctaTupleProto])
+	if !net.IP(ip[ctaIPv4Src]).Equal(local.IP) || !net.IP(ip[ctaIPv4Dst]).Equal(remote.IP) {
+		t.Error("wrong addresses", ip)
+	}
+	if binary.BigEndian.Uint16(proto[ctaProtoSrcPort]) != 1081 ||
+		binary.BigEndian.Uint16(proto[ctaProtoDstPort]) != 54321 {
+		t.Error("wrong ports", proto)
+	}
+
+	msg = conntrackRequest(10, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1081},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 54321})
+	if msg[unix.SizeofNlMsghdr] != unix.AF_INET6 {
+		t.Error("wrong family for IPv6")
+	}
+}
+
+func TestParseConntrackEntry(t *testing.T) {
+	t.Parallel()
+
+	var ip, proto, tuple []byte
+	ip = netlinkAttr(ip, ctaIPv4Src, net.ParseIP("192.0.2.1").To4())
+	ip = netlinkAttr(ip, ctaIPv4Dst, net.ParseIP("198.51.100.1").To4())
+	proto = netlinkAttr(proto, ctaProtoNum, []byte{unix.IPPROTO_TCP})
+	proto = netlinkAttr(proto, ctaProtoSrcPort, []byte{0xd4, 0x31})
+	proto = netlinkAttr(proto, ctaProtoDstPort, []byte{0x01, 0xbb})
+	tuple = netlinkAttr(tuple, ctaTupleIP|nlaFNested, ip)
+	tuple = netlinkAttr(tuple, ctaTupleProto|nlaFNested, proto)
+	entry := []byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0}
+	entry = netlinkAttr(entry, ctaTupleOrig|nlaFNested, tuple)
+
+	addr, err := parseConntrackEntry(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "198.51.100.1:443" {
+		t.Error("wrong original destination", addr)
+	}
+
+	if _, err := parseConntrackEntry(entry[:4]); err == nil {
+		t.Error("entry without tuples should be an error")
+	}
+}
@@ -0,0 +1,59 @@
+package transocks
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// socketOption sets an option to the socket fd before bind.
+type socketOption func(fd int, network string) error
+
+// controlFunc returns a function for net.ListenConfig.Control or
+// net.Dialer.Control that calls f with the socket file descriptor.
+func controlFunc(f func(fd int, network string) error) func(string, string, syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = f(int(fd), network)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// listenTCP creates a TCP listener with socket options.
+func listenTCP(addr string, opts ...socketOption) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: controlFunc(func(fd int, network string) error {
+			for _, opt := range opts {
+				if err := opt(fd, network); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// listenUDP creates a UDP socket with socket options.
+func listenUDP(addr string, opts ...socketOption) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: controlFunc(func(fd int, network string) error {
+			for _, opt := range opts {
+				if err := opt(fd, network); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
@@ -0,0 +1,113 @@
+package transocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	credentialsCheckInterval = 5 * time.Second
+)
+
+// readCredentials reads "USER:PASSWORD" from a file.
+// Leading and trailing white spaces are ignored.
+func readCredentials(name string) (*url.Userinfo, []byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	data = bytes.TrimSpace(data)
+	i := bytes.IndexByte(data, ':')
+	if i < 1 {
+		return nil, nil, errors.New("credentials must be USER:PASSWORD in " + name)
+	}
+	return url.UserPassword(string(data[:i]), string(data[i+1:])), data, nil
+}
+
+// credentialsWatcher applies credentials in a file to upstream proxies
+// and re-applies them whenever the file is modified.
+type credentialsWatcher struct {
+	name    string
+	groups  map[string]*upstreamGroup
+	logger  *log.Logger
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+// load reads the file and applies the credentials if changed.
+func (w *credentialsWatcher) load() error {
+	fi, err := os.Stat(w.name)
+	if err != nil {
+		return err
+	}
+	if w.data != nil && fi.ModTime().Equal(w.modTime) && fi.Size() == w.size {
+		return nil
+	}
+
+	user, data, err := readCredentials(w.name)
+	if err != nil {
+		return err
+	}
+	w.modTime = fi.ModTime()
+	w.size = fi.Size()
+	if bytes.Equal(data, w.data) {
+		return nil
+	}
+
+	// Dialers of all groups are built first so that nothing is changed
+	// if an error happens.
+	dialers := make(map[*upstreamGroup][]proxy.Dialer)
+	for _, g := range w.groups {
+		ds, err := g.buildCredentials(user)
+		if err != nil {
+			for _, ds := range dialers {
+				closeDialers(ds)
+			}
+			return err
+		}
+		dialers[g] = ds
+	}
+	for g, ds := range dialers {
+		g.setDialers(ds)
+	}
+	w.data = data
+	return nil
+}
+
+// watch calls load periodically until ctx is done.
+func (w *credentialsWatcher) watch(ctx context.Context) {
+	ticker := time.NewTicker(credentialsCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		old := w.data
+		err := w.load()
+		if err != nil {
+			w.logger.Error("failed to reload proxy credentials", map[string]interface{}{
+				"filename":  w.name,
+				log.FnError: err.Error(),
+			})
+			continue
+		}
+		if !bytes.Equal(old, w.data) {
+			w.logger.Info("proxy credentials reloaded", map[string]interface{}{
+				"filename": w.name,
+			})
+		}
+	}
+}
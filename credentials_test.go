@@ -0,0 +1,128 @@
+package transocks
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+func TestCredentialsWatcher(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "transocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(name, []byte("user:pass1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	authz := make(chan string, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			req, err := http.ReadRequest(bufio.NewReader(c))
+			if err == nil {
+				authz <- req.Header.Get("Proxy-Authorization")
+				c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			}
+			c.Close()
+		}
+	}()
+
+	c := NewConfig()
+	c.ProxyURL, _ = url.Parse("http://" + l.Addr().String())
+	g, err := newUpstreamGroup(UpstreamDefault, []*url.URL{c.ProxyURL}, c.Balance, c, &net.Dialer{Timeout: 5 * time.Second}, log.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssURL, _ := url.Parse("ss://aes-128-gcm:secret@127.0.0.1:8388")
+	sg, err := newUpstreamGroup("ss", []*url.URL{ssURL}, c.Balance, c, &net.Dialer{Timeout: 5 * time.Second}, log.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssDialer := sg.upstreams[0].proxyDialer()
+	w := &credentialsWatcher{
+		name:   name,
+		groups: map[string]*upstreamGroup{UpstreamDefault: g, "ss": sg},
+		logger: log.NewLogger(),
+	}
+
+	basic := func(up string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(up))
+	}
+	testAuthz := func(expected string) {
+		conn, err := g.Dial("tcp", "www.example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if a := <-authz; a != expected {
+			t.Errorf("unexpected Proxy-Authorization: %s != %s", a, expected)
+		}
+	}
+
+	if err := w.load(); err != nil {
+		t.Fatal(err)
+	}
+	testAuthz(basic("user:pass1"))
+	if sg.upstreams[0].proxyDialer() != ssDialer {
+		t.Error("credentials should not be applied to ss upstreams")
+	}
+
+	// make sure the modification time changes.
+	if err := ioutil.WriteFile(name, []byte("user:pass2:x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(name, time.Now(), time.Now().Add(time.Minute))
+	if err := w.load(); err != nil {
+		t.Fatal(err)
+	}
+	testAuthz(basic("user:pass2:x"))
+
+	if err := ioutil.WriteFile(name, []byte("invalid\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(name, time.Now(), time.Now().Add(2*time.Minute))
+	if err := w.load(); err == nil {
+		t.Error("invalid credentials should be rejected")
+	}
+	testAuthz(basic("user:pass2:x"))
+
+	// A SOCKS5 username longer than 255 octets is rejected, and
+	// credentials of other groups are not changed either.
+	socksURL, _ := url.Parse("socks5://127.0.0.1:1080")
+	xg, err := newUpstreamGroup("socks", []*url.URL{socksURL}, c.Balance, c, &net.Dialer{Timeout: 5 * time.Second}, log.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.groups["socks"] = xg
+	if err := ioutil.WriteFile(name, []byte(strings.Repeat("u", 256)+":pass3"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(name, time.Now(), time.Now().Add(3*time.Minute))
+	if err := w.load(); err == nil {
+		t.Error("long SOCKS5 username should be rejected")
+	}
+	testAuthz(basic("user:pass2:x"))
+}
@@ -9,4 +9,16 @@ const (
 
 	// IP6T_SO_ORIGINAL_DST a Linux getsockopt optname.
 	IP6T_SO_ORIGINAL_DST = 80
+
+	// IP_RECVORIGDSTADDR is a Linux setsockopt optname.
+	IP_RECVORIGDSTADDR = 20
+
+	// IP_ORIGDSTADDR is a Linux control message type.
+	IP_ORIGDSTADDR = 20
+
+	// IPV6_RECVORIGDSTADDR is a Linux setsockopt optname.
+	IPV6_RECVORIGDSTADDR = 74
+
+	// IPV6_ORIGDSTADDR is a Linux control message type.
+	IPV6_ORIGDSTADDR = 74
 )
@@ -0,0 +1,370 @@
+package transocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"golang.org/x/net/proxy"
+)
+
+// This file implements a DNS forwarder.
+//
+// Queries received by UDP or TCP are forwarded to a resolver through
+// the default upstream, either by DNS over TCP or DNS over HTTPS.
+// Messages are not parsed; transocks just relays them.
+
+const (
+	dnsTimeout     = 5 * time.Second
+	dnsIdleTimeout = 30 * time.Second
+
+	// dnsMaxMessageSize is the maximum size of DNS messages over TCP.
+	dnsMaxMessageSize = 65535
+
+	dohContentType = "application/dns-message"
+
+	// dnsMaxInflight limits queries being forwarded at the same time.
+	// UDP queries over the limit are dropped, and clients retry them.
+	dnsMaxInflight = 256
+
+	// dnsTCPIdleConns is the number of idle connections to the
+	// resolver kept for DNS over TCP.
+	dnsTCPIdleConns = 16
+)
+
+// dnsExchanger sends a DNS query and returns the response.
+type dnsExchanger interface {
+	exchange(query []byte) ([]byte, error)
+}
+
+// dnsTCP forwards queries by DNS over TCP (RFC 7766).  Connections
+// to the resolver are reused for subsequent queries.
+type dnsTCP struct {
+	addr    string
+	forward proxy.Dialer
+	idle    chan idleConn
+}
+
+func newDNSTCP(addr string, forward proxy.Dialer) *dnsTCP {
+	return &dnsTCP{
+		addr:    addr,
+		forward: forward,
+		idle:    make(chan idleConn, dnsTCPIdleConns),
+	}
+}
+
+// get returns an idle connection, or nil if none is available.
+func (d *dnsTCP) get() net.Conn {
+	for {
+		select {
+		case ic := <-d.idle:
+			if time.Since(ic.since) < dnsIdleTimeout {
+				return ic.Conn
+			}
+			ic.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (d *dnsTCP) put(c net.Conn) {
+	select {
+	case d.idle <- idleConn{c, time.Now()}:
+	default:
+		c.Close()
+	}
+}
+
+func (d *dnsTCP) exchange(query []byte) ([]byte, error) {
+	// The resolver may have closed an idle connection, so a query
+	// failed on it is retried with a new connection.
+	if c := d.get(); c != nil {
+		if resp, err := d.exchangeOn(c, query); err == nil {
+			return resp, nil
+		}
+	}
+	c, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.exchangeOn(c, query)
+}
+
+// exchangeOn sends query on c, and returns c to the idle connections
+// if it succeeds.  Otherwise c is closed.
+func (d *dnsTCP) exchangeOn(c net.Conn, query []byte) ([]byte, error) {
+	c.SetDeadline(time.Now().Add(dnsTimeout))
+	err := writeDNSMessage(c, query)
+	var resp []byte
+	if err == nil {
+		resp, err = readDNSMessage(c)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	d.put(c)
+	return resp, nil
+}
+
+// dnsHTTPS forwards queries by DNS over HTTPS (RFC 8484).
+type dnsHTTPS struct {
+	url    string
+	client *http.Client
+}
+
+func newDNSHTTPS(u *url.URL, forward proxy.Dialer) *dnsHTTPS {
+	return &dnsHTTPS{
+		url: u.String(),
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial:                forward.Dial,
+				TLSHandshakeTimeout: dnsTimeout,
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     90 * time.Second,
+			},
+			Timeout: dnsTimeout,
+		},
+	}
+}
+
+func (d *dnsHTTPS) exchange(query []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, errors.New("DNS over HTTPS server returns " + resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, dnsMaxMessageSize))
+}
+
+func newDNSExchanger(u *url.URL, forward proxy.Dialer) (dnsExchanger, error) {
+	switch u.Scheme {
+	case "tcp":
+		return newDNSTCP(u.Host, forward), nil
+	case "https":
+		return newDNSHTTPS(u, forward), nil
+	}
+	return nil, fmt.Errorf("unsupported DNS upstream: %s", u.Scheme)
+}
+
+// readDNSMessage reads a message prefixed by two-byte length.
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeDNSMessage writes msg prefixed by two-byte length.
+func writeDNSMessage(w io.Writer, msg []byte) error {
+	if len(msg) > dnsMaxMessageSize {
+		return errors.New("too large DNS message")
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ListenDNS creates UDP and TCP sockets to receive DNS queries on
+// c.DNSAddr.  SO_REUSEPORT is set if supported, so that a new process
+// can listen on the address while the old one stops in graceful restart.
+func ListenDNS(c *Config) (*net.UDPConn, net.Listener, error) {
+	pc, err := listenUDP(c.DNSAddr, setReusePort)
+	if err != nil {
+		addr, err := net.ResolveUDPAddr("udp", c.DNSAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		pc, err = net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	ln, err := listenTCP(c.DNSAddr, setReusePort)
+	if err != nil {
+		ln, err = net.Listen("tcp", c.DNSAddr)
+	}
+	if err != nil {
+		pc.Close()
+		return nil, nil, err
+	}
+	return pc, ln, nil
+}
+
+func (s *Server) logDNSError(client net.Addr, err error) {
+	s.logger.Error("failed to forward DNS query", map[string]interface{}{
+		"client_addr": client.String(),
+		log.FnError:   err.Error(),
+	})
+}
+
+// allowsDNSClient returns true if addr may send DNS queries by
+// Config.AllowClients and Config.DenyClients.
+func (s *Server) allowsDNSClient(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	if s.ruleset().profile.acl.allowsClient(ip) {
+		return true
+	}
+	return !s.denyPacket(map[string]interface{}{
+		"client_addr": addr.String(),
+	}, "DNS client denied")
+}
+
+// serveDNSUDP forwards queries received by pc.  sem limits queries in
+// flight; queries over the limit are dropped.
+func (s *Server) serveDNSUDP(ctx context.Context, ex dnsExchanger, sem chan struct{}, pc *net.UDPConn) {
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, client, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			s.logger.Error("failed to read DNS query", map[string]interface{}{
+				log.FnError: err.Error(),
+			})
+			return
+		}
+
+		if !s.allowsDNSClient(client) {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-sem }()
+			resp, err := ex.exchange(query)
+			if err != nil {
+				s.logDNSError(client, err)
+				return
+			}
+			pc.WriteToUDP(resp, client)
+		}()
+	}
+}
+
+// serveDNSTCP forwards queries received on connections accepted by ln.
+// sem limits queries in flight; queries over the limit wait.
+func (s *Server) serveDNSTCP(ctx context.Context, ex dnsExchanger, sem chan struct{}, ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			s.logger.Error("failed to accept DNS connection", map[string]interface{}{
+				log.FnError: err.Error(),
+			})
+			return
+		}
+		if !s.allowsDNSClient(c.RemoteAddr()) {
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer c.Close()
+			for {
+				c.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+				query, err := readDNSMessage(c)
+				if err != nil {
+					return
+				}
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				resp, err := ex.exchange(query)
+				<-sem
+				if err != nil {
+					s.logDNSError(c.RemoteAddr(), err)
+					return
+				}
+				if err := writeDNSMessage(c, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// ServeDNS forwards DNS queries received by pc and ln to the resolver
+// in Config.DNSUpstream through the default upstream.  pc and ln
+// should be created by ListenDNS.
+//
+// ServeDNS returns immediately and serves queries in background
+// until the environment of the server is canceled.  It returns
+// non-nil error only if Config.DNSUpstream is not supported.
+func (s *Server) ServeDNS(pc *net.UDPConn, ln net.Listener) error {
+	if s.dnsUpstream == nil {
+		return errors.New("no DNS upstream")
+	}
+	ex, err := newDNSExchanger(s.dnsUpstream, s.dialer(UpstreamDefault))
+	if err != nil {
+		return err
+	}
+	if s.fakeIP != nil {
+		ex = &fakeIPExchanger{pool: s.fakeIP, next: ex}
+	}
+
+	s.goBackground(func(ctx context.Context) {
+		<-ctx.Done()
+		pc.Close()
+		ln.Close()
+	})
+	sem := make(chan struct{}, dnsMaxInflight)
+	s.goBackground(func(ctx context.Context) {
+		s.serveDNSUDP(ctx, ex, sem, pc)
+	})
+	s.goBackground(func(ctx context.Context) {
+		s.serveDNSTCP(ctx, ex, sem, ln)
+	})
+	return nil
+}
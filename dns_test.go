@@ -0,0 +1,187 @@
+package transocks
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+func TestDNSTCP(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The resolver closes connections after "close" queries.
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				defer c.Close()
+				for {
+					q, err := readDNSMessage(c)
+					if err != nil {
+						return
+					}
+					writeDNSMessage(c, append(q, "-answer"...))
+					if string(q) == "close" {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	u, _ := url.Parse("tcp://" + l.Addr().String())
+	ex, err := newDNSExchanger(u, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"query", "query2", "close", "query3"} {
+		resp, err := ex.exchange([]byte(q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp) != q+"-answer" {
+			t.Errorf("unexpected response: %q", resp)
+		}
+	}
+	// The connection is reused until the resolver closes it.
+	if len(accepted) != 2 {
+		t.Error("unexpected connections:", len(accepted))
+	}
+}
+
+func TestDNSHTTPS(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		q, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(append(q, "-answer"...))
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL + "/dns-query")
+	ex := newDNSHTTPS(u, &net.Dialer{Timeout: 5 * time.Second})
+	resp, err := ex.exchange([]byte("query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "query-answer" {
+		t.Errorf("unexpected response: %q", resp)
+	}
+
+	u, _ = url.Parse(ts.URL + "/unknown")
+	if _, err := newDNSExchanger(u, &net.Dialer{}); err == nil {
+		t.Error("http scheme should not be supported")
+	}
+}
+
+func TestDNSMessage(t *testing.T) {
+	t.Parallel()
+
+	buf := new(bytes.Buffer)
+	if err := writeDNSMessage(buf, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "\x00\x05hello" {
+		t.Errorf("unexpected message: %q", buf.Bytes())
+	}
+	msg, err := readDNSMessage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "hello" {
+		t.Errorf("unexpected message: %q", msg)
+	}
+
+	if err := writeDNSMessage(buf, make([]byte, 65536)); err == nil {
+		t.Error("too large message should be rejected")
+	}
+}
+
+func TestAllowsDNSClient(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1080")
+	c.DenyClients = []string{"10.0.0.0/8"}
+	c.Logger = log.NewLogger()
+	c.Logger.SetOutput(ioutil.Discard)
+	s, err := NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.allowsDNSClient(&net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 10000}) {
+		t.Error("client should be allowed")
+	}
+	if s.allowsDNSClient(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 10000}) {
+		t.Error("UDP client should be denied")
+	}
+	if s.allowsDNSClient(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 10000}) {
+		t.Error("TCP client should be denied")
+	}
+
+	c.AuditOnly = true
+	s, err = NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.allowsDNSClient(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 10000}) {
+		t.Error("client should be allowed in audit-only mode")
+	}
+}
+
+func TestListenDNSReusePort(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+
+	c := NewConfig()
+	c.DNSAddr = "127.0.0.1:0"
+	pc, ln, err := ListenDNS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	c.DNSAddr = pc.LocalAddr().String()
+	pc.Close()
+
+	pc, ln, err = ListenDNS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	defer ln.Close()
+
+	// A new process listens on the address during graceful restart.
+	pc2, ln2, err := ListenDNS(c)
+	if err != nil {
+		t.Fatal("DNS address should be reusable:", err)
+	}
+	pc2.Close()
+	ln2.Close()
+}
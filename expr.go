@@ -0,0 +1,499 @@
+package transocks
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// This file implements expressions of Rule.Expr such as
+//
+//     host endsWith ".dev" && clientIP in 10.0.0.0/8
+//
+// The grammar is:
+//
+//     expr    = and { "||" and }
+//     and     = unary { "&&" unary }
+//     unary   = "!" unary | "(" expr ")" | cond
+//     cond    = field op value
+//     value   = string | number | network | "[" value { "," value } "]"
+//
+// Conditions on fields whose values are not known, such as country
+// without GeoIP data, are unknown rather than false.  As in SQL,
+// "!" of an unknown condition is also unknown, "&&" and "||" are
+// unknown unless the other operand decides the result, and a whole
+// expression that is unknown does not match.  So both
+// `country == "JP"` and `!(country == "JP")` are false without GeoIP.
+
+// Types of fields in expressions.
+const (
+	exprString = iota
+	exprList
+	exprInt
+	exprIP
+)
+
+var exprFields = map[string]int{
+	"host":     exprString,
+	"sni":      exprString,
+	"country":  exprString,
+	"asn":      exprInt,
+	"protocol": exprString,
+	"alpn":     exprList,
+	"port":     exprInt,
+	"uid":      exprInt,
+	"clientIP": exprIP,
+	"destIP":   exprIP,
+}
+
+var exprOps = map[int][]string{
+	exprString: {"==", "!=", "startsWith", "endsWith", "contains", "in"},
+	exprList:   {"contains", "in"},
+	exprInt:    {"==", "!=", "<", "<=", ">", ">=", "in"},
+	exprIP:     {"==", "!=", "in"},
+}
+
+// Values of expressions.
+const (
+	exprFalse = iota
+	exprTrue
+	exprUnknown
+)
+
+func exprBool(b bool) int {
+	if b {
+		return exprTrue
+	}
+	return exprFalse
+}
+
+// exprNode is a compiled expression.
+type exprNode interface {
+	eval(c *connInfo) int
+}
+
+type exprAnd struct{ l, r exprNode }
+type exprOr struct{ l, r exprNode }
+type exprNot struct{ x exprNode }
+
+func (e exprAnd) eval(c *connInfo) int {
+	l := e.l.eval(c)
+	if l == exprFalse {
+		return exprFalse
+	}
+	if r := e.r.eval(c); r != exprTrue {
+		return r
+	}
+	return l
+}
+
+func (e exprOr) eval(c *connInfo) int {
+	l := e.l.eval(c)
+	if l == exprTrue {
+		return exprTrue
+	}
+	if r := e.r.eval(c); r != exprFalse {
+		return r
+	}
+	return l
+}
+
+func (e exprNot) eval(c *connInfo) int {
+	switch v := e.x.eval(c); v {
+	case exprTrue:
+		return exprFalse
+	case exprFalse:
+		return exprTrue
+	default:
+		return v
+	}
+}
+
+// exprCond is a condition on a field.
+type exprCond struct {
+	field    string
+	op       string
+	strs     []string
+	nums     []int
+	networks []*net.IPNet
+}
+
+func (e *exprCond) evalString(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	switch e.op {
+	case "==", "in":
+		for _, v := range e.strs {
+			if s == v {
+				return true
+			}
+		}
+		return false
+	case "!=":
+		return s != e.strs[0]
+	case "startsWith":
+		return strings.HasPrefix(s, e.strs[0])
+	case "endsWith":
+		return strings.HasSuffix(s, e.strs[0])
+	case "contains":
+		return strings.Contains(s, e.strs[0])
+	}
+	return false
+}
+
+func (e *exprCond) evalInt(n int) bool {
+	switch e.op {
+	case "==", "in":
+		for _, v := range e.nums {
+			if n == v {
+				return true
+			}
+		}
+		return false
+	case "!=":
+		return n != e.nums[0]
+	case "<":
+		return n < e.nums[0]
+	case "<=":
+		return n <= e.nums[0]
+	case ">":
+		return n > e.nums[0]
+	case ">=":
+		return n >= e.nums[0]
+	}
+	return false
+}
+
+func (e *exprCond) evalIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	in := matchNetworks(e.networks, ip)
+	if e.op == "!=" {
+		return !in
+	}
+	return in
+}
+
+// known returns true if the value of the field is known for c.
+func (e *exprCond) known(c *connInfo) bool {
+	switch e.field {
+	case "host", "sni":
+		return len(c.host) > 0
+	case "country":
+		return len(c.country) > 0
+	case "asn":
+		return c.asn != 0
+	case "protocol":
+		return len(c.protocol) > 0
+	case "alpn":
+		return len(c.alpn) > 0
+	case "uid":
+		return c.owner != nil
+	case "clientIP":
+		return c.clientIP != nil
+	case "destIP":
+		return c.ip != nil
+	}
+	return true
+}
+
+func (e *exprCond) eval(c *connInfo) int {
+	if !e.known(c) {
+		return exprUnknown
+	}
+	return exprBool(e.holds(c))
+}
+
+func (e *exprCond) holds(c *connInfo) bool {
+	switch e.field {
+	case "host", "sni":
+		return e.evalString(c.host)
+	case "country":
+		return e.evalString(c.country)
+	case "asn":
+		if c.asn == 0 {
+			return false
+		}
+		return e.evalInt(c.asn)
+	case "protocol":
+		return e.evalString(c.protocol)
+	case "alpn":
+		// contains tests whether the list has the element.
+		for _, a := range c.alpn {
+			if (e.op == "contains" && a == e.strs[0]) || (e.op != "contains" && e.evalString(a)) {
+				return true
+			}
+		}
+		return false
+	case "port":
+		return e.evalInt(c.port)
+	case "uid":
+		if c.owner == nil {
+			return false
+		}
+		return e.evalInt(c.owner.uid)
+	case "clientIP":
+		return e.evalIP(c.clientIP)
+	case "destIP":
+		return e.evalIP(c.ip)
+	}
+	return false
+}
+
+// expression is a compiled Rule.Expr.
+type expression struct {
+	root   exprNode
+	fields map[string]bool
+}
+
+// uses returns true if e refers to any of fields.
+func (e *expression) uses(fields ...string) bool {
+	if e == nil {
+		return false
+	}
+	for _, f := range fields {
+		if e.fields[f] {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns true if e is nil or true for c.  Unknown is false.
+func (e *expression) match(c *connInfo) bool {
+	return e == nil || e.root.eval(c) == exprTrue
+}
+
+func isExprWordByte(b byte) bool {
+	return b == '_' || b == '.' || b == ':' || b == '/' || b == '-' ||
+		('0' <= b && b <= '9') || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
+
+// tokenizeExpr splits s into tokens.  String literals keep quotes.
+func tokenizeExpr(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch b := s[i]; {
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			i++
+		case b == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string in expression: %s", s[i:])
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		case strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||") ||
+			strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!=") ||
+			strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">="):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case strings.IndexByte("!()[],<>", b) >= 0:
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case isExprWordByte(b):
+			j := i
+			for j < len(s) && isExprWordByte(s[j]) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character in expression: %q", b)
+		}
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+	fields map[string]bool
+}
+
+func (p *exprParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *exprParser) expect(t string) error {
+	if got := p.next(); got != t {
+		return fmt.Errorf("expected %q but got %q in expression", t, got)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = exprOr{l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = exprAnd{l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprNot{x}, nil
+	case "(":
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+	return p.parseCond()
+}
+
+// parseValues parses a value or a list of values.
+func (p *exprParser) parseValues() ([]string, error) {
+	if p.peek() != "[" {
+		v := p.next()
+		if len(v) == 0 {
+			return nil, fmt.Errorf("missing value in expression")
+		}
+		return []string{v}, nil
+	}
+	p.next()
+	var values []string
+	for {
+		v := p.next()
+		if len(v) == 0 || strings.IndexByte("[],", v[0]) >= 0 {
+			return nil, fmt.Errorf("unexpected %q in expression", v)
+		}
+		values = append(values, v)
+		switch t := p.next(); t {
+		case ",":
+		case "]":
+			return values, nil
+		default:
+			return nil, fmt.Errorf("unexpected %q in expression", t)
+		}
+	}
+}
+
+func (p *exprParser) parseCond() (exprNode, error) {
+	field := p.next()
+	typ, ok := exprFields[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown field in expression: %q", field)
+	}
+	p.fields[field] = true
+
+	op := p.next()
+	var valid bool
+	for _, o := range exprOps[typ] {
+		valid = valid || o == op
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid operator for %s in expression: %q", field, op)
+	}
+
+	if p.peek() == "[" && op != "in" {
+		return nil, fmt.Errorf("list for %s in expression", op)
+	}
+	values, err := p.parseValues()
+	if err != nil {
+		return nil, err
+	}
+
+	cond := &exprCond{field: field, op: op}
+	for _, v := range values {
+		switch typ {
+		case exprString, exprList:
+			s, err := strconv.Unquote(v)
+			if err != nil || v[0] != '"' {
+				return nil, fmt.Errorf("invalid string in expression: %s", v)
+			}
+			switch field {
+			case "host", "sni":
+				s = strings.ToLower(s)
+			case "country":
+				s = strings.ToUpper(s)
+			}
+			cond.strs = append(cond.strs, s)
+		case exprInt:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number in expression: %s", v)
+			}
+			cond.nums = append(cond.nums, n)
+		case exprIP:
+			n, err := parseNetwork(v)
+			if err != nil {
+				return nil, err
+			}
+			cond.networks = append(cond.networks, n)
+		}
+	}
+	return cond, nil
+}
+
+// compileExpr compiles s.  If s is empty, this returns nil.
+func compileExpr(s string) (*expression, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return nil, nil
+	}
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens, fields: make(map[string]bool)}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression", p.peek())
+	}
+	return &expression{root: root, fields: p.fields}, nil
+}
@@ -0,0 +1,130 @@
+package transocks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	t.Parallel()
+
+	c := &connInfo{
+		host:     "www.example.dev",
+		country:  "JP",
+		alpn:     []string{"h2", "http/1.1"},
+		protocol: PeekTLS,
+		owner:    &processInfo{uid: 1000},
+		clientIP: net.ParseIP("10.1.2.3"),
+		ip:       net.ParseIP("2001:db8::1"),
+		port:     443,
+	}
+
+	testCases := []struct {
+		expr   string
+		expect bool
+	}{
+		{`host endsWith ".dev" && clientIP in 10.0.0.0/8`, true},
+		{`sni endsWith ".DEV"`, true},
+		{`host == "www.example.dev"`, true},
+		{`host != "www.example.dev"`, false},
+		{`host startsWith "www." && host contains "example"`, true},
+		{`host in ["a.example.com", "www.example.dev"]`, true},
+		{`country == "jp"`, true},
+		{`protocol == "tls"`, true},
+		{`alpn contains "h2"`, true},
+		{`alpn contains "h"`, false},
+		{`alpn contains "http"`, false},
+		{`alpn in ["h3", "dot"]`, false},
+		{`port == 443 && port >= 443 && port <= 443 && port > 80 && port < 8443`, true},
+		{`port in [80, 8080]`, false},
+		{`uid == 1000`, true},
+		{`clientIP == 10.1.2.3`, true},
+		{`clientIP != 10.0.0.0/8`, false},
+		{`destIP in [192.0.2.0/24, 2001:db8::/32]`, true},
+		{`!(port == 443) || host endsWith ".com"`, false},
+		{`port == 80 || port == 443 && host endsWith ".dev"`, true},
+		{`!!(port == 443)`, true},
+	}
+	for _, tc := range testCases {
+		e, err := compileExpr(tc.expr)
+		if err != nil {
+			t.Error(tc.expr, err)
+			continue
+		}
+		if e.match(c) != tc.expect {
+			t.Errorf("%s should be %v", tc.expr, tc.expect)
+		}
+	}
+
+	// elements of lists are not matched by substrings.
+	e, err := compileExpr(`alpn contains "h2"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.match(&connInfo{alpn: []string{"h2c"}}) {
+		t.Error(`alpn contains "h2" should not match h2c`)
+	}
+
+	// conditions on unknown values are false, even under negation.
+	unknown := &connInfo{port: 443}
+	for _, s := range []string{
+		`host != "a"`, `uid != 0`, `clientIP != 10.0.0.0/8`, `alpn contains "h2"`,
+		`!(country == "JP")`, `!(asn == 64496)`, `!!(host == "a")`,
+		`!(country == "JP") && port == 443`, `!(country == "JP" || port == 80)`,
+	} {
+		e, err := compileExpr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.match(unknown) {
+			t.Errorf("%s should be false for unknown values", s)
+		}
+	}
+	// unknown operands do not matter if the other decides the result.
+	for _, s := range []string{
+		`!(country == "JP") || port == 443`, `!(country == "JP" && port == 80)`,
+	} {
+		e, err := compileExpr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !e.match(unknown) {
+			t.Errorf("%s should be true for unknown values", s)
+		}
+	}
+
+	e, err = compileExpr("")
+	if err != nil || e != nil || !e.match(c) || e.uses("host") {
+		t.Error("empty expression should match all")
+	}
+
+	e, err = compileExpr(`sni == "a" && uid == 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.uses("host", "sni") || !e.uses("uid") || e.uses("country") {
+		t.Error("unexpected fields:", e.fields)
+	}
+
+	invalid := []string{
+		`host`,
+		`host ==`,
+		`host == www`,
+		`host == "a`,
+		`host < "a"`,
+		`port == "443"`,
+		`port == [443]`,
+		`clientIP in "10.0.0.0/8"`,
+		`user == "root"`,
+		`(port == 443`,
+		`port == 443)`,
+		`port == 443 &&`,
+		`port in [443,]`,
+		`port == 443 $`,
+	}
+	for _, s := range invalid {
+		if _, err := compileExpr(s); err == nil {
+			t.Errorf("%s should be invalid", s)
+		}
+	}
+}
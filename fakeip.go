@@ -0,0 +1,156 @@
+package transocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// This file implements fake-IP DNS.
+//
+// The DNS forwarder answers A queries with addresses from a reserved
+// network and remembers the names.  Connections to the addresses are
+// made to the names through proxies, so that routing rules with
+// domains work even for clients that send neither TLS SNI nor HTTP
+// Host header.
+
+const (
+	// fakeIPTTL is the TTL of fake answers.  Addresses may be
+	// reused for other names after the pool is exhausted.
+	fakeIPTTL = 1
+)
+
+// fakeIPPool allocates IPv4 addresses for names.
+type fakeIPPool struct {
+	network *net.IPNet
+	first   uint32
+	size    uint32
+
+	mu     sync.Mutex
+	next   uint32
+	byName map[string]uint32
+	byIP   map[uint32]string
+}
+
+func newFakeIPPool(cidr string) (*fakeIPPool, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if n.IP.To4() == nil {
+		return nil, errors.New("fake IP network must be IPv4: " + cidr)
+	}
+	ones, bits := n.Mask.Size()
+	if bits-ones < 2 || bits-ones > 24 {
+		return nil, errors.New("fake IP network must be from /8 to /30: " + cidr)
+	}
+
+	// network and broadcast addresses are not used.
+	return &fakeIPPool{
+		network: n,
+		first:   binary.BigEndian.Uint32(n.IP.To4()) + 1,
+		size:    1<<uint(bits-ones) - 2,
+		byName:  make(map[string]uint32),
+		byIP:    make(map[uint32]string),
+	}, nil
+}
+
+// lookup returns the address for name.  A new address is allocated
+// if name does not have one.  The oldest allocation is reused when
+// all addresses are allocated.
+func (p *fakeIPPool) lookup(name string) net.IP {
+	name = normalizeHost(name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	v, ok := p.byName[name]
+	if !ok {
+		v = p.first + p.next
+		p.next = (p.next + 1) % p.size
+		if old, ok := p.byIP[v]; ok {
+			delete(p.byName, old)
+		}
+		p.byName[name] = v
+		p.byIP[v] = name
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+// host returns the name for ip if ip is allocated by p.
+func (p *fakeIPPool) host(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !p.network.Contains(ip4) {
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name, ok := p.byIP[binary.BigEndian.Uint32(ip4)]
+	return name, ok
+}
+
+// fakeIPExchanger answers A and AAAA queries by itself and forwards
+// other queries to next.  AAAA queries get empty answers so that
+// clients use fake IPv4 addresses.
+type fakeIPExchanger struct {
+	pool *fakeIPPool
+	next dnsExchanger
+}
+
+func (f *fakeIPExchanger) exchange(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	if h.Response || h.OpCode != 0 || q.Class != dnsmessage.ClassINET {
+		return f.next.exchange(query)
+	}
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+	default:
+		return f.next.exchange(query)
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if q.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], f.pool.lookup(q.Name.String()))
+		err := b.AResource(dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   fakeIPTTL,
+		}, a)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
@@ -0,0 +1,116 @@
+package transocks
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type echoExchanger struct{}
+
+func (echoExchanger) exchange(query []byte) ([]byte, error) {
+	return query, nil
+}
+
+func TestFakeIPPool(t *testing.T) {
+	t.Parallel()
+
+	for _, cidr := range []string{"2001:db8::/64", "198.18.0.0/31", "10.0.0.0/7", "198.18.0.0"} {
+		if _, err := newFakeIPPool(cidr); err == nil {
+			t.Errorf("%s should be rejected", cidr)
+		}
+	}
+
+	p, err := newFakeIPPool("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.lookup("a.example.com.")
+	if !a.Equal(net.ParseIP("198.18.0.1")) {
+		t.Error("unexpected address for a:", a)
+	}
+	if ip := p.lookup("A.Example.COM"); !ip.Equal(a) {
+		t.Error("same name should have the same address:", ip)
+	}
+	b := p.lookup("b.example.com")
+	if !b.Equal(net.ParseIP("198.18.0.2")) {
+		t.Error("unexpected address for b:", b)
+	}
+	if h, ok := p.host(b); !ok || h != "b.example.com" {
+		t.Error("unexpected host for b:", h, ok)
+	}
+
+	// the pool is exhausted.
+	c := p.lookup("c.example.com")
+	if !c.Equal(a) {
+		t.Error("the oldest address should be reused:", c)
+	}
+	if h, _ := p.host(a); h != "c.example.com" {
+		t.Error("unexpected host for reused address:", h)
+	}
+	if _, ok := p.host(net.ParseIP("192.0.2.1")); ok {
+		t.Error("address outside of the pool should not be found")
+	}
+}
+
+func TestFakeIPExchanger(t *testing.T) {
+	t.Parallel()
+
+	p, err := newFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &fakeIPExchanger{pool: p, next: echoExchanger{}}
+
+	query := func(typ dnsmessage.Type) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1234, RecursionDesired: true})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{
+			Name:  dnsmessage.MustNewName("www.example.com."),
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+		})
+		msg, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	var msg dnsmessage.Message
+	resp, err := ex.exchange(query(dnsmessage.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 1234 || !msg.Response || len(msg.Answers) != 1 {
+		t.Fatalf("unexpected response: %+v", msg)
+	}
+	a := msg.Answers[0].Body.(*dnsmessage.AResource).A
+	if h, ok := p.host(net.IP(a[:])); !ok || h != "www.example.com" {
+		t.Error("unexpected host for the answer:", h, ok)
+	}
+
+	resp, err = ex.exchange(query(dnsmessage.TypeAAAA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Response || len(msg.Answers) != 0 {
+		t.Errorf("AAAA query should get an empty answer: %+v", msg)
+	}
+
+	q := query(dnsmessage.TypeMX)
+	resp, err = ex.exchange(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != string(q) {
+		t.Error("MX query should be forwarded")
+	}
+}
@@ -0,0 +1,92 @@
+package transocks
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// This file implements feedback to clients whose connections cannot
+// be relayed.  Without it, clients see connections accepted and then
+// closed normally, which many applications retry or wait on.
+
+// resetConn makes Close of c send TCP RST instead of FIN.
+func resetConn(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+}
+
+// udpUnreachable returns an ICMP or ICMPv6 port unreachable message
+// for a datagram from client to dst.  The message quotes IP and UDP
+// headers rebuilt from the addresses, as the original ones are not
+// available to UDP sockets.
+func udpUnreachable(client, dst *net.UDPAddr) ([]byte, error) {
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:], uint16(client.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], 8)
+
+	if src4, dst4 := client.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		hdr := make([]byte, ipv4.HeaderLen)
+		hdr[0] = 4<<4 | ipv4.HeaderLen>>2
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(hdr)+len(udp)))
+		hdr[8] = 64 // TTL
+		hdr[9] = 17 // UDP
+		copy(hdr[12:], src4)
+		copy(hdr[16:], dst4)
+		var sum uint32
+		for i := 0; i < len(hdr); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+		}
+		for sum>>16 != 0 {
+			sum = sum&0xffff + sum>>16
+		}
+		binary.BigEndian.PutUint16(hdr[10:], ^uint16(sum))
+		m := &icmp.Message{
+			Type: ipv4.ICMPTypeDestinationUnreachable,
+			Code: 3, // port unreachable
+			Body: &icmp.DstUnreach{Data: append(hdr, udp...)},
+		}
+		return m.Marshal(nil)
+	}
+
+	hdr := make([]byte, ipv6.HeaderLen)
+	hdr[0] = 6 << 4
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(udp)))
+	hdr[6] = 17 // UDP
+	hdr[7] = 64 // hop limit
+	copy(hdr[8:], client.IP.To16())
+	copy(hdr[24:], dst.IP.To16())
+	m := &icmp.Message{
+		Type: ipv6.ICMPTypeDestinationUnreachable,
+		Code: 4, // port unreachable
+		Body: &icmp.DstUnreach{Data: append(hdr, udp...)},
+	}
+	// The kernel computes the checksum for ICMPv6 sockets.
+	return m.Marshal(nil)
+}
+
+// sendUDPUnreachable sends ICMP port unreachable to client for a
+// datagram sent to dst.  This needs CAP_NET_RAW capability.
+func sendUDPUnreachable(client, dst *net.UDPAddr) error {
+	msg, err := udpUnreachable(client, dst)
+	if err != nil {
+		return err
+	}
+
+	network, laddr := "ip4:icmp", "0.0.0.0"
+	if client.IP.To4() == nil {
+		network, laddr = "ip6:ipv6-icmp", "::"
+	}
+	c, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.WriteTo(msg, &net.IPAddr{IP: client.IP})
+	return err
+}
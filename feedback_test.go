@@ -0,0 +1,56 @@
+package transocks
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestUDPUnreachable(t *testing.T) {
+	t.Parallel()
+
+	client := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 12345}
+	dst := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 53}
+	b, err := udpUnreachable(client, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := icmp.ParseMessage(1, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != ipv4.ICMPTypeDestinationUnreachable || m.Code != 3 {
+		t.Error("unexpected ICMP type or code:", m.Type, m.Code)
+	}
+	data := m.Body.(*icmp.DstUnreach).Data
+	h, err := ipv4.ParseHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Src.Equal(client.IP) || !h.Dst.Equal(dst.IP) || h.Protocol != 17 {
+		t.Error("unexpected quoted header:", h)
+	}
+	if len(data) != ipv4.HeaderLen+8 || data[20] != 0x30 || data[21] != 0x39 || data[23] != 53 {
+		t.Errorf("unexpected quoted UDP header: %x", data[ipv4.HeaderLen:])
+	}
+
+	client = &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 12345}
+	dst = &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	b, err = udpUnreachable(client, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = icmp.ParseMessage(58, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != ipv6.ICMPTypeDestinationUnreachable || m.Code != 4 {
+		t.Error("unexpected ICMPv6 type or code:", m.Type, m.Code)
+	}
+	if len(m.Body.(*icmp.DstUnreach).Data) != ipv6.HeaderLen+8 {
+		t.Error("unexpected quoted data length")
+	}
+}
@@ -0,0 +1,48 @@
+package transocks
+
+import (
+	"net"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// geoIP looks up countries of IP addresses in a MaxMind DB file
+// such as GeoLite2 Country, or autonomous systems in one such as
+// GeoLite2 ASN.
+type geoIP struct {
+	db *maxminddb.Reader
+}
+
+func openGeoIP(name string) (*geoIP, error) {
+	db, err := maxminddb.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &geoIP{db: db}, nil
+}
+
+// country returns ISO 3166-1 alpha-2 country code of ip.
+// If not found, this returns an empty string.
+func (g *geoIP) country(ip net.IP) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := g.db.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// asn returns the autonomous system number of ip.
+// If not found, this returns zero.
+func (g *geoIP) asn(ip net.IP) int {
+	var record struct {
+		ASN uint `maxminddb:"autonomous_system_number"`
+	}
+	if err := g.db.Lookup(ip, &record); err != nil {
+		return 0
+	}
+	return int(record.ASN)
+}
@@ -0,0 +1,154 @@
+package transocks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbString encodes s as a string in MaxMind DB format.
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+// mmdbUint16 encodes v as an uint16 in MaxMind DB format.
+func mmdbUint16(v uint16) []byte {
+	return []byte{5<<5 | 2, byte(v >> 8), byte(v)}
+}
+
+// mmdbMap encodes key-value pairs as a map in MaxMind DB format.
+func mmdbMap(kvs ...[]byte) []byte {
+	b := []byte{7<<5 | byte(len(kvs)/2)}
+	for _, kv := range kvs {
+		b = append(b, kv...)
+	}
+	return b
+}
+
+// newTestGeoIP creates a database of IPv4 addresses where
+// 1.0.0.0/8 is in JP.
+func newTestGeoIP(t *testing.T) *geoIP {
+	return newTestMMDB(t, mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString("JP"))))
+}
+
+// newTestMMDB creates a database of IPv4 addresses where
+// 1.0.0.0/8 has record.
+func newTestMMDB(t *testing.T, record []byte) *geoIP {
+	const nodeCount = 8
+	const prefix = 0x01
+
+	var buf bytes.Buffer
+	put24 := func(v uint32) {
+		buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+	}
+	for i := uint(0); i < nodeCount; i++ {
+		next := uint32(i + 1)
+		if i == nodeCount-1 {
+			// pointer to the first record in the data section.
+			next = nodeCount + 16
+		}
+		if (prefix>>(7-i))&1 == 0 {
+			put24(next)
+			put24(nodeCount)
+		} else {
+			put24(nodeCount)
+			put24(next)
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(record)
+	buf.WriteString("\xAB\xCD\xEFMaxMind.com")
+	buf.Write(mmdbMap(
+		mmdbString("node_count"), mmdbUint16(nodeCount),
+		mmdbString("record_size"), mmdbUint16(24),
+		mmdbString("ip_version"), mmdbUint16(4),
+	))
+
+	db, err := maxminddb.FromBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &geoIP{db: db}
+}
+
+func TestGeoIP(t *testing.T) {
+	t.Parallel()
+
+	g := newTestGeoIP(t)
+	if c := g.country(net.ParseIP("1.2.3.4")); c != "JP" {
+		t.Error("unexpected country for 1.2.3.4:", c)
+	}
+	if c := g.country(net.ParseIP("2.2.3.4")); c != "" {
+		t.Error("unexpected country for 2.2.3.4:", c)
+	}
+
+	r, err := compileRule(&Rule{Countries: []string{"jp"}, Upstream: UpstreamDirect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.needsCountry() {
+		t.Error("rule with countries needs country")
+	}
+	ip := net.ParseIP("1.2.3.4")
+	if !r.match(&connInfo{country: g.country(ip), ip: ip, port: 443}) {
+		t.Error("rule should match JP")
+	}
+	ip = net.ParseIP("2.2.3.4")
+	if r.match(&connInfo{country: g.country(ip), ip: ip, port: 443}) {
+		t.Error("rule should not match unknown country")
+	}
+
+	if _, err := compileRule(&Rule{Countries: []string{"JPN"}, Upstream: UpstreamDirect}); err == nil {
+		t.Error("invalid country code should be rejected")
+	}
+}
+
+func TestASN(t *testing.T) {
+	t.Parallel()
+
+	g := newTestMMDB(t, mmdbMap(mmdbString("autonomous_system_number"), mmdbUint16(15169)))
+	if n := g.asn(net.ParseIP("1.2.3.4")); n != 15169 {
+		t.Error("unexpected ASN for 1.2.3.4:", n)
+	}
+	if n := g.asn(net.ParseIP("2.2.3.4")); n != 0 {
+		t.Error("unexpected ASN for 2.2.3.4:", n)
+	}
+
+	r, err := compileRule(&Rule{ASNs: []string{"AS15169", " 13335"}, Upstream: UpstreamDirect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.needsASN() {
+		t.Error("rule with ASNs needs ASN")
+	}
+	ip := net.ParseIP("1.2.3.4")
+	if !r.match(&connInfo{asn: g.asn(ip), ip: ip, port: 443}) {
+		t.Error("rule should match AS15169")
+	}
+	if !r.match(&connInfo{asn: 13335, ip: ip, port: 443}) {
+		t.Error("rule should match AS13335")
+	}
+	ip = net.ParseIP("2.2.3.4")
+	if r.match(&connInfo{asn: g.asn(ip), ip: ip, port: 443}) {
+		t.Error("rule should not match unknown AS")
+	}
+
+	for _, a := range []string{"", "AS", "ASN15169", "0", "-1", "4294967296"} {
+		if _, err := compileRule(&Rule{ASNs: []string{a}, Upstream: UpstreamDirect}); err == nil {
+			t.Errorf("AS number %q should be rejected", a)
+		}
+	}
+
+	r, err = compileRule(&Rule{Expr: "asn in [15169, 13335]", Upstream: UpstreamDirect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.needsASN() {
+		t.Error("rule with asn in expr needs ASN")
+	}
+	if !r.match(&connInfo{asn: 13335}) || r.match(&connInfo{}) {
+		t.Error("unexpected match of asn in expr")
+	}
+}
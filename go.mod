@@ -5,6 +5,9 @@ require (
 	github.com/cybozu-go/log v1.5.0
 	github.com/cybozu-go/netutil v1.2.0
 	github.com/cybozu-go/well v1.8.1
+	github.com/oschwald/maxminddb-golang v1.3.1
+	golang.org/x/crypto v0.0.0-20180904163835-0709b304e793
 	golang.org/x/net v0.0.0-20180911220305-26e67e76b6c3
 	golang.org/x/sys v0.0.0-20180906133057-8cf3aee42992
+	golang.org/x/text v0.3.0
 )
@@ -0,0 +1,105 @@
+package transocks
+
+import (
+	"runtime"
+	"strings"
+)
+
+const natGuide = `# Redirect locally-generated TCP connections to transocks.
+# Connections made by transocks itself must be excluded, here by the owner.
+iptables -t nat -N TRANSOCKS
+iptables -t nat -A TRANSOCKS -d 127.0.0.0/8 -j RETURN
+iptables -t nat -A TRANSOCKS -m owner --uid-owner TRANSOCKS_USER -j RETURN
+iptables -t nat -A TRANSOCKS -p tcp -j REDIRECT --to-ports PORT
+iptables -t nat -A OUTPUT -p tcp -j TRANSOCKS
+`
+
+// TPROXY target works only in PREROUTING chain of the mangle table,
+// i.e., for packets forwarded by this host.  Packets marked by TPROXY
+// need to be routed to the local host by a policy routing table.
+const tproxyGuide = `# Route TCP packets forwarded by this host to transocks by TPROXY.
+# transocks needs CAP_NET_ADMIN capability.
+iptables -t mangle -N TRANSOCKS
+iptables -t mangle -A TRANSOCKS -d 127.0.0.0/8 -j RETURN
+iptables -t mangle -A TRANSOCKS -p tcp -j TPROXY --on-port PORT --tproxy-mark 0x1/0x1
+iptables -t mangle -A PREROUTING -p tcp -j TRANSOCKS
+
+# With udp = true, route UDP packets as well.
+#iptables -t mangle -A TRANSOCKS -p udp -j TPROXY --on-port PORT --tproxy-mark 0x1/0x1
+#iptables -t mangle -A PREROUTING -p udp -j TRANSOCKS
+
+# Deliver marked packets to the local host.
+ip rule add fwmark 0x1/0x1 lookup 100
+ip route add local 0.0.0.0/0 dev lo table 100
+
+# For IPv6, do the same with ip6tables and "ip -6".
+`
+
+// On FreeBSD, ipfw fwd and pf divert-to keep packet destinations intact,
+// so the original destination is the local address of accepted
+// connections in both modes.
+const ipfwGuide = `# Forward locally-generated TCP connections to transocks by ipfw.
+# Connections made by transocks itself must be excluded, here by the owner.
+ipfw add 1000 allow tcp from any to 127.0.0.0/8
+ipfw add 1010 allow tcp from me to any uid TRANSOCKS_USER
+ipfw add 1020 fwd 127.0.0.1,PORT tcp from me to any out
+`
+
+const pfDivertGuide = `# Divert TCP connections forwarded by this host to transocks by pf.
+# Add the rule to /etc/pf.conf and run "pfctl -f /etc/pf.conf".
+# transocks must run as root.
+pass in quick on INTERNAL_IF inet proto tcp to !127.0.0.0/8 divert-to 127.0.0.1 port PORT
+`
+
+// On OpenBSD, the original destinations of connections redirected by
+// rdr-to are looked up in the pf state table.
+const pfRdrGuide = `# Redirect TCP connections forwarded by this host to transocks by pf.
+# Add the rule to /etc/pf.conf and run "pfctl -f /etc/pf.conf".
+# transocks must run as root to look up destinations in /dev/pf.
+pass in quick on INTERNAL_IF inet proto tcp to !127.0.0.0/8 rdr-to 127.0.0.1 port PORT
+`
+
+// On macOS, locally-generated connections are routed to lo0 and
+// redirected there, as rdr rules apply only to incoming packets.
+const pfMacGuide = `# Redirect locally-generated TCP connections to transocks by pf.
+# Connections made by transocks itself must be excluded, here by the owner.
+# Save the rules to a file and run "sudo pfctl -ef FILE".
+# transocks must run as root to look up destinations in /dev/pf.
+rdr pass on lo0 inet proto tcp from any to !127.0.0.0/8 -> 127.0.0.1 port PORT
+pass out route-to (lo0 127.0.0.1) inet proto tcp from any to !127.0.0.0/8 user != TRANSOCKS_USER
+`
+
+// Connections come from load balancers, so no packet filter is needed.
+const proxyProtocolGuide = `# Configure the load balancer to send PROXY protocol headers
+# to transocks on port PORT.  For HAProxy:
+server transocks 127.0.0.1:PORT send-proxy-v2
+`
+
+// SetupGuide returns example commands to route connections to transocks
+// in the mode of c for the running operating system.
+func (c *Config) SetupGuide() string {
+	return c.setupGuide(runtime.GOOS)
+}
+
+func (c *Config) setupGuide(goos string) string {
+	port := listenPort(c.Addr)
+
+	var guide string
+	switch {
+	case c.Mode == ModeProxyProtocol:
+		guide = proxyProtocolGuide
+	case goos == "freebsd" && c.Mode == ModeTPROXY:
+		guide = pfDivertGuide
+	case goos == "freebsd":
+		guide = ipfwGuide
+	case goos == "openbsd":
+		guide = pfRdrGuide
+	case goos == "darwin":
+		guide = pfMacGuide
+	case c.Mode == ModeTPROXY:
+		guide = tproxyGuide
+	default:
+		guide = natGuide
+	}
+	return strings.Replace(guide, "PORT", port, -1)
+}
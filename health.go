@@ -0,0 +1,60 @@
+package transocks
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// healthCheck probes upstream proxies every interval until ctx is done.
+//
+// A probe connects to addr through a proxy.  If the proxy is unreachable,
+// the proxy is ejected and will be tried only after all others.
+// Errors reported by the proxy itself, such as connection refused by the
+// destination, do not eject the proxy as it is working.
+func (s *Server) healthCheck(ctx context.Context, interval time.Duration, addr string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, g := range s.upstreams {
+			for _, u := range g.upstreams {
+				if atomic.CompareAndSwapInt32(&u.probing, 0, 1) {
+					go s.probe(g, u, addr)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) probe(g *upstreamGroup, u *upstream, addr string) {
+	defer atomic.StoreInt32(&u.probing, 0)
+
+	c, err := u.proxyDialer().Dial("tcp", addr)
+	if err == nil {
+		c.Close()
+	}
+
+	fields := map[string]interface{}{
+		"upstream":  g.name,
+		"proxy_url": u.url,
+	}
+	if err != nil && isUpstreamError(err) {
+		if atomic.CompareAndSwapInt32(&u.ejected, 0, 1) {
+			fields[log.FnError] = err.Error()
+			s.logger.Warn("upstream proxy is ejected", fields)
+		}
+		return
+	}
+	if atomic.CompareAndSwapInt32(&u.ejected, 1, 0) {
+		s.logger.Info("upstream proxy is restored", fields)
+	}
+}
@@ -0,0 +1,72 @@
+package transocks
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+func TestHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	good := newConnectProxy(t)
+	defer good.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := "http://" + l.Addr().String()
+	l.Close()
+
+	c := NewConfig()
+	c.ProxyURL, _ = url.Parse(bad)
+	u, _ := url.Parse(good.URL)
+	c.ProxyURLs = []*url.URL{u}
+	c.Balance = BalanceRoundRobin
+
+	g, err := newUpstreamGroup(UpstreamDefault, append([]*url.URL{c.ProxyURL}, c.ProxyURLs...), c.Balance, c, &net.Dialer{Timeout: 5 * time.Second}, log.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		logger:    log.NewLogger(),
+		upstreams: map[string]*upstreamGroup{UpstreamDefault: g},
+	}
+
+	// the destination is refused, but the good proxy is working.
+	for _, up := range g.upstreams {
+		up.probing = 1
+		s.probe(g, up, l.Addr().String())
+	}
+	stats := s.UpstreamStats()
+	if !stats[0].Ejected {
+		t.Error("unreachable proxy should be ejected")
+	}
+	if stats[1].Ejected {
+		t.Error("working proxy should not be ejected")
+	}
+	if stats[0].Total != 0 || stats[0].Failures != 0 {
+		t.Error("probes should not be counted:", stats[0])
+	}
+
+	for i := 0; i < 3; i++ {
+		if idx := g.order(""); idx[0] != 1 {
+			t.Error("ejected proxy should be tried last:", idx)
+		}
+	}
+
+	atomic.StoreInt32(&g.upstreams[0].ejected, 0)
+	atomic.StoreInt32(&g.upstreams[1].ejected, 1)
+	s.probe(g, g.upstreams[1], l.Addr().String())
+	if g.upstreams[1].ejected != 0 {
+		t.Error("working proxy should be restored")
+	}
+	if g.upstreams[1].probing != 0 {
+		t.Error("probing flag should be cleared")
+	}
+}
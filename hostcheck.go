@@ -0,0 +1,58 @@
+package transocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// This file checks that host names found in client streams resolve to
+// the original destination addresses.  Without the check, clients can
+// send arbitrary server names to choose rules with Domains.
+
+const hostCheckTimeout = 5 * time.Second
+
+type hostChecker struct {
+	resolver *net.Resolver
+	block    bool
+}
+
+// newHostChecker returns nil if mode is empty.  def is used unless
+// resolver is given.
+func newHostChecker(mode HostCheckMode, resolver string, def *net.Resolver) *hostChecker {
+	if len(mode) == 0 {
+		return nil
+	}
+	hc := &hostChecker{
+		resolver: def,
+		block:    mode == HostCheckBlock,
+	}
+	if len(resolver) > 0 {
+		hc.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, resolver)
+			},
+		}
+	}
+	return hc
+}
+
+// check returns non-nil error if host does not resolve to ip.
+func (hc *hostChecker) check(ctx context.Context, host string, ip net.IP) error {
+	ctx, cancel := context.WithTimeout(ctx, hostCheckTimeout)
+	defer cancel()
+
+	addrs, err := hc.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if a.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s does not resolve to %s", host, ip)
+}
@@ -0,0 +1,31 @@
+package transocks
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestHostChecker(t *testing.T) {
+	t.Parallel()
+
+	if newHostChecker("", "", net.DefaultResolver) != nil {
+		t.Error("empty mode should disable host checks")
+	}
+
+	hc := newHostChecker(HostCheckBlock, "", net.DefaultResolver)
+	if !hc.block {
+		t.Error("block mode should block")
+	}
+
+	ctx := context.Background()
+	if err := hc.check(ctx, "localhost", net.ParseIP("127.0.0.1")); err != nil {
+		t.Error(err)
+	}
+	if err := hc.check(ctx, "localhost", net.ParseIP("192.0.2.1")); err == nil {
+		t.Error("localhost should not resolve to 192.0.2.1")
+	}
+	if err := hc.check(ctx, "no-such-host.invalid", net.ParseIP("192.0.2.1")); err == nil {
+		t.Error("unresolvable host should not match")
+	}
+}
@@ -0,0 +1,72 @@
+package transocks
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hostMapping redirects connections to host names matching pattern
+// to dest.  dest is "HOST" or "HOST:PORT".
+type hostMapping struct {
+	pattern string
+	dest    string
+}
+
+// hostMap is a list of mappings ordered by precedence.
+type hostMap []hostMapping
+
+// compileHostMap compiles Config.HostMap.  Exact names take precedence
+// over wildcard patterns, and longer patterns over shorter ones.
+func compileHostMap(m map[string]string) (hostMap, error) {
+	var hm hostMap
+	for pattern, dest := range m {
+		p, err := compileDomain(pattern)
+		if err != nil {
+			return nil, err
+		}
+		host := dest
+		if h, port, err := net.SplitHostPort(dest); err == nil {
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return nil, fmt.Errorf("invalid port in HostMap: %s", dest)
+			}
+			host = h
+		}
+		if len(host) == 0 || strings.ContainsAny(host, " /@[]") {
+			return nil, fmt.Errorf("invalid destination in HostMap: %s", dest)
+		}
+		hm = append(hm, hostMapping{p, dest})
+	}
+
+	wildcard := func(p string) bool {
+		return strings.HasPrefix(p, "*.") || strings.HasPrefix(p, ".")
+	}
+	sort.Slice(hm, func(i, j int) bool {
+		wi, wj := wildcard(hm[i].pattern), wildcard(hm[j].pattern)
+		if wi != wj {
+			return wj
+		}
+		if len(hm[i].pattern) != len(hm[j].pattern) {
+			return len(hm[i].pattern) > len(hm[j].pattern)
+		}
+		return hm[i].pattern < hm[j].pattern
+	})
+	return hm, nil
+}
+
+// lookup returns the address to connect instead of host:port.
+func (hm hostMap) lookup(host string, port int) (string, bool) {
+	host = normalizeHost(host)
+	for _, m := range hm {
+		if !matchDomain(m.pattern, host) {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(m.dest); err == nil {
+			return m.dest, true
+		}
+		return net.JoinHostPort(m.dest, strconv.Itoa(port)), true
+	}
+	return "", false
+}
@@ -0,0 +1,53 @@
+package transocks
+
+import "testing"
+
+func TestHostMap(t *testing.T) {
+	t.Parallel()
+
+	hm, err := compileHostMap(map[string]string{
+		"legacy.example.com":  "new.example.com",
+		"*.old.example.com":   "gateway.example.net:8443",
+		"api.old.example.com": "api.example.net",
+		".v1.old.example.com": "192.0.2.1",
+		"ipv6.example.com":    "[2001:db8::1]:443",
+		"Upper.Example.COM.":  "lower.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		host string
+		dest string
+	}{
+		{"legacy.example.com", "new.example.com:443"},
+		{"LEGACY.example.com.", "new.example.com:443"},
+		{"www.old.example.com", "gateway.example.net:8443"},
+		{"api.old.example.com", "api.example.net:443"},
+		{"v1.old.example.com", "192.0.2.1:443"},
+		{"a.v1.old.example.com", "192.0.2.1:443"},
+		{"ipv6.example.com", "[2001:db8::1]:443"},
+		{"upper.example.com", "lower.example.com:443"},
+		{"old.example.com", ""},
+		{"www.example.com", ""},
+	}
+	for _, tc := range testCases {
+		dest, ok := hm.lookup(tc.host, 443)
+		if ok != (len(tc.dest) > 0) || dest != tc.dest {
+			t.Errorf("unexpected destination for %s: %q", tc.host, dest)
+		}
+	}
+
+	invalid := []map[string]string{
+		{"*.*.example.com": "www.example.com"},
+		{"www.example.com": ""},
+		{"www.example.com": "www.example.net:https"},
+		{"www.example.com": "user@www.example.net"},
+	}
+	for _, m := range invalid {
+		if _, err := compileHostMap(m); err == nil {
+			t.Errorf("%v should be invalid", m)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package transocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// hostProfile converts internationalized host names to ASCII.
+//
+// Underscores are allowed as they are found in real host names, so
+// STD3 rules are not applied.  Other characters are checked by
+// sanitizeHost.
+var hostProfile = idna.New(
+	idna.MapForLookup(),
+	idna.Transitional(true),
+	idna.StrictDomainName(false),
+	idna.VerifyDNSLength(true),
+)
+
+// sanitizeHost validates a host name found in client streams and
+// returns it in the form used for routing and dialing.  Ports and
+// the trailing dot are removed, and internationalized names are
+// converted to punycode.
+//
+// An error is returned for names that contain control characters or
+// spaces, or exceed the length limits of DNS.
+func sanitizeHost(host string) (string, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(host, "[")
+	host = strings.TrimSuffix(host, "]")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+
+	for i := 0; i < len(host); i++ {
+		if host[i] <= ' ' || host[i] == 0x7f {
+			return "", errors.New("control character or space in host name")
+		}
+	}
+
+	a, err := hostProfile.ToASCII(strings.TrimSuffix(host, "."))
+	if err != nil {
+		return "", fmt.Errorf("invalid host name: %v", err)
+	}
+	for i := 0; i < len(a); i++ {
+		c := a[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return "", fmt.Errorf("invalid character in host name: %q", c)
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,50 @@
+package transocks
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeHost(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		host     string
+		expected string
+	}{
+		{"www.example.com", "www.example.com"},
+		{"WWW.Example.COM.", "www.example.com"},
+		{"www.example.com:8080", "www.example.com"},
+		{"_sip.example.com", "_sip.example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+	}
+	for _, tc := range testCases {
+		h, err := sanitizeHost(tc.host)
+		if err != nil {
+			t.Errorf("%q: %v", tc.host, err)
+			continue
+		}
+		if h != tc.expected {
+			t.Errorf("unexpected host for %q: %q", tc.host, h)
+		}
+	}
+
+	invalid := []string{
+		"www.example.com\x00.evil.example",
+		"www.example.com\r\nlevel=error",
+		"www example.com",
+		"www.example.com/path",
+		"user@www.example.com",
+		strings.Repeat("a", 64) + ".example.com",
+		strings.Repeat("abcdefghi.", 26) + "example",
+		"",
+	}
+	for _, host := range invalid {
+		if h, err := sanitizeHost(host); err == nil {
+			t.Errorf("%q should be invalid: %q", host, h)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package transocks
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// This file implements forwarding of plain HTTP requests to upstream
+// HTTP proxies without CONNECT tunnels.
+//
+// Requests from clients have the origin form like "GET /index.html",
+// so they are rewritten to the absolute form that proxies expect,
+// "GET http://example.com/index.html".  Proxies can then cache and
+// filter responses, which they cannot for CONNECT tunnels.
+//
+// Requests can also be given Via and X-Forwarded-For headers that
+// identify clients for Config.ForwardedHeaders.
+
+// networkPlainHTTP is the network name for httpDialer.Dial to connect
+// to the proxy for plain HTTP requests instead of making a tunnel.
+const networkPlainHTTP = "http-proxy"
+
+// flushingBody is a request body that flushes the header written to
+// bw before reading the body.  Clients sending "Expect: 100-continue"
+// wait for the proxy to respond to the header before sending the body.
+type flushingBody struct {
+	io.ReadCloser
+	bw *bufio.Writer
+}
+
+func (b flushingBody) Read(p []byte) (int, error) {
+	if err := b.bw.Flush(); err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// rewriteRequests reads HTTP requests from r, modifies them by rewrite,
+// and writes them to w, in the absolute form if proxy is true.  After
+// a request to upgrade the protocol, such as WebSocket, the rest of r
+// is copied as is.
+func rewriteRequests(w io.Writer, r io.Reader, proxy bool, rewrite func(req *http.Request)) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for {
+		req, err := http.ReadRequest(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// keep net/http from adding its own User-Agent.
+			req.Header["User-Agent"] = nil
+		}
+		rewrite(req)
+		if req.Body != http.NoBody {
+			req.Body = flushingBody{req.Body, bw}
+		}
+		if proxy {
+			err = req.WriteProxy(bw)
+		} else {
+			err = req.Write(bw)
+		}
+		if err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if len(req.Header.Get("Upgrade")) > 0 {
+			_, err := io.Copy(w, br)
+			return err
+		}
+	}
+}
+
+// forwardRequests reads HTTP requests from r and writes them to w in
+// the absolute form with header added.  addr is used for requests
+// without Host header.
+func forwardRequests(w io.Writer, r io.Reader, addr string, header http.Header) error {
+	return rewriteRequests(w, r, true, func(req *http.Request) {
+		req.URL.Scheme = "http"
+		req.URL.Host = req.Host
+		if len(req.URL.Host) == 0 {
+			req.URL.Host = addr
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+	})
+}
+
+// addForwardedHeaders appends transocks to Via and clientIP to
+// X-Forwarded-For headers of req.
+func addForwardedHeaders(req *http.Request, clientIP net.IP) {
+	appendHeader(req.Header, "Via", fmt.Sprintf("%d.%d transocks", req.ProtoMajor, req.ProtoMinor))
+	appendHeader(req.Header, "X-Forwarded-For", clientIP.String())
+}
+
+// appendHeader appends v to the comma-separated list in header key.
+func appendHeader(h http.Header, key, v string) {
+	if prior := h[key]; len(prior) > 0 {
+		v = strings.Join(prior, ", ") + ", " + v
+	}
+	h.Set(key, v)
+}
+
+// requestConn is a connection that rewrites HTTP requests written to it
+// by forward, such as forwardRequests.
+type requestConn struct {
+	net.Conn
+	pw   *io.PipeWriter
+	done chan struct{}
+}
+
+func newRequestConn(c net.Conn, forward func(w io.Writer, r io.Reader) error) *requestConn {
+	pr, pw := io.Pipe()
+	pc := &requestConn{
+		Conn: c,
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(pc.done)
+		err := forward(c, pr)
+		if err == nil {
+			err = errors.New("no more requests")
+		}
+		// make further writes fail.
+		pr.CloseWithError(err)
+	}()
+	return pc
+}
+
+func (c *requestConn) Write(p []byte) (int, error) {
+	return c.pw.Write(p)
+}
+
+// CloseWrite closes the write side of the connection after all
+// requests are forwarded.
+func (c *requestConn) CloseWrite() error {
+	c.pw.Close()
+	<-c.done
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func (c *requestConn) CloseRead() error {
+	if hc, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
+
+func (c *requestConn) Close() error {
+	c.pw.Close()
+	err := c.Conn.Close()
+	<-c.done
+	return err
+}
+
+// dialPlain connects to the proxy to forward plain HTTP requests to addr.
+func (d *httpDialer) dialPlain(addr string) (net.Conn, error) {
+	if d.ntlm != nil {
+		return nil, errors.New("NTLM authentication is not supported for plain HTTP")
+	}
+
+	var c net.Conn
+	if d.pool != nil {
+		c = d.pool.get()
+	}
+	if c == nil {
+		var err error
+		c, err = d.forward.Dial("tcp", d.addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newRequestConn(c, func(w io.Writer, r io.Reader) error {
+		return forwardRequests(w, r, addr, d.header)
+	}), nil
+}
+
+// supportsPlainHTTP returns true if all proxies of g can forward plain
+// HTTP requests.
+func (g *upstreamGroup) supportsPlainHTTP() bool {
+	for _, u := range g.upstreams {
+		hd, ok := u.proxyDialer().(*httpDialer)
+		if !ok || hd.ntlm != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// isHTTPRequest returns true if data begins with an HTTP/1 request.
+func isHTTPRequest(data []byte) bool {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	return err == nil && req.ProtoMajor == 1
+}
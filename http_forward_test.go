@@ -0,0 +1,159 @@
+package transocks
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardRequests(t *testing.T) {
+	t.Parallel()
+
+	in := "GET /index.html HTTP/1.1\r\nHost: www.example.com\r\n\r\n" +
+		"POST /form HTTP/1.1\r\nHost: www.example.com:8080\r\nContent-Length: 4\r\n\r\na=bc"
+	header := http.Header{"Proxy-Authorization": []string{"Basic dXNlcjpwYXNz"}}
+	out := new(bytes.Buffer)
+	if err := forwardRequests(out, strings.NewReader(in), "192.0.2.1:80", header); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(out)
+	for _, u := range []string{"http://www.example.com/index.html", "http://www.example.com:8080/form"} {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.RequestURI != u {
+			t.Error("unexpected request URI:", req.RequestURI)
+		}
+		if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			t.Error("no Proxy-Authorization")
+		}
+	}
+
+	out.Reset()
+	in = "GET /chat HTTP/1.1\r\nHost: www.example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n" +
+		"\x81\x05hello"
+	if err := forwardRequests(out, strings.NewReader(in), "192.0.2.1:80", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "GET http://www.example.com/chat HTTP/1.1\r\n") {
+		t.Error("unexpected request:", out.String())
+	}
+	if !strings.HasSuffix(out.String(), "\r\n\r\n\x81\x05hello") {
+		t.Error("frames after upgrade are not copied:", out.String())
+	}
+}
+
+func TestForwardRequestsExpect(t *testing.T) {
+	t.Parallel()
+
+	pr, pw := io.Pipe()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		forwardRequests(c1, pr, "192.0.2.1:80", nil)
+		c1.Close()
+	}()
+	go io.WriteString(pw, "PUT /upload HTTP/1.1\r\nHost: www.example.com\r\n"+
+		"Expect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+
+	// The header must reach the proxy before the body is sent.
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c2)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("Expect") != "100-continue" {
+		t.Error("Expect is not forwarded")
+	}
+
+	go func() {
+		io.WriteString(pw, "hello")
+		pw.Close()
+	}()
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Error("unexpected body:", string(body))
+	}
+}
+
+func TestHTTPDialerPlain(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	u, err := url.Parse("http://user:pass@" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := httpDialType(u, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *http.Request, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ch <- req
+		c.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+	}()
+
+	conn, err := d.Dial(networkPlainHTTP, "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+
+	req := <-ch
+	if req.RequestURI != "http://www.example.com/" {
+		t.Error("unexpected request URI:", req.RequestURI)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Error("unexpected status:", resp.StatusCode)
+	}
+}
+
+func TestIsHTTPRequest(t *testing.T) {
+	t.Parallel()
+
+	if !isHTTPRequest([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")) {
+		t.Error("HTTP/1.1 request should be recognized")
+	}
+	if isHTTPRequest([]byte(http2Preface)) {
+		t.Error("HTTP/2 preface should not be recognized")
+	}
+	if isHTTPRequest(clientHello(t, "www.example.com")) {
+		t.Error("ClientHello should not be recognized")
+	}
+}
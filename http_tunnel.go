@@ -4,7 +4,15 @@
 // The dialer type will be automatically registered by init().
 //
 // The dialer requests an upstream HTTP proxy to create a TCP tunnel
-// by CONNECT method.
+// by CONNECT method.  If the proxy URL has user information, the dialer
+// sends it by "Proxy-Authorization: Basic" header.
+//
+// If the proxy URL has "auth=ntlm" query parameter, the dialer
+// authenticates with NTLM instead of Basic.  The NT domain can be
+// given by "domain" query parameter or as "DOMAIN\USER" user name.
+//
+// If the proxy URL has "pool=N" query parameter, the dialer keeps N
+// connections to the proxy established in advance.  See conn_pool.go.
 
 package transocks
 
@@ -13,54 +21,189 @@ import (
 	"bytes"
 	"encoding/base64"
 	"errors"
-	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/textproto"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/net/proxy"
 )
 
+const (
+	// maxConnectResponseSize is the maximum size of CONNECT response headers.
+	maxConnectResponseSize = 16 << 10
+)
+
 func init() {
 	proxy.RegisterDialerType("http", httpDialType)
 }
 
+// HTTPProxyError is returned when an upstream HTTP proxy does not
+// accept a CONNECT request.
+type HTTPProxyError struct {
+	// StatusCode is the HTTP status code returned by the proxy.
+	StatusCode int
+
+	// Status is the status line such as "403 Forbidden".
+	Status string
+
+	// Authenticate is the list of Proxy-Authenticate header values.
+	// This is available only when StatusCode is 407.
+	Authenticate []string
+
+	// Authorized is true if the request had Proxy-Authorization.
+	Authorized bool
+}
+
+func (e *HTTPProxyError) Error() string {
+	if e.StatusCode != http.StatusProxyAuthRequired {
+		return "proxy returns " + e.Status
+	}
+
+	msg := "proxy requires authentication"
+	if e.Authorized {
+		msg = "proxy rejected credentials"
+	}
+	if len(e.Authenticate) > 0 {
+		msg += " (" + strings.Join(e.Authenticate, ", ") + ")"
+	}
+	return msg
+}
+
 type httpDialer struct {
 	addr    string
 	header  http.Header
+	ntlm    *ntlmCredential
+	pool    *connPool
 	forward proxy.Dialer
 }
 
 func httpDialType(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
-	var header http.Header
-	if uu := u.User; uu != nil {
-		passwd, _ := uu.Password()
-		up := uu.Username() + ":" + passwd
-		authz := "Basic " + base64.StdEncoding.EncodeToString([]byte(up))
-		header = map[string][]string{
-			"Proxy-Authorization": {authz},
-		}
-	}
-	return &httpDialer{
+	d := &httpDialer{
 		addr:    u.Host,
-		header:  header,
 		forward: forward,
-	}, nil
+	}
+
+	q := u.Query()
+	if s := q.Get("pool"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPoolSize {
+			return nil, errors.New("invalid pool size: " + s)
+		}
+		d.pool = newConnPool(forward, u.Host, n)
+	}
+
+	auth := strings.ToLower(q.Get("auth"))
+	switch auth {
+	case "", "basic", "ntlm":
+	default:
+		return nil, errors.New("unsupported proxy authentication: " + auth)
+	}
+
+	uu := u.User
+	if uu == nil {
+		return d, nil
+	}
+	passwd, _ := uu.Password()
+	if auth == "ntlm" {
+		d.ntlm = newNTLMCredential(q.Get("domain"), uu.Username(), passwd)
+		return d, nil
+	}
+
+	up := uu.Username() + ":" + passwd
+	authz := "Basic " + base64.StdEncoding.EncodeToString([]byte(up))
+	d.header = map[string][]string{
+		"Proxy-Authorization": {authz},
+	}
+	return d, nil
+}
+
+// Close closes pooled connections.
+func (d *httpDialer) Close() error {
+	if d.pool != nil {
+		d.pool.close()
+	}
+	return nil
 }
 
-func (d *httpDialer) Dial(network, addr string) (c net.Conn, err error) {
+func (d *httpDialer) Dial(network, addr string) (net.Conn, error) {
+	if network == networkPlainHTTP {
+		return d.dialPlain(addr)
+	}
+
+	if d.pool != nil {
+		if c := d.pool.get(); c != nil {
+			resp, authorized, err := d.handshake(c, addr)
+			if err == nil {
+				return d.established(c, resp, authorized)
+			}
+			// The proxy may have closed the idle connection.
+			// Retry with a new connection.
+			c.Close()
+		}
+	}
+
+	c, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, authorized, err := d.handshake(c, addr)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return d.established(c, resp, authorized)
+}
+
+// handshake sends CONNECT request(s) to c and returns the final response.
+// The returned bool is true if the credentials were sent to the proxy.
+func (d *httpDialer) handshake(c net.Conn, addr string) (*http.Response, bool, error) {
+	if d.ntlm != nil {
+		return d.connectNTLM(c, addr)
+	}
+	resp, err := d.connect(c, addr, d.header)
+	return resp, d.header.Get("Proxy-Authorization") != "", err
+}
+
+// established returns c if resp indicates the tunnel is established.
+// Otherwise, c is closed and *HTTPProxyError is returned.
+func (d *httpDialer) established(c net.Conn, resp *http.Response, authorized bool) (net.Conn, error) {
+	if resp.StatusCode != 200 {
+		c.Close()
+		perr := &HTTPProxyError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Authorized: authorized,
+		}
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			perr.Authenticate = resp.Header["Proxy-Authenticate"]
+		}
+		return nil, perr
+	}
+
+	return c, nil
+}
+
+// connect sends a CONNECT request to c and reads the response header.
+// The response body, if any, is left unread.
+func (d *httpDialer) connect(c net.Conn, addr string, header http.Header) (*http.Response, error) {
 	req := &http.Request{
 		Method: "CONNECT",
 		URL:    &url.URL{Opaque: addr},
 		Host:   addr,
-		Header: d.header,
+		Header: header,
 	}
-	c, err = d.forward.Dial("tcp", d.addr)
+	err := req.Write(c)
 	if err != nil {
-		return
+		return nil, err
 	}
-	req.Write(c)
 
 	// Read response until "\r\n\r\n".
 	// bufio cannot be used as the connected server may not be
@@ -72,9 +215,11 @@ func (d *httpDialer) Dial(network, addr string) (c net.Conn, err error) {
 	for {
 		_, e := c.Read(b)
 		if e != nil {
-			c.Close()
 			return nil, errors.New("reset proxy connection")
 		}
+		if len(buf) >= maxConnectResponseSize {
+			return nil, errors.New("too large response from proxy")
+		}
 		buf = append(buf, b[0])
 		switch state {
 		case 0:
@@ -108,16 +253,66 @@ func (d *httpDialer) Dial(network, addr string) (c net.Conn, err error) {
 PARSE:
 	var zero time.Time
 	c.SetReadDeadline(zero)
-	resp, e := http.ReadResponse(bufio.NewReader(bytes.NewBuffer(buf)), req)
-	if e != nil {
-		c.Close()
-		return nil, e
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewBuffer(buf)), req)
+	if err != nil {
+		return nil, err
 	}
 	resp.Body.Close()
-	if resp.StatusCode != 200 {
-		c.Close()
-		return nil, fmt.Errorf("proxy returns %s", resp.Status)
+	return resp, nil
+}
+
+// connectNTLM authenticates with NTLM over c.  NTLM authenticates
+// a connection rather than a request, so all messages are exchanged
+// on the same connection.  The returned bool is true if the credentials
+// were sent to the proxy.
+func (d *httpDialer) connectNTLM(c net.Conn, addr string) (*http.Response, bool, error) {
+	negotiate := "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiate())
+	resp, err := d.connect(c, addr, http.Header{"Proxy-Authorization": {negotiate}})
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		return resp, false, err
 	}
 
-	return c, nil
+	var challenge []byte
+	for _, v := range resp.Header["Proxy-Authenticate"] {
+		if len(v) > 5 && strings.EqualFold(v[:5], "NTLM ") {
+			challenge, err = base64.StdEncoding.DecodeString(strings.TrimSpace(v[5:]))
+			if err != nil {
+				return nil, false, errors.New("invalid NTLM challenge from proxy")
+			}
+			break
+		}
+	}
+	if challenge == nil {
+		return resp, false, nil
+	}
+	if resp.Close {
+		return nil, false, errors.New("proxy closed connection during NTLM authentication")
+	}
+
+	// Discard the response body to reuse the connection.
+	// The proxy sends nothing more until it receives the next request,
+	// so reading ahead by bufio is safe here.
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	switch {
+	case len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked":
+		br := bufio.NewReader(c)
+		_, err = io.Copy(ioutil.Discard, httputil.NewChunkedReader(br))
+		if err == nil {
+			// read trailers and the final CRLF
+			_, err = textproto.NewReader(br).ReadMIMEHeader()
+		}
+	case resp.ContentLength > 0:
+		_, err = io.CopyN(ioutil.Discard, c, resp.ContentLength)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	msg, err := d.ntlm.authenticate(challenge)
+	if err != nil {
+		return nil, false, err
+	}
+	authz := "NTLM " + base64.StdEncoding.EncodeToString(msg)
+	resp, err = d.connect(c, addr, http.Header{"Proxy-Authorization": {authz}})
+	return resp, true, err
 }
@@ -1,9 +1,15 @@
 package transocks
 
 import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -28,3 +34,171 @@ func TestHTTPDialer(t *testing.T) {
 	conn.Write([]byte("GET / HTTP/1.1\r\nHost: www.yahoo.com:80\r\nConnection: close\r\n\r\n"))
 	io.Copy(os.Stdout, conn)
 }
+
+// serveCONNECT accepts a connection on l, reads a CONNECT request,
+// and writes resp as the response.  The request is sent to ch.
+func serveCONNECT(t *testing.T, l net.Listener, resp string, ch chan<- *http.Request) {
+	c, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ch <- req
+	io.WriteString(c, resp)
+}
+
+func TestHTTPDialerAuth(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	u, err := url.Parse("http://user:p%40ss@" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := httpDialType(u, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *http.Request, 1)
+	go serveCONNECT(t, l, "HTTP/1.1 200 Connection established\r\n\r\n", ch)
+	conn, err := d.Dial("tcp", "www.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	req := <-ch
+	if req.Method != "CONNECT" {
+		t.Error("unexpected method:", req.Method)
+	}
+	if req.Host != "www.example.com:443" {
+		t.Error("unexpected host:", req.Host)
+	}
+	authz := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:p@ss"))
+	if req.Header.Get("Proxy-Authorization") != authz {
+		t.Error("unexpected Proxy-Authorization:", req.Header.Get("Proxy-Authorization"))
+	}
+
+	go serveCONNECT(t, l, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+		"Proxy-Authenticate: Basic realm=\"proxy\"\r\n"+
+		"Content-Length: 0\r\n\r\n", ch)
+	_, err = d.Dial("tcp", "www.example.com:443")
+	<-ch
+	perr, ok := err.(*HTTPProxyError)
+	if !ok {
+		t.Fatal("unexpected error:", err)
+	}
+	if perr.StatusCode != http.StatusProxyAuthRequired {
+		t.Error("unexpected status:", perr.StatusCode)
+	}
+	if !perr.Authorized {
+		t.Error("Authorized should be true")
+	}
+	if len(perr.Authenticate) != 1 || perr.Authenticate[0] != `Basic realm="proxy"` {
+		t.Error("unexpected Authenticate:", perr.Authenticate)
+	}
+	if perr.Error() != `proxy rejected credentials (Basic realm="proxy")` {
+		t.Error("unexpected message:", perr.Error())
+	}
+}
+
+func TestHTTPDialerNTLM(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	u, err := url.Parse("http://Domain%5CUser:Password@" + l.Addr().String() + "?auth=ntlm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := httpDialType(u, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge, _ := hex.DecodeString("4e544c4d53535000020000000c000c003800000033828ae2" +
+		"0123456789abcdef00000000000000002400240044000000060070170000000f" +
+		"530065007200760065007200020000000c0044006f006d00610069006e000100" +
+		"0c0053006500720076006500720000000000")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		msg := decodeNTLMHeader(t, req.Header.Get("Proxy-Authorization"))
+		if len(msg) < 9 || msg[8] != 1 {
+			t.Error("expected negotiate message:", msg)
+		}
+		io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Proxy-Authenticate: NTLM "+base64.StdEncoding.EncodeToString(challenge)+"\r\n"+
+			"Transfer-Encoding: chunked\r\n\r\n"+
+			"5\r\nerror\r\n0\r\n\r\n")
+
+		req, err = http.ReadRequest(br)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		msg = decodeNTLMHeader(t, req.Header.Get("Proxy-Authorization"))
+		if len(msg) < 9 || msg[8] != 3 {
+			t.Error("expected authenticate message:", msg)
+		}
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+	}()
+
+	conn, err := d.Dial("tcp", "www.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Error("unexpected data:", string(buf))
+	}
+	<-done
+}
+
+func decodeNTLMHeader(t *testing.T, v string) []byte {
+	if !strings.HasPrefix(v, "NTLM ") {
+		t.Error("unexpected Proxy-Authorization:", v)
+		return nil
+	}
+	msg, err := base64.StdEncoding.DecodeString(v[5:])
+	if err != nil {
+		t.Error(err)
+	}
+	return msg
+}
@@ -0,0 +1,166 @@
+package transocks
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// This file manages iptables rules to route connections to transocks.
+//
+// Rules are added to a dedicated chain jumped from a built-in chain.
+// The chain is flushed before rules are added, and the jump is added
+// only if it does not exist, so installing rules repeatedly does not
+// make duplicates.
+
+const iptablesChain = "TRANSOCKS"
+
+// destinations never routed to transocks, for iptables and ip6tables.
+var (
+	iptablesExcludes  = []string{"0.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "224.0.0.0/4", "255.255.255.255/32"}
+	ip6tablesExcludes = []string{"::1/128", "fe80::/10", "ff00::/8"}
+)
+
+// iptablesTable returns the table and the built-in chain to be used.
+func (c *Config) iptablesTable() (string, string) {
+	if c.Mode == ModeTPROXY {
+		return "mangle", "PREROUTING"
+	}
+	return "nat", "OUTPUT"
+}
+
+// iptablesProtocols returns protocols to be routed to transocks.
+func (c *Config) iptablesProtocols() []string {
+	if c.Mode == ModeTPROXY && c.UDP {
+		return []string{"tcp", "udp"}
+	}
+	return []string{"tcp"}
+}
+
+// iptablesInterceptMatches returns iptables matches for connections
+// made by InterceptUIDs and InterceptCgroups.
+func (c *Config) iptablesInterceptMatches() [][]string {
+	var matches [][]string
+	for _, uid := range c.InterceptUIDs {
+		matches = append(matches, []string{"-m", "owner", "--uid-owner", strconv.Itoa(uid)})
+	}
+	for _, cg := range c.InterceptCgroups {
+		matches = append(matches, []string{"-m", "cgroup", "--path", strings.Trim(cg, "/")})
+	}
+	return matches
+}
+
+// iptablesRules returns rules in the dedicated chain.
+func (c *Config) iptablesRules(excludes []string) [][]string {
+	port := listenPort(c.Addr)
+
+	var rules [][]string
+	for _, d := range excludes {
+		rules = append(rules, []string{"-d", d, "-j", "RETURN"})
+	}
+
+	if c.Mode != ModeTPROXY {
+		rules = append(rules,
+			[]string{"-m", "owner", "--uid-owner", strconv.Itoa(os.Getuid()), "-j", "RETURN"})
+		matches := c.iptablesInterceptMatches()
+		if len(matches) == 0 {
+			matches = [][]string{nil}
+		}
+		for _, m := range matches {
+			rules = append(rules, append(m, "-p", "tcp", "-j", "REDIRECT", "--to-ports", port))
+		}
+		return rules
+	}
+
+	for _, p := range c.iptablesProtocols() {
+		rules = append(rules, []string{"-p", p, "-j", "TPROXY",
+			"--on-port", port, "--tproxy-mark", tproxyMark + "/" + tproxyMark})
+	}
+	return rules
+}
+
+func (c *Config) installIPTables(cmd string, excludes []string) error {
+	table, builtin := c.iptablesTable()
+	run := func(args ...string) error {
+		return runCommand("", cmd, append([]string{"-w", "-t", table}, args...)...)
+	}
+
+	// The chain may exist already.
+	run("-N", iptablesChain)
+	if err := run("-F", iptablesChain); err != nil {
+		return err
+	}
+	for _, r := range c.iptablesRules(excludes) {
+		if err := run(append([]string{"-A", iptablesChain}, r...)...); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range c.iptablesProtocols() {
+		jump := []string{builtin, "-p", p, "-j", iptablesChain}
+		if run(append([]string{"-C"}, jump...)...) == nil {
+			continue
+		}
+		if err := run(append([]string{"-A"}, jump...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) removeIPTables(cmd string) error {
+	table, builtin := c.iptablesTable()
+	run := func(args ...string) error {
+		return runCommand("", cmd, append([]string{"-w", "-t", table}, args...)...)
+	}
+
+	// Delete all jumps to the chain including duplicates added by hand.
+	for _, p := range []string{"tcp", "udp"} {
+		jump := []string{builtin, "-p", p, "-j", iptablesChain}
+		for {
+			if run(append([]string{"-D"}, jump...)...) != nil {
+				break
+			}
+		}
+	}
+
+	// The chain may not exist.
+	if run("-F", iptablesChain) != nil {
+		return nil
+	}
+	return run("-X", iptablesChain)
+}
+
+// InstallIPTables adds iptables and ip6tables rules to route connections
+// to transocks in the mode of c.  In ModeTPROXY, policy routing for
+// marked packets is also added.  Rules installed previously are replaced.
+//
+// This requires "iptables", "ip6tables", and "ip" commands and
+// CAP_NET_ADMIN capability.
+func (c *Config) InstallIPTables() error {
+	if err := c.installIPTables("iptables", iptablesExcludes); err != nil {
+		return err
+	}
+	if err := c.installIPTables("ip6tables", ip6tablesExcludes); err != nil {
+		return err
+	}
+	if c.Mode != ModeTPROXY {
+		return nil
+	}
+	return addTPROXYRoutes()
+}
+
+// RemoveIPTables removes the rules and policy routing installed by
+// InstallIPTables.  It does nothing for rules not installed.
+func (c *Config) RemoveIPTables() error {
+	if err := c.removeIPTables("iptables"); err != nil {
+		return err
+	}
+	if err := c.removeIPTables("ip6tables"); err != nil {
+		return err
+	}
+	if c.Mode == ModeTPROXY {
+		removeTPROXYRoutes()
+	}
+	return nil
+}
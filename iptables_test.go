@@ -0,0 +1,52 @@
+package transocks
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestIPTablesRules(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.Addr = "127.0.0.1:12345"
+	rules := c.iptablesRules([]string{"127.0.0.0/8"})
+	expect := [][]string{
+		{"-d", "127.0.0.0/8", "-j", "RETURN"},
+		{"-m", "owner", "--uid-owner", strconv.Itoa(os.Getuid()), "-j", "RETURN"},
+		{"-p", "tcp", "-j", "REDIRECT", "--to-ports", "12345"},
+	}
+	if !reflect.DeepEqual(rules, expect) {
+		t.Errorf("unexpected NAT rules: %v", rules)
+	}
+
+	c.InterceptUIDs = []int{1000}
+	c.InterceptCgroups = []string{"system.slice/foo.service"}
+	rules = c.iptablesRules(nil)
+	expect = [][]string{
+		{"-m", "owner", "--uid-owner", strconv.Itoa(os.Getuid()), "-j", "RETURN"},
+		{"-m", "owner", "--uid-owner", "1000", "-p", "tcp", "-j", "REDIRECT", "--to-ports", "12345"},
+		{"-m", "cgroup", "--path", "system.slice/foo.service", "-p", "tcp", "-j", "REDIRECT", "--to-ports", "12345"},
+	}
+	if !reflect.DeepEqual(rules, expect) {
+		t.Errorf("unexpected scoped rules: %v", rules)
+	}
+	c.InterceptUIDs = nil
+	c.InterceptCgroups = nil
+
+	c.Mode = ModeTPROXY
+	c.UDP = true
+	if table, chain := c.iptablesTable(); table != "mangle" || chain != "PREROUTING" {
+		t.Errorf("unexpected table for TPROXY: %s %s", table, chain)
+	}
+	rules = c.iptablesRules(nil)
+	expect = [][]string{
+		{"-p", "tcp", "-j", "TPROXY", "--on-port", "12345", "--tproxy-mark", "0x1/0x1"},
+		{"-p", "udp", "-j", "TPROXY", "--on-port", "12345", "--tproxy-mark", "0x1/0x1"},
+	}
+	if !reflect.DeepEqual(rules, expect) {
+		t.Errorf("unexpected TPROXY rules: %v", rules)
+	}
+}
@@ -0,0 +1,90 @@
+package transocks
+
+import "sync"
+
+// This file implements limits of concurrent connections.
+
+// Values of the limit field in logs of rejected connections.
+const (
+	limitConnections       = "max_connections"
+	limitClientConnections = "max_client_connections"
+	limitConnectionRate    = "connection_rate"
+	limitRuleConnections   = "rule_max_connections"
+	limitQuota             = "quota"
+)
+
+// ConnectionStats is a snapshot of counters of TCP connections.
+type ConnectionStats struct {
+	// Active is the number of connections being handled.
+	Active int64
+
+	// Total is the number of connections accepted so far.
+	Total int64
+
+	// Rejected is the number of connections closed by
+	// Config.ConnectionRate, Config.MaxConnections,
+	// Config.MaxClientConnections, Config.Quotas, or Rule.MaxConnections.
+	Rejected int64
+
+	// Killed is the number of connections reset by Config.KillSwitch
+	// because upstream proxies were down.
+	Killed int64
+}
+
+type connCounters struct {
+	active   int64
+	total    int64
+	rejected int64
+	killed   int64
+}
+
+// connCounter counts active connections for each key to keep them
+// under max.  A nil connCounter allows any number of connections.
+type connCounter struct {
+	max int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newConnCounter(max int) *connCounter {
+	if max == 0 {
+		return nil
+	}
+	return &connCounter{
+		max:    max,
+		counts: make(map[string]int),
+	}
+}
+
+// acquire increments the count for key and returns true,
+// or returns false if the count has reached the maximum.
+func (c *connCounter) acquire(key string) bool {
+	if c == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[key] >= c.max {
+		return false
+	}
+	c.counts[key]++
+	return true
+}
+
+// release decrements the count for key.
+func (c *connCounter) release(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counts[key]--
+	if c.counts[key] <= 0 {
+		delete(c.counts, key)
+	}
+}
@@ -0,0 +1,31 @@
+package transocks
+
+import "testing"
+
+func TestConnCounter(t *testing.T) {
+	t.Parallel()
+
+	var c *connCounter
+	if !c.acquire("a") {
+		t.Error("nil counter should allow all")
+	}
+	c.release("a")
+
+	c = newConnCounter(2)
+	if !c.acquire("a") || !c.acquire("a") || !c.acquire("b") {
+		t.Fatal("connections under the limit should be allowed")
+	}
+	if c.acquire("a") {
+		t.Error("connection over the limit should be rejected")
+	}
+	c.release("a")
+	if !c.acquire("a") {
+		t.Error("released connection should be allowed")
+	}
+	c.release("a")
+	c.release("a")
+	c.release("b")
+	if len(c.counts) != 0 {
+		t.Error("counts should be removed:", c.counts)
+	}
+}
@@ -0,0 +1,125 @@
+package transocks
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// This file detects connections to transocks itself or its upstream
+// proxies.  Such connections are made when iptables redirects
+// connections from transocks back to it, and relaying them would loop.
+
+const (
+	loopListener = "listener"
+	loopProxy    = "upstream proxy"
+)
+
+// loopDetector knows addresses of listeners and upstream proxies.
+type loopDetector struct {
+	// listeners are TCP addresses of listeners.  IP is nil for
+	// listeners on all addresses or on host names.
+	listeners []*net.TCPAddr
+
+	// proxies are addresses of proxies normalized by loopKey.
+	proxies map[string]bool
+}
+
+// loopKey returns addr in lower case with IP addresses in the canonical
+// form, or an empty string if addr is not "host:port".
+func loopKey(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || len(host) == 0 {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(strings.ToLower(host), port)
+}
+
+func newLoopDetector(c *Config) *loopDetector {
+	d := &loopDetector{proxies: make(map[string]bool)}
+
+	addrs := []string{c.Addr}
+	for _, l := range c.Listeners {
+		if l.mode() != ModeUnix {
+			addrs = append(addrs, l.Addr)
+		}
+	}
+	for _, a := range addrs {
+		host, p, err := net.SplitHostPort(a)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil || port == 0 {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip != nil && ip.IsUnspecified() {
+			ip = nil
+		}
+		d.listeners = append(d.listeners, &net.TCPAddr{IP: ip, Port: port})
+	}
+
+	urls := append([]*url.URL{c.ProxyURL}, c.ProxyURLs...)
+	urls = append(urls, c.ProxyChain...)
+	for _, up := range c.Upstreams {
+		urls = append(urls, up.ProxyURLs...)
+	}
+	for _, u := range urls {
+		if u == nil {
+			continue
+		}
+		if key := loopKey(u.Host); len(key) > 0 {
+			d.proxies[key] = true
+		}
+	}
+	return d
+}
+
+// isLocalIP returns true if ip is an address of this host.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// detect returns loopListener or loopProxy if addr, "host:port" of
+// a destination, is that of a listener or an upstream proxy.
+// Otherwise, this returns an empty string.
+func (d *loopDetector) detect(addr string) string {
+	if d.proxies[loopKey(addr)] {
+		return loopProxy
+	}
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(p)
+	if ip == nil || err != nil {
+		return ""
+	}
+	for _, l := range d.listeners {
+		if l.Port != port {
+			continue
+		}
+		if (l.IP == nil && isLocalIP(ip)) || l.IP.Equal(ip) {
+			return loopListener
+		}
+	}
+	return ""
+}
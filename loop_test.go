@@ -0,0 +1,43 @@
+package transocks
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestLoopDetector(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.Addr = ":1081"
+	c.ProxyURL, _ = url.Parse("socks5://192.0.2.1:1080")
+	office, _ := url.Parse("http://Proxy.Example.COM:3128")
+	c.Upstreams = map[string]*Upstream{"office": {ProxyURLs: []*url.URL{office}}}
+	c.Listeners = []*ListenerConfig{
+		{Addr: "192.0.2.2:1082"},
+		{Addr: "/run/transocks.sock", Mode: ModeUnix},
+	}
+	d := newLoopDetector(c)
+
+	testCases := []struct {
+		addr   string
+		expect string
+	}{
+		{"127.0.0.1:1081", loopListener},
+		{"[::1]:1081", loopListener},
+		{"192.0.2.2:1082", loopListener},
+		{"192.0.2.3:1082", ""},
+		{"127.0.0.1:1082", ""},
+		{"192.0.2.1:1080", loopProxy},
+		{"proxy.example.com:3128", loopProxy},
+		{"proxy.example.com:443", ""},
+		{"www.example.com:1081", ""},
+		{"198.51.100.1:1081", ""},
+		{"invalid", ""},
+	}
+	for _, tc := range testCases {
+		if loop := d.detect(tc.addr); loop != tc.expect {
+			t.Errorf("detect(%q) = %q, expected %q", tc.addr, loop, tc.expect)
+		}
+	}
+}
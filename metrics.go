@@ -0,0 +1,292 @@
+package transocks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// This file exposes counters of Server in Prometheus text format.
+
+const metricsShutdownTimeout = 5 * time.Second
+
+// Classes of errors in connecting to destinations.
+const (
+	dialErrorDirect      = "direct"
+	dialErrorUnreachable = "unreachable"
+	dialErrorCircuitOpen = "circuit_open"
+	dialErrorProxy       = "proxy"
+)
+
+// Outcomes of reading client streams to find host names.
+const (
+	peekFoundHost = "host"
+	peekNoHost    = "no_host"
+)
+
+// metrics counts events not counted by connCounters.
+type metrics struct {
+	// int64 fields are accessed atomically.
+	denied   int64
+	sent     int64
+	received int64
+
+	mu         sync.Mutex
+	dialErrors map[string]int64
+	peeks      map[string]int64
+	rules      map[string]int64 // connections by tags of rules
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		dialErrors: make(map[string]int64),
+		peeks:      make(map[string]int64),
+		rules:      make(map[string]int64),
+	}
+}
+
+func (m *metrics) count(counts map[string]int64, key string) {
+	m.mu.Lock()
+	counts[key]++
+	m.mu.Unlock()
+}
+
+// dialErrorClass returns the class of err in connecting to a destination
+// through upstream.
+func dialErrorClass(upstream string, err error) string {
+	if upstream == UpstreamDirect {
+		return dialErrorDirect
+	}
+	for {
+		switch e := err.(type) {
+		case *upstreamError:
+			if e.err == errCircuitOpen {
+				return dialErrorCircuitOpen
+			}
+			return dialErrorUnreachable
+		case *net.OpError:
+			err = e.Err
+		default:
+			return dialErrorProxy
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricSample is a sample of a metric.  labels are pairs of names
+// and values.
+type metricSample struct {
+	labels []string
+	value  int64
+}
+
+func writeMetric(w io.Writer, name, typ, help string, samples ...metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, s := range samples {
+		io.WriteString(w, name)
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			sep := ","
+			if i == 0 {
+				sep = "{"
+			}
+			fmt.Fprintf(w, `%s%s="%s"`, sep, s.labels[i], labelEscaper.Replace(s.labels[i+1]))
+		}
+		if len(s.labels) > 0 {
+			io.WriteString(w, "}")
+		}
+		fmt.Fprintf(w, " %d\n", s.value)
+	}
+}
+
+// labeled returns samples of counts labeled by name in the order of keys.
+func labeled(name string, counts map[string]int64, keys ...string) []metricSample {
+	samples := make([]metricSample, len(keys))
+	for i, k := range keys {
+		samples[i] = metricSample{[]string{name, k}, counts[k]}
+	}
+	return samples
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writeMetrics writes counters of s in Prometheus text format.
+func (s *Server) writeMetrics(w io.Writer) {
+	cs := s.ConnectionStats()
+	writeMetric(w, "transocks_connections_active", "gauge",
+		"Number of TCP connections being handled.",
+		metricSample{value: cs.Active})
+	writeMetric(w, "transocks_connections_accepted_total", "counter",
+		"Number of TCP connections accepted.",
+		metricSample{value: cs.Total})
+	writeMetric(w, "transocks_connections_rejected_total", "counter",
+		"Number of TCP connections closed by limits of connections.",
+		metricSample{value: cs.Rejected})
+	writeMetric(w, "transocks_connections_denied_total", "counter",
+		"Number of TCP connections denied by access control or rules.",
+		metricSample{value: atomic.LoadInt64(&s.metrics.denied)})
+	writeMetric(w, "transocks_connections_killed_total", "counter",
+		"Number of TCP connections reset by the kill switch.",
+		metricSample{value: cs.Killed})
+
+	s.metrics.mu.Lock()
+	dialErrors := labeled("class", s.metrics.dialErrors,
+		dialErrorDirect, dialErrorUnreachable, dialErrorCircuitOpen, dialErrorProxy)
+	peeks := labeled("outcome", s.metrics.peeks, peekFoundHost, peekNoHost)
+	tags := make([]string, 0, len(s.metrics.rules))
+	for tag := range s.metrics.rules {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	rules := labeled("rule", s.metrics.rules, tags...)
+	s.metrics.mu.Unlock()
+	writeMetric(w, "transocks_dial_errors_total", "counter",
+		"Number of failures to connect to destinations by class.",
+		dialErrors...)
+	writeMetric(w, "transocks_peeks_total", "counter",
+		"Number of client streams read to find host names by outcome.",
+		peeks...)
+	writeMetric(w, "transocks_rule_connections_total", "counter",
+		"Number of TCP connections matching rules by tag.",
+		rules...)
+
+	writeMetric(w, "transocks_sent_bytes_total", "counter",
+		"Bytes relayed from clients to destinations.",
+		metricSample{value: atomic.LoadInt64(&s.metrics.sent)})
+	writeMetric(w, "transocks_received_bytes_total", "counter",
+		"Bytes relayed from destinations to clients.",
+		metricSample{value: atomic.LoadInt64(&s.metrics.received)})
+
+	ups := s.UpstreamStats()
+	var up, active, total, failures []metricSample
+	for _, st := range ups {
+		labels := []string{"upstream", st.Upstream, "proxy_url", st.URL}
+		up = append(up, metricSample{labels, boolValue(!st.Ejected && !st.CircuitOpen)})
+		active = append(active, metricSample{labels, st.Active})
+		total = append(total, metricSample{labels, st.Total})
+		failures = append(failures, metricSample{labels, st.Failures})
+	}
+	writeMetric(w, "transocks_upstream_up", "gauge",
+		"1 if the proxy passed the last health check and its circuit is closed.",
+		up...)
+	writeMetric(w, "transocks_upstream_connections_active", "gauge",
+		"Number of connections to the proxy in use.",
+		active...)
+	writeMetric(w, "transocks_upstream_connections_total", "counter",
+		"Number of connections established through the proxy.",
+		total...)
+	writeMetric(w, "transocks_upstream_failures_total", "counter",
+		"Number of failed attempts to connect through the proxy.",
+		failures...)
+
+	us := s.UDPStats()
+	writeMetric(w, "transocks_udp_sessions_active", "gauge",
+		"Number of UDP sessions in the session table.",
+		metricSample{value: int64(us.Active)})
+	writeMetric(w, "transocks_udp_sessions_total", "counter",
+		"Number of UDP sessions created.",
+		metricSample{value: us.Total})
+	writeMetric(w, "transocks_udp_datagrams_dropped_total", "counter",
+		"Number of UDP datagrams dropped.",
+		metricSample{value: us.Dropped})
+
+	var daily, monthly, exhausted []metricSample
+	for _, u := range s.QuotaUsage() {
+		labels := []string{"client", u.Client}
+		daily = append(daily, metricSample{labels, u.Daily})
+		monthly = append(monthly, metricSample{labels, u.Monthly})
+		exhausted = append(exhausted, metricSample{labels, boolValue(u.Exhausted)})
+	}
+	writeMetric(w, "transocks_quota_daily_bytes", "gauge",
+		"Bytes transferred by the client today.",
+		daily...)
+	writeMetric(w, "transocks_quota_monthly_bytes", "gauge",
+		"Bytes transferred by the client this month.",
+		monthly...)
+	writeMetric(w, "transocks_quota_exhausted", "gauge",
+		"1 if the client has exhausted its quota.",
+		exhausted...)
+
+	stats := s.BlocklistStats()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].URL < stats[j].URL
+	})
+	var feeds, updated []metricSample
+	for _, st := range stats {
+		labels := []string{"url", st.URL}
+		feeds = append(feeds, metricSample{labels, int64(st.Entries)})
+		var ts int64
+		if !st.Updated.IsZero() {
+			ts = st.Updated.Unix()
+		}
+		updated = append(updated, metricSample{labels, ts})
+	}
+	writeMetric(w, "transocks_blocklist_entries", "gauge",
+		"Number of domains and networks in the blocklist feed.",
+		feeds...)
+	writeMetric(w, "transocks_blocklist_last_success_timestamp_seconds", "gauge",
+		"Unix time when the blocklist feed was fetched successfully, or 0.",
+		updated...)
+}
+
+// MetricsHandler returns an http.Handler that serves counters of
+// the server in Prometheus text format.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.writeMetrics(w)
+	})
+}
+
+// ListenMetrics creates a listener on Config.MetricsAddr.  SO_REUSEPORT
+// is set if supported, so that a new process can listen on the address
+// while the old one stops in graceful restart.
+func ListenMetrics(c *Config) (net.Listener, error) {
+	ln, err := listenTCP(c.MetricsAddr, setReusePort)
+	if err == nil {
+		return ln, nil
+	}
+	return net.Listen("tcp", c.MetricsAddr)
+}
+
+// ServeMetrics serves metrics at /metrics on ln, which should be
+// created by ListenMetrics.
+//
+// ServeMetrics returns immediately and serves requests in background
+// until the environment of the server is canceled.
+func (s *Server) ServeMetrics(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	hs := &http.Server{
+		Handler:     mux,
+		ReadTimeout: 30 * time.Second,
+	}
+	s.goBackground(func(ctx context.Context) {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		hs.Shutdown(sctx)
+	})
+	s.goBackground(func(ctx context.Context) {
+		if err := hs.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("metrics server stopped", map[string]interface{}{
+				"addr":      ln.Addr().String(),
+				log.FnError: err.Error(),
+			})
+		}
+	})
+}
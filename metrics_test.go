@@ -0,0 +1,83 @@
+package transocks
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+func TestDialErrorClass(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		upstream string
+		err      error
+		expect   string
+	}{
+		{UpstreamDirect, errors.New("refused"), dialErrorDirect},
+		{UpstreamDefault, &upstreamError{errors.New("refused")}, dialErrorUnreachable},
+		{UpstreamDefault, &net.OpError{Op: "dial", Err: &upstreamError{errCircuitOpen}}, dialErrorCircuitOpen},
+		{UpstreamDefault, errors.New("proxy: failed to read greeting"), dialErrorProxy},
+	}
+	for _, tc := range testCases {
+		if class := dialErrorClass(tc.upstream, tc.err); class != tc.expect {
+			t.Errorf("class of %v should be %s, but %s", tc.err, tc.expect, class)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1080")
+	office, _ := url.Parse(`http://proxy"1:3128`)
+	c.Upstreams = map[string]*Upstream{"office": {ProxyURLs: []*url.URL{office}}}
+	c.Quotas = []*Quota{{Daily: 200}}
+	c.BlocklistURLs = []string{"http://127.0.0.1:1/blocklist.txt"}
+	c.BlocklistInterval = time.Hour
+	c.Logger = log.NewLogger()
+	c.Logger.SetOutput(ioutil.Discard)
+	s, err := NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.metrics.count(s.metrics.dialErrors, dialErrorUnreachable)
+	s.metrics.count(s.metrics.peeks, peekFoundHost)
+	s.metrics.count(s.metrics.rules, "office-web")
+	s.metrics.sent = 100
+	s.quotas.add(net.ParseIP("10.0.0.1"), s.quotas.list[0], 300, time.Now())
+
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatal("unexpected status:", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE transocks_connections_active gauge\ntransocks_connections_active 0\n",
+		"# TYPE transocks_connections_accepted_total counter\n",
+		`transocks_dial_errors_total{class="unreachable"} 1` + "\n",
+		`transocks_dial_errors_total{class="direct"} 0` + "\n",
+		`transocks_peeks_total{outcome="host"} 1` + "\n",
+		"transocks_sent_bytes_total 100\n",
+		`transocks_rule_connections_total{rule="office-web"} 1` + "\n",
+		`transocks_blocklist_last_success_timestamp_seconds{url="http://127.0.0.1:1/blocklist.txt"} 0` + "\n",
+		`transocks_quota_monthly_bytes{client="10.0.0.1"} 300` + "\n",
+		`transocks_quota_exhausted{client="10.0.0.1"} 1` + "\n",
+		`transocks_upstream_up{upstream="default",proxy_url="socks5://127.0.0.1:1080"} 1` + "\n",
+		`transocks_upstream_up{upstream="office",proxy_url="http://proxy\"1:3128"} 1` + "\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("%q is not found in:\n%s", line, body)
+		}
+	}
+}
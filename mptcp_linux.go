@@ -0,0 +1,292 @@
+// +build linux
+
+package transocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"golang.org/x/sys/unix"
+)
+
+// This file implements Multipath TCP sockets.
+//
+// MPTCP sockets are created with IPPROTO_MPTCP, which cannot be chosen
+// by net.ListenConfig nor net.Dialer of the Go releases transocks
+// supports; SetMultipathTCP needs Go 1.21.  Sockets are created manually
+// and converted by net.FileListener and net.FileConn.  Peers without
+// MPTCP are served by plain TCP transparently.
+//
+// If the kernel does not support MPTCP (before Linux 5.6 or disabled
+// by net.mptcp.enabled sysctl), plain TCP sockets are used instead.
+
+const (
+	ipprotoMPTCP = 262
+
+	defaultMPTCPDialTimeout = 30 * time.Second
+)
+
+// mptcpUnsupported returns true if err means that MPTCP is not available.
+func mptcpUnsupported(err error) bool {
+	switch err {
+	case unix.EPROTONOSUPPORT, unix.EINVAL, unix.ENOPROTOOPT:
+		return true
+	}
+	return false
+}
+
+// tcpSockaddr converts addr to a socket address of family.
+func tcpSockaddr(addr *net.TCPAddr, family int) unix.Sockaddr {
+	if family == unix.AF_INET {
+		sa := &unix.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], addr.IP.To4())
+		return sa
+	}
+	sa := &unix.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To16())
+	return sa
+}
+
+// mptcpSocket creates an MPTCP socket for addr.  It returns the socket,
+// the address family, and the network name for socketOption.
+func mptcpSocket(addr *net.TCPAddr) (int, int, string, error) {
+	if addr.IP.To4() != nil {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, ipprotoMPTCP)
+		return fd, unix.AF_INET, "tcp4", err
+	}
+
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, ipprotoMPTCP)
+	if err != nil || addr.IP != nil {
+		return fd, unix.AF_INET6, "tcp6", err
+	}
+
+	// nil IP listens on both IPv4 and IPv6.
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0); err != nil {
+		unix.Close(fd)
+		return -1, 0, "", err
+	}
+	return fd, unix.AF_INET6, "tcp", nil
+}
+
+// resolveTCPAddrs resolves addr for network by r, or the default
+// resolver if r is nil.  Addresses of families other than network are
+// excluded.
+func resolveTCPAddrs(ctx context.Context, r *net.Resolver, network, addr string) ([]*net.TCPAddr, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	host, service, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := r.LookupPort(ctx, network, service)
+	if err != nil {
+		return nil, err
+	}
+	if len(host) == 0 {
+		return []*net.TCPAddr{{Port: port}}, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []*net.TCPAddr{{IP: ip, Port: port}}, nil
+	}
+
+	ips, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*net.TCPAddr
+	for _, ip := range ips {
+		is4 := ip.IP.To4() != nil
+		if (network == "tcp4" && !is4) || (network == "tcp6" && is4) {
+			continue
+		}
+		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: port, Zone: ip.Zone})
+	}
+	if len(addrs) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return addrs, nil
+}
+
+// listenMPTCP creates an MPTCP listener with socket options.
+func listenMPTCP(addr string, opts ...socketOption) (net.Listener, error) {
+	addrs, err := resolveTCPAddrs(context.Background(), nil, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ta := addrs[0]
+	fd, family, network, err := mptcpSocket(ta)
+	if mptcpUnsupported(err) {
+		return listenTCP(addr, opts...)
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "mptcp")
+	defer f.Close()
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	for _, opt := range opts {
+		if err := opt(fd, network); err != nil {
+			return nil, err
+		}
+	}
+	if err := unix.Bind(fd, tcpSockaddr(ta, family)); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return net.FileListener(f)
+}
+
+// mptcpDialer makes MPTCP connections.  Timeout, LocalAddr, KeepAlive,
+// and Resolver of the base dialer are respected.
+type mptcpDialer struct {
+	base *net.Dialer
+}
+
+func newMPTCPDialer(base *net.Dialer) proxy.Dialer {
+	return &mptcpDialer{base: base}
+}
+
+func (d *mptcpDialer) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return d.base.Dial(network, addr)
+	}
+	timeout := d.base.Timeout
+	if timeout == 0 {
+		timeout = defaultMPTCPDialTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	addrs, err := resolveTCPAddrs(ctx, d.base.Resolver, network, addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	// Addresses are tried in turn, each with an equal share of the
+	// remaining time like net.Dialer.
+	var firstErr error
+	for i, ta := range addrs {
+		if ta.IP == nil {
+			ta.IP = net.IPv4(127, 0, 0, 1)
+		}
+		partial := deadline
+		if remaining := time.Until(deadline); remaining > 0 {
+			partial = time.Now().Add(remaining / time.Duration(len(addrs)-i))
+		}
+		c, err := d.dialAddr(network, ta, partial)
+		if err == errMPTCPUnsupported {
+			return d.base.Dial(network, addr)
+		}
+		if err == nil {
+			return c, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+var errMPTCPUnsupported = errors.New("MPTCP is not supported")
+
+// dialAddr makes an MPTCP connection to ta until deadline.
+func (d *mptcpDialer) dialAddr(network string, ta *net.TCPAddr, deadline time.Time) (net.Conn, error) {
+	fd, family, _, err := mptcpSocket(ta)
+	if mptcpUnsupported(err) {
+		return nil, errMPTCPUnsupported
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	// A non-blocking file is registered with the netpoller, so that
+	// connect is waited for without blocking a thread.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	f := os.NewFile(uintptr(fd), "mptcp")
+	defer f.Close()
+
+	if la, ok := d.base.LocalAddr.(*net.TCPAddr); ok {
+		if err := unix.Bind(fd, tcpSockaddr(la, family)); err != nil {
+			return nil, os.NewSyscallError("bind", err)
+		}
+	}
+	if err := connectFile(f, tcpSockaddr(ta, family), deadline); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: ta, Err: err}
+	}
+
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok && d.base.KeepAlive >= 0 {
+		tc.SetKeepAlive(true)
+		if d.base.KeepAlive > 0 {
+			tc.SetKeepAlivePeriod(d.base.KeepAlive)
+		}
+	}
+	return c, nil
+}
+
+// connectFile connects the non-blocking socket of f to sa.  Like net.Dialer,
+// it waits until the socket gets writable by the netpoller, or deadline.
+func connectFile(f *os.File, sa unix.Sockaddr, deadline time.Time) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cerr error
+	if err := rc.Control(func(fd uintptr) {
+		cerr = unix.Connect(int(fd), sa)
+	}); err != nil {
+		return err
+	}
+	switch cerr {
+	case nil:
+		return nil
+	case unix.EINPROGRESS, unix.EALREADY, unix.EINTR:
+	default:
+		return os.NewSyscallError("connect", cerr)
+	}
+
+	if err := f.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	err = rc.Write(func(fd uintptr) bool {
+		n, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			cerr = os.NewSyscallError("getsockopt", err)
+			return true
+		}
+		switch e := unix.Errno(n); e {
+		case unix.EINPROGRESS, unix.EALREADY, unix.EINTR:
+			return false
+		case 0:
+			// The socket may be writable before connected.
+			_, err := unix.Getpeername(int(fd))
+			cerr = nil
+			return err == nil
+		default:
+			cerr = os.NewSyscallError("connect", e)
+			return true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return cerr
+}
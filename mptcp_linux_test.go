@@ -0,0 +1,126 @@
+// +build linux
+
+package transocks
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMPTCP(t *testing.T) {
+	t.Parallel()
+
+	l, err := listenMPTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("hello"))
+		c.Close()
+	}()
+
+	d := newMPTCPDialer(&net.Dialer{Timeout: 5 * time.Second})
+	c, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(*net.TCPConn); !ok {
+		t.Errorf("unexpected connection type: %T", c)
+	}
+	data, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Error("unexpected data:", string(data))
+	}
+
+	// nothing listens on the port after l is closed.
+	addr := l.Addr().String()
+	l.Close()
+	if _, err := d.Dial("tcp", addr); err == nil {
+		t.Error("dial to closed port should fail")
+	}
+}
+
+func TestMPTCPDialerResolver(t *testing.T) {
+	t.Parallel()
+
+	// The resolver answers loopback addresses for any names.
+	p, err := newFakeIPPool("127.77.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &fakeIPExchanger{pool: p, next: echoExchanger{}}
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, s := net.Pipe()
+			go func() {
+				defer s.Close()
+				for {
+					q, err := readDNSMessage(s)
+					if err != nil {
+						return
+					}
+					resp, err := ex.exchange(q)
+					if err != nil {
+						return
+					}
+					writeDNSMessage(s, resp)
+				}
+			}()
+			return c, nil
+		},
+	}
+
+	addrs, err := resolveTCPAddrs(context.Background(), r, "tcp", "www.example.com:https")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].Port != 443 {
+		t.Fatal("unexpected addresses:", addrs)
+	}
+	if h, ok := p.host(addrs[0].IP); !ok || h != "www.example.com" {
+		t.Error("address should be resolved by the resolver:", addrs[0])
+	}
+	if _, err := resolveTCPAddrs(context.Background(), r, "tcp6", "www.example.com:443"); err == nil {
+		t.Error("IPv4 addresses should not be used for tcp6")
+	}
+
+	l, err := listenMPTCP(net.JoinHostPort(addrs[0].IP.String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	d := newMPTCPDialer(&net.Dialer{Timeout: 5 * time.Second, Resolver: r})
+	c, err := d.Dial("tcp", net.JoinHostPort("www.example.com", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ta := c.RemoteAddr().(*net.TCPAddr); !ta.IP.Equal(addrs[0].IP) {
+		t.Error("resolved address should be dialed:", ta)
+	}
+	c.Close()
+
+	// connect is waited for by the netpoller until the deadline.
+	md := d.(*mptcpDialer)
+	_, err = md.dialAddr("tcp", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}, time.Now().Add(-time.Second))
+	if err == errMPTCPUnsupported {
+		return
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Error("expired deadline should be a timeout:", err)
+	}
+}
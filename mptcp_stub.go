@@ -0,0 +1,19 @@
+// +build !linux
+
+package transocks
+
+import (
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// MPTCP is supported only on Linux.  Plain TCP is used elsewhere.
+
+func listenMPTCP(addr string, opts ...socketOption) (net.Listener, error) {
+	return listenTCP(addr, opts...)
+}
+
+func newMPTCPDialer(base *net.Dialer) proxy.Dialer {
+	return base
+}
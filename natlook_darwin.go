@@ -0,0 +1,31 @@
+package transocks
+
+// struct pfioc_natlook in <net/pfvar.h> of macOS.
+// Ports are the first members of union pf_state_xport in network
+// byte order.
+type pfiocNatlook struct {
+	saddr        [16]byte
+	daddr        [16]byte
+	rsaddr       [16]byte
+	rdaddr       [16]byte
+	sxport       [4]byte
+	dxport       [4]byte
+	rsxport      [4]byte
+	rdxport      [4]byte
+	af           uint8
+	proto        uint8
+	protoVariant uint8
+	direction    uint8
+}
+
+// _IOWR('D', 23, struct pfioc_natlook)
+const diocNatlook = 0xc0544417
+
+func (nl *pfiocNatlook) setPorts(sport, dport int) {
+	nl.sxport = [4]byte{byte(sport >> 8), byte(sport)}
+	nl.dxport = [4]byte{byte(dport >> 8), byte(dport)}
+}
+
+func (nl *pfiocNatlook) rdPort() int {
+	return int(nl.rdxport[0])<<8 | int(nl.rdxport[1])
+}
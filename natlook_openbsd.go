@@ -0,0 +1,32 @@
+package transocks
+
+// struct pfioc_natlook in <net/pfvar.h> of OpenBSD.
+// Ports are in network byte order.
+type pfiocNatlook struct {
+	saddr     [16]byte
+	daddr     [16]byte
+	rsaddr    [16]byte
+	rdaddr    [16]byte
+	rdomain   uint16
+	rrdomain  uint16
+	sport     [2]byte
+	dport     [2]byte
+	rsport    [2]byte
+	rdport    [2]byte
+	af        uint8
+	proto     uint8
+	direction uint8
+	_         uint8
+}
+
+// _IOWR('D', 23, struct pfioc_natlook)
+const diocNatlook = 0xc0504417
+
+func (nl *pfiocNatlook) setPorts(sport, dport int) {
+	nl.sport = [2]byte{byte(sport >> 8), byte(sport)}
+	nl.dport = [2]byte{byte(dport >> 8), byte(dport)}
+}
+
+func (nl *pfiocNatlook) rdPort() int {
+	return int(nl.rdport[0])<<8 | int(nl.rdport[1])
+}
@@ -0,0 +1,17 @@
+// +build openbsd darwin
+
+package transocks
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestPFIOCNatlookSize(t *testing.T) {
+	t.Parallel()
+
+	// The size is encoded in DIOCNATLOOK.
+	if size := unsafe.Sizeof(pfiocNatlook{}); size != (diocNatlook>>16)&0x1fff {
+		t.Error("unexpected size of pfioc_natlook:", size)
+	}
+}
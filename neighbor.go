@@ -0,0 +1,93 @@
+package transocks
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file finds MAC addresses of clients on the same link in the
+// neighbor table of the kernel, so that connections can be routed by
+// client devices regardless of their IP addresses.
+
+const (
+	// neighborTTL is the time to cache the neighbor table.
+	neighborTTL = 30 * time.Second
+
+	// neighborRetry is the minimum interval to dump the table again
+	// for unknown clients.
+	neighborRetry = 1 * time.Second
+)
+
+// compileMACs parses MAC addresses such as "00:11:22:33:44:55", or
+// their prefixes of 3 bytes or more such as OUI "00:11:22".
+// Bytes are separated by ":" or "-".
+func compileMACs(list []string) ([][]byte, error) {
+	var macs [][]byte
+	for _, s := range list {
+		parts := strings.Split(strings.Replace(s, "-", ":", -1), ":")
+		if len(parts) < 3 || len(parts) > 6 {
+			return nil, fmt.Errorf("invalid MAC address: %s", s)
+		}
+		mac := make([]byte, len(parts))
+		for i, p := range parts {
+			b, err := strconv.ParseUint(p, 16, 8)
+			if err != nil || len(p) != 2 {
+				return nil, fmt.Errorf("invalid MAC address: %s", s)
+			}
+			mac[i] = byte(b)
+		}
+		macs = append(macs, mac)
+	}
+	return macs, nil
+}
+
+// matchMAC returns true if mac begins with any of prefixes.
+func matchMAC(prefixes [][]byte, mac net.HardwareAddr) bool {
+	for _, p := range prefixes {
+		if bytes.HasPrefix(mac, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// neighborTable caches the neighbor table dumped by dump.
+type neighborTable struct {
+	dump func() (map[string]net.HardwareAddr, error)
+
+	mu      sync.Mutex
+	entries map[string]net.HardwareAddr
+	updated time.Time
+}
+
+func newNeighborTable() *neighborTable {
+	return &neighborTable{dump: dumpNeighbors}
+}
+
+// lookup returns the MAC address of the neighbor at ip, or nil.
+// The table is dumped again when the cache expires, or when ip is not
+// in it and the last dump is older than neighborRetry.
+func (t *neighborTable) lookup(ip net.IP, now time.Time) net.HardwareAddr {
+	key := ip.String()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	age := now.Sub(t.updated)
+	mac, ok := t.entries[key]
+	if (ok && age < neighborTTL) || (!ok && age < neighborRetry) {
+		return mac
+	}
+	entries, err := t.dump()
+	if err != nil {
+		return mac
+	}
+	t.entries = entries
+	t.updated = now
+	return entries[key]
+}
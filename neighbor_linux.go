@@ -0,0 +1,70 @@
+// +build linux
+
+package transocks
+
+import (
+	"net"
+	"syscall"
+)
+
+// Attributes of neighbor messages in linux/neighbour.h.
+const (
+	ndaDst    = 1
+	ndaLLAddr = 2
+
+	// ndMsgLen is the length of struct ndmsg.
+	ndMsgLen = 12
+)
+
+// dumpNeighbors returns MAC addresses of neighbors by their IP addresses
+// in the neighbor table of the kernel.
+func dumpNeighbors() (map[string]net.HardwareAddr, error) {
+	b, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	return parseNeighbors(msgs), nil
+}
+
+// parseNeighbors parses RTM_NEWNEIGH messages.  Entries without MAC
+// addresses, such as incomplete or failed ones, are skipped.
+func parseNeighbors(msgs []syscall.NetlinkMessage) map[string]net.HardwareAddr {
+	order := nativeOrder()
+	entries := make(map[string]net.HardwareAddr)
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < ndMsgLen {
+			continue
+		}
+		var ip net.IP
+		var mac net.HardwareAddr
+		attrs := m.Data[ndMsgLen:]
+		for len(attrs) >= syscall.SizeofRtAttr {
+			l := int(order.Uint16(attrs[0:2]))
+			typ := order.Uint16(attrs[2:4])
+			if l < syscall.SizeofRtAttr || l > len(attrs) {
+				break
+			}
+			v := attrs[syscall.SizeofRtAttr:l]
+			switch {
+			case typ == ndaDst && (len(v) == net.IPv4len || len(v) == net.IPv6len):
+				ip = net.IP(append([]byte(nil), v...))
+			case typ == ndaLLAddr && len(v) == 6:
+				mac = net.HardwareAddr(append([]byte(nil), v...))
+			}
+			// Attributes are aligned to 4 bytes.
+			l = (l + 3) &^ 3
+			if l > len(attrs) {
+				break
+			}
+			attrs = attrs[l:]
+		}
+		if ip != nil && mac != nil {
+			entries[ip.String()] = mac
+		}
+	}
+	return entries
+}
@@ -0,0 +1,56 @@
+// +build linux
+
+package transocks
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestParseNeighbors(t *testing.T) {
+	t.Parallel()
+
+	order := nativeOrder()
+	attr := func(typ uint16, v []byte) []byte {
+		b := make([]byte, syscall.SizeofRtAttr, syscall.SizeofRtAttr+len(v)+3)
+		order.PutUint16(b[0:2], uint16(syscall.SizeofRtAttr+len(v)))
+		order.PutUint16(b[2:4], typ)
+		b = append(b, v...)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	mac := []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	msg := func(ip net.IP, lladdr []byte) syscall.NetlinkMessage {
+		data := make([]byte, ndMsgLen)
+		data = append(data, attr(ndaDst, ip)...)
+		if lladdr != nil {
+			data = append(data, attr(ndaLLAddr, lladdr)...)
+		}
+		return syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: syscall.RTM_NEWNEIGH},
+			Data:   data,
+		}
+	}
+
+	entries := parseNeighbors([]syscall.NetlinkMessage{
+		msg(net.ParseIP("192.0.2.1").To4(), mac),
+		msg(net.ParseIP("2001:db8::1"), mac),
+		msg(net.ParseIP("192.0.2.2").To4(), nil),
+		{Header: syscall.NlMsghdr{Type: syscall.NLMSG_DONE}},
+	})
+	if len(entries) != 2 {
+		t.Fatal("unexpected entries:", entries)
+	}
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		if entries[ip].String() != "00:11:22:33:44:55" {
+			t.Errorf("unexpected MAC address of %s: %s", ip, entries[ip])
+		}
+	}
+
+	if _, err := dumpNeighbors(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,14 @@
+// +build !linux
+
+package transocks
+
+import (
+	"errors"
+	"net"
+)
+
+// The neighbor table is read only on Linux.
+
+func dumpNeighbors() (map[string]net.HardwareAddr, error) {
+	return nil, errors.New("neighbor table is not supported")
+}
@@ -0,0 +1,71 @@
+package transocks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCompileMACs(t *testing.T) {
+	t.Parallel()
+
+	macs, err := compileMACs([]string{"00:11:22:33:44:55", "AA-BB-CC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		mac    string
+		expect bool
+	}{
+		{"00:11:22:33:44:55", true},
+		{"00:11:22:33:44:56", false},
+		{"aa:bb:cc:01:02:03", true},
+		{"aa:bb:cd:01:02:03", false},
+	}
+	for _, tc := range testCases {
+		mac, _ := net.ParseMAC(tc.mac)
+		if matchMAC(macs, mac) != tc.expect {
+			t.Errorf("matchMAC(%s) should be %v", tc.mac, tc.expect)
+		}
+	}
+	if matchMAC(macs, nil) {
+		t.Error("unknown MAC address should not match")
+	}
+
+	for _, s := range []string{"00:11", "00:11:22:33:44:55:66", "0:11:22", "00:11:zz", "001122"} {
+		if _, err := compileMACs([]string{s}); err == nil {
+			t.Errorf("%s should be invalid", s)
+		}
+	}
+}
+
+func TestNeighborTable(t *testing.T) {
+	t.Parallel()
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	var dumps int
+	table := &neighborTable{
+		dump: func() (map[string]net.HardwareAddr, error) {
+			dumps++
+			return map[string]net.HardwareAddr{"192.0.2.1": mac}, nil
+		},
+	}
+
+	now := time.Now()
+	known, unknown := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	if m := table.lookup(known, now); m.String() != mac.String() {
+		t.Error("unexpected MAC address:", m)
+	}
+	table.lookup(known, now.Add(time.Second))
+	table.lookup(unknown, now.Add(time.Second/2))
+	if dumps != 1 {
+		t.Error("table should be cached:", dumps)
+	}
+	if table.lookup(unknown, now.Add(2*time.Second)) != nil {
+		t.Error("unknown neighbor should not be found")
+	}
+	table.lookup(known, now.Add(2*time.Second+neighborTTL))
+	if dumps != 3 {
+		t.Error("table should be dumped again:", dumps)
+	}
+}
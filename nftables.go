@@ -0,0 +1,182 @@
+package transocks
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// This file manages nftables rules to route connections to transocks.
+//
+// All rules are kept in a dedicated table so that they can be
+// replaced or removed atomically without touching other rules.
+// Connections made by transocks itself are excluded by the user ID
+// of the process to avoid loops.
+
+const (
+	nftTable = "transocks"
+
+	// tproxyMark and tproxyRouteTable are the packet mark and the
+	// routing table to deliver packets marked by TPROXY locally.
+	tproxyMark       = "0x1"
+	tproxyRouteTable = "100"
+)
+
+// destinations never routed to transocks.
+var nftExcludes = []string{
+	"ip daddr { 0.0.0.0/8, 127.0.0.0/8, 169.254.0.0/16, 224.0.0.0/4, 255.255.255.255 } return",
+	"ip6 daddr { ::1, fe80::/10, ff00::/8 } return",
+}
+
+func listenPort(addr string) string {
+	if _, p, err := net.SplitHostPort(addr); err == nil {
+		return p
+	}
+	return "1081"
+}
+
+// nftInterceptMatches returns nftables expressions to match
+// connections made by InterceptUIDs and InterceptCgroups.
+func (c *Config) nftInterceptMatches() []string {
+	var matches []string
+	for _, uid := range c.InterceptUIDs {
+		matches = append(matches, fmt.Sprintf("meta skuid %d ", uid))
+	}
+	for _, cg := range c.InterceptCgroups {
+		cg = strings.Trim(cg, "/")
+		level := strings.Count(cg, "/") + 1
+		matches = append(matches, fmt.Sprintf("socket cgroupv2 level %d %q ", level, cg))
+	}
+	return matches
+}
+
+// NFTRuleset returns the nftables ruleset to route connections to
+// transocks in the mode of c.  The ruleset can be applied by "nft -f".
+// Applying it replaces the rules previously installed by transocks.
+func (c *Config) NFTRuleset() string {
+	port := listenPort(c.Addr)
+	buf := new(bytes.Buffer)
+
+	// Declaring the table before deleting it makes the deletion
+	// succeed even if the table does not exist.
+	fmt.Fprintf(buf, "table inet %s\n", nftTable)
+	fmt.Fprintf(buf, "delete table inet %s\n", nftTable)
+	fmt.Fprintf(buf, "table inet %s {\n", nftTable)
+
+	if c.Mode == ModeTPROXY {
+		protos := "tcp"
+		if c.UDP {
+			protos = "{ tcp, udp }"
+		}
+		buf.WriteString("\tchain prerouting {\n")
+		buf.WriteString("\t\ttype filter hook prerouting priority mangle; policy accept;\n")
+		for _, e := range nftExcludes {
+			fmt.Fprintf(buf, "\t\t%s\n", e)
+		}
+		// packets of established connections
+		fmt.Fprintf(buf, "\t\tmeta l4proto %s socket transparent 1 meta mark set %s accept\n", protos, tproxyMark)
+		fmt.Fprintf(buf, "\t\tmeta l4proto %s tproxy ip to :%s meta mark set %s accept\n", protos, port, tproxyMark)
+		fmt.Fprintf(buf, "\t\tmeta l4proto %s tproxy ip6 to :%s meta mark set %s accept\n", protos, port, tproxyMark)
+		buf.WriteString("\t}\n")
+	} else {
+		buf.WriteString("\tchain output {\n")
+		buf.WriteString("\t\ttype nat hook output priority -100; policy accept;\n")
+		for _, e := range nftExcludes {
+			fmt.Fprintf(buf, "\t\t%s\n", e)
+		}
+		fmt.Fprintf(buf, "\t\tmeta skuid %d return\n", os.Getuid())
+		matches := c.nftInterceptMatches()
+		if len(matches) == 0 {
+			matches = []string{""}
+		}
+		for _, m := range matches {
+			fmt.Fprintf(buf, "\t\t%smeta l4proto tcp redirect to :%s\n", m, port)
+		}
+		buf.WriteString("\t}\n")
+	}
+
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// runCommand runs a command with stdin.  The output of the command
+// is included in the returned error.
+func runCommand(stdin string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// tproxyRoutes returns "ip" command arguments to deliver packets
+// marked by TPROXY to the local host.
+func tproxyRoutes(op string) [][]string {
+	var cmds [][]string
+	for _, family := range []string{"-4", "-6"} {
+		dst := "0.0.0.0/0"
+		if family == "-6" {
+			dst = "::/0"
+		}
+		cmds = append(cmds,
+			[]string{family, "rule", op, "fwmark", tproxyMark + "/" + tproxyMark, "lookup", tproxyRouteTable},
+			[]string{family, "route", op, "local", dst, "dev", "lo", "table", tproxyRouteTable},
+		)
+	}
+	return cmds
+}
+
+// addTPROXYRoutes adds policy routing for packets marked by TPROXY.
+func addTPROXYRoutes() error {
+	// Remove stale entries first not to add duplicates.
+	removeTPROXYRoutes()
+	for _, args := range tproxyRoutes("add") {
+		if err := runCommand("", "ip", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTPROXYRoutes removes policy routing added by addTPROXYRoutes.
+// Errors are ignored as the entries may not exist.
+func removeTPROXYRoutes() {
+	for _, args := range tproxyRoutes("del") {
+		runCommand("", "ip", args...)
+	}
+}
+
+// InstallNFT installs nftables rules returned by NFTRuleset.
+// In ModeTPROXY, policy routing for marked packets is also added.
+//
+// This requires "nft" and "ip" commands and CAP_NET_ADMIN capability.
+func (c *Config) InstallNFT() error {
+	err := runCommand(c.NFTRuleset(), "nft", "-f", "-")
+	if err != nil {
+		return err
+	}
+	if c.Mode != ModeTPROXY {
+		return nil
+	}
+	return addTPROXYRoutes()
+}
+
+// RemoveNFT removes the nftables rules and policy routing installed
+// by InstallNFT.  It does nothing for rules not installed.
+func (c *Config) RemoveNFT() error {
+	err := runCommand(fmt.Sprintf("table inet %s\ndelete table inet %s\n", nftTable, nftTable),
+		"nft", "-f", "-")
+	if err != nil {
+		return err
+	}
+	if c.Mode == ModeTPROXY {
+		removeTPROXYRoutes()
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package transocks
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNFTRuleset(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.Addr = "127.0.0.1:12345"
+	rs := c.NFTRuleset()
+	expects := []string{
+		"delete table inet transocks\n",
+		"type nat hook output priority -100;",
+		fmt.Sprintf("meta skuid %d return", os.Getuid()),
+		"meta l4proto tcp redirect to :12345",
+	}
+	for _, e := range expects {
+		if !strings.Contains(rs, e) {
+			t.Errorf("NAT ruleset should contain %q:\n%s", e, rs)
+		}
+	}
+
+	c.InterceptUIDs = []int{1000}
+	c.InterceptCgroups = []string{"/system.slice/foo.service"}
+	rs = c.NFTRuleset()
+	expects = []string{
+		"meta skuid 1000 meta l4proto tcp redirect to :12345",
+		`socket cgroupv2 level 2 "system.slice/foo.service" meta l4proto tcp redirect to :12345`,
+	}
+	for _, e := range expects {
+		if !strings.Contains(rs, e) {
+			t.Errorf("scoped ruleset should contain %q:\n%s", e, rs)
+		}
+	}
+	if strings.Contains(rs, "\t\tmeta l4proto tcp redirect") {
+		t.Errorf("scoped ruleset should not redirect all connections:\n%s", rs)
+	}
+	c.InterceptUIDs = nil
+	c.InterceptCgroups = nil
+
+	c.Mode = ModeTPROXY
+	c.UDP = true
+	rs = c.NFTRuleset()
+	expects = []string{
+		"type filter hook prerouting priority mangle;",
+		"meta l4proto { tcp, udp } tproxy ip to :12345 meta mark set 0x1 accept",
+		"meta l4proto { tcp, udp } tproxy ip6 to :12345 meta mark set 0x1 accept",
+	}
+	for _, e := range expects {
+		if !strings.Contains(rs, e) {
+			t.Errorf("TPROXY ruleset should contain %q:\n%s", e, rs)
+		}
+	}
+	if strings.Contains(rs, "redirect") {
+		t.Errorf("TPROXY ruleset should not redirect:\n%s", rs)
+	}
+}
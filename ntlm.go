@@ -0,0 +1,220 @@
+package transocks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// This file implements NTLMv2 authentication defined in [MS-NLMP]
+// for HTTP proxies.  Only the messages needed by clients are implemented.
+// Message signing and sealing are not supported as HTTP does not use them.
+
+const (
+	ntlmNegotiateUnicode            = 0x00000001
+	ntlmNegotiateOEM                = 0x00000002
+	ntlmRequestTarget               = 0x00000004
+	ntlmNegotiateNTLM               = 0x00000200
+	ntlmNegotiateAlwaysSign         = 0x00008000
+	ntlmNegotiateExtendedSessionSec = 0x00080000
+	ntlmNegotiateTargetInfo         = 0x00800000
+
+	ntlmNegotiateFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM |
+		ntlmRequestTarget | ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign |
+		ntlmNegotiateExtendedSessionSec
+
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+
+	// the number of 100ns intervals between 1601-01-01 and 1970-01-01.
+	filetimeEpochDelta = 116444736000000000
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmCredential is a set of credentials for NTLM authentication.
+type ntlmCredential struct {
+	domain   string
+	user     string
+	password string
+}
+
+// newNTLMCredential creates ntlmCredential.
+// If domain is empty and user looks like "DOMAIN\USER", it is split.
+func newNTLMCredential(domain, user, password string) *ntlmCredential {
+	if len(domain) == 0 {
+		if i := strings.IndexByte(user, '\\'); i >= 0 {
+			domain, user = user[:i], user[i+1:]
+		}
+	}
+	return &ntlmCredential{
+		domain:   domain,
+		user:     user,
+		password: password,
+	}
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// ntowfv2 computes NTOWFv2 from the credential.
+func (c *ntlmCredential) ntowfv2() []byte {
+	h := md4.New()
+	h.Write(utf16le(c.password))
+	return hmacMD5(h.Sum(nil), utf16le(strings.ToUpper(c.user)+c.domain))
+}
+
+// ntlmNegotiate returns NEGOTIATE_MESSAGE.
+func ntlmNegotiate() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateFlags)
+	// DomainNameFields and WorkstationFields are empty.
+	binary.LittleEndian.PutUint32(msg[20:], 32)
+	binary.LittleEndian.PutUint32(msg[28:], 32)
+	return msg
+}
+
+// ntlmChallenge is a parsed CHALLENGE_MESSAGE.
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+func readSecBuf(msg []byte, off int) ([]byte, error) {
+	if len(msg) < off+8 {
+		return nil, errors.New("ntlm: message too short")
+	}
+	l := int(binary.LittleEndian.Uint16(msg[off:]))
+	o := int(binary.LittleEndian.Uint32(msg[off+4:]))
+	if o+l > len(msg) {
+		return nil, errors.New("ntlm: invalid field in message")
+	}
+	return msg[o : o+l], nil
+}
+
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 32 || !bytes.Equal(msg[:8], ntlmSignature) {
+		return nil, errors.New("ntlm: invalid challenge message")
+	}
+	if binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errors.New("ntlm: not a challenge message")
+	}
+
+	c := &ntlmChallenge{
+		flags:     binary.LittleEndian.Uint32(msg[20:]),
+		challenge: msg[24:32],
+	}
+	if c.flags&ntlmNegotiateTargetInfo != 0 {
+		ti, err := readSecBuf(msg, 40)
+		if err != nil {
+			return nil, err
+		}
+		c.targetInfo = ti
+	}
+	return c, nil
+}
+
+// timestamp returns MsvAvTimestamp in target info, if any.
+func (c *ntlmChallenge) timestamp() []byte {
+	ti := c.targetInfo
+	for len(ti) >= 4 {
+		id := binary.LittleEndian.Uint16(ti)
+		l := int(binary.LittleEndian.Uint16(ti[2:]))
+		if id == ntlmAvEOL || len(ti) < 4+l {
+			break
+		}
+		if id == ntlmAvTimestamp && l == 8 {
+			return ti[4:12]
+		}
+		ti = ti[4+l:]
+	}
+	return nil
+}
+
+// responses computes NTLMv2 LmChallengeResponse and NtChallengeResponse.
+func (c *ntlmCredential) responses(ch *ntlmChallenge, timestamp, clientChallenge []byte) (lm, nt []byte) {
+	key := c.ntowfv2()
+
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, ch.targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	ntProof := hmacMD5(key, ch.challenge, temp)
+	nt = append(ntProof, temp...)
+	lm = append(hmacMD5(key, ch.challenge, clientChallenge), clientChallenge...)
+	return lm, nt
+}
+
+// authenticate returns AUTHENTICATE_MESSAGE for a challenge message.
+func (c *ntlmCredential) authenticate(challenge []byte) ([]byte, error) {
+	ch, err := parseNTLMChallenge(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+	timestamp := ch.timestamp()
+	if timestamp == nil {
+		timestamp = make([]byte, 8)
+		ft := uint64(time.Now().UnixNano()/100) + filetimeEpochDelta
+		binary.LittleEndian.PutUint64(timestamp, ft)
+	}
+	lm, nt := c.responses(ch, timestamp, clientChallenge)
+
+	flags := uint32(ntlmNegotiateFlags) &^ ntlmNegotiateOEM
+	domain, user := utf16le(c.domain), utf16le(c.user)
+	if ch.flags&ntlmNegotiateUnicode == 0 {
+		flags = flags&^ntlmNegotiateUnicode | ntlmNegotiateOEM
+		domain, user = []byte(strings.ToUpper(c.domain)), []byte(strings.ToUpper(c.user))
+	}
+
+	const headerLen = 64
+	msg := make([]byte, headerLen)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	putSecBuf := func(off int, data []byte) {
+		binary.LittleEndian.PutUint16(msg[off:], uint16(len(data)))
+		binary.LittleEndian.PutUint16(msg[off+2:], uint16(len(data)))
+		binary.LittleEndian.PutUint32(msg[off+4:], uint32(len(msg)))
+		msg = append(msg, data...)
+	}
+	putSecBuf(12, lm)
+	putSecBuf(20, nt)
+	putSecBuf(28, domain)
+	putSecBuf(36, user)
+	putSecBuf(44, nil) // Workstation
+	putSecBuf(52, nil) // EncryptedRandomSessionKey
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+	return msg, nil
+}
@@ -0,0 +1,71 @@
+package transocks
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestNTLMv2(t *testing.T) {
+	t.Parallel()
+
+	// Test vectors from [MS-NLMP] 4.2.4.
+	c := newNTLMCredential("", "Domain\\User", "Password")
+	if c.domain != "Domain" || c.user != "User" {
+		t.Fatal("unexpected credential:", c.domain, c.user)
+	}
+
+	if hex.EncodeToString(c.ntowfv2()) != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Error("unexpected NTOWFv2:", hex.EncodeToString(c.ntowfv2()))
+	}
+
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e00" +
+		"01000c0053006500720076006500720000000000")
+	ch := &ntlmChallenge{
+		flags:      ntlmNegotiateUnicode | ntlmNegotiateTargetInfo,
+		challenge:  []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef},
+		targetInfo: targetInfo,
+	}
+	clientChallenge := bytes.Repeat([]byte{0xaa}, 8)
+	lm, nt := c.responses(ch, make([]byte, 8), clientChallenge)
+
+	if hex.EncodeToString(nt[:16]) != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Error("unexpected NTProofStr:", hex.EncodeToString(nt[:16]))
+	}
+	if hex.EncodeToString(lm) != "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" {
+		t.Error("unexpected LMv2 response:", hex.EncodeToString(lm))
+	}
+}
+
+func TestNTLMMessages(t *testing.T) {
+	t.Parallel()
+
+	neg := ntlmNegotiate()
+	if !bytes.Equal(neg[:8], ntlmSignature) || neg[8] != 1 {
+		t.Error("invalid negotiate message:", neg)
+	}
+
+	challenge, _ := hex.DecodeString("4e544c4d53535000020000000c000c003800000033828ae2" +
+		"0123456789abcdef00000000000000002400240044000000060070170000000f" +
+		"530065007200760065007200020000000c0044006f006d00610069006e000100" +
+		"0c0053006500720076006500720000000000")
+	c := newNTLMCredential("Domain", "User", "Password")
+	msg, err := c.authenticate(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg[:8], ntlmSignature) || msg[8] != 3 {
+		t.Fatal("invalid authenticate message")
+	}
+	user, err := readSecBuf(msg, 36)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(user, utf16le("User")) {
+		t.Error("unexpected user name:", user)
+	}
+
+	if _, err := c.authenticate(neg); err == nil {
+		t.Error("negotiate message should not be accepted as challenge")
+	}
+}
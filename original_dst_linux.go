@@ -26,6 +26,9 @@ func getsockopt(s int, level int, optname int, optval unsafe.Pointer, optlen *ui
 //
 // Note that this function only works when nf_conntrack_ipv4 and/or
 // nf_conntrack_ipv6 is loaded in the kernel.
+//
+// If SO_ORIGINAL_DST fails with ENOENT, the conntrack table is looked
+// up through ctnetlink, which requires CAP_NET_ADMIN capability.
 func GetOriginalDST(conn *net.TCPConn) (*net.TCPAddr, error) {
 	f, err := conn.File()
 	if err != nil {
@@ -48,7 +51,7 @@ func GetOriginalDST(conn *net.TCPConn) (*net.TCPAddr, error) {
 		err = getsockopt(fd, syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST,
 			unsafe.Pointer(&addr), &len)
 		if err != nil {
-			return nil, os.NewSyscallError("getsockopt", err)
+			return conntrackFallback(conn, err)
 		}
 		ip := make([]byte, 16)
 		for i, b := range addr.Addr {
@@ -68,7 +71,7 @@ func GetOriginalDST(conn *net.TCPConn) (*net.TCPAddr, error) {
 	err = getsockopt(fd, syscall.IPPROTO_IP, SO_ORIGINAL_DST,
 		unsafe.Pointer(&addr), &len)
 	if err != nil {
-		return nil, os.NewSyscallError("getsockopt", err)
+		return conntrackFallback(conn, err)
 	}
 	ip := make([]byte, 4)
 	for i, b := range addr.Addr {
@@ -80,3 +83,17 @@ func GetOriginalDST(conn *net.TCPConn) (*net.TCPAddr, error) {
 		Port: int(pb[0])*256 + int(pb[1]),
 	}, nil
 }
+
+// conntrackFallback looks up the conntrack table when getsockopt
+// failed with ENOENT.  Otherwise, or if the lookup fails too, err is
+// returned.
+func conntrackFallback(conn *net.TCPConn, err error) (*net.TCPAddr, error) {
+	if err == syscall.ENOENT {
+		local := conn.LocalAddr().(*net.TCPAddr)
+		remote := conn.RemoteAddr().(*net.TCPAddr)
+		if addr, cerr := conntrackOriginalDST(local, remote); cerr == nil {
+			return addr, nil
+		}
+	}
+	return nil, os.NewSyscallError("getsockopt", err)
+}
@@ -0,0 +1,84 @@
+// +build openbsd darwin
+
+package transocks
+
+import (
+	"net"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// pf(4) definitions to look up states of redirected connections.
+const (
+	pfDevice = "/dev/pf"
+	pfOut    = 2
+)
+
+var (
+	pfOnce sync.Once
+	pfFile *os.File
+	pfErr  error
+)
+
+// openPF opens /dev/pf once.  The device is kept open.
+func openPF() (*os.File, error) {
+	pfOnce.Do(func() {
+		pfFile, pfErr = os.OpenFile(pfDevice, os.O_RDWR, 0)
+	})
+	return pfFile, pfErr
+}
+
+// copyPFAddr copies ip to a pf_addr and returns the address family.
+func copyPFAddr(dst *[16]byte, ip net.IP) uint8 {
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(dst[:], ip4)
+		return unix.AF_INET
+	}
+	copy(dst[:], ip.To16())
+	return unix.AF_INET6
+}
+
+// GetOriginalDST retrieves the original destination address from
+// NATed connection.  On OpenBSD and macOS, the address is looked up
+// in the state table of pf redirecting connections by rdr-to (or rdr
+// on macOS).  This requires read-write access to /dev/pf.
+//
+// If no state is found, e.g. connections are diverted by divert-to,
+// this returns conn.LocalAddr().
+func GetOriginalDST(conn *net.TCPConn) (*net.TCPAddr, error) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+
+	f, err := openPF()
+	if err != nil {
+		return nil, err
+	}
+
+	var nl pfiocNatlook
+	nl.af = copyPFAddr(&nl.saddr, remote.IP)
+	copyPFAddr(&nl.daddr, local.IP)
+	nl.setPorts(remote.Port, local.Port)
+	nl.proto = unix.IPPROTO_TCP
+	nl.direction = pfOut
+
+	_, _, e := unix.Syscall(unix.SYS_IOCTL, f.Fd(), diocNatlook, uintptr(unsafe.Pointer(&nl)))
+	if e == unix.ENOENT {
+		return local, nil
+	}
+	if e != 0 {
+		return nil, os.NewSyscallError("ioctl", e)
+	}
+
+	ip := make(net.IP, 16)
+	copy(ip, nl.rdaddr[:])
+	if nl.af == unix.AF_INET {
+		ip = ip[:4]
+	}
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: nl.rdPort(),
+	}, nil
+}
@@ -1,4 +1,4 @@
-// +build !linux
+// +build !linux,!openbsd,!darwin
 
 package transocks
 
@@ -9,8 +9,8 @@ import "net"
 // is supported.  For other operating systems, this will just return
 // conn.LocalAddr().
 //
-// Note that this function only works when nf_conntrack_ipv4 and/or
-// nf_conntrack_ipv6 is loaded in the kernel.
+// On FreeBSD, ipfw fwd keeps the destination of forwarded connections,
+// so conn.LocalAddr() is the original destination.
 func GetOriginalDST(conn *net.TCPConn) (*net.TCPAddr, error) {
 	return conn.LocalAddr().(*net.TCPAddr), nil
 }
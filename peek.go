@@ -0,0 +1,296 @@
+package transocks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// defaultPeekTimeout limits the time to wait for the first bytes
+	// from clients if Config.PeekTimeout is zero.
+	defaultPeekTimeout = 5 * time.Second
+
+	// defaultMaxPeekBytes limits bytes read from clients to find host
+	// names if Config.MaxPeekBytes is zero.
+	defaultMaxPeekBytes = 64 << 10
+)
+
+// Protocols of Config.PeekProtocols.
+const (
+	// PeekTLS looks for TLS server name indication.
+	PeekTLS = "tls"
+
+	// PeekHTTP looks for HTTP Host header or :authority of HTTP/2
+	// with prior knowledge.
+	PeekHTTP = "http"
+
+	// PeekNone does not read client streams.
+	PeekNone = "none"
+)
+
+// tlsExtensionECH is the type of encrypted_client_hello extension.
+const tlsExtensionECH = 0xfe0d
+
+// echPublicName returns the server name if data begins with a TLS
+// record of ClientHello carrying Encrypted ClientHello.  The server
+// name of such ClientHello is the public name of the ECH provider, not
+// the real destination.  The returned bool is false without ECH.
+func echPublicName(data []byte) (string, bool) {
+	hello, err := clientHelloMessage(data)
+	if err != nil {
+		return "", false
+	}
+	if _, err := clientHelloExtension(hello, tlsExtensionECH); err != nil {
+		return "", false
+	}
+	name, _ := clientHelloServerName(hello)
+	return name, true
+}
+
+// defaultNoPeekPorts are ports of protocols where servers speak first:
+// FTP, SSH, SMTP, POP3, IMAP, submission, and MySQL.
+var defaultNoPeekPorts = []string{"21", "22", "25", "110", "143", "587", "3306"}
+
+// compileNoPeekPorts parses Config.NoPeekPorts.  If ports is nil,
+// defaultNoPeekPorts is used.
+func compileNoPeekPorts(ports []string) ([]portRange, error) {
+	if ports == nil {
+		ports = defaultNoPeekPorts
+	}
+	var prs []portRange
+	for _, p := range ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		prs = append(prs, pr)
+	}
+	return prs, nil
+}
+
+// readOnlyConn is a net.Conn that only reads from a reader.
+// Writes always fail.
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// readClientHello reads a TLS ClientHello from r.
+//
+// This uses crypto/tls to parse the message.  The handshake is aborted
+// as soon as the ClientHello is read.
+func readClientHello(r io.Reader) (*tls.ClientHelloInfo, error) {
+	var hello *tls.ClientHelloInfo
+
+	err := tls.Server(readOnlyConn{reader: r}, &tls.Config{
+		GetConfigForClient: func(argHello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *argHello
+			return nil, errors.New("peek done")
+		},
+	}).Handshake()
+
+	if hello == nil {
+		return nil, err
+	}
+	return hello, nil
+}
+
+// peekClientHello reads a TLS ClientHello from r.
+//
+// The returned reader reproduces all bytes read from r followed by
+// the rest of r, whether or not a ClientHello is found.
+func peekClientHello(r io.Reader) (*tls.ClientHelloInfo, io.Reader, error) {
+	peeked := new(bytes.Buffer)
+	hello, err := readClientHello(io.TeeReader(r, peeked))
+	return hello, io.MultiReader(peeked, r), err
+}
+
+// readHTTPHeader reads the request line and header fields of an HTTP/1
+// request from r.  The request line is returned split into the method,
+// the request target, and the version.
+//
+// Unlike http.ReadRequest, this does not interpret header fields for
+// the body such as Content-Length, Transfer-Encoding, or Expect, so
+// that requests are not rejected for reasons irrelevant to routing.
+func readHTTPHeader(r *bufio.Reader) ([]string, textproto.MIMEHeader, error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, nil, err
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || len(parts[0]) == 0 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return nil, nil, fmt.Errorf("malformed HTTP request line: %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	return parts, header, nil
+}
+
+// readHTTPHost reads the header of an HTTP/1 request from r, and
+// returns the host of the request target in the absolute form or
+// the Host header.
+func readHTTPHost(r *bufio.Reader) (string, error) {
+	parts, header, err := readHTTPHeader(r)
+	if err != nil {
+		return "", err
+	}
+
+	var host string
+	if parts[0] == "CONNECT" {
+		host = parts[1]
+	} else if u, err := url.ParseRequestURI(parts[1]); err == nil && u.IsAbs() {
+		host = u.Host
+	}
+	if len(host) == 0 {
+		host = header.Get("Host")
+	}
+	if len(host) == 0 {
+		return "", errors.New("no host in HTTP request")
+	}
+	return host, nil
+}
+
+// peekHTTP reads the host of an HTTP request from r.
+//
+// The returned reader reproduces all bytes read from r followed by
+// the rest of r, whether or not a request is found.  The request body
+// and pipelined requests that are read ahead are reproduced as well.
+func peekHTTP(r io.Reader) (string, io.Reader, error) {
+	peeked := new(bytes.Buffer)
+	host, err := readHTTPHost(bufio.NewReader(io.TeeReader(r, peeked)))
+	return host, io.MultiReader(peeked, r), err
+}
+
+// connectRequest returns the port of the target if data begins with
+// a CONNECT request sent by clients that regard transocks as a proxy.
+// n is the length of the request header to be consumed.
+func connectRequest(data []byte) (port, n int, ok bool) {
+	r := bytes.NewReader(data)
+	br := bufio.NewReader(r)
+	parts, _, err := readHTTPHeader(br)
+	if err != nil || parts[0] != "CONNECT" {
+		return 0, 0, false
+	}
+	_, p, err := net.SplitHostPort(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	port, err = strconv.Atoi(p)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, 0, false
+	}
+	return port, len(data) - br.Buffered() - r.Len(), true
+}
+
+// isWebSocket returns true if data begins with an HTTP request to
+// upgrade the connection to WebSocket.
+func isWebSocket(data []byte) bool {
+	_, header, err := readHTTPHeader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return false
+	}
+	for _, v := range header["Upgrade"] {
+		for _, p := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(p), "websocket") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// http2Preface is the client connection preface of HTTP/2.
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// readHTTP2Authority reads HTTP/2 frames with prior knowledge (h2c)
+// from r and returns :authority of the first HEADERS frame.
+func readHTTP2Authority(r io.Reader) (string, error) {
+	// Stop reading as soon as the data differ from the preface, or
+	// clients sending short data would be blocked.
+	var preface []byte
+	buf := make([]byte, len(http2Preface))
+	for len(preface) < len(http2Preface) {
+		n, err := r.Read(buf[:len(http2Preface)-len(preface)])
+		preface = append(preface, buf[:n]...)
+		if !strings.HasPrefix(http2Preface, string(preface)) {
+			return "", errors.New("no HTTP/2 connection preface")
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	fr := http2.NewFramer(ioutil.Discard, r)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return "", err
+		}
+		switch f := f.(type) {
+		case *http2.MetaHeadersFrame:
+			authority := f.PseudoValue("authority")
+			if len(authority) == 0 {
+				return "", errors.New("no :authority in HEADERS")
+			}
+			return authority, nil
+		case *http2.SettingsFrame, *http2.WindowUpdateFrame, *http2.PriorityFrame:
+		default:
+			return "", fmt.Errorf("unexpected HTTP/2 frame: %v", f.Header().Type)
+		}
+	}
+}
+
+// peekHTTP2 reads :authority of the first HTTP/2 request from r.
+//
+// The returned reader reproduces all bytes read from r followed by
+// the rest of r, whether or not :authority is found.
+func peekHTTP2(r io.Reader) (string, io.Reader, error) {
+	peeked := new(bytes.Buffer)
+	authority, err := readHTTP2Authority(io.TeeReader(r, peeked))
+	return authority, io.MultiReader(peeked, r), err
+}
+
+// tlsAlerts are alert descriptions of Config.NoSNIAlert.
+var tlsAlerts = map[string]byte{
+	"handshake_failure": 40,
+	"access_denied":     49,
+	"internal_error":    80,
+	"unrecognized_name": 112,
+}
+
+// defaultNoSNIAlert is the alert sent if Config.NoSNIAlert is empty.
+const defaultNoSNIAlert = "unrecognized_name"
+
+// writeTLSAlert writes a fatal TLS alert record of description desc.
+func writeTLSAlert(w io.Writer, desc byte) error {
+	// alert record of TLS 1.2, length 2, and level fatal.
+	_, err := w.Write([]byte{21, 3, 3, 0, 2, 2, desc})
+	return err
+}
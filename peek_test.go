@@ -0,0 +1,338 @@
+package transocks
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// clientHello returns a TLS ClientHello message for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	c1, c2 := net.Pipe()
+	go func() {
+		tls.Client(c1, &tls.Config{ServerName: serverName}).Handshake()
+		c1.Close()
+	}()
+
+	buf := make([]byte, 4096)
+	n, err := c2.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.Close()
+	return buf[:n]
+}
+
+// http2Request returns the beginning of an HTTP/2 stream with prior
+// knowledge for authority.
+func http2Request(t *testing.T, authority string) []byte {
+	buf := bytes.NewBufferString(http2Preface)
+	fr := http2.NewFramer(buf, nil)
+	if err := fr.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fr.WriteWindowUpdate(0, 65535); err != nil {
+		t.Fatal(err)
+	}
+
+	hbuf := new(bytes.Buffer)
+	enc := hpack.NewEncoder(hbuf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: "POST"})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: authority})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/helloworld.Greeter/SayHello"})
+	err := fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: hbuf.Bytes(),
+		EndHeaders:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPeekHost(t *testing.T) {
+	t.Parallel()
+
+	hello := clientHello(t, "www.example.com")
+	h2c := http2Request(t, "grpc.example.com:50051")
+	testCases := []struct {
+		data []byte
+		host string
+	}{
+		{hello, "www.example.com"},
+		{[]byte("GET / HTTP/1.1\r\nHost: www.example.org:8080\r\n\r\n"), "www.example.org"},
+		{[]byte("GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\nbody"), "www.example.org"},
+		{h2c, "grpc.example.com"},
+		{[]byte("PUT /upload HTTP/1.1\r\nHost: www.example.org\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"), "www.example.org"},
+		{[]byte("GET /a HTTP/1.1\r\nHost: a.example.org\r\n\r\nGET /b HTTP/1.1\r\nHost: b.example.org\r\n\r\n"), "a.example.org"},
+		{[]byte("POST / HTTP/1.1\r\nHost: www.example.org\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab"), "www.example.org"},
+		{[]byte("GET http://www.example.net/ HTTP/1.1\r\nHost: www.example.org\r\n\r\n"), "www.example.net"},
+		{[]byte("CONNECT www.example.net:443 HTTP/1.1\r\n\r\n"), "www.example.net"},
+		{[]byte("SSH-2.0-OpenSSH_7.4\r\n"), ""},
+		{[]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}, ""}, // PostgreSQL SSLRequest
+	}
+
+	for _, tc := range testCases {
+		host, _, r := peekHost(bytes.NewReader(tc.data), "")
+		if host != tc.host {
+			t.Errorf("unexpected host %q for %q", host, tc.data)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, tc.data) {
+			t.Errorf("peeked data are not reproduced: %q", data)
+		}
+	}
+}
+
+func TestPeekHTTPHeaderOnly(t *testing.T) {
+	t.Parallel()
+
+	// The client waits for 100 Continue before sending the body.
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go io.WriteString(c1, "PUT /upload HTTP/1.1\r\nHost: www.example.org\r\n"+
+		"Expect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	host, _, _ := peekHost(c2, PeekHTTP)
+	if host != "www.example.org" {
+		t.Error("unexpected host:", host)
+	}
+}
+
+func TestIsWebSocket(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		data      string
+		websocket bool
+	}{
+		{"GET /chat HTTP/1.1\r\nHost: www.example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", true},
+		{"GET /chat HTTP/1.1\r\nHost: www.example.com\r\nUpgrade: foo, WebSocket\r\nConnection: Upgrade\r\n\r\n", true},
+		{"GET / HTTP/1.1\r\nHost: www.example.com\r\nUpgrade: h2c\r\nConnection: Upgrade\r\n\r\n", false},
+		{"GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", false},
+		{"GET / HTTP/1.1\r\nUpgrade: websocket\r\n", false},
+	}
+	for _, tc := range testCases {
+		if isWebSocket([]byte(tc.data)) != tc.websocket {
+			t.Errorf("unexpected result for %q", tc.data)
+		}
+	}
+}
+
+func TestPeekHostProtocol(t *testing.T) {
+	t.Parallel()
+
+	hello := clientHello(t, "www.example.com")
+	req := []byte("GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n")
+	testCases := []struct {
+		data     []byte
+		protocol string
+		host     string
+	}{
+		{hello, PeekTLS, "www.example.com"},
+		{hello, PeekHTTP, ""},
+		{req, PeekHTTP, "www.example.org"},
+		{req, PeekTLS, ""},
+	}
+
+	for _, tc := range testCases {
+		host, _, r := peekHost(bytes.NewReader(tc.data), tc.protocol)
+		if host != tc.host {
+			t.Errorf("unexpected host %q for %s", host, tc.protocol)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, tc.data) {
+			t.Errorf("peeked data are not reproduced: %q", data)
+		}
+	}
+
+	s := &Server{protocols: map[int]string{8443: PeekNone}}
+	if s.peeks(8443) {
+		t.Error("port with PeekNone should not be peeked")
+	}
+}
+
+func TestNoPeekPorts(t *testing.T) {
+	t.Parallel()
+
+	prs, err := compileNoPeekPorts(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{noPeek: prs}
+	if s.peeks(22) || s.peeks(25) {
+		t.Error("SSH and SMTP should not be peeked by default")
+	}
+	if !s.peeks(443) {
+		t.Error("HTTPS should be peeked")
+	}
+
+	prs, err = compileNoPeekPorts([]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = &Server{noPeek: prs}
+	if !s.peeks(22) {
+		t.Error("empty list should peek all ports")
+	}
+
+	prs, err = compileNoPeekPorts([]string{"8000-8999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = &Server{noPeek: prs}
+	if s.peeks(8080) || !s.peeks(22) {
+		t.Error("wrong ports are peeked")
+	}
+
+	if _, err := compileNoPeekPorts([]string{"ssh"}); err == nil {
+		t.Error("invalid port should be an error")
+	}
+}
+
+// withExtension appends a TLS extension to a ClientHello record.
+func withExtension(rec []byte, typ uint16, data []byte) []byte {
+	ext := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint16(ext[0:], typ)
+	binary.BigEndian.PutUint16(ext[2:], uint16(len(data)))
+	ext = append(ext, data...)
+
+	b := append(append([]byte(nil), rec...), ext...)
+	binary.BigEndian.PutUint16(b[3:], binary.BigEndian.Uint16(b[3:])+uint16(len(ext)))
+	hsLen := int(b[6])<<16 | int(b[7])<<8 | int(b[8]) + len(ext)
+	b[6], b[7], b[8] = byte(hsLen>>16), byte(hsLen>>8), byte(hsLen)
+
+	// record header, handshake header, legacy_version, and random
+	off := 5 + 4 + 2 + 32
+	off += 1 + int(b[off])
+	off += 2 + int(binary.BigEndian.Uint16(b[off:]))
+	off += 1 + int(b[off])
+	binary.BigEndian.PutUint16(b[off:], binary.BigEndian.Uint16(b[off:])+uint16(len(ext)))
+	return b
+}
+
+func TestECHPublicName(t *testing.T) {
+	t.Parallel()
+
+	hello := clientHello(t, "public.example.com")
+	if _, ok := echPublicName(hello); ok {
+		t.Error("ClientHello without ECH")
+	}
+
+	// outer ECHClientHello with HKDF-SHA256, AES-128-GCM, config_id,
+	// enc, and payload.
+	payload := []byte{0, 0, 1, 0, 1, 7, 0, 32}
+	payload = append(payload, make([]byte, 32)...)
+	payload = append(payload, 0, 16)
+	payload = append(payload, make([]byte, 16)...)
+	name, ok := echPublicName(withExtension(hello, tlsExtensionECH, payload))
+	if !ok {
+		t.Fatal("ECH should be found")
+	}
+	if name != "public.example.com" {
+		t.Error("unexpected public name:", name)
+	}
+
+	if _, ok := echPublicName([]byte("GET / HTTP/1.1\r\n")); ok {
+		t.Error("HTTP request should not have ECH")
+	}
+}
+
+func TestPeekHostLimit(t *testing.T) {
+	t.Parallel()
+
+	req := []byte("GET / HTTP/1.1\r\nCookie: " + strings.Repeat("a", 100) + "\r\nHost: www.example.org\r\n\r\n")
+	host, _, _ := peekHost(io.LimitReader(bytes.NewReader(req), 64), "")
+	if host != "" {
+		t.Error("host should not be found beyond the limit:", host)
+	}
+	host, _, _ = peekHost(io.LimitReader(bytes.NewReader(req), defaultMaxPeekBytes), "")
+	if host != "www.example.org" {
+		t.Error("unexpected host:", host)
+	}
+}
+
+func TestRegisterSniffer(t *testing.T) {
+	// MQTT CONNECT packets carry client identifiers, not host names,
+	// but this is enough to test the registration.
+	RegisterSniffer("test-mqtt", SnifferFunc(func(r io.Reader) (string, string, io.Reader, error) {
+		peeked := new(bytes.Buffer)
+		buf := make([]byte, 9)
+		_, err := io.ReadFull(io.TeeReader(r, peeked), buf)
+		rest := io.MultiReader(peeked, r)
+		if err != nil {
+			return "", "", rest, err
+		}
+		if buf[0] != 0x10 || string(buf[4:8]) != "MQTT" {
+			return "", "", rest, errors.New("not MQTT")
+		}
+		return "broker.example.com", "", rest, nil
+	}))
+
+	data := []byte{0x10, 0x10, 0, 4, 'M', 'Q', 'T', 'T', 4, 2, 0, 60, 0, 4, 't', 'e', 's', 't'}
+	for _, protocol := range []string{"", "test-mqtt"} {
+		host, proto, r := peekHost(bytes.NewReader(data), protocol)
+		if host != "broker.example.com" || proto != "test-mqtt" {
+			t.Errorf("unexpected host and protocol for %q: %q, %q", protocol, host, proto)
+		}
+		peeked, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(peeked, data) {
+			t.Errorf("peeked data are not reproduced: %q", peeked)
+		}
+	}
+
+	c := NewConfig()
+	c.ProxyURL, _ = url.Parse("socks5://10.20.30.40:1080")
+	c.PeekProtocols = map[int]string{1883: "test-mqtt"}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+	c.PeekProtocols = map[int]string{1883: "mqtt"}
+	if err := c.Validate(); err == nil {
+		t.Error("unregistered protocol should be an error")
+	}
+}
+
+func TestConnectRequest(t *testing.T) {
+	t.Parallel()
+
+	req := "CONNECT www.example.com:443 HTTP/1.1\r\nHost: www.example.com:443\r\n\r\n"
+	port, n, ok := connectRequest([]byte(req + "\x16\x03\x01"))
+	if !ok || port != 443 || n != len(req) {
+		t.Error("unexpected result:", port, n, ok)
+	}
+
+	for _, data := range []string{
+		"GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n",
+		"CONNECT www.example.com HTTP/1.1\r\n\r\n",
+		"CONNECT www.example.com:443 HTTP/1.1\r\n",
+	} {
+		if _, _, ok := connectRequest([]byte(data)); ok {
+			t.Errorf("%q is not a CONNECT request", data)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package transocks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// This file finds local processes that own client sockets, so that
+// connections from the same host can be logged and routed by users.
+//
+// Sockets are looked up in /proc/net/tcp and /proc/net/tcp6 by the
+// client address.  These list sockets of all users with owner UIDs
+// and inode numbers, which are matched against /proc/PID/fd to find
+// processes.
+
+var errSocketNotFound = errors.New("socket not found")
+
+// processInfo is the owner of a client socket.
+// pid is zero and command is empty if the process is not found.
+type processInfo struct {
+	uid     int
+	pid     int
+	command string
+}
+
+func (pi *processInfo) addFields(fields map[string]interface{}) {
+	fields["client_uid"] = pi.uid
+	if pi.pid > 0 {
+		fields["client_pid"] = pi.pid
+		fields["client_command"] = pi.command
+	}
+}
+
+// parseProcNetAddr parses an address in /proc/net/tcp such as
+// "0100007F:1F90".  IP addresses are printed as 32-bit words in the
+// byte order of the host, given by order.
+func parseProcNetAddr(s string, order binary.ByteOrder) (*net.TCPAddr, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid address: %s", s)
+	}
+	b, err := hex.DecodeString(s[:i])
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, fmt.Errorf("invalid address: %s", s)
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %s", s)
+	}
+
+	ip := make(net.IP, len(b))
+	for j := 0; j < len(b); j += 4 {
+		order.PutUint32(ip[j:], binary.BigEndian.Uint32(b[j:]))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// findProcNetTCP finds the socket bound to addr in r, the contents of
+// /proc/net/tcp or /proc/net/tcp6, and returns its UID and inode.
+func findProcNetTCP(r io.Reader, order binary.ByteOrder, addr *net.TCPAddr) (int, uint64, error) {
+	s := bufio.NewScanner(r)
+	// skip the header line.
+	s.Scan()
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		local, err := parseProcNetAddr(fields[1], order)
+		if err != nil {
+			return 0, 0, err
+		}
+		if local.Port != addr.Port || !local.IP.Equal(addr.IP) {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid uid: %s", fields[7])
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid inode: %s", fields[9])
+		}
+		return uid, inode, nil
+	}
+	if err := s.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, errSocketNotFound
+}
+
+// compileUsers converts user names or numeric UIDs into UIDs.
+func compileUsers(users []string) ([]int, error) {
+	var uids []int
+	for _, u := range users {
+		if uid, err := strconv.Atoi(u); err == nil && uid >= 0 {
+			uids = append(uids, uid)
+			continue
+		}
+		usr, err := user.Lookup(u)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.Atoi(usr.Uid)
+		if err != nil {
+			return nil, fmt.Errorf("non-numeric uid of %s: %s", u, usr.Uid)
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
@@ -0,0 +1,88 @@
+// +build linux
+
+package transocks
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var procNetTCPFiles = []string{"/proc/net/tcp", "/proc/net/tcp6"}
+
+// nativeOrder returns the byte order of the host.
+func nativeOrder() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// lookupProcess returns the owner of the local socket bound to client.
+// If findPID is true, processes of the owner are searched for the
+// socket to find PID and command.
+func lookupProcess(client *net.TCPAddr, findPID bool) (*processInfo, error) {
+	order := nativeOrder()
+	for _, name := range procNetTCPFiles {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		uid, inode, err := findProcNetTCP(f, order, client)
+		f.Close()
+		if err == errSocketNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		pi := &processInfo{uid: uid}
+		if findPID {
+			pi.pid = findSocketOwner(uid, inode)
+		}
+		if pi.pid > 0 {
+			comm, _ := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pi.pid), "comm"))
+			pi.command = strings.TrimSpace(string(comm))
+		}
+		return pi, nil
+	}
+	return nil, errSocketNotFound
+}
+
+// findSocketOwner returns PID of a process of uid having the socket
+// of inode, or zero if not found.
+func findSocketOwner(uid int, inode uint64) int {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	link := "socket:[" + strconv.FormatUint(inode, 10) + "]"
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil || !d.IsDir() {
+			continue
+		}
+		if st, ok := d.Sys().(*syscall.Stat_t); ok && int(st.Uid) != uid {
+			continue
+		}
+		fdDir := filepath.Join("/proc", d.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if l, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && l == link {
+				return pid
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,39 @@
+// +build linux
+
+package transocks
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestLookupProcess(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pi, err := lookupProcess(conn.LocalAddr().(*net.TCPAddr), true)
+	if err != nil {
+		t.Skip("/proc/net/tcp is not available:", err)
+	}
+	if pi.uid != os.Getuid() {
+		t.Error("unexpected uid:", pi.uid)
+	}
+	if pi.pid != os.Getpid() {
+		t.Error("unexpected pid:", pi.pid)
+	}
+	if len(pi.command) == 0 {
+		t.Error("command should be found")
+	}
+}
@@ -0,0 +1,14 @@
+// +build !linux
+
+package transocks
+
+import (
+	"errors"
+	"net"
+)
+
+// Owners of sockets are found only on Linux.
+
+func lookupProcess(client *net.TCPAddr, findPID bool) (*processInfo, error) {
+	return nil, errors.New("process lookup is not supported")
+}
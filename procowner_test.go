@@ -0,0 +1,90 @@
+package transocks
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+const testProcNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:0438 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 11111 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:D431 0100007F:0438 01 00000000:00000000 00:00000000 00000000  1000        0 22222 1 0000000000000000 20 4 30 10 -1
+`
+
+const testProcNetTCP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0000000000000000FFFF00000100007F:D432 0000000000000000FFFF00000100007F:0438 01 00000000:00000000 00:00000000 00000000  1001        0 33333 1 0000000000000000 20 4 30 10 -1
+   1: B80D0120000000000000000001000000:D433 B80D0120000000000000000002000000:01BB 01 00000000:00000000 00:00000000 00000000  1002        0 44444 1 0000000000000000 20 4 30 10 -1
+`
+
+func TestParseProcNetAddr(t *testing.T) {
+	t.Parallel()
+
+	addr, err := parseProcNetAddr("0100007F:1F90", binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.IP.Equal(net.ParseIP("127.0.0.1")) || addr.Port != 8080 {
+		t.Error("unexpected address:", addr)
+	}
+
+	addr, err = parseProcNetAddr("7F000001:1F90", binary.BigEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Error("unexpected address:", addr)
+	}
+
+	for _, s := range []string{"0100007F", "01007F:0050", "0100007F:XYZ"} {
+		if _, err := parseProcNetAddr(s, binary.LittleEndian); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestFindProcNetTCP(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		data  string
+		addr  string
+		uid   int
+		inode uint64
+	}{
+		{testProcNetTCP, "127.0.0.1:54321", 1000, 22222},
+		{testProcNetTCP6, "127.0.0.1:54322", 1001, 33333},
+		{testProcNetTCP6, "[2001:db8::1]:54323", 1002, 44444},
+	}
+	for _, tc := range testCases {
+		addr, _ := net.ResolveTCPAddr("tcp", tc.addr)
+		uid, inode, err := findProcNetTCP(strings.NewReader(tc.data), binary.LittleEndian, addr)
+		if err != nil {
+			t.Error(tc.addr, err)
+			continue
+		}
+		if uid != tc.uid || inode != tc.inode {
+			t.Errorf("unexpected socket for %s: %d %d", tc.addr, uid, inode)
+		}
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:1")
+	if _, _, err := findProcNetTCP(strings.NewReader(testProcNetTCP), binary.LittleEndian, addr); err != errSocketNotFound {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestCompileUsers(t *testing.T) {
+	t.Parallel()
+
+	uids, err := compileUsers([]string{"0", "1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uids) != 2 || uids[0] != 0 || uids[1] != 1000 {
+		t.Error("unexpected uids:", uids)
+	}
+	if _, err := compileUsers([]string{"no-such-user-for-transocks"}); err == nil {
+		t.Error("unknown user should be an error")
+	}
+}
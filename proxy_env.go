@@ -0,0 +1,75 @@
+package transocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// getenvAny returns the value of the first non-empty environment variable
+// in names.
+func getenvAny(getenv func(string) string, names ...string) string {
+	for _, name := range names {
+		if v := getenv(name); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// LoadProxyEnvironment sets ProxyURL and adds Bypass entries from
+// the standard proxy environment variables.
+//
+// ProxyURL is taken from https_proxy, http_proxy, or all_proxy in this
+// order as transocks tunnels any protocols.  Upper case names are also
+// accepted.  Values without a scheme, such as "proxy:3128", are treated
+// as HTTP proxies.
+//
+// Host names and addresses in no_proxy are added to Bypass.
+// Port numbers in no_proxy are ignored.
+func (c *Config) LoadProxyEnvironment() error {
+	return c.loadProxyEnvironment(os.Getenv)
+}
+
+func (c *Config) loadProxyEnvironment(getenv func(string) string) error {
+	s := getenvAny(getenv,
+		"https_proxy", "HTTPS_PROXY",
+		"http_proxy", "HTTP_PROXY",
+		"all_proxy", "ALL_PROXY")
+	if len(s) == 0 {
+		return errors.New("no proxy environment variable is set")
+	}
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		// url.Error contains the whole URL that may include a password.
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return fmt.Errorf("invalid proxy environment variable: %v", err)
+	}
+	c.ProxyURL = u
+
+	noProxy := getenvAny(getenv, "no_proxy", "NO_PROXY")
+	for _, e := range strings.Split(noProxy, ",") {
+		e = strings.TrimSpace(e)
+		switch {
+		case len(e) == 0:
+			continue
+		case e == "*":
+			c.Bypass = append(c.Bypass, "0.0.0.0/0", "::/0")
+			continue
+		}
+
+		if host, _, err := net.SplitHostPort(e); err == nil {
+			e = host
+		}
+		c.Bypass = append(c.Bypass, strings.Trim(e, "[]"))
+	}
+	return nil
+}
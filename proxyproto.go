@@ -0,0 +1,150 @@
+package transocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// This file implements PROXY protocol version 1 and 2 receivers.
+// See https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+const (
+	// maxProxyV1HeaderSize is the maximum length of v1 header lines
+	// including CRLF.
+	maxProxyV1HeaderSize = 107
+
+	proxyV2HeaderSize = 16
+	proxyV2Version    = 0x20
+	proxyV2CmdLocal   = 0x00
+	proxyV2CmdProxy   = 0x01
+	proxyV2FamTCP4    = 0x11
+	proxyV2FamTCP6    = 0x21
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol header from r and returns
+// the source and destination addresses in it.  If the header does not
+// carry addresses, such as "PROXY UNKNOWN" or LOCAL command, both are
+// nil.  r is not read beyond the header.
+func readProxyHeader(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	buf := make([]byte, 6, proxyV2HeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case string(buf) == "PROXY ":
+		return readProxyV1(r)
+	case bytes.Equal(buf, proxyV2Signature[:6]):
+		buf = buf[:proxyV2HeaderSize]
+		if _, err := io.ReadFull(r, buf[6:]); err != nil {
+			return nil, nil, err
+		}
+		return readProxyV2(r, buf)
+	}
+	return nil, nil, errors.New("no PROXY protocol header")
+}
+
+func readProxyV1(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	line := make([]byte, 0, maxProxyV1HeaderSize)
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) == maxProxyV1HeaderSize-len("PROXY \n") {
+			return nil, nil, errors.New("too long PROXY protocol header")
+		}
+		line = append(line, b[0])
+	}
+	if len(line) == 0 || line[len(line)-1] != '\r' {
+		return nil, nil, errors.New("PROXY protocol header must end with CRLF")
+	}
+
+	f := strings.Split(string(line[:len(line)-1]), " ")
+	switch f[0] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, errors.New("unsupported PROXY protocol family: " + f[0])
+	}
+	if len(f) != 5 {
+		return nil, nil, errors.New("invalid PROXY protocol header")
+	}
+	src, err = parseProxyV1Addr(f[1], f[3])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err = parseProxyV1Addr(f[2], f[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("invalid address in PROXY protocol header: " + host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, errors.New("invalid port in PROXY protocol header: " + port)
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+func readProxyV2(r io.Reader, hdr []byte) (src, dst *net.TCPAddr, err error) {
+	if !bytes.Equal(hdr[:12], proxyV2Signature) {
+		return nil, nil, errors.New("no PROXY protocol header")
+	}
+	if hdr[12]&0xf0 != proxyV2Version {
+		return nil, nil, errors.New("unsupported PROXY protocol version")
+	}
+
+	// TLVs following addresses are read and discarded.
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch hdr[12] & 0x0f {
+	case proxyV2CmdLocal:
+		return nil, nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, nil, errors.New("unsupported PROXY protocol command")
+	}
+
+	var l int
+	switch hdr[13] {
+	case proxyV2FamTCP4:
+		l = net.IPv4len
+	case proxyV2FamTCP6:
+		l = net.IPv6len
+	default:
+		// UNSPEC, UDP, or unix sockets.
+		return nil, nil, nil
+	}
+	if len(body) < l*2+4 {
+		return nil, nil, errors.New("too short PROXY protocol addresses")
+	}
+	src = &net.TCPAddr{
+		IP:   net.IP(body[:l]),
+		Port: int(binary.BigEndian.Uint16(body[l*2:])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(body[l : l*2]),
+		Port: int(binary.BigEndian.Uint16(body[l*2+2:])),
+	}
+	return src, dst, nil
+}
@@ -0,0 +1,78 @@
+package transocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(cmd, fam byte, addrs []byte) []byte {
+	buf := append([]byte(nil), proxyV2Signature...)
+	buf = append(buf, proxyV2Version|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(buf[14:], uint16(len(addrs)))
+	return append(buf, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	tcp4 := []byte{
+		10, 1, 2, 3, // source
+		192, 168, 0, 1, // destination
+		0x30, 0x39, // 12345
+		0x01, 0xbb, // 443
+		0x04, 0x00, 0x01, 0x00, // TLV
+	}
+	tcp6 := make([]byte, 36)
+	copy(tcp6, net.ParseIP("2001:db8::1"))
+	copy(tcp6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(tcp6[32:], 12345)
+	binary.BigEndian.PutUint16(tcp6[34:], 80)
+
+	testCases := []struct {
+		input []byte
+		src   string
+		dst   string
+		valid bool
+	}{
+		{[]byte("PROXY TCP4 10.1.2.3 192.168.0.1 12345 443\r\n"), "10.1.2.3:12345", "192.168.0.1:443", true},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 80\r\n"), "[2001:db8::1]:12345", "[2001:db8::2]:80", true},
+		{[]byte("PROXY UNKNOWN\r\n"), "", "", true},
+		{[]byte("PROXY TCP4 10.1.2.3 192.168.0.1 12345\r\n"), "", "", false},
+		{[]byte("PROXY TCP4 10.1.2.3 192.168.0.1 12345 443\n"), "", "", false},
+		{[]byte("PROXY TCP4 " + string(bytes.Repeat([]byte("1"), 120)) + "\r\n"), "", "", false},
+		{proxyV2Header(proxyV2CmdProxy, proxyV2FamTCP4, tcp4), "10.1.2.3:12345", "192.168.0.1:443", true},
+		{proxyV2Header(proxyV2CmdProxy, proxyV2FamTCP6, tcp6), "[2001:db8::1]:12345", "[2001:db8::2]:80", true},
+		{proxyV2Header(proxyV2CmdLocal, 0, nil), "", "", true},
+		{proxyV2Header(proxyV2CmdProxy, proxyV2FamTCP6, tcp4), "", "", false},
+		{[]byte("GET / HTTP/1.1\r\n"), "", "", false},
+	}
+
+	for i, tc := range testCases {
+		r := bytes.NewReader(append(tc.input, "data"...))
+		src, dst, err := readProxyHeader(r)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%d: %q should be invalid", i, tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if len(tc.src) == 0 {
+			if src != nil || dst != nil {
+				t.Errorf("%d: addresses should be nil: %v %v", i, src, dst)
+			}
+		} else if src.String() != tc.src || dst.String() != tc.dst {
+			t.Errorf("%d: unexpected addresses: %v %v", i, src, dst)
+		}
+		rest, _ := ioutil.ReadAll(r)
+		if string(rest) != "data" {
+			t.Errorf("%d: unexpected rest: %q", i, rest)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package transocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// This file finds TLS server names in QUIC Initial packets.
+//
+// Initial packets are protected by keys derived from the destination
+// connection ID chosen by the client (RFC 9001 Section 5.2), so
+// anyone on the path can decrypt them.  The ClientHello is carried in
+// CRYPTO frames of the first Initial packets.
+//
+// Only the first datagram of a flow is examined.  If the ClientHello
+// spans multiple packets and the server_name extension is not in the
+// first one, no name is found.
+
+const (
+	quicVersion1       = 0x00000001
+	quicHPSampleSize   = 16
+	quicInitialKeySize = 16
+	quicInitialIVSize  = 12
+)
+
+var quicV1InitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+var errNotQUICInitial = errors.New("not a QUIC Initial packet")
+
+// quicReader reads QUIC variable-length fields from a byte slice.
+type quicReader struct {
+	b   []byte
+	err error
+}
+
+func (r *quicReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *quicReader) byte() byte {
+	p := r.bytes(1)
+	if p == nil {
+		return 0
+	}
+	return p[0]
+}
+
+func (r *quicReader) uint16() uint16 {
+	p := r.bytes(2)
+	if p == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(p)
+}
+
+func (r *quicReader) uint32() uint32 {
+	p := r.bytes(4)
+	if p == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(p)
+}
+
+// varint reads a variable-length integer (RFC 9000 Section 16).
+func (r *quicReader) varint() uint64 {
+	if r.err != nil || len(r.b) == 0 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	p := r.bytes(1 << (r.b[0] >> 6))
+	if p == nil {
+		return 0
+	}
+	v := uint64(p[0] & 0x3f)
+	for _, c := range p[1:] {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// hkdfExtract implements HKDF-Extract with SHA-256 (RFC 5869).
+// golang.org/x/crypto/hkdf provides only Extract and Expand combined.
+func hkdfExtract(secret, salt []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label of TLS 1.3 with SHA-256.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	// HKDF-Expand
+	var out, t []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+// decryptQUICInitial removes the protection of a client Initial
+// packet and returns its payload.
+func decryptQUICInitial(packet []byte) ([]byte, error) {
+	r := &quicReader{b: packet}
+	first := r.byte()
+	version := r.uint32()
+	if r.err != nil || first&0xc0 != 0xc0 || version != quicVersion1 || first&0x30 != 0 {
+		return nil, errNotQUICInitial
+	}
+	dcid := r.bytes(int(r.byte()))
+	r.bytes(int(r.byte())) // source connection ID
+	r.bytes(int(r.varint()))
+	length := r.varint()
+	if r.err != nil {
+		return nil, r.err
+	}
+	pnOffset := len(packet) - len(r.b)
+	if length > uint64(len(r.b)) || length < 4+quicHPSampleSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	secret := hkdfExtract(dcid, quicV1InitialSalt)
+	clientSecret := hkdfExpandLabel(secret, "client in", sha256.Size)
+	key := hkdfExpandLabel(clientSecret, "quic key", quicInitialKeySize)
+	iv := hkdfExpandLabel(clientSecret, "quic iv", quicInitialIVSize)
+	hp := hkdfExpandLabel(clientSecret, "quic hp", quicInitialKeySize)
+
+	// The header is modified to remove protection, so work on a copy.
+	pkt := append([]byte(nil), packet[:pnOffset+int(length)]...)
+
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, pkt[pnOffset+4:pnOffset+4+quicHPSampleSize])
+	pkt[0] ^= mask[0] & 0x0f
+	pnLen := int(pkt[0]&0x03) + 1
+
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < pnLen; i++ {
+		pkt[pnOffset+i] ^= mask[1+i]
+		nonce[len(nonce)-pnLen+i] ^= pkt[pnOffset+i]
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hdrLen := pnOffset + pnLen
+	return aead.Open(nil, nonce, pkt[hdrLen:], pkt[:hdrLen])
+}
+
+// quicCryptoData returns the contiguous data of CRYPTO frames in
+// payload from offset zero.
+func quicCryptoData(payload []byte) []byte {
+	chunks := make(map[uint64][]byte)
+	r := &quicReader{b: payload}
+loop:
+	for len(r.b) > 0 && r.err == nil {
+		switch r.varint() {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x06: // CRYPTO
+			offset := r.varint()
+			data := r.bytes(int(r.varint()))
+			if r.err == nil {
+				chunks[offset] = data
+			}
+		default:
+			// Other frames are not expected in the first Initial packet.
+			break loop
+		}
+	}
+
+	var data []byte
+	for {
+		chunk, ok := chunks[uint64(len(data))]
+		if !ok || len(chunk) == 0 {
+			return data
+		}
+		data = append(data, chunk...)
+	}
+}
+
+// clientHelloExtension returns the data of the extension of typ in a
+// ClientHello handshake message.  hello may be truncated as long as it
+// includes the extension.
+func clientHelloExtension(hello []byte, typ uint16) ([]byte, error) {
+	r := &quicReader{b: hello}
+	if r.byte() != 1 { // client_hello
+		return nil, errors.New("not a ClientHello")
+	}
+	r.bytes(3 + 2 + 32) // length, legacy_version, random
+	r.bytes(int(r.byte()))
+	r.bytes(int(r.uint16()))
+	r.bytes(int(r.byte()))
+	r.bytes(2) // length of extensions
+	for r.err == nil {
+		t := r.uint16()
+		data := r.bytes(int(r.uint16()))
+		if r.err == nil && t == typ {
+			return data, nil
+		}
+	}
+	return nil, r.err
+}
+
+// clientHelloServerName returns server_name in a ClientHello handshake
+// message.  hello may be truncated as long as it includes the extension.
+func clientHelloServerName(hello []byte) (string, error) {
+	data, err := clientHelloExtension(hello, 0) // server_name
+	if err != nil {
+		return "", err
+	}
+
+	ext := &quicReader{b: data}
+	ext.bytes(2) // length of server_name_list
+	for ext.err == nil {
+		nameType := ext.byte()
+		name := ext.bytes(int(ext.uint16()))
+		if ext.err == nil && nameType == 0 { // host_name
+			return string(name), nil
+		}
+	}
+	return "", ext.err
+}
+
+// quicServerName returns the TLS server name in a QUIC Initial packet.
+func quicServerName(packet []byte) (string, error) {
+	payload, err := decryptQUICInitial(packet)
+	if err != nil {
+		return "", err
+	}
+	return clientHelloServerName(quicCryptoData(payload))
+}
@@ -0,0 +1,123 @@
+package transocks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// sealQUICInitial makes a client Initial packet carrying crypto data
+// split into two CRYPTO frames in reverse order.
+func sealQUICInitial(t *testing.T, dcid, crypto []byte) []byte {
+	half := len(crypto) / 2
+	payload := []byte{0x06, 0x40 | byte(half>>8), byte(half)}
+	payload = append(payload, 0x40|byte((len(crypto)-half)>>8), byte(len(crypto)-half))
+	payload = append(payload, crypto[half:]...)
+	payload = append(payload, 0x06, 0x00, 0x40|byte(half>>8), byte(half))
+	payload = append(payload, crypto[:half]...)
+	// Pad with PADDING frames like clients do.  ClientHello with large
+	// key shares needs no padding.
+	if len(payload) < 1100 {
+		payload = append(payload, make([]byte, 1100-len(payload))...)
+	}
+
+	pn := []byte{0x00, 0x02}
+	length := len(pn) + len(payload) + 16
+	hdr := []byte{0xc1, 0, 0, 0, 1, byte(len(dcid))}
+	hdr = append(hdr, dcid...)
+	hdr = append(hdr, 0, 0, 0x40|byte(length>>8), byte(length))
+	pnOffset := len(hdr)
+	hdr = append(hdr, pn...)
+
+	secret := hkdfExtract(dcid, quicV1InitialSalt)
+	clientSecret := hkdfExpandLabel(secret, "client in", sha256.Size)
+	block, err := aes.NewCipher(hkdfExpandLabel(clientSecret, "quic key", 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := hkdfExpandLabel(clientSecret, "quic iv", 12)
+	nonce[10] ^= pn[0]
+	nonce[11] ^= pn[1]
+	pkt := aead.Seal(hdr, nonce, payload, hdr)
+
+	hpBlock, err := aes.NewCipher(hkdfExpandLabel(clientSecret, "quic hp", 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask := make([]byte, 16)
+	hpBlock.Encrypt(mask, pkt[pnOffset+4:pnOffset+20])
+	pkt[0] ^= mask[0] & 0x0f
+	pkt[pnOffset] ^= mask[1]
+	pkt[pnOffset+1] ^= mask[2]
+	return pkt
+}
+
+func TestQUICInitialKeys(t *testing.T) {
+	t.Parallel()
+
+	// RFC 9001 Appendix A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	secret := hkdfExtract(dcid, quicV1InitialSalt)
+	clientSecret := hkdfExpandLabel(secret, "client in", sha256.Size)
+	testCases := []struct {
+		label    string
+		length   int
+		expected string
+	}{
+		{"quic key", 16, "1f369613dd76d5467730efcbe3b1a22d"},
+		{"quic iv", 12, "fa044b2f42a3fd3b46fb255c"},
+		{"quic hp", 16, "9f50449e04a0e810283a1e9933adedd2"},
+	}
+	for _, tc := range testCases {
+		v := hex.EncodeToString(hkdfExpandLabel(clientSecret, tc.label, tc.length))
+		if v != tc.expected {
+			t.Errorf("%s = %s, expected %s", tc.label, v, tc.expected)
+		}
+	}
+}
+
+func TestQUICServerName(t *testing.T) {
+	t.Parallel()
+
+	// Strip the TLS record header.
+	hello := clientHello(t, "www.example.com")[5:]
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	pkt := sealQUICInitial(t, dcid, hello)
+	orig := append([]byte(nil), pkt...)
+
+	name, err := quicServerName(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "www.example.com" {
+		t.Error("unexpected server name:", name)
+	}
+	if !bytes.Equal(pkt, orig) {
+		t.Error("packet should not be modified")
+	}
+
+	// truncated ClientHello
+	pkt = sealQUICInitial(t, dcid, hello[:len(hello)-10])
+	name, err = quicServerName(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "www.example.com" {
+		t.Error("unexpected server name for truncated ClientHello:", name)
+	}
+
+	if _, err := quicServerName([]byte("\x40not a long header packet")); err == nil {
+		t.Error("short header packet should be rejected")
+	}
+	pkt[len(pkt)-1] ^= 1
+	if _, err := quicServerName(pkt); err == nil {
+		t.Error("broken packet should be rejected")
+	}
+}
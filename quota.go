@@ -0,0 +1,308 @@
+package transocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// This file implements quotas of bytes transferred by each client.
+
+// Quota limits bytes sent and received by each client address in
+// a day or a month in local time.
+type Quota struct {
+	// Clients is a list of IP addresses or CIDR networks of clients
+	// to which this quota applies.  If empty, it applies to all clients.
+	Clients []string
+
+	// Daily is the maximum bytes for a client in a day.
+	// Zero means no limit.
+	Daily int64
+
+	// Monthly is the maximum bytes for a client in a month.
+	// Zero means no limit.
+	Monthly int64
+
+	// RateLimit is the bytes per second relayed in each direction for
+	// clients that have exhausted this quota.  If zero, connections
+	// from such clients are reset.
+	RateLimit int64
+}
+
+// QuotaUsage is a snapshot of bytes transferred by a client.
+type QuotaUsage struct {
+	// Client is the IP address of the client.
+	Client string
+
+	// Daily is the bytes transferred today.
+	Daily int64
+
+	// Monthly is the bytes transferred this month.
+	Monthly int64
+
+	// Exhausted is true if the client has exhausted its quota.
+	Exhausted bool
+}
+
+type quota struct {
+	networks []*net.IPNet
+	daily    int64
+	monthly  int64
+	throttle *throttle
+}
+
+type clientUsage struct {
+	quota   *quota
+	day     string
+	daily   int64
+	monthly int64
+}
+
+// quotas counts bytes of clients for Config.Quotas.  Counters are kept
+// in memory and lost on restart.  A nil quotas has no limits.
+type quotas struct {
+	list []*quota
+
+	mu    sync.Mutex
+	month string
+	usage map[string]*clientUsage
+}
+
+func compileQuotas(qs []*Quota) (*quotas, error) {
+	if len(qs) == 0 {
+		return nil, nil
+	}
+	t := &quotas{usage: make(map[string]*clientUsage)}
+	for _, q := range qs {
+		if q.Daily < 0 || q.Monthly < 0 || q.RateLimit < 0 {
+			return nil, fmt.Errorf("negative quota: %+v", *q)
+		}
+		if q.Daily == 0 && q.Monthly == 0 {
+			return nil, fmt.Errorf("quota without limits: %v", q.Clients)
+		}
+		cq := &quota{daily: q.Daily, monthly: q.Monthly}
+		for _, c := range q.Clients {
+			n, err := parseNetwork(c)
+			if err != nil {
+				return nil, err
+			}
+			cq.networks = append(cq.networks, n)
+		}
+		if q.RateLimit > 0 {
+			th, err := newThrottle(q.RateLimit, 0, 0)
+			if err != nil {
+				return nil, err
+			}
+			cq.throttle = th
+		}
+		t.list = append(t.list, cq)
+	}
+	return t, nil
+}
+
+// find returns the first quota for the client at ip, or nil.
+func (t *quotas) find(ip net.IP) *quota {
+	if t == nil || ip == nil {
+		return nil
+	}
+	for _, q := range t.list {
+		if len(q.networks) == 0 || matchNetworks(q.networks, ip) {
+			return q
+		}
+	}
+	return nil
+}
+
+// rollover forgets clients of past months.  t.mu must be locked.
+func (t *quotas) rollover(now time.Time) {
+	if month := now.Format("2006-01"); month != t.month {
+		t.month = month
+		t.usage = make(map[string]*clientUsage)
+	}
+}
+
+// get returns the usage of key for now, resetting counters of past
+// days and months.  t.mu must be locked.
+func (t *quotas) get(key string, q *quota, now time.Time) *clientUsage {
+	t.rollover(now)
+	day := now.Format("2006-01-02")
+	u, ok := t.usage[key]
+	if !ok {
+		u = &clientUsage{quota: q, day: day}
+		t.usage[key] = u
+	}
+	if u.day != day {
+		u.day = day
+		u.daily = 0
+	}
+	return u
+}
+
+func (u *clientUsage) exhausted() bool {
+	return (u.quota.daily > 0 && u.daily >= u.quota.daily) ||
+		(u.quota.monthly > 0 && u.monthly >= u.quota.monthly)
+}
+
+// exhausted returns true if the client at ip has exhausted q.
+func (t *quotas) exhausted(ip net.IP, q *quota, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.get(ip.String(), q, now).exhausted()
+}
+
+// add adds n bytes to the usage of the client at ip, and returns true
+// if the client has exhausted q.
+func (t *quotas) add(ip net.IP, q *quota, n int64, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u := t.get(ip.String(), q, now)
+	u.daily += n
+	u.monthly += n
+	return u.exhausted()
+}
+
+var errQuotaExhausted = errors.New("quota exhausted")
+
+// quotaMeter counts bytes of a connection toward the quota of the
+// client while relaying, so that long-lived connections cannot exceed
+// the quota.  When the quota is exhausted, the connection is throttled
+// by the rate limit of the quota, or closed by stop if it has none.
+// Methods of a nil quotaMeter do nothing.
+type quotaMeter struct {
+	t    *quotas
+	ip   net.IP
+	q    *quota
+	stop func()
+
+	mu sync.Mutex
+	// limited is true if the connection has been throttled since
+	// it was accepted, or cb is set.
+	limited bool
+	key     string
+	cb      *clientBuckets
+	once    sync.Once
+}
+
+// meter returns a quotaMeter for a connection from ip.  limited should
+// be true if the connection is already throttled for q.  stop is called
+// once when q is exhausted and q has no rate limit.
+func (t *quotas) meter(ip net.IP, q *quota, limited bool, stop func()) *quotaMeter {
+	if q == nil {
+		return nil
+	}
+	return &quotaMeter{t: t, ip: ip, q: q, limited: limited, stop: stop}
+}
+
+// count adds n bytes, and returns the buckets to throttle the
+// connection if the quota has been exhausted.
+func (m *quotaMeter) count(n int) (*clientBuckets, error) {
+	if m == nil || n == 0 {
+		return nil, nil
+	}
+	if !m.t.add(m.ip, m.q, int64(n), time.Now()) {
+		return nil, nil
+	}
+	if m.q.throttle == nil {
+		m.once.Do(m.stop)
+		return nil, errQuotaExhausted
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cb == nil && !m.limited {
+		m.key, m.cb = m.q.throttle.acquire(m.ip)
+		m.limited = true
+	}
+	return m.cb, nil
+}
+
+func (m *quotaMeter) throttled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cb != nil
+}
+
+// release releases buckets acquired by count.
+func (m *quotaMeter) release() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cb != nil {
+		m.q.throttle.release(m.key)
+		m.cb = nil
+	}
+}
+
+// reader returns r that counts bytes read from r.  up is true for
+// bytes sent by the client.  If m is nil, r is returned as is to keep
+// splice(2) for TCP connections.
+func (m *quotaMeter) reader(ctx context.Context, r io.Reader, up bool) io.Reader {
+	if m == nil {
+		return r
+	}
+	return &meteredReader{ctx: ctx, r: r, m: m, up: up}
+}
+
+type meteredReader struct {
+	ctx context.Context
+	r   io.Reader
+	m   *quotaMeter
+	up  bool
+}
+
+func (mr *meteredReader) Read(p []byte) (int, error) {
+	if mr.m.throttled() {
+		if burst := int(mr.m.q.throttle.rate); len(p) > burst {
+			p = p[:burst]
+		}
+	}
+	n, err := mr.r.Read(p)
+	cb, cerr := mr.m.count(n)
+	if cerr != nil {
+		return n, cerr
+	}
+	if cb != nil {
+		b := cb.down
+		if mr.up {
+			b = cb.up
+		}
+		if serr := sleep(mr.ctx, b.take(n, time.Now())); serr != nil {
+			return n, serr
+		}
+	}
+	return n, err
+}
+
+func (t *quotas) stats(now time.Time) []QuotaUsage {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rollover(now)
+	stats := make([]QuotaUsage, 0, len(t.usage))
+	for key := range t.usage {
+		u := t.get(key, nil, now)
+		stats = append(stats, QuotaUsage{
+			Client:    key,
+			Daily:     u.daily,
+			Monthly:   u.monthly,
+			Exhausted: u.exhausted(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Client < stats[j].Client
+	})
+	return stats
+}
@@ -0,0 +1,116 @@
+package transocks
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotas(t *testing.T) {
+	t.Parallel()
+
+	qs, err := compileQuotas([]*Quota{
+		{Clients: []string{"10.0.0.0/8"}, Daily: 100, RateLimit: 10},
+		{Monthly: 150},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := net.ParseIP("10.1.2.3")
+	b := net.ParseIP("192.168.0.1")
+	qa, qb := qs.find(a), qs.find(b)
+	if qa == nil || qa.throttle == nil || qb == nil || qb.throttle != nil {
+		t.Fatal("unexpected quotas:", qa, qb)
+	}
+
+	day1 := time.Date(2018, 10, 31, 12, 0, 0, 0, time.Local)
+	day2 := day1.Add(24 * time.Hour)
+	day3 := day2.Add(24 * time.Hour)
+
+	qs.add(a, qa, 100, day1)
+	qs.add(b, qb, 100, day1)
+	if !qs.exhausted(a, qa, day1) {
+		t.Error("daily quota should be exhausted")
+	}
+	if qs.exhausted(b, qb, day1) {
+		t.Error("monthly quota should not be exhausted")
+	}
+
+	// 2018-11-01 begins a new day and a new month.
+	if qs.exhausted(a, qa, day2) {
+		t.Error("daily quota should be reset")
+	}
+	qs.add(b, qb, 100, day2)
+	qs.add(b, qb, 100, day3)
+	if !qs.exhausted(b, qb, day3) {
+		t.Error("monthly quota should be exhausted")
+	}
+
+	stats := qs.stats(day3)
+	if len(stats) != 2 {
+		t.Fatal("unexpected stats:", stats)
+	}
+	if s := stats[1]; s.Client != "192.168.0.1" || s.Daily != 100 || s.Monthly != 200 || !s.Exhausted {
+		t.Error("unexpected stats:", s)
+	}
+
+	if _, err := compileQuotas([]*Quota{{Clients: []string{"10.0.0.0/8"}}}); err == nil {
+		t.Error("quota without limits should be an error")
+	}
+	if _, err := compileQuotas([]*Quota{{Daily: -1}}); err == nil {
+		t.Error("negative quota should be an error")
+	}
+}
+
+func TestQuotaMeter(t *testing.T) {
+	t.Parallel()
+
+	qs, err := compileQuotas([]*Quota{
+		{Clients: []string{"10.0.0.0/8"}, Daily: 100, RateLimit: 1000},
+		{Daily: 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nilMeter *quotaMeter
+	r := strings.NewReader("data")
+	if nilMeter.reader(context.Background(), r, true) != r {
+		t.Error("nil meter should not wrap readers")
+	}
+
+	// A connection is throttled when the quota runs out while relaying.
+	a := net.ParseIP("10.1.2.3")
+	m := qs.meter(a, qs.find(a), false, nil)
+	if cb, err := m.count(60); cb != nil || err != nil {
+		t.Fatal("quota should not be exhausted:", cb, err)
+	}
+	data, err := ioutil.ReadAll(m.reader(context.Background(), strings.NewReader(strings.Repeat("x", 50)), true))
+	if err != nil || len(data) != 50 {
+		t.Fatal("unexpected read:", len(data), err)
+	}
+	if !m.throttled() {
+		t.Error("connection should be throttled")
+	}
+	m.release()
+	if len(qs.find(a).throttle.buckets) != 0 {
+		t.Error("buckets should be released")
+	}
+
+	// A connection is stopped if the quota has no rate limit.
+	b := net.ParseIP("192.168.0.1")
+	stopped := 0
+	m = qs.meter(b, qs.find(b), false, func() { stopped++ })
+	_, err = ioutil.ReadAll(m.reader(context.Background(), strings.NewReader(strings.Repeat("x", 150)), false))
+	if err != errQuotaExhausted {
+		t.Error("connection should be stopped:", err)
+	}
+	m.count(10)
+	if stopped != 1 {
+		t.Error("stop should be called once:", stopped)
+	}
+}
@@ -0,0 +1,91 @@
+package transocks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// This file looks up PTR records of destination addresses to log
+// names of connections without host names, such as those of clients
+// connecting to addresses in NAT mode.
+
+const (
+	// reverseDNSTimeout limits the time to wait for PTR lookups.
+	reverseDNSTimeout = 2 * time.Second
+
+	// reverseDNSTTL is the time to cache the results, including
+	// failures.
+	reverseDNSTTL = 10 * time.Minute
+
+	// reverseDNSCacheSize limits the number of cached addresses.
+	reverseDNSCacheSize = 4096
+)
+
+type reverseEntry struct {
+	name    string
+	expires time.Time
+}
+
+type reverseResolver struct {
+	resolver *net.Resolver
+
+	mu    sync.Mutex
+	cache map[string]reverseEntry
+}
+
+func newReverseResolver(resolver *net.Resolver) *reverseResolver {
+	return &reverseResolver{
+		resolver: resolver,
+		cache:    make(map[string]reverseEntry),
+	}
+}
+
+func (rr *reverseResolver) cached(key string, now time.Time) (string, bool) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	e, ok := rr.cache[key]
+	if !ok || now.After(e.expires) {
+		return "", false
+	}
+	return e.name, true
+}
+
+func (rr *reverseResolver) store(key, name string, now time.Time) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if len(rr.cache) >= reverseDNSCacheSize {
+		for k, e := range rr.cache {
+			if now.After(e.expires) {
+				delete(rr.cache, k)
+			}
+		}
+	}
+	if len(rr.cache) >= reverseDNSCacheSize {
+		rr.cache = make(map[string]reverseEntry)
+	}
+	rr.cache[key] = reverseEntry{name, now.Add(reverseDNSTTL)}
+}
+
+// lookup returns the name of ip, or an empty string if not found.
+// Names are validated by sanitizeHost not to inject garbage into logs.
+func (rr *reverseResolver) lookup(ctx context.Context, ip net.IP) string {
+	key := ip.String()
+	if name, ok := rr.cached(key, time.Now()); ok {
+		return name
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, reverseDNSTimeout)
+	defer cancel()
+
+	var name string
+	names, err := rr.resolver.LookupAddr(ctx, key)
+	if err == nil && len(names) > 0 {
+		name, _ = sanitizeHost(names[0])
+	}
+	rr.store(key, name, time.Now())
+	return name
+}
@@ -0,0 +1,32 @@
+package transocks
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReverseResolverCache(t *testing.T) {
+	t.Parallel()
+
+	rr := newReverseResolver(net.DefaultResolver)
+	now := time.Now()
+	rr.store("192.0.2.1", "www.example.com", now)
+	if name, ok := rr.cached("192.0.2.1", now); !ok || name != "www.example.com" {
+		t.Error("cached name should be found:", name)
+	}
+	if _, ok := rr.cached("192.0.2.1", now.Add(reverseDNSTTL+time.Second)); ok {
+		t.Error("expired name should not be found")
+	}
+	if name := rr.lookup(context.Background(), net.ParseIP("192.0.2.1")); name != "www.example.com" {
+		t.Error("lookup should use the cache:", name)
+	}
+
+	for i := 0; i < reverseDNSCacheSize; i++ {
+		rr.store(net.IPv4(10, 0, byte(i>>8), byte(i)).String(), "", now)
+	}
+	if len(rr.cache) > reverseDNSCacheSize {
+		t.Error("too many cached addresses:", len(rr.cache))
+	}
+}
@@ -0,0 +1,189 @@
+package transocks
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ruleset is the routing rules and access control lists of a server.
+// Server.Reload replaces it while connections are being relayed.
+type ruleset struct {
+	profile  *listenProfile
+	profiles []*listenProfile
+}
+
+// compileRuleset compiles rules and access control lists of c.
+// The GeoIP and ASN databases of old are reused if old is not nil.
+func compileRuleset(c *Config, old *ruleset) (*ruleset, error) {
+	bypass, err := compileBypass(c.Bypass)
+	if err != nil {
+		return nil, err
+	}
+	profile, needsCountry, err := newListenProfile(c.Addr, c.Mode, bypass, c.Rules, c.RewriteDest)
+	if err != nil {
+		return nil, err
+	}
+	rs := &ruleset{profile: profile}
+	for _, l := range c.Listeners {
+		rules := l.Rules
+		if rules == nil {
+			rules = c.Rules
+		}
+		p, nc, err := newListenProfile(l.Addr, l.mode(), bypass, rules, c.RewriteDest)
+		if err != nil {
+			return nil, err
+		}
+		rs.profiles = append(rs.profiles, p)
+		needsCountry = needsCountry || nc
+	}
+
+	var geoip *geoIP
+	if needsCountry {
+		if old != nil {
+			geoip = old.profile.geoip
+		}
+		if geoip == nil {
+			if len(c.GeoIPDatabase) == 0 {
+				return nil, errors.New("GeoIPDatabase is required for rules with countries")
+			}
+			geoip, err = openGeoIP(c.GeoIPDatabase)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	all := append([]*listenProfile{profile}, rs.profiles...)
+	var needsASN bool
+	for _, p := range all {
+		needsASN = needsASN || p.needsASN
+	}
+	var asnDB *geoIP
+	if needsASN {
+		if old != nil {
+			asnDB = old.profile.asnDB
+		}
+		if asnDB == nil {
+			if len(c.ASNDatabase) == 0 {
+				return nil, errors.New("ASNDatabase is required for rules with ASNs")
+			}
+			asnDB, err = openGeoIP(c.ASNDatabase)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	groups, err := compileClientGroups(c.ClientGroups)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range all {
+		if err := p.bindClientGroups(groups); err != nil {
+			return nil, err
+		}
+	}
+	acl, err := compileACL(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range all {
+		p.acl = acl
+		p.geoip = geoip
+		p.asnDB = asnDB
+	}
+	return rs, nil
+}
+
+// profileAt returns the profile of Config.Listeners[i], or that of
+// Config.Addr if i is negative.
+func (rs *ruleset) profileAt(i int) *listenProfile {
+	if i < 0 {
+		return rs.profile
+	}
+	return rs.profiles[i]
+}
+
+// feeds returns the blocklists of rs, or nil.
+func (rs *ruleset) feeds() *blocklists {
+	if rs.profile.acl == nil {
+		return nil
+	}
+	return rs.profile.acl.feeds
+}
+
+func (s *Server) ruleset() *ruleset {
+	return s.current.Load().(*ruleset)
+}
+
+// runFeeds fetches blocklists in background.  feeds may be nil.
+func (s *Server) runFeeds(feeds *blocklists) {
+	if feeds == nil {
+		return
+	}
+	feeds.logger = s.logger
+	s.goBackground(feeds.run)
+}
+
+// Reload replaces routing rules and access control lists with those in
+// c: Bypass, Rules, RewriteDest, Rules of Listeners, ClientGroups,
+// AllowClients, DenyClients, AllowPorts, AllowDomains, DenyDomains,
+// DomainsSchedule, BlocklistURLs, and BlocklistInterval.  Other fields
+// are ignored.  Files and ipsets of ClientGroups are read again.
+//
+// New connections use the new rules, and connections being relayed are
+// not affected.  Counters of Rule.RateLimit and Rule.MaxConnections
+// start from zero.  Addresses and modes of listeners cannot be changed,
+// and GeoIPDatabase and ASNDatabase are not reopened once rules with
+// countries or ASNs are used.  Upstreams are not rebuilt, so rules
+// can choose only upstreams that existed when s was created.
+func (s *Server) Reload(c *Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	old := s.ruleset()
+	changed := c.Addr != old.profile.addr || c.Mode != old.profile.mode ||
+		len(c.Listeners) != len(old.profiles)
+	for i := 0; !changed && i < len(c.Listeners); i++ {
+		changed = c.Listeners[i].Addr != old.profiles[i].addr ||
+			c.Listeners[i].mode() != old.profiles[i].mode
+	}
+	if changed {
+		return errors.New("listeners cannot be changed without restart")
+	}
+
+	rs, err := compileRuleset(c, old)
+	if err != nil {
+		return err
+	}
+	for _, p := range append([]*listenProfile{rs.profile}, rs.profiles...) {
+		for _, r := range p.rules {
+			switch r.upstream {
+			case UpstreamDirect, UpstreamBlock:
+				continue
+			}
+			if s.upstreams[r.upstream] == nil {
+				return fmt.Errorf("upstreams cannot be added without restart: %s", r.upstream)
+			}
+		}
+	}
+	// Blocklists are kept unless their URLs are changed, so that they
+	// are not fetched again.
+	feeds := old.feeds()
+	if feeds.sameAs(rs.feeds()) {
+		if feeds != nil {
+			rs.profile.acl.feeds = feeds
+		}
+	} else {
+		if feeds != nil {
+			feeds.stop()
+		}
+		s.runFeeds(rs.feeds())
+	}
+	s.current.Store(rs)
+
+	s.logger.Info("rules reloaded", nil)
+	return nil
+}
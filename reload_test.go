@@ -0,0 +1,68 @@
+package transocks
+
+import (
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/cybozu-go/log"
+)
+
+func TestServerReload(t *testing.T) {
+	t.Parallel()
+
+	logger := log.NewLogger()
+	logger.SetOutput(ioutil.Discard)
+	newConfig := func() *Config {
+		c := NewConfig()
+		c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1")
+		c.Logger = logger
+		c.Listeners = []*ListenerConfig{{Addr: "127.0.0.1:1082", Mode: ModeNAT}}
+		return c
+	}
+
+	c := newConfig()
+	s, err := NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs := s.ruleset(); len(rs.profile.rules) != 0 || rs.profile.acl != nil {
+		t.Fatal("unexpected rules")
+	}
+
+	c = newConfig()
+	c.Rules = []*Rule{{Domains: []string{".example.com"}, Upstream: UpstreamDirect}}
+	c.DenyDomains = []string{".example.org"}
+	if err := s.Reload(c); err != nil {
+		t.Fatal(err)
+	}
+	rs := s.ruleset()
+	for i := -1; i < 1; i++ {
+		p := rs.profileAt(i)
+		if len(p.rules) != 1 || p.acl == nil || !p.needsHost {
+			t.Error("rules are not reloaded for listener", i)
+		}
+	}
+
+	// Invalid rules and changes of listeners keep the current rules.
+	c = newConfig()
+	c.Rules = []*Rule{{Upstream: "unknown"}}
+	if err := s.Reload(c); err == nil {
+		t.Error("invalid rules should be an error")
+	}
+	c = newConfig()
+	c.Listeners[0].Addr = "127.0.0.1:1083"
+	if err := s.Reload(c); err == nil {
+		t.Error("changes of listeners should be an error")
+	}
+	c = newConfig()
+	office, _ := url.Parse("socks5://127.0.0.1:2")
+	c.Upstreams = map[string]*Upstream{"office": {ProxyURLs: []*url.URL{office}}}
+	c.Rules = []*Rule{{Domains: []string{".example.com"}, Upstream: "office"}}
+	if err := s.Reload(c); err == nil {
+		t.Error("rules with new upstreams should be an error")
+	}
+	if s.ruleset() != rs {
+		t.Error("rules should not be replaced")
+	}
+}
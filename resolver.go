@@ -0,0 +1,110 @@
+package transocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// This file implements the resolver for lookups by transocks itself,
+// such as host name checks, local resolution, reverse DNS, and
+// connections to DIRECT destinations and proxies.
+//
+// net.Resolver in pure Go speaks DNS over TCP to connections that are
+// not net.PacketConn, so DNS over TLS is just a TLS connection, and
+// DNS over HTTPS is a pseudo connection that exchanges each message
+// by an HTTP request.
+
+const defaultDoTPort = "853"
+
+// dohConn is a pseudo connection to exchange DNS messages over TCP
+// by DNS over HTTPS.
+type dohConn struct {
+	ex   dnsExchanger
+	wbuf bytes.Buffer
+	rbuf bytes.Buffer
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	c.wbuf.Write(p)
+	for c.wbuf.Len() >= 2 {
+		l := int(binary.BigEndian.Uint16(c.wbuf.Bytes()))
+		if c.wbuf.Len() < 2+l {
+			break
+		}
+		c.wbuf.Next(2)
+		resp, err := c.ex.exchange(c.wbuf.Next(l))
+		if err != nil {
+			return 0, err
+		}
+		if err := writeDNSMessage(&c.rbuf, resp); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *dohConn) Read(p []byte) (int, error) {
+	if c.rbuf.Len() == 0 {
+		return 0, errors.New("no DNS response")
+	}
+	return c.rbuf.Read(p)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return nil }
+func (c *dohConn) RemoteAddr() net.Addr               { return nil }
+func (c *dohConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// newResolver returns a resolver that sends queries to u.  The scheme
+// of u is "tcp" for DNS over TCP, "tls" for DNS over TLS, or "https"
+// for DNS over HTTPS.
+//
+// Servers are connected directly by the system resolver, so that
+// host names in u do not need themselves to be resolved.
+func newResolver(u *url.URL) (*net.Resolver, error) {
+	forward := &net.Dialer{Timeout: dnsTimeout}
+
+	var dial func(ctx context.Context) (net.Conn, error)
+	switch u.Scheme {
+	case "tcp":
+		dial = func(ctx context.Context) (net.Conn, error) {
+			return forward.DialContext(ctx, "tcp", u.Host)
+		}
+	case "tls":
+		addr := u.Host
+		if len(u.Port()) == 0 {
+			addr = net.JoinHostPort(u.Hostname(), defaultDoTPort)
+		}
+		config := &tls.Config{ServerName: u.Hostname()}
+		dial = func(ctx context.Context) (net.Conn, error) {
+			c, err := forward.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			return tls.Client(c, config), nil
+		}
+	case "https":
+		ex := newDNSHTTPS(u, forward)
+		dial = func(ctx context.Context) (net.Conn, error) {
+			return &dohConn{ex: ex}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported resolver: %s", u.Scheme)
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dial(ctx)
+		},
+	}, nil
+}
@@ -0,0 +1,88 @@
+package transocks
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func testResolver(t *testing.T, r *net.Resolver, p *fakeIPPool) {
+	addrs, err := r.LookupIPAddr(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 {
+		t.Fatal("unexpected addresses:", addrs)
+	}
+	if h, ok := p.host(addrs[0].IP); !ok || h != "www.example.com" {
+		t.Error("unexpected address:", addrs[0].IP)
+	}
+}
+
+func TestResolverTCP(t *testing.T) {
+	t.Parallel()
+
+	p, err := newFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &fakeIPExchanger{pool: p, next: echoExchanger{}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					q, err := readDNSMessage(c)
+					if err != nil {
+						return
+					}
+					resp, err := ex.exchange(q)
+					if err != nil {
+						return
+					}
+					writeDNSMessage(c, resp)
+				}
+			}()
+		}
+	}()
+
+	u, _ := url.Parse("tcp://" + l.Addr().String())
+	r, err := newResolver(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testResolver(t, r, p)
+
+	u, _ = url.Parse("udp://" + l.Addr().String())
+	if _, err := newResolver(u); err == nil {
+		t.Error("udp scheme should not be supported")
+	}
+}
+
+func TestResolverDoH(t *testing.T) {
+	t.Parallel()
+
+	p, err := newFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &fakeIPExchanger{pool: p, next: echoExchanger{}}
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &dohConn{ex: ex}, nil
+		},
+	}
+	testResolver(t, r, p)
+}
@@ -0,0 +1,9 @@
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package transocks
+
+import "errors"
+
+func setReusePort(fd int, network string) error {
+	return errors.New("SO_REUSEPORT is not supported")
+}
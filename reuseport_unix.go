@@ -0,0 +1,10 @@
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package transocks
+
+import "golang.org/x/sys/unix"
+
+// setReusePort sets SO_REUSEPORT to fd.
+func setReusePort(fd int, network string) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
@@ -0,0 +1,186 @@
+package transocks
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// rotatedTimeFormat is the suffix of rotated files.  It sorts in the
+// order of rotation.
+const rotatedTimeFormat = "20060102-150405.000"
+
+// rotatingFile is an access log file rotated by size or time.
+// Rotated files are renamed with the time of rotation, such as
+// "access.log.20240102-030405.000", and compressed by gzip optionally.
+type rotatingFile struct {
+	name       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	compress   bool
+	logger     *log.Logger
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+
+	// wg waits for compression and removal of rotated files, which
+	// are serialized by bg in the order of rotation.
+	wg sync.WaitGroup
+	bg sync.Mutex
+}
+
+func openRotatingFile(c *Config, logger *log.Logger) (*rotatingFile, error) {
+	r := &rotatingFile{
+		name:       c.AccessLogFile,
+		maxSize:    c.AccessLogMaxSize,
+		interval:   c.AccessLogRotateInterval,
+		maxBackups: c.AccessLogMaxBackups,
+		compress:   c.AccessLogCompress,
+		logger:     logger,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the file.  If the file exists, it is appended and
+// rotated by the time it was last modified.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	r.opened = time.Now()
+	if r.size > 0 {
+		r.opened = fi.ModTime()
+	}
+	return nil
+}
+
+// expired returns true if the file was opened in an earlier interval.
+// Intervals start at multiples of the interval since the zero time,
+// so a day starts at midnight in UTC.
+func (r *rotatingFile) expired(now time.Time) bool {
+	if r.interval <= 0 {
+		return false
+	}
+	return !now.Truncate(r.interval).Equal(r.opened.Truncate(r.interval))
+}
+
+// Write writes p to the file after rotating it if needed.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	full := r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize
+	if full || (r.size > 0 && r.expired(now)) {
+		if err := r.rotate(now); err != nil {
+			r.logger.Error("failed to rotate access log", map[string]interface{}{
+				"filename":  r.name,
+				log.FnError: err.Error(),
+			})
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file and opens a new one.  r.mu must be held.
+func (r *rotatingFile) rotate(now time.Time) error {
+	rotated := r.name + "." + now.Format(rotatedTimeFormat)
+	r.f.Close()
+	renamed := os.Rename(r.name, rotated)
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renamed != nil {
+		return renamed
+	}
+	r.opened = now
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.bg.Lock()
+		defer r.bg.Unlock()
+		if r.compress {
+			if err := gzipFile(rotated); err != nil {
+				r.logger.Error("failed to compress access log", map[string]interface{}{
+					"filename":  rotated,
+					log.FnError: err.Error(),
+				})
+			}
+		}
+		r.removeBackups()
+	}()
+	return nil
+}
+
+// gzipFile compresses name to name.gz and removes name.
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// removeBackups removes rotated files but the newest maxBackups.
+func (r *rotatingFile) removeBackups() {
+	if r.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(r.name + ".*")
+	if err != nil || len(backups) <= r.maxBackups {
+		return
+	}
+	sort.Strings(backups)
+	for _, name := range backups[:len(backups)-r.maxBackups] {
+		os.Remove(name)
+	}
+}
+
+// Close closes the file after compressing rotated files.
+func (r *rotatingFile) Close() error {
+	r.wg.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
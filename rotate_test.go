@@ -0,0 +1,138 @@
+package transocks
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+func TestRotatingFileSize(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "transocks-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewConfig()
+	c.AccessLogFile = filepath.Join(dir, "access.log")
+	c.AccessLogMaxSize = 10
+	c.AccessLogMaxBackups = 2
+	c.AccessLogCompress = true
+	r, err := openRotatingFile(c, log.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		// rotated files are named by milliseconds.
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(c.AccessLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "fourth\n" {
+		t.Errorf("unexpected content: %q", data)
+	}
+
+	backups, err := filepath.Glob(c.AccessLogFile + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(backups)
+	if len(backups) != 2 {
+		t.Fatal("unexpected backups:", backups)
+	}
+	for i, expected := range []string{"second\n", "third\n"} {
+		if filepath.Ext(backups[i]) != ".gz" {
+			t.Error("backup is not compressed:", backups[i])
+			continue
+		}
+		f, err := os.Open(backups[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("%s should have %q, but %q", backups[i], expected, data)
+		}
+	}
+}
+
+func TestRotatingFileInterval(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "transocks-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewConfig()
+	c.AccessLogFile = filepath.Join(dir, "access.log")
+	c.AccessLogRotateInterval = time.Hour
+	if err := ioutil.WriteFile(c.AccessLogFile, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(c.AccessLogFile, yesterday, yesterday); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openRotatingFile(c, log.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.expired(time.Now()) {
+		t.Error("file modified yesterday should be expired")
+	}
+	r.Write([]byte("new\n"))
+	r.Write([]byte("newer\n"))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(c.AccessLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new\nnewer\n" {
+		t.Errorf("unexpected content: %q", data)
+	}
+	backups, err := filepath.Glob(c.AccessLogFile + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatal("unexpected backups:", backups)
+	}
+	data, err = ioutil.ReadFile(backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "old\n" {
+		t.Errorf("unexpected backup: %q", data)
+	}
+}
@@ -0,0 +1,630 @@
+package transocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// UpstreamDefault is the name of the upstream consisting of
+	// Config.ProxyURL and Config.ProxyURLs.
+	UpstreamDefault = "default"
+
+	// UpstreamDirect is a special upstream name to connect destinations
+	// directly without proxies.
+	UpstreamDirect = "DIRECT"
+
+	// UpstreamBlock is a special upstream name to deny connections.
+	UpstreamBlock = "BLOCK"
+)
+
+// Values of Rule.Dest.
+const (
+	// DestHost sends host names found in client streams to upstreams.
+	DestHost = "host"
+
+	// DestOriginal sends original destination addresses to upstreams.
+	DestOriginal = "original"
+)
+
+// Values of Rule.Resolve.
+const (
+	// ResolveLocal makes transocks resolve host names and send
+	// addresses to upstreams.
+	ResolveLocal = "local"
+
+	// ResolveProxy sends host names to upstreams to be resolved.
+	ResolveProxy = "proxy"
+)
+
+// Rule is a routing rule to choose an upstream for connections.
+//
+// A rule matches a connection if all non-empty conditions match.
+// Each condition matches if any of its items matches.
+type Rule struct {
+	// Tag is a name of the rule.  It is logged as "rule" for
+	// connections matching the rule.  Connections matching
+	// Config.Bypass are logged with "bypass".
+	Tag string
+
+	// Domains is a list of domain name patterns matched against the host
+	// name found in TLS server name indication or HTTP Host header.
+	//
+	// "example.com" matches only "example.com".
+	// "*.example.com" matches subdomains of "example.com".
+	// ".example.com" matches both "example.com" and its subdomains.
+	// "~" followed by an RE2 regular expression like "~api[0-9]+\.example\.com"
+	// matches host names in lower case that the whole expression matches.
+	// Up to 256 regular expressions of up to 1024 bytes are allowed.
+	Domains []string
+
+	// Networks is a list of CIDR networks such as "10.0.0.0/8"
+	// matched against the original destination address.
+	Networks []string
+
+	// Ports is a list of destination ports or port ranges
+	// such as "443" or "8000-8999".
+	Ports []string
+
+	// Countries is a list of ISO 3166-1 alpha-2 country codes such as
+	// "JP" matched against the country of the original destination address.
+	// Config.GeoIPDatabase is required to use this.
+	Countries []string
+
+	// ASNs is a list of autonomous system numbers such as "AS15169" or
+	// "15169" matched against the AS of the original destination address.
+	// Config.ASNDatabase is required to use this.
+	ASNs []string
+
+	// ALPN is a list of application protocols such as "h2" matched
+	// against those offered in TLS ClientHello.  The condition matches
+	// if the client offers any of them.
+	ALPN []string
+
+	// Users is a list of user names or numeric UIDs matched against
+	// the owner of client sockets.  This works only on Linux for
+	// clients on the same host as transocks.
+	Users []string
+
+	// MACs is a list of MAC addresses such as "00:11:22:33:44:55", or
+	// their prefixes such as OUI "00:11:22", matched against the MAC
+	// address of the client found in the neighbor table.  This works
+	// only on Linux for TCP clients on the same link as transocks.
+	MACs []string
+
+	// ClientGroups is a list of names of Config.ClientGroups matched
+	// against the address of the client.  The condition matches if the
+	// client is in any of the groups.
+	ClientGroups []string
+
+	// Expr is an expression of conditions such as
+	//
+	//     host endsWith ".dev" && clientIP in 10.0.0.0/8
+	//
+	// Fields are host (or sni), country, asn, protocol, alpn, port, uid,
+	// clientIP, and destIP.  See README.md for operators.
+	Expr string
+
+	// Schedule is a list of time ranges in local time when the rule
+	// is effective, such as "Mon-Fri 09:00-18:00", "Sat,Sun", or
+	// "22:00-06:00".
+	Schedule []string
+
+	// Upstream is the name of an upstream in Config.Upstreams,
+	// UpstreamDefault, UpstreamDirect, or UpstreamBlock.
+	Upstream string
+
+	// BlockAction is the action for connections denied by UpstreamBlock.
+	// It is BlockReset, BlockDrop, BlockHTTP, BlockTLSAlert, or empty to
+	// follow Config.BlockAction.
+	BlockAction string
+
+	// Dest overrides Config.RewriteDest for connections matching
+	// the rule.  It is DestHost, DestOriginal, or empty to follow
+	// Config.RewriteDest.
+	Dest string
+
+	// Resolve overrides Config.ResolveLocally for connections matching
+	// the rule.  It is ResolveLocal, ResolveProxy, or empty to follow
+	// Config.ResolveLocally.
+	Resolve string
+
+	// RateLimit limits bytes per second relayed in each direction for
+	// connections matching the rule.  The limit is shared by
+	// connections from the same client.  Zero means no limit.
+	RateLimit int64
+
+	// RateLimitPrefix is the prefix length of IPv4 networks whose
+	// clients share RateLimit.  Zero means each address, or 32.
+	RateLimitPrefix int
+
+	// RateLimitPrefix6 is the prefix length of IPv6 networks whose
+	// clients share RateLimit.  Zero means each address, or 128.
+	RateLimitPrefix6 int
+
+	// MaxConnections limits connections matching the rule at once.
+	// Connections over the limit are reset.  Zero means no limit.
+	MaxConnections int
+}
+
+type portRange struct {
+	begin, end int
+}
+
+type rule struct {
+	tag       string
+	domains   domainSet
+	networks  []*net.IPNet
+	ports     []portRange
+	countries []string
+	asns      []int
+	alpn      []string
+	uids      []int
+	macs      [][]byte
+	groups    []string
+	clients   []*net.IPNet
+	expr      *expression
+	schedule  schedule
+	upstream  string
+	block     string
+	dest      string
+	resolve   string
+	throttle  *throttle
+	conns     *connCounter
+}
+
+func parsePortRange(s string) (portRange, error) {
+	var pr portRange
+
+	begin, end := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		begin, end = s[:i], s[i+1:]
+	}
+
+	var err error
+	pr.begin, err = strconv.Atoi(strings.TrimSpace(begin))
+	if err != nil {
+		return pr, fmt.Errorf("invalid port: %s", s)
+	}
+	pr.end, err = strconv.Atoi(strings.TrimSpace(end))
+	if err != nil {
+		return pr, fmt.Errorf("invalid port: %s", s)
+	}
+	if pr.begin < 1 || pr.end > 65535 || pr.begin > pr.end {
+		return pr, fmt.Errorf("invalid port range: %s", s)
+	}
+	return pr, nil
+}
+
+// normalizeHost lowers the case of a host name and removes the trailing dot.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// compileDomain validates and normalizes a domain name pattern.
+func compileDomain(d string) (string, error) {
+	if strings.HasPrefix(d, "~") {
+		return "", fmt.Errorf("regular expression is not allowed: %s", d)
+	}
+	d = normalizeHost(d)
+	if len(d) == 0 || strings.Contains(strings.TrimPrefix(d, "*."), "*") {
+		return "", fmt.Errorf("invalid domain pattern: %s", d)
+	}
+	return d, nil
+}
+
+// Limits of regular expressions in a list of domain name patterns.
+const (
+	maxDomainRegexps   = 256
+	maxDomainRegexpLen = 1024
+)
+
+// domainSet is a list of domain name patterns.  Patterns beginning
+// with "~" are RE2 regular expressions matched against whole host names.
+type domainSet struct {
+	patterns []string
+	regexps  []*regexp.Regexp
+}
+
+func compileDomainSet(list []string) (domainSet, error) {
+	var ds domainSet
+	for _, d := range list {
+		if !strings.HasPrefix(d, "~") {
+			p, err := compileDomain(d)
+			if err != nil {
+				return ds, err
+			}
+			ds.patterns = append(ds.patterns, p)
+			continue
+		}
+		if len(ds.regexps) >= maxDomainRegexps {
+			return ds, fmt.Errorf("too many regular expressions of domains: %d", len(list))
+		}
+		expr := d[1:]
+		if len(expr) == 0 || len(expr) > maxDomainRegexpLen {
+			return ds, fmt.Errorf("invalid length of regular expression: %d", len(expr))
+		}
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return ds, fmt.Errorf("invalid regular expression %q: %v", expr, err)
+		}
+		ds.regexps = append(ds.regexps, re)
+	}
+	return ds, nil
+}
+
+func (ds *domainSet) empty() bool {
+	return len(ds.patterns) == 0 && len(ds.regexps) == 0
+}
+
+// match returns true if host matches any pattern in ds.
+// host must be normalized by normalizeHost.
+func (ds *domainSet) match(host string) bool {
+	for _, p := range ds.patterns {
+		if matchDomain(p, host) {
+			return true
+		}
+	}
+	for _, re := range ds.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileRule(r *Rule) (*rule, error) {
+	if len(r.Upstream) == 0 {
+		return nil, errors.New("rule without upstream")
+	}
+	cr := &rule{
+		tag:      r.Tag,
+		upstream: r.Upstream,
+		block:    r.BlockAction,
+		dest:     r.Dest,
+		resolve:  r.Resolve,
+	}
+	if err := validateBlockAction(r.BlockAction); err != nil {
+		return nil, err
+	}
+	switch r.Dest {
+	case "", DestHost, DestOriginal:
+	default:
+		return nil, fmt.Errorf("invalid dest: %s", r.Dest)
+	}
+	switch r.Resolve {
+	case "", ResolveLocal, ResolveProxy:
+	default:
+		return nil, fmt.Errorf("invalid resolve: %s", r.Resolve)
+	}
+
+	domains, err := compileDomainSet(r.Domains)
+	if err != nil {
+		return nil, err
+	}
+	cr.domains = domains
+	for _, n := range r.Networks {
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, err
+		}
+		cr.networks = append(cr.networks, ipnet)
+	}
+	for _, p := range r.Ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		cr.ports = append(cr.ports, pr)
+	}
+	for _, c := range r.Countries {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if len(c) != 2 {
+			return nil, fmt.Errorf("invalid country code: %s", c)
+		}
+		cr.countries = append(cr.countries, c)
+	}
+	for _, a := range r.ASNs {
+		n, err := parseASN(a)
+		if err != nil {
+			return nil, err
+		}
+		cr.asns = append(cr.asns, n)
+	}
+	for _, a := range r.ALPN {
+		if len(a) == 0 || len(a) > 255 {
+			return nil, fmt.Errorf("invalid ALPN protocol: %q", a)
+		}
+		cr.alpn = append(cr.alpn, a)
+	}
+	uids, err := compileUsers(r.Users)
+	if err != nil {
+		return nil, err
+	}
+	cr.uids = uids
+	macs, err := compileMACs(r.MACs)
+	if err != nil {
+		return nil, err
+	}
+	cr.macs = macs
+	for _, g := range r.ClientGroups {
+		if len(g) == 0 {
+			return nil, errors.New("empty client group name")
+		}
+		cr.groups = append(cr.groups, g)
+	}
+	expr, err := compileExpr(r.Expr)
+	if err != nil {
+		return nil, err
+	}
+	cr.expr = expr
+	s, err := parseSchedule(r.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	cr.schedule = s
+	if r.MaxConnections < 0 {
+		return nil, fmt.Errorf("invalid max connections: %d", r.MaxConnections)
+	}
+	cr.conns = newConnCounter(r.MaxConnections)
+	if r.RateLimit < 0 {
+		return nil, fmt.Errorf("invalid rate limit: %d", r.RateLimit)
+	}
+	if r.RateLimit > 0 {
+		t, err := newThrottle(r.RateLimit, r.RateLimitPrefix, r.RateLimitPrefix6)
+		if err != nil {
+			return nil, err
+		}
+		cr.throttle = t
+	}
+	return cr, nil
+}
+
+// matchDomain returns true if host matches pattern.
+// host must be normalized by normalizeHost.
+func matchDomain(pattern, host string) bool {
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	case strings.HasPrefix(pattern, "."):
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	}
+	return host == pattern
+}
+
+func (r *rule) matchHost(host string) bool {
+	if r.domains.empty() {
+		return true
+	}
+	return len(host) > 0 && r.domains.match(host)
+}
+
+func (r *rule) matchIP(ip net.IP) bool {
+	if len(r.networks) == 0 {
+		return true
+	}
+	for _, n := range r.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchPort(port int) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, pr := range r.ports {
+		if pr.begin <= port && port <= pr.end {
+			return true
+		}
+	}
+	return false
+}
+
+// parseASN parses s as an AS number like "AS15169" or "15169".
+func parseASN(s string) (int, error) {
+	t := strings.TrimSpace(s)
+	if len(t) > 2 && strings.EqualFold(t[:2], "AS") {
+		t = t[2:]
+	}
+	n, err := strconv.ParseUint(t, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid AS number: %s", s)
+	}
+	return int(n), nil
+}
+
+func (r *rule) matchCountry(country string) bool {
+	if len(r.countries) == 0 {
+		return true
+	}
+	for _, c := range r.countries {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchALPN(alpn []string) bool {
+	if len(r.alpn) == 0 {
+		return true
+	}
+	for _, a := range r.alpn {
+		for _, p := range alpn {
+			if a == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *rule) matchUser(owner *processInfo) bool {
+	if len(r.uids) == 0 {
+		return true
+	}
+	if owner == nil {
+		return false
+	}
+	for _, u := range r.uids {
+		if u == owner.uid {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchASN(asn int) bool {
+	if len(r.asns) == 0 {
+		return true
+	}
+	for _, n := range r.asns {
+		if n == asn {
+			return true
+		}
+	}
+	return false
+}
+
+// matchClient returns true if ip is in r.clients, the members of
+// client groups bound by listenProfile.bindClientGroups.
+func (r *rule) matchClient(ip net.IP) bool {
+	if len(r.groups) == 0 {
+		return true
+	}
+	return ip != nil && matchNetworks(r.clients, ip)
+}
+
+func (r *rule) matchMAC(mac net.HardwareAddr) bool {
+	return len(r.macs) == 0 || matchMAC(r.macs, mac)
+}
+
+// connInfo is a connection to be matched against rules.
+type connInfo struct {
+	// host is the host name normalized by normalizeHost,
+	// or empty if not known.
+	host string
+
+	// country is the country of the destination, or empty.
+	country string
+
+	// asn is the autonomous system number of the destination, or zero.
+	asn int
+
+	// alpn is the list of protocols offered in TLS ClientHello.
+	alpn []string
+
+	// protocol is the protocol found in the client stream, or empty.
+	protocol string
+
+	// owner is the owner of the local client socket, or nil.
+	owner *processInfo
+
+	// clientIP is the address of the client, or nil.
+	clientIP net.IP
+
+	// mac is the MAC address of the client, or nil.
+	mac net.HardwareAddr
+
+	ip   net.IP
+	port int
+}
+
+// match returns true if the connection c matches the rule.
+func (r *rule) match(c *connInfo) bool {
+	return r.matchHost(c.host) && r.matchIP(c.ip) && r.matchPort(c.port) &&
+		r.matchCountry(c.country) && r.matchASN(c.asn) && r.matchALPN(c.alpn) &&
+		r.matchUser(c.owner) && r.matchClient(c.clientIP) && r.matchMAC(c.mac) && r.expr.match(c) && r.schedule.match(time.Now())
+}
+
+// needsHost returns true if r needs client streams for conditions,
+// that is, host names, ALPN, or protocols, or for block actions.
+func (r *rule) needsHost() bool {
+	return !r.domains.empty() || len(r.alpn) > 0 ||
+		r.expr.uses("host", "sni", "alpn", "protocol") ||
+		r.block == BlockHTTP || r.block == BlockTLSAlert
+}
+
+// needsCountry returns true if r has conditions on countries.
+func (r *rule) needsCountry() bool {
+	return len(r.countries) > 0 || r.expr.uses("country")
+}
+
+// needsASN returns true if r has conditions on autonomous systems.
+func (r *rule) needsASN() bool {
+	return len(r.asns) > 0 || r.expr.uses("asn")
+}
+
+// needsUser returns true if r has conditions on owners of sockets.
+func (r *rule) needsUser() bool {
+	return len(r.uids) > 0 || r.expr.uses("uid")
+}
+
+// needsMAC returns true if r has conditions on MAC addresses of clients.
+func (r *rule) needsMAC() bool {
+	return len(r.macs) > 0
+}
+
+// parseNetwork parses s as a CIDR network or an IP address.
+// An IP address is a network of the address only.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid network: %s", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// tagBypass is the tag of rules compiled from Config.Bypass.
+const tagBypass = "bypass"
+
+// compileBypass compiles bypass list entries into rules for UpstreamDirect.
+//
+// An entry is either an IP address, a CIDR network, or a domain name.
+// A domain name matches itself and its subdomains.
+func compileBypass(entries []string) ([]*rule, error) {
+	hosts := &rule{tag: tagBypass, upstream: UpstreamDirect}
+	networks := &rule{tag: tagBypass, upstream: UpstreamDirect}
+
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if len(e) == 0 {
+			continue
+		}
+		if ipnet, err := parseNetwork(e); err == nil {
+			networks.networks = append(networks.networks, ipnet)
+			continue
+		}
+
+		d := normalizeHost(strings.TrimPrefix(strings.TrimPrefix(e, "*"), "."))
+		if len(d) == 0 || strings.ContainsAny(d, "*/ ") {
+			return nil, fmt.Errorf("invalid bypass entry: %s", e)
+		}
+		hosts.domains.patterns = append(hosts.domains.patterns, "."+d)
+	}
+
+	var rules []*rule
+	if len(networks.networks) > 0 {
+		rules = append(rules, networks)
+	}
+	if !hosts.domains.empty() {
+		rules = append(rules, hosts)
+	}
+	return rules, nil
+}
@@ -0,0 +1,231 @@
+package transocks
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMatchDomain(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		pattern string
+		host    string
+		expect  bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "wwwexample.com", false},
+		{".example.com", "example.com", true},
+		{".example.com", "www.example.com", true},
+		{".example.com", "badexample.com", false},
+	}
+
+	for _, tc := range testCases {
+		if matchDomain(tc.pattern, tc.host) != tc.expect {
+			t.Errorf("matchDomain(%q, %q) should be %v", tc.pattern, tc.host, tc.expect)
+		}
+	}
+}
+
+func TestDomainSet(t *testing.T) {
+	t.Parallel()
+
+	ds, err := compileDomainSet([]string{".example.com", `~api[0-9]+\.example\.(net|org)`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		host   string
+		expect bool
+	}{
+		{"www.example.com", true},
+		{"api1.example.net", true},
+		{"api42.example.org", true},
+		{"api.example.net", false},
+		{"xapi1.example.net", false},
+		{"api1.example.net.evil.com", false},
+	}
+	for _, tc := range testCases {
+		if ds.match(tc.host) != tc.expect {
+			t.Errorf("match(%q) should be %v", tc.host, tc.expect)
+		}
+	}
+
+	invalid := [][]string{
+		{"~"},
+		{"~(unclosed"},
+		{"~" + strings.Repeat("a", maxDomainRegexpLen+1)},
+		make([]string, maxDomainRegexps+1),
+	}
+	for i := range invalid[3] {
+		invalid[3][i] = "~a"
+	}
+	for _, list := range invalid {
+		if _, err := compileDomainSet(list); err == nil {
+			t.Errorf("%.40q should be invalid", list)
+		}
+	}
+	if _, err := compileHostMap(map[string]string{"~a": "b"}); err == nil {
+		t.Error("regular expressions in HostMap should be invalid")
+	}
+}
+
+func TestCompileRule(t *testing.T) {
+	t.Parallel()
+
+	invalid := []*Rule{
+		{Domains: []string{"example.com"}},
+		{Domains: []string{"www.*.com"}, Upstream: "a"},
+		{Domains: []string{"*example.com"}, Upstream: "a"},
+		{Networks: []string{"10.0.0.0"}, Upstream: "a"},
+		{Ports: []string{"0"}, Upstream: "a"},
+		{Ports: []string{"100-10"}, Upstream: "a"},
+		{Ports: []string{"65536"}, Upstream: "a"},
+		{Ports: []string{"http"}, Upstream: "a"},
+		{RateLimit: -1, Upstream: "a"},
+		{MaxConnections: -1, Upstream: "a"},
+		{RateLimit: 1, RateLimitPrefix: 33, Upstream: "a"},
+		{RateLimit: 1, RateLimitPrefix6: 129, Upstream: "a"},
+	}
+	for _, r := range invalid {
+		if _, err := compileRule(r); err == nil {
+			t.Errorf("%+v should be invalid", r)
+		}
+	}
+
+	r, err := compileRule(&Rule{
+		Domains:  []string{"*.Example.COM."},
+		Networks: []string{"10.0.0.0/8", "2001:db8::/32"},
+		Ports:    []string{"443", "8000-8999"},
+		Upstream: "a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.needsHost() {
+		t.Error("rule with domains needs host")
+	}
+	if r.conns != nil || r.throttle != nil {
+		t.Error("rule without limits should not limit connections")
+	}
+
+	testCases := []struct {
+		host   string
+		ip     string
+		port   int
+		expect bool
+	}{
+		{"www.example.com", "10.1.2.3", 443, true},
+		{"www.example.com", "2001:db8::1", 8080, true},
+		{"", "10.1.2.3", 443, false},
+		{"www.example.org", "10.1.2.3", 443, false},
+		{"www.example.com", "192.168.1.1", 443, false},
+		{"www.example.com", "10.1.2.3", 80, false},
+	}
+	for _, tc := range testCases {
+		if r.match(&connInfo{host: tc.host, ip: net.ParseIP(tc.ip), port: tc.port}) != tc.expect {
+			t.Errorf("match(%q, %s, %d) should be %v", tc.host, tc.ip, tc.port, tc.expect)
+		}
+	}
+
+	r, err = compileRule(&Rule{Upstream: UpstreamDirect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.match(&connInfo{ip: net.ParseIP("192.0.2.1"), port: 22}) {
+		t.Error("rule without conditions should match everything")
+	}
+
+	r, err = compileRule(&Rule{Upstream: UpstreamDirect, MaxConnections: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.conns.acquire("") || r.conns.acquire("") {
+		t.Error("connections matching the rule should be limited")
+	}
+}
+
+func TestCompileBypass(t *testing.T) {
+	t.Parallel()
+
+	rules, err := compileBypass([]string{
+		"10.0.0.0/8",
+		"192.0.2.1",
+		"2001:db8::1",
+		"corp.example.com",
+		".internal",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match := func(host, ip string) bool {
+		for _, r := range rules {
+			if r.match(&connInfo{host: host, ip: net.ParseIP(ip), port: 443}) {
+				return r.upstream == UpstreamDirect
+			}
+		}
+		return false
+	}
+
+	testCases := []struct {
+		host   string
+		ip     string
+		expect bool
+	}{
+		{"", "10.1.2.3", true},
+		{"", "192.0.2.1", true},
+		{"", "192.0.2.2", false},
+		{"", "2001:db8::1", true},
+		{"corp.example.com", "203.0.113.1", true},
+		{"www.corp.example.com", "203.0.113.1", true},
+		{"example.com", "203.0.113.1", false},
+		{"db.internal", "203.0.113.1", true},
+	}
+	for _, tc := range testCases {
+		if match(tc.host, tc.ip) != tc.expect {
+			t.Errorf("bypass for %q, %s should be %v", tc.host, tc.ip, tc.expect)
+		}
+	}
+
+	if _, err := compileBypass([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid CIDR should be rejected")
+	}
+}
+
+func TestRuleALPN(t *testing.T) {
+	t.Parallel()
+
+	r, err := compileRule(&Rule{ALPN: []string{"h2", "dot"}, Upstream: UpstreamDirect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.needsHost() {
+		t.Error("rule with ALPN needs client streams")
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	testCases := []struct {
+		alpn   []string
+		expect bool
+	}{
+		{[]string{"h2", "http/1.1"}, true},
+		{[]string{"dot"}, true},
+		{[]string{"http/1.1"}, false},
+		{nil, false},
+	}
+	for _, tc := range testCases {
+		if r.match(&connInfo{alpn: tc.alpn, ip: ip, port: 443}) != tc.expect {
+			t.Errorf("unexpected result for %v", tc.alpn)
+		}
+	}
+
+	if _, err := compileRule(&Rule{ALPN: []string{""}, Upstream: UpstreamDirect}); err == nil {
+		t.Error("empty protocol should be an error")
+	}
+}
@@ -0,0 +1,169 @@
+package transocks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file implements schedules of rules, such as "Mon-Fri 09:00-18:00".
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+const minutesPerDay = 24 * 60
+
+// timeRange is a range of time in days of week.
+// days is a bit mask of time.Weekday.  begin and end are minutes
+// from midnight.  If end is less than begin, the range continues to
+// end of the next day.
+type timeRange struct {
+	days       uint8
+	begin, end int
+}
+
+// schedule is a list of time ranges.  An empty schedule is always on.
+type schedule []timeRange
+
+func parseWeekday(s string) (time.Weekday, error) {
+	d, ok := weekdays[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("invalid day of week: %s", s)
+	}
+	return d, nil
+}
+
+// parseDays parses days of week like "Mon-Fri" or "Sat,Sun".
+func parseDays(s string) (uint8, error) {
+	var days uint8
+	for _, item := range strings.Split(s, ",") {
+		begin, end := item, item
+		if i := strings.IndexByte(item, '-'); i >= 0 {
+			begin, end = item[:i], item[i+1:]
+		}
+		b, err := parseWeekday(begin)
+		if err != nil {
+			return 0, err
+		}
+		e, err := parseWeekday(end)
+		if err != nil {
+			return 0, err
+		}
+		for d := b; ; d = (d + 1) % 7 {
+			days |= 1 << uint(d)
+			if d == e {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses time of day like "09:00" into minutes from
+// midnight.  "24:00" is allowed as the end of a day.
+func parseClock(s string) (int, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	h, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	m, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	t := h*60 + m
+	if h < 0 || m < 0 || m >= 60 || t > minutesPerDay {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	return t, nil
+}
+
+// parseTimeRange parses days of week, time of day, or both separated
+// by a space, such as "Mon-Fri 09:00-18:00".
+func parseTimeRange(s string) (timeRange, error) {
+	tr := timeRange{days: 0x7f, begin: 0, end: minutesPerDay}
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return tr, fmt.Errorf("invalid schedule: %q", s)
+	}
+	if !strings.Contains(fields[0], ":") {
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return tr, err
+		}
+		tr.days = days
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return tr, nil
+	}
+
+	i := strings.IndexByte(fields[0], '-')
+	if i < 0 {
+		return tr, fmt.Errorf("invalid schedule: %q", s)
+	}
+	begin, err := parseClock(fields[0][:i])
+	if err != nil {
+		return tr, err
+	}
+	end, err := parseClock(fields[0][i+1:])
+	if err != nil {
+		return tr, err
+	}
+	if begin == end || begin == minutesPerDay {
+		return tr, fmt.Errorf("invalid schedule: %q", s)
+	}
+	tr.begin, tr.end = begin, end
+	return tr, nil
+}
+
+func parseSchedule(items []string) (schedule, error) {
+	var s schedule
+	for _, item := range items {
+		tr, err := parseTimeRange(item)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, tr)
+	}
+	return s, nil
+}
+
+func (tr timeRange) match(t time.Time) bool {
+	d := t.Weekday()
+	m := t.Hour()*60 + t.Minute()
+	if tr.begin < tr.end {
+		return tr.days&(1<<uint(d)) != 0 && tr.begin <= m && m < tr.end
+	}
+	// the range continues to the next day.
+	if tr.days&(1<<uint(d)) != 0 && m >= tr.begin {
+		return true
+	}
+	prev := (d + 6) % 7
+	return tr.days&(1<<uint(prev)) != 0 && m < tr.end
+}
+
+// match returns true if t is in s.
+func (s schedule) match(t time.Time) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, tr := range s {
+		if tr.match(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package transocks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	t.Parallel()
+
+	s, err := parseSchedule([]string{"Mon-Fri 09:00-18:00", "Sat,Sun", "Fri 22:00-02:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2018-10-01 is Monday.
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2018, 10, day, hour, min, 0, 0, time.Local)
+	}
+	testCases := []struct {
+		t      time.Time
+		expect bool
+	}{
+		{at(1, 9, 0), true},
+		{at(1, 17, 59), true},
+		{at(1, 18, 0), false},
+		{at(2, 8, 59), false},
+		{at(5, 23, 0), true},
+		{at(6, 1, 59), true},
+		{at(6, 12, 0), true},
+		{at(7, 23, 0), true},
+		{at(8, 1, 0), false},
+	}
+	for _, tc := range testCases {
+		if s.match(tc.t) != tc.expect {
+			t.Errorf("match(%s) should be %v", tc.t.Format(time.RFC1123), tc.expect)
+		}
+	}
+
+	// wrapping days of week
+	s, err = parseSchedule([]string{"Sat-Mon"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.match(at(1, 12, 0)) || !s.match(at(7, 12, 0)) || s.match(at(2, 12, 0)) {
+		t.Error("Sat-Mon should match Saturday through Monday")
+	}
+
+	if !schedule(nil).match(at(1, 0, 0)) {
+		t.Error("empty schedule should always match")
+	}
+
+	invalid := []string{
+		"",
+		"Monday",
+		"Mon-Fri 9-18",
+		"09:00-09:00",
+		"09:00-24:01",
+		"25:00-26:00",
+		"Mon 09:00-18:00 extra",
+	}
+	for _, i := range invalid {
+		if _, err := parseSchedule([]string{i}); err == nil {
+			t.Errorf("%q should be invalid", i)
+		}
+	}
+}
@@ -1,10 +1,18 @@
 package transocks
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cybozu-go/log"
@@ -18,67 +26,594 @@ const (
 	copyBufferSize   = 64 << 10
 )
 
-// Listeners returns a list of net.Listener.
+// Listeners returns a list of net.Listener for c.Addr and c.Listeners.
+//
+// If c.ReusePort is true, this returns c.Shards listeners for each
+// address with SO_REUSEPORT option.  The kernel distributes connections
+// among them.
+//
+// If transocks is activated by systemd sockets, the passed sockets are
+// returned and c.Addr is not used.  For ModeTPROXY, the socket unit
+// needs "Transparent=yes".
 func Listeners(c *Config) ([]net.Listener, error) {
-	ln, err := net.Listen("tcp", c.Addr)
+	lns, err := systemdListeners()
+	if err != nil || lns != nil {
+		return lns, err
+	}
+
+	lns, err = listen(c, c.Addr, c.Mode)
 	if err != nil {
 		return nil, err
 	}
-	return []net.Listener{ln}, nil
+	for _, l := range c.Listeners {
+		ls, err := listen(c, l.Addr, l.mode())
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ls...)
+	}
+	return lns, nil
+}
+
+func listen(c *Config, addr string, mode Mode) ([]net.Listener, error) {
+	if mode == ModeUnix {
+		ln, err := listenUnix(addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+
+	n := 1
+	var opts []socketOption
+	if c.ReusePort {
+		n = c.Shards
+		if n <= 0 {
+			n = runtime.NumCPU()
+		}
+		opts = append(opts, setReusePort)
+	}
+
+	var lns []net.Listener
+	for i := 0; i < n; i++ {
+		var ln net.Listener
+		var err error
+		switch mode {
+		case ModeTPROXY:
+			ln, err = listenTransparent(addr, opts...)
+		default:
+			if c.MPTCP {
+				ln, err = listenMPTCP(addr, opts...)
+			} else {
+				ln, err = listenTCP(addr, opts...)
+			}
+		}
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+
+		// If the port is zero, the rest share the chosen port.
+		addr = ln.Addr().String()
+	}
+	return lns, nil
+}
+
+// listenProfile is the mode and routing rules of a listener.
+// acl, geoip, and asnDB are shared among listeners.
+type listenProfile struct {
+	addr      string
+	mode      Mode
+	rules     []*rule
+	rewrite   bool
+	needsHost bool
+	needsUser bool
+	needsMAC  bool
+	needsASN  bool
+	acl       *acl
+	geoip     *geoIP
+	asnDB     *geoIP
+}
+
+// newListenProfile compiles rules.  bypass is prepended to them.
+// rewrite is the default of Rule.Dest.
+// The returned bool is true if some rules have Countries.
+func newListenProfile(addr string, mode Mode, bypass []*rule, rules []*Rule, rewrite bool) (*listenProfile, bool, error) {
+	p := &listenProfile{
+		addr:      addr,
+		mode:      mode,
+		rules:     append([]*rule(nil), bypass...),
+		rewrite:   rewrite,
+		needsHost: rewrite,
+	}
+	var needsCountry bool
+	for _, r := range bypass {
+		p.needsHost = p.needsHost || r.needsHost()
+	}
+	for _, r := range rules {
+		cr, err := compileRule(r)
+		if err != nil {
+			return nil, false, err
+		}
+		p.rules = append(p.rules, cr)
+		p.needsHost = p.needsHost || cr.needsHost() || cr.dest == DestHost
+		p.needsUser = p.needsUser || cr.needsUser()
+		p.needsMAC = p.needsMAC || cr.needsMAC()
+		p.needsASN = p.needsASN || cr.needsASN()
+		needsCountry = needsCountry || cr.needsCountry()
+	}
+	return p, needsCountry, nil
+}
+
+// accepts returns true if addr, the address of a listener, is p.addr.
+func (p *listenProfile) accepts(addr net.Addr) bool {
+	if ua, ok := addr.(*net.UnixAddr); ok {
+		return p.mode == ModeUnix && ua.Name == p.addr
+	}
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok || p.mode == ModeUnix {
+		return false
+	}
+	pa, err := net.ResolveTCPAddr("tcp", p.addr)
+	if err != nil || pa.Port != ta.Port {
+		return false
+	}
+	return pa.IP == nil || pa.IP.IsUnspecified() || pa.IP.Equal(ta.IP)
+}
+
+// match returns the first rule matching c, or nil.
+// c.host need not be normalized.
+func (p *listenProfile) match(c *connInfo) *rule {
+	ci := *c
+	ci.host = normalizeHost(c.host)
+	for _, r := range p.rules {
+		if r.match(&ci) {
+			return r
+		}
+	}
+	return nil
+}
+
+// route returns the name of the upstream for a connection, and the tag
+// of the matching rule.
+func (p *listenProfile) route(c *connInfo) (string, string) {
+	if r := p.match(c); r != nil {
+		return r.upstream, r.tag
+	}
+	return UpstreamDefault, ""
+}
+
+// rewrites returns true if the destination of connections matching r
+// is replaced with host names found in client streams.  r may be nil.
+func (p *listenProfile) rewrites(r *rule) bool {
+	if r == nil {
+		return p.rewrite
+	}
+	switch r.dest {
+	case DestHost:
+		return true
+	case DestOriginal:
+		return false
+	}
+	return p.rewrite
 }
 
 // Server provides transparent proxy server functions.
 type Server struct {
 	well.Server
-	mode   Mode
-	logger *log.Logger
-	dialer proxy.Dialer
-	pool   sync.Pool
+	current     atomic.Value // *ruleset
+	reloadMu    sync.Mutex
+	logger      *log.Logger
+	direct      proxy.Dialer
+	upstreams   map[string]*upstreamGroup
+	udpProxy    *url.URL
+	udpIdle     time.Duration
+	udpLifetime time.Duration
+	udpMax      int
+	udpMu       sync.Mutex
+	udpRelays   []*udpRelay
+	dnsUpstream *url.URL
+	fakeIP      *fakeIPPool
+	peekTimeout time.Duration
+	maxPeek     int64
+	noPeek      []portRange
+	protocols   map[int]string
+	echPublic   bool
+	rejectNoSNI bool
+	connect     bool
+	noSNIAlert  byte
+	hostCheck   *hostChecker
+	resolver    *net.Resolver
+	hostMap     hostMap
+	connLimit   *connLimiter
+	maxConns    *connCounter
+	clientConns *connCounter
+	quotas      *quotas
+	counters    *connCounters
+	tracer      *tracer
+	accessLog   *accessLogger
+	resolve     bool
+	plainHTTP   bool
+	rdns        *reverseResolver
+	authz       *authorizer
+	blockAction string
+	audit       bool
+	killSwitch  bool
+	forwarded   bool
+	loop        *loopDetector
+	metrics     *metrics
+	procInfo    bool
+	neighbors   *neighborTable
+	reset       bool
+	pool        sync.Pool
 }
 
 // NewServer creates Server.
 // If c is not valid, this returns non-nil error.
 func NewServer(c *Config) (*Server, error) {
-	if err := c.validate(); err != nil {
+	if err := c.Validate(); err != nil {
 		return nil, err
 	}
 
-	dialer := c.Dialer
-	if dialer == nil {
-		dialer = &net.Dialer{
+	resolver := net.DefaultResolver
+	if c.Resolver != nil {
+		r, err := newResolver(c.Resolver)
+		if err != nil {
+			return nil, err
+		}
+		resolver = r
+	}
+
+	base := c.Dialer
+	if base == nil {
+		base = &net.Dialer{
 			KeepAlive: keepAliveTimeout,
 			DualStack: true,
+			Resolver:  resolver,
 		}
 	}
-	pdialer, err := proxy.FromURL(c.ProxyURL, dialer)
-	if err != nil {
-		return nil, err
+	var dialer proxy.Dialer = base
+	if c.MPTCP {
+		dialer = newMPTCPDialer(base)
 	}
 	logger := c.Logger
 	if logger == nil {
 		logger = log.DefaultLogger()
 	}
+	upstreams := make(map[string]*upstreamGroup)
+	urls := append([]*url.URL{c.ProxyURL}, c.ProxyURLs...)
+	g, err := newUpstreamGroup(UpstreamDefault, urls, c.Balance, c, dialer, logger)
+	if err != nil {
+		return nil, err
+	}
+	upstreams[UpstreamDefault] = g
+	for name, up := range c.Upstreams {
+		g, err := newUpstreamGroup(name, up.ProxyURLs, up.Balance, c, dialer, logger)
+		if err != nil {
+			return nil, err
+		}
+		upstreams[name] = g
+	}
+
+	rs, err := compileRuleset(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var fakeIP *fakeIPPool
+	if len(c.DNSFakeIPNetwork) > 0 {
+		fakeIP, err = newFakeIPPool(c.DNSFakeIPNetwork)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	noPeek, err := compileNoPeekPorts(c.NoPeekPorts)
+	if err != nil {
+		return nil, err
+	}
+	hostMap, err := compileHostMap(c.HostMap)
+	if err != nil {
+		return nil, err
+	}
+	quotas, err := compileQuotas(c.Quotas)
+	if err != nil {
+		return nil, err
+	}
+	peekTimeout := c.PeekTimeout
+	if peekTimeout == 0 {
+		peekTimeout = defaultPeekTimeout
+	}
+
+	maxPeek := int64(c.MaxPeekBytes)
+	if maxPeek == 0 {
+		maxPeek = defaultMaxPeekBytes
+	}
+
+	noSNIAlert := tlsAlerts[defaultNoSNIAlert]
+	if len(c.NoSNIAlert) > 0 {
+		noSNIAlert = tlsAlerts[c.NoSNIAlert]
+	}
+
+	var connLimit *connLimiter
+	if c.ConnectionRate > 0 {
+		connLimit = newConnLimiter(c.ConnectionRate, c.ConnectionBurst, c.ConnectionQueue)
+	}
+
+	var authz *authorizer
+	if c.AuthzURL != nil {
+		authz = newAuthorizer(c.AuthzURL, c.AuthzTimeout, c.AuthzCacheTTL, c.AuthzFailOpen)
+	}
+
+	var rdns *reverseResolver
+	if c.ReverseDNS {
+		rdns = newReverseResolver(resolver)
+	}
+
+	accessLog := c.AccessLog
+	if accessLog == nil && len(c.AccessLogFile) > 0 {
+		f, err := openRotatingFile(c, logger)
+		if err != nil {
+			return nil, err
+		}
+		accessLog = f
+	}
 
 	s := &Server{
 		Server: well.Server{
 			ShutdownTimeout: c.ShutdownTimeout,
 			Env:             c.Env,
 		},
-		mode:   c.Mode,
-		logger: logger,
-		dialer: pdialer,
+		logger:      logger,
+		direct:      dialer,
+		upstreams:   upstreams,
+		udpProxy:    c.ProxyURL,
+		udpIdle:     c.UDPIdleTimeout,
+		udpLifetime: c.UDPSessionTimeout,
+		udpMax:      c.UDPMaxSessions,
+		dnsUpstream: c.DNSUpstream,
+		fakeIP:      fakeIP,
+		peekTimeout: peekTimeout,
+		maxPeek:     maxPeek,
+		noPeek:      noPeek,
+		protocols:   c.PeekProtocols,
+		echPublic:   c.ECHPublicName,
+		rejectNoSNI: c.RejectNoSNI,
+		connect:     c.DetectConnect,
+		noSNIAlert:  noSNIAlert,
+		hostCheck:   newHostChecker(c.HostCheck, c.HostCheckResolver, resolver),
+		resolver:    resolver,
+		hostMap:     hostMap,
+		connLimit:   connLimit,
+		maxConns:    newConnCounter(c.MaxConnections),
+		clientConns: newConnCounter(c.MaxClientConnections),
+		quotas:      quotas,
+		counters:    new(connCounters),
+		resolve:     c.ResolveLocally,
+		plainHTTP:   c.PlainHTTP,
+		forwarded:   c.ForwardedHeaders,
+		loop:        newLoopDetector(c),
+		metrics:     newMetrics(),
+		accessLog:   newAccessLogger(accessLog, c.AccessLogFields),
+		rdns:        rdns,
+		authz:       authz,
+		blockAction: c.BlockAction,
+		audit:       c.AuditOnly,
+		killSwitch:  c.KillSwitch,
+		procInfo:    c.ProcessInfo,
+		neighbors:   newNeighborTable(),
+		reset:       c.ResetOnFailure,
 		pool: sync.Pool{
 			New: func() interface{} {
 				return make([]byte, copyBufferSize)
 			},
 		},
 	}
-	s.Server.Handler = s.handleConnection
+	s.current.Store(rs)
+	s.Server.Handler = s.handler(-1)
+	s.runFeeds(rs.feeds())
+
+	if len(c.ProxyCredentialsFile) > 0 {
+		w := &credentialsWatcher{
+			name:   c.ProxyCredentialsFile,
+			groups: upstreams,
+			logger: logger,
+		}
+		if err := w.load(); err != nil {
+			return nil, err
+		}
+		s.goBackground(func(ctx context.Context) {
+			w.watch(ctx)
+		})
+	}
+	if c.HealthCheckInterval > 0 {
+		s.goBackground(func(ctx context.Context) {
+			s.healthCheck(ctx, c.HealthCheckInterval, c.HealthCheckAddr)
+		})
+	}
+	if c.TracingEndpoint != nil {
+		s.tracer = newTracer(c.TracingEndpoint, logger)
+		s.goBackground(s.tracer.run)
+	}
 	return s, nil
 }
 
-func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
-	tc, ok := conn.(*net.TCPConn)
+// goBackground runs f in a goroutine on the environment of the server.
+func (s *Server) goBackground(f func(ctx context.Context)) {
+	g := func(ctx context.Context) error {
+		f(ctx)
+		return nil
+	}
+	if s.Env != nil {
+		s.Env.Go(g)
+	} else {
+		well.Go(g)
+	}
+}
+
+// BlocklistStats returns the state of Config.BlocklistURLs.
+func (s *Server) BlocklistStats() []BlocklistStats {
+	return s.ruleset().feeds().stats()
+}
+
+// UpstreamStats returns counters of upstream proxies.
+// Proxies are sorted by upstream names, then listed in configured order.
+func (s *Server) UpstreamStats() []UpstreamStats {
+	names := make([]string, 0, len(s.upstreams))
+	for name := range s.upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var stats []UpstreamStats
+	for _, name := range names {
+		stats = append(stats, s.upstreams[name].stats()...)
+	}
+	return stats
+}
+
+// Serve starts a goroutine to accept connections from ln.
+// If ln is for one of Config.Listeners, its mode and rules are used.
+func (s *Server) Serve(ln net.Listener) {
+	for i, p := range s.ruleset().profiles {
+		if !p.accepts(ln.Addr()) {
+			continue
+		}
+		srv := &well.Server{
+			ShutdownTimeout: s.ShutdownTimeout,
+			Env:             s.Env,
+			Handler:         s.handler(i),
+		}
+		srv.Serve(ln)
+		return
+	}
+	s.Server.Serve(ln)
+}
+
+// handler returns the handler for the listener of Config.Listeners[i],
+// or Config.Addr if i is negative.
+func (s *Server) handler(i int) func(context.Context, net.Conn) {
+	return func(ctx context.Context, conn net.Conn) {
+		atomic.AddInt64(&s.counters.total, 1)
+		atomic.AddInt64(&s.counters.active, 1)
+		defer atomic.AddInt64(&s.counters.active, -1)
+
+		if err := s.connLimit.accept(ctx); err != nil {
+			fields := well.FieldsFromContext(ctx)
+			fields["client_addr"] = conn.RemoteAddr().String()
+			s.reject(conn, fields, limitConnectionRate)
+			return
+		}
+		s.handleConnection(ctx, conn, s.ruleset().profileAt(i))
+	}
+}
+
+// reject resets conn closed by a limit of connections.
+func (s *Server) reject(conn net.Conn, fields map[string]interface{}, limit string) {
+	atomic.AddInt64(&s.counters.rejected, 1)
+	fields["limit"] = limit
+	s.logger.Warn("connection limit exceeded", fields)
+	resetConn(conn)
+}
+
+// loops resets tc and returns true if addr is the address of transocks
+// itself or an upstream proxy.
+func (s *Server) loops(tc relayConn, fields map[string]interface{}, addr string) bool {
+	loop := s.loop.detect(addr)
+	if len(loop) == 0 {
+		return false
+	}
+	fields["loop"] = loop
+	fields["loop_addr"] = addr
+	s.logger.Error("connection loop detected; check redirection rules", fields)
+	resetConn(tc)
+	return true
+}
+
+// kill resets tc whose upstream proxies are down in kill switch mode.
+func (s *Server) kill(tc relayConn) {
+	atomic.AddInt64(&s.counters.killed, 1)
+	resetConn(tc)
+}
+
+// QuotaUsage returns bytes transferred by clients with Config.Quotas
+// in this month.
+func (s *Server) QuotaUsage() []QuotaUsage {
+	return s.quotas.stats(time.Now())
+}
+
+// ConnectionStats returns counters of TCP connections.
+func (s *Server) ConnectionStats() ConnectionStats {
+	return ConnectionStats{
+		Active:   atomic.LoadInt64(&s.counters.active),
+		Total:    atomic.LoadInt64(&s.counters.total),
+		Rejected: atomic.LoadInt64(&s.counters.rejected),
+		Killed:   atomic.LoadInt64(&s.counters.killed),
+	}
+}
+
+func (s *Server) dialer(upstream string) proxy.Dialer {
+	if upstream == UpstreamDirect {
+		return s.direct
+	}
+	return s.upstreams[upstream]
+}
+
+// resolves returns true if host names of connections matching r are
+// resolved by transocks.  r may be nil.
+func (s *Server) resolves(r *rule) bool {
+	if r == nil {
+		return s.resolve
+	}
+	switch r.resolve {
+	case ResolveLocal:
+		return true
+	case ResolveProxy:
+		return false
+	}
+	return s.resolve
+}
+
+// peeks returns true if client streams to port are read to find
+// host names.
+func (s *Server) peeks(port int) bool {
+	switch s.protocols[port] {
+	case "":
+	case PeekNone:
+		return false
+	default:
+		return true
+	}
+	for _, pr := range s.noPeek {
+		if pr.begin <= port && port <= pr.end {
+			return false
+		}
+	}
+	return true
+}
+
+// readsClient returns true if client streams of connections accepted
+// for p need to be read.
+func (s *Server) readsClient(p *listenProfile) bool {
+	return p.needsHost || s.plainHTTP || s.forwarded || s.rejectNoSNI || s.connect ||
+		len(s.hostMap) > 0 || p.acl.needsHost() || s.authz != nil ||
+		s.blockAction == BlockHTTP || s.blockAction == BlockTLSAlert
+}
+
+// relayConn is a client connection that can be half-closed.
+type relayConn interface {
+	net.Conn
+	netutil.HalfCloser
+}
+
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn, p *listenProfile) {
+	tc, ok := conn.(relayConn)
 	if !ok {
 		s.logger.Error("non-TCP connection", map[string]interface{}{
 			"conn": conn,
@@ -89,39 +624,471 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	fields := well.FieldsFromContext(ctx)
 	fields[log.FnType] = "access"
 	fields["client_addr"] = conn.RemoteAddr().String()
+	client, _ := conn.RemoteAddr().(*net.TCPAddr)
+	defer s.accessLog.log(fields, time.Now())
+	sp := s.tracer.start("connection", spanServer)
+	defer sp.finish(fields)
 
-	var addr string
-	switch s.mode {
+	var dst *net.TCPAddr
+	var host string
+	switch p.mode {
 	case ModeNAT:
-		origAddr, err := GetOriginalDST(tc)
+		origAddr, err := GetOriginalDST(tc.(*net.TCPConn))
 		if err != nil {
 			fields[log.FnError] = err.Error()
 			s.logger.Error("GetOriginalDST failed", fields)
 			return
 		}
-		addr = origAddr.String()
+		dst = origAddr
+	case ModeUnix:
+		tc.SetReadDeadline(time.Now().Add(s.peekTimeout))
+		h, port, err := readDestHeader(tc)
+		tc.SetReadDeadline(time.Time{})
+		if err != nil {
+			fields[log.FnError] = err.Error()
+			s.logger.Error("failed to read destination header", fields)
+			return
+		}
+		dst = &net.TCPAddr{IP: net.ParseIP(h), Port: port}
+		if dst.IP == nil {
+			host = h
+		}
+	case ModeProxyProtocol:
+		tc.SetReadDeadline(time.Now().Add(s.peekTimeout))
+		src, origAddr, err := readProxyHeader(tc)
+		tc.SetReadDeadline(time.Time{})
+		if err != nil {
+			fields[log.FnError] = err.Error()
+			s.logger.Error("failed to read PROXY protocol header", fields)
+			return
+		}
+		if src != nil {
+			client = src
+			fields["client_addr"] = src.String()
+			fields["proxy_addr"] = conn.RemoteAddr().String()
+		}
+		dst = origAddr
+		if dst == nil {
+			dst = tc.LocalAddr().(*net.TCPAddr)
+		}
 	default:
-		addr = tc.LocalAddr().String()
+		dst = tc.LocalAddr().(*net.TCPAddr)
+	}
+	addr := dst.String()
+	if len(host) > 0 {
+		addr = net.JoinHostPort(host, strconv.Itoa(dst.Port))
+		fields["dest_host"] = host
 	}
 	fields["dest_addr"] = addr
+	if s.loops(tc, fields, addr) {
+		return
+	}
+
+	var clientIP net.IP
+	if client != nil {
+		clientIP = client.IP
+	}
+	if !p.acl.allowsClient(clientIP) {
+		if s.deny(tc, fields, "client denied", "", "", nil) {
+			return
+		}
+	}
+	if !s.maxConns.acquire("") {
+		s.reject(tc, fields, limitConnections)
+		return
+	}
+	defer s.maxConns.release("")
+	if clientIP != nil {
+		key := clientIP.String()
+		if !s.clientConns.acquire(key) {
+			s.reject(tc, fields, limitClientConnections)
+			return
+		}
+		defer s.clientConns.release(key)
+	}
+	q := s.quotas.find(clientIP)
+	exhausted := q != nil && s.quotas.exhausted(clientIP, q, time.Now())
+	if exhausted {
+		if q.throttle == nil {
+			s.reject(tc, fields, limitQuota)
+			return
+		}
+		fields["quota_exhausted"] = true
+	}
+	var owner *processInfo
+	if (s.procInfo || p.needsUser) && client != nil {
+		if pi, err := lookupProcess(client, s.procInfo); err == nil {
+			owner = pi
+			pi.addFields(fields)
+		}
+	}
+	var mac net.HardwareAddr
+	if p.needsMAC && clientIP != nil {
+		mac = s.neighbors.lookup(clientIP, time.Now())
+		if mac != nil {
+			fields["client_mac"] = mac.String()
+		}
+	}
 
-	destConn, err := s.dialer.Dial("tcp", addr)
+	// peeked keeps bytes read from tc to find the host name.
+	// They are sent before relaying the rest of tc, so that tc can be
+	// relayed by splice(2) without copying data in user space.
+	peeked := new(bytes.Buffer)
+	if s.fakeIP != nil {
+		if h, ok := s.fakeIP.host(dst.IP); ok {
+			host = h
+			addr = net.JoinHostPort(h, strconv.Itoa(dst.Port))
+			fields["dest_host"] = host
+		}
+	}
+	var peekedHost bool
+	var alpn []string
+	var protocol string
+	var noSNI bool
+	var isConnect bool
+	var startTLS string
+	var answered []string
+	if s.readsClient(p) && len(host) == 0 && s.peeks(dst.Port) {
+		psp := sp.child("peek", spanInternal)
+		proto := s.protocols[dst.Port]
+		// Limit the bytes buffered in peeked.
+		lr := io.LimitReader(tc, s.maxPeek)
+		tc.SetReadDeadline(time.Now().Add(s.peekTimeout))
+		if isStartTLS(proto) {
+			startTLS = proto
+			rw := struct {
+				io.Reader
+				io.Writer
+			}{lr, tc}
+			host, answered = peekStartTLS(rw, proto, peeked)
+		} else {
+			var sniffed string
+			host, sniffed, _ = peekHost(io.TeeReader(lr, peeked), proto)
+			if len(sniffed) > 0 {
+				protocol = sniffed
+				fields["protocol"] = sniffed
+			}
+			noSNI = sniffed == PeekTLS && len(host) == 0
+		}
+		tc.SetReadDeadline(time.Time{})
+		if len(host) == 0 {
+			// Unknown protocols are relayed to the original destination.
+			s.logger.Debug("no host name found in client stream", fields)
+			s.metrics.count(s.metrics.peeks, peekNoHost)
+		} else {
+			s.metrics.count(s.metrics.peeks, peekFoundHost)
+		}
+		if d, err := peekedClientHello(peeked.Bytes()); err == nil {
+			d.addFields(fields)
+			alpn = d.alpn
+		}
+		if isWebSocket(peeked.Bytes()) {
+			fields["websocket"] = true
+		}
+		if isHTTPRequest(peeked.Bytes()) {
+			sp.adopt(traceParent(peeked.Bytes()))
+		}
+		psp.set("peeked_bytes", peeked.Len())
+		psp.finish(nil)
+		// crypto/tls may reject ClientHello with ECH, so the public
+		// name is read from the raw bytes.
+		if name, ok := echPublicName(peeked.Bytes()); ok {
+			fields["ech_public_name"] = name
+			host = ""
+			if s.echPublic {
+				host = name
+			}
+		}
+		if len(host) > 0 {
+			h, err := sanitizeHost(host)
+			if err != nil {
+				fields["invalid_host"] = strconv.Quote(host)
+				fields["invalid_host_error"] = err.Error()
+				s.logger.Warn("invalid host name in client stream", fields)
+			}
+			host = h
+		}
+		if port, n, ok := connectRequest(peeked.Bytes()); ok && s.connect && len(host) > 0 {
+			// The client regards transocks as a proxy.  The request
+			// is answered by transocks, and the target is the
+			// destination like a host name known by DNSFakeIPNetwork.
+			peeked.Next(n)
+			isConnect = true
+			dst = &net.TCPAddr{IP: net.ParseIP(host), Port: port}
+			addr = net.JoinHostPort(host, strconv.Itoa(port))
+			fields["connect"] = true
+			fields["dest_addr"] = addr
+			fields["dest_host"] = host
+		} else if len(host) > 0 {
+			fields["dest_host"] = host
+			peekedHost = true
+		}
+	}
+	if noSNI && s.rejectNoSNI {
+		s.logger.Warn("TLS connection without server name is rejected", fields)
+		writeTLSAlert(tc, s.noSNIAlert)
+		return
+	}
+	if peekedHost && s.hostCheck != nil {
+		if err := s.hostCheck.check(ctx, host, dst.IP); err != nil {
+			fields["host_check_error"] = err.Error()
+			s.logger.Warn("host name does not match the destination", fields)
+			if s.hostCheck.block {
+				if s.reset {
+					resetConn(tc)
+				}
+				return
+			}
+		}
+	}
+	if p.acl != nil {
+		if !p.acl.allows(host, dst.IP, dst.Port) {
+			if s.deny(tc, fields, "connection denied", "", protocol, peeked.Bytes()) {
+				return
+			}
+		}
+		allow(fields)
+	}
+	var country string
+	if p.geoip != nil && dst.IP != nil {
+		country = p.geoip.country(dst.IP)
+		if len(country) > 0 {
+			fields["dest_country"] = country
+		}
+	}
+	var asn int
+	if p.asnDB != nil && dst.IP != nil {
+		asn = p.asnDB.asn(dst.IP)
+		if asn != 0 {
+			fields["dest_asn"] = asn
+		}
+	}
+	upstream := UpstreamDefault
+	matched := p.match(&connInfo{
+		host:     host,
+		country:  country,
+		asn:      asn,
+		alpn:     alpn,
+		protocol: protocol,
+		owner:    owner,
+		clientIP: clientIP,
+		mac:      mac,
+		ip:       dst.IP,
+		port:     dst.Port,
+	})
+	if matched != nil {
+		upstream = matched.upstream
+		if len(matched.tag) > 0 {
+			fields["rule"] = matched.tag
+			s.metrics.count(s.metrics.rules, matched.tag)
+		}
+	}
+	fields["upstream"] = upstream
+	if s.authz != nil {
+		req := &authzRequest{
+			Client:   fields["client_addr"].(string),
+			DestAddr: dst.String(),
+			DestHost: host,
+			Protocol: protocol,
+			ALPN:     alpn,
+		}
+		if owner != nil {
+			req.UID = &owner.uid
+		}
+		resp, err := s.authz.authorize(ctx, req, clientIP.String())
+		if err == nil && len(resp.Upstream) > 0 && resp.Upstream != UpstreamDirect &&
+			resp.Upstream != UpstreamBlock && s.upstreams[resp.Upstream] == nil {
+			err = fmt.Errorf("unknown upstream: %s", resp.Upstream)
+		}
+		if err != nil {
+			fields["authz_error"] = err.Error()
+			s.logger.Warn("authorization failed", fields)
+		}
+		if (err != nil && !s.authz.failOpen) || (err == nil && resp.Verdict == verdictDeny) {
+			if s.deny(tc, fields, "connection denied", "", protocol, peeked.Bytes()) {
+				return
+			}
+		}
+		if err == nil && len(resp.Upstream) > 0 {
+			upstream = resp.Upstream
+			fields["upstream"] = upstream
+		}
+		allow(fields)
+	}
+	if upstream == UpstreamBlock {
+		var action string
+		if matched != nil && matched.upstream == UpstreamBlock {
+			action = matched.block
+		}
+		if s.deny(tc, fields, "connection blocked by rule", action, protocol, peeked.Bytes()) {
+			return
+		}
+	}
+	if s.audit {
+		// Connections are not rerouted by rules in audit-only mode.
+		if upstream != UpstreamDefault {
+			fields["audit_upstream"] = upstream
+		}
+		upstream = UpstreamDefault
+		fields["upstream"] = upstream
+		matched = nil
+	}
+	if matched != nil {
+		if !matched.conns.acquire("") {
+			s.reject(tc, fields, limitRuleConnections)
+			return
+		}
+		defer matched.conns.release("")
+	}
+	if peekedHost && p.rewrites(matched) {
+		addr = net.JoinHostPort(host, strconv.Itoa(dst.Port))
+	}
+	if mapped, ok := s.hostMap.lookup(host, dst.Port); ok && len(host) > 0 {
+		addr = mapped
+		fields["mapped_dest"] = mapped
+	}
+	if h, port, _ := net.SplitHostPort(addr); net.ParseIP(h) == nil && s.resolves(matched) {
+		addrs, err := s.resolver.LookupIPAddr(ctx, h)
+		if err != nil {
+			fields[log.FnError] = err.Error()
+			s.logger.Error("failed to resolve host name", fields)
+			if s.reset {
+				resetConn(tc)
+			}
+			return
+		}
+		addr = net.JoinHostPort(addrs[0].IP.String(), port)
+		fields["resolved_addr"] = addr
+	}
+
+	// Look up the PTR record while connecting.
+	var ptr chan string
+	if s.rdns != nil && len(host) == 0 && dst.IP != nil {
+		ptr = make(chan string, 1)
+		go func() {
+			ptr <- s.rdns.lookup(ctx, dst.IP)
+		}()
+	}
+
+	network := "tcp"
+	if s.plainHTTP && upstream != UpstreamDirect && isHTTPRequest(peeked.Bytes()) &&
+		s.upstreams[upstream].supportsPlainHTTP() {
+		network = networkPlainHTTP
+		fields["plain_http"] = true
+	}
+	if addr != fields["dest_addr"] && s.loops(tc, fields, addr) {
+		return
+	}
+	if s.killSwitch && upstream != UpstreamDirect && s.upstreams[upstream].down() {
+		fields["kill_switch"] = true
+		s.logger.Warn("upstream proxies are down", fields)
+		s.kill(tc)
+		return
+	}
+	dsp := sp.child("dial", spanClient)
+	dsp.set("upstream", upstream)
+	dsp.set("addr", addr)
+	destConn, err := s.dialer(upstream).Dial(network, addr)
+	dsp.fail(err)
+	dsp.finish(nil)
 	if err != nil {
+		sp.fail(err)
+		s.metrics.count(s.metrics.dialErrors, dialErrorClass(upstream, err))
+		killed := s.killSwitch && !isConnect && isUpstreamError(err)
+		if killed {
+			fields["kill_switch"] = true
+		}
 		fields[log.FnError] = err.Error()
 		s.logger.Error("failed to connect to proxy server", fields)
+		switch {
+		case isConnect:
+			io.WriteString(tc, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		case killed:
+			s.kill(tc)
+		case s.reset:
+			resetConn(tc)
+		}
 		return
 	}
+	if s.forwarded && !isConnect && clientIP != nil && isHTTPRequest(peeked.Bytes()) {
+		destConn = newRequestConn(destConn, func(w io.Writer, r io.Reader) error {
+			return rewriteRequests(w, r, false, func(req *http.Request) {
+				addForwardedHeaders(req, clientIP)
+			})
+		})
+		fields["forwarded_headers"] = true
+	}
 	defer destConn.Close()
 
+	// The greeting and responses to commands answered by transocks
+	// are discarded.
+	if len(startTLS) > 0 {
+		destConn.SetDeadline(time.Now().Add(s.peekTimeout))
+		err := replayStartTLS(destConn, startTLS, answered)
+		destConn.SetDeadline(time.Time{})
+		if err != nil {
+			fields[log.FnError] = err.Error()
+			s.logger.Error("failed to replay STARTTLS negotiation", fields)
+			if s.reset {
+				resetConn(tc)
+			}
+			return
+		}
+	}
+
+	if ptr != nil {
+		if name := <-ptr; len(name) > 0 {
+			fields["dest_ptr"] = name
+		}
+	}
+	if isConnect {
+		if _, err := io.WriteString(tc, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			fields[log.FnError] = err.Error()
+			s.logger.Error("failed to answer CONNECT", fields)
+			return
+		}
+	}
+	var th *throttle
+	if matched != nil {
+		th = matched.throttle
+	}
+	if exhausted && (th == nil || q.throttle.rate < th.rate) {
+		th = q.throttle
+	}
+	var up, down *tokenBucket
+	if th != nil {
+		key, cb := th.acquire(clientIP)
+		defer th.release(key)
+		up, down = cb.up, cb.down
+		fields["rate_limit"] = th.rate
+	}
 	s.logger.Info("proxy starts", fields)
 
 	// do proxy
+	rsp := sp.child("relay", spanInternal)
 	st := time.Now()
+	var sent, received int64
+	meter := s.quotas.meter(clientIP, q, exhausted, func() {
+		resetConn(tc)
+		destConn.Close()
+	})
+	defer meter.release()
+	// Copy from and to the raw connection so that *net.TCPConn on both
+	// ends are relayed by splice(2).
+	raw := rawConn(destConn)
 	env := well.NewEnvironment(ctx)
 	env.Go(func(ctx context.Context) error {
-		buf := s.pool.Get().([]byte)
-		_, err := io.CopyBuffer(destConn, tc, buf)
-		s.pool.Put(buf)
+		n, err := peeked.WriteTo(destConn)
+		sent = n
+		if err == nil {
+			_, err = meter.count(int(n))
+		}
+		if err == nil {
+			buf := s.pool.Get().([]byte)
+			n, err = io.CopyBuffer(raw, meter.reader(ctx, throttleReader(ctx, tc, up), true), buf)
+			s.pool.Put(buf)
+			sent += n
+		}
 		if hc, ok := destConn.(netutil.HalfCloser); ok {
 			hc.CloseWrite()
 		}
@@ -130,8 +1097,9 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	})
 	env.Go(func(ctx context.Context) error {
 		buf := s.pool.Get().([]byte)
-		_, err := io.CopyBuffer(tc, destConn, buf)
+		n, err := io.CopyBuffer(tc, meter.reader(ctx, throttleReader(ctx, raw, down), false), buf)
 		s.pool.Put(buf)
+		received = n
 		tc.CloseWrite()
 		if hc, ok := destConn.(netutil.HalfCloser); ok {
 			hc.CloseRead()
@@ -140,6 +1108,18 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	})
 	env.Stop()
 	err = env.Wait()
+	atomic.AddInt64(&s.metrics.sent, sent)
+	atomic.AddInt64(&s.metrics.received, received)
+	rsp.set("sent_bytes", sent)
+	rsp.set("received_bytes", received)
+	rsp.fail(err)
+	rsp.finish(nil)
+	sp.fail(err)
+	fields["sent_bytes"] = sent
+	fields["received_bytes"] = received
+	if err != nil {
+		fields[log.FnError] = err.Error()
+	}
 
 	fields = well.FieldsFromContext(ctx)
 	fields["elapsed"] = time.Since(st).Seconds()
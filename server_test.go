@@ -0,0 +1,384 @@
+package transocks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+func TestListenersReusePort(t *testing.T) {
+	t.Parallel()
+
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd", "openbsd", "netbsd", "dragonfly":
+	default:
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+
+	c := NewConfig()
+	c.Addr = "127.0.0.1:0"
+	c.ReusePort = true
+	c.Shards = 3
+	lns, err := Listeners(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}()
+
+	if len(lns) != 3 {
+		t.Fatal("unexpected number of listeners:", len(lns))
+	}
+	for _, ln := range lns[1:] {
+		if ln.Addr().String() != lns[0].Addr().String() {
+			t.Error("listeners should share the address:", ln.Addr(), lns[0].Addr())
+		}
+	}
+}
+
+func TestListenProfile(t *testing.T) {
+	t.Parallel()
+
+	bypass, err := compileBypass([]string{"192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, needsCountry, err := newListenProfile(":1082", ModeTPROXY, bypass, []*Rule{
+		{Tag: "office-net", Networks: []string{"10.0.0.0/8"}, Upstream: "office"},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if needsCountry {
+		t.Error("profile should not need countries")
+	}
+
+	testCases := []struct {
+		addr     *net.TCPAddr
+		accepted bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1082}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::"), Port: 1082}, true},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1081}, false},
+	}
+	for _, tc := range testCases {
+		if p.accepts(tc.addr) != tc.accepted {
+			t.Errorf("accepts(%s) should be %v", tc.addr, tc.accepted)
+		}
+	}
+
+	p2, _, err := newListenProfile("127.0.0.1:1082", ModeNAT, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.accepts(&net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1082}) {
+		t.Error("listener on another address should not be accepted")
+	}
+
+	routes := []struct {
+		ip       string
+		upstream string
+		tag      string
+	}{
+		{"192.168.1.1", UpstreamDirect, tagBypass},
+		{"10.1.2.3", "office", "office-net"},
+		{"172.16.0.1", UpstreamDefault, ""},
+	}
+	for _, r := range routes {
+		dst := &net.TCPAddr{IP: net.ParseIP(r.ip), Port: 443}
+		if u, tag := p.route(&connInfo{ip: dst.IP, port: dst.Port}); u != r.upstream || tag != r.tag {
+			t.Errorf("route(%s) = %s, %q, expected %s, %q", r.ip, u, tag, r.upstream, r.tag)
+		}
+		if u, _ := p2.route(&connInfo{ip: dst.IP, port: dst.Port}); u != UpstreamDefault {
+			t.Errorf("route(%s) without rules = %s", r.ip, u)
+		}
+	}
+}
+
+func TestListenProfileRewrite(t *testing.T) {
+	t.Parallel()
+
+	p, _, err := newListenProfile(":1082", ModeNAT, nil, []*Rule{
+		{Ports: []string{"443"}, Upstream: UpstreamDefault, Dest: DestOriginal},
+		{Ports: []string{"80"}, Upstream: UpstreamDefault},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.needsHost {
+		t.Error("rewriting profile should need host names")
+	}
+
+	rewrites := []struct {
+		port    int
+		rewrite bool
+	}{
+		{443, false},
+		{80, true},
+		{8080, true},
+	}
+	for _, r := range rewrites {
+		dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: r.port}
+		if p.rewrites(p.match(&connInfo{ip: dst.IP, port: dst.Port})) != r.rewrite {
+			t.Errorf("rewrites for port %d should be %v", r.port, r.rewrite)
+		}
+	}
+
+	p2, _, err := newListenProfile(":1082", ModeNAT, nil, []*Rule{
+		{Ports: []string{"443"}, Upstream: UpstreamDefault, Dest: DestHost},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p2.needsHost {
+		t.Error("profile with DestHost should need host names")
+	}
+	if p2.rewrites(nil) {
+		t.Error("unmatched connections should not be rewritten")
+	}
+
+	_, _, err = newListenProfile(":1082", ModeNAT, nil, []*Rule{
+		{Upstream: UpstreamDefault, Dest: "ip"},
+	}, false)
+	if err == nil {
+		t.Error("invalid dest should be an error")
+	}
+}
+
+func TestServerResolves(t *testing.T) {
+	t.Parallel()
+
+	local, err := compileRule(&Rule{Upstream: UpstreamDefault, Resolve: ResolveLocal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := compileRule(&Rule{Upstream: UpstreamDefault, Resolve: ResolveProxy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	follow, err := compileRule(&Rule{Upstream: UpstreamDefault})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, resolve := range []bool{true, false} {
+		s := &Server{resolve: resolve}
+		if !s.resolves(local) {
+			t.Error("ResolveLocal should resolve")
+		}
+		if s.resolves(proxy) {
+			t.Error("ResolveProxy should not resolve")
+		}
+		if s.resolves(follow) != resolve || s.resolves(nil) != resolve {
+			t.Error("rules without Resolve should follow ResolveLocally")
+		}
+	}
+
+	if _, err := compileRule(&Rule{Upstream: UpstreamDefault, Resolve: "remote"}); err == nil {
+		t.Error("invalid resolve should be an error")
+	}
+}
+
+// serveOnce starts a server of c on a new listener to handle one
+// connection.  c.Mode should be ModeProxyProtocol to give destinations.
+func serveOnce(t *testing.T, c *Config) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Logger = log.NewLogger()
+	c.Logger.SetOutput(ioutil.Discard)
+	s, err := NewServer(c)
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s.handleConnection(context.Background(), conn, s.ruleset().profile)
+	}()
+	return l
+}
+
+// dialOnce connects to l and sends PROXY protocol header to dst.
+func dialOnce(t *testing.T, l, dst net.Listener) net.Conn {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(dst.Addr().String())
+	fmt.Fprintf(conn, "PROXY TCP4 127.0.0.1 127.0.0.1 12345 %s\r\n", port)
+	return conn
+}
+
+func TestServerEarlyData(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	c := NewConfig()
+	c.Mode = ModeProxyProtocol
+	c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1")
+	c.Rules = []*Rule{{Domains: []string{"www.example.com"}, Upstream: UpstreamDirect}}
+	l := serveOnce(t, c)
+	defer l.Close()
+
+	// A 0-RTT client sends ChangeCipherSpec and early data right after
+	// ClientHello without waiting for the server.
+	hello := clientHello(t, "www.example.com")
+	early := append([]byte{20, 3, 3, 0, 1, 1, 23, 3, 3, 0, 16}, bytes.Repeat([]byte{0xee}, 16)...)
+	data := append(append([]byte(nil), hello...), early...)
+
+	conn := dialOnce(t, l, echo)
+	defer conn.Close()
+
+	// The ClientHello is split into two segments, and the second one
+	// carries the early data.
+	if _, err := conn.Write(data[:100]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := conn.Write(data[100:]); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("ClientHello and early data are not relayed in order")
+	}
+}
+
+func TestServerRejectNoSNI(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	c := NewConfig()
+	c.Mode = ModeProxyProtocol
+	c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1")
+	c.Rules = []*Rule{{Upstream: UpstreamDirect}}
+	c.RejectNoSNI = true
+	c.NoSNIAlert = "access_denied"
+	l := serveOnce(t, c)
+	defer l.Close()
+
+	conn := dialOnce(t, l, echo)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	err := tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Error("unexpected error:", err)
+	}
+
+	c = NewConfig()
+	c.NoSNIAlert = "bad_certificate"
+	c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1")
+	if err := c.Validate(); err == nil {
+		t.Error("unknown alert should be an error")
+	}
+}
+
+func TestServerDetectConnect(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+	// the original destination is not used.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	c := NewConfig()
+	c.Mode = ModeProxyProtocol
+	c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1")
+	c.Rules = []*Rule{{Upstream: UpstreamDirect}}
+	c.DetectConnect = true
+	l := serveOnce(t, c)
+	defer l.Close()
+
+	conn := dialOnce(t, l, closed)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	target := echo.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nhello", target, target)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status:", resp.StatusCode)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("unexpected echo: %q", buf)
+	}
+}
+
+func TestServerForwardedHeaders(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	c := NewConfig()
+	c.Mode = ModeProxyProtocol
+	c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1")
+	c.Rules = []*Rule{{Upstream: UpstreamDirect}}
+	c.ForwardedHeaders = true
+	l := serveOnce(t, c)
+	defer l.Close()
+
+	conn := dialOnce(t, l, echo)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: www.example.com\r\n"+
+		"X-Forwarded-For: 192.0.2.1\r\n\r\n")
+
+	// The echo server returns the request received.
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if via := req.Header.Get("Via"); via != "1.1 transocks" {
+		t.Error("unexpected Via:", via)
+	}
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "192.0.2.1, 127.0.0.1" {
+		t.Error("unexpected X-Forwarded-For:", xff)
+	}
+	if ua, ok := req.Header["User-Agent"]; ok {
+		t.Error("User-Agent should not be added:", ua)
+	}
+}
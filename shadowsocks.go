@@ -0,0 +1,316 @@
+// This file provides a dialer type of "ss://" scheme for
+// golang.org/x/net/proxy package.
+//
+// The dialer type will be automatically registered by init().
+//
+// The dialer implements Shadowsocks AEAD protocol (SIP004).
+// The URL follows SIP002 and looks like one of:
+//
+//     ss://BASE64URL(METHOD:PASSWORD)@HOST:PORT
+//     ss://METHOD:PASSWORD@HOST:PORT
+//
+// Supported methods are "aes-128-gcm", "aes-256-gcm", and
+// "chacha20-ietf-poly1305".
+
+package transocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	ssMaxPayloadSize = 0x3FFF
+)
+
+func init() {
+	proxy.RegisterDialerType("ss", ssDialType)
+}
+
+// ssCipher is a Shadowsocks AEAD cipher with a pre-shared key.
+type ssCipher struct {
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ssKDF derives a key from a password like EVP_BytesToKey of OpenSSL.
+func ssKDF(password string, keyLen int) []byte {
+	var key, prev []byte
+	h := md5.New()
+	for len(key) < keyLen {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		key = h.Sum(key)
+		prev = key[len(key)-h.Size():]
+	}
+	return key[:keyLen]
+}
+
+func newSSCipher(method, password string) (*ssCipher, error) {
+	switch strings.ToLower(method) {
+	case "aes-128-gcm":
+		return &ssCipher{ssKDF(password, 16), newAESGCM}, nil
+	case "aes-256-gcm":
+		return &ssCipher{ssKDF(password, 32), newAESGCM}, nil
+	case "chacha20-ietf-poly1305":
+		return &ssCipher{ssKDF(password, chacha20poly1305.KeySize), chacha20poly1305.New}, nil
+	}
+	return nil, errors.New("ss: unsupported method " + method)
+}
+
+// aead returns AEAD for a session identified by salt.
+func (c *ssCipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	_, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey)
+	if err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// increment increments a little-endian nonce.
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// ssConn encrypts and decrypts a stream by Shadowsocks AEAD protocol.
+// The salt for each direction is sent or received at the first
+// Write or Read.
+type ssConn struct {
+	net.Conn
+	cipher *ssCipher
+
+	enc      cipher.AEAD
+	encNonce []byte
+	wbuf     []byte
+
+	dec      cipher.AEAD
+	decNonce []byte
+	rbuf     []byte
+	leftover []byte
+}
+
+func newSSConn(c net.Conn, ciph *ssCipher) *ssConn {
+	return &ssConn{Conn: c, cipher: ciph}
+}
+
+func (c *ssConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	var salt []byte
+	if c.enc == nil {
+		salt = make([]byte, len(c.cipher.key))
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.cipher.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.enc = aead
+		c.encNonce = make([]byte, aead.NonceSize())
+		c.wbuf = make([]byte, len(salt)+2+ssMaxPayloadSize+2*aead.Overhead())
+	}
+
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > ssMaxPayloadSize {
+			chunk = chunk[:ssMaxPayloadSize]
+		}
+
+		buf := append(c.wbuf[:0], salt...)
+		var size [2]byte
+		binary.BigEndian.PutUint16(size[:], uint16(len(chunk)))
+		buf = c.enc.Seal(buf, c.encNonce, size[:], nil)
+		increment(c.encNonce)
+		buf = c.enc.Seal(buf, c.encNonce, chunk, nil)
+		increment(c.encNonce)
+
+		if _, err := c.Conn.Write(buf); err != nil {
+			return n, err
+		}
+		salt = nil
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *ssConn) Read(p []byte) (int, error) {
+	if len(c.leftover) > 0 {
+		n := copy(p, c.leftover)
+		c.leftover = c.leftover[n:]
+		return n, nil
+	}
+
+	if c.dec == nil {
+		salt := make([]byte, len(c.cipher.key))
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.cipher.aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.dec = aead
+		c.decNonce = make([]byte, aead.NonceSize())
+		c.rbuf = make([]byte, ssMaxPayloadSize+aead.Overhead())
+	}
+
+	overhead := c.dec.Overhead()
+	buf := c.rbuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	size, err := c.dec.Open(buf[:0], c.decNonce, buf, nil)
+	if err != nil {
+		return 0, err
+	}
+	increment(c.decNonce)
+
+	buf = c.rbuf[:int(binary.BigEndian.Uint16(size)&ssMaxPayloadSize)+overhead]
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	payload, err := c.dec.Open(buf[:0], c.decNonce, buf, nil)
+	if err != nil {
+		return 0, err
+	}
+	increment(c.decNonce)
+
+	n := copy(p, payload)
+	c.leftover = payload[n:]
+	return n, nil
+}
+
+func (c *ssConn) CloseRead() error {
+	if hc, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
+
+func (c *ssConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+// socksAddr encodes addr in SOCKS5 address format.
+func socksAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port " + portStr)
+	}
+
+	var b []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append([]byte{1}, ip4...)
+		} else {
+			b = append([]byte{4}, ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("too long host name: " + host)
+		}
+		b = append([]byte{3, byte(len(host))}, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+type ssDialer struct {
+	addr    string
+	cipher  *ssCipher
+	forward proxy.Dialer
+}
+
+func ssDialType(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	if u.User == nil {
+		return nil, errors.New("ss: method and password are not specified")
+	}
+
+	method := u.User.Username()
+	password, ok := u.User.Password()
+	if !ok {
+		encoded := strings.TrimRight(method, "=")
+		userinfo, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			userinfo, err = base64.RawStdEncoding.DecodeString(encoded)
+		}
+		if err != nil {
+			return nil, errors.New("ss: invalid user info")
+		}
+		fields := strings.SplitN(string(userinfo), ":", 2)
+		if len(fields) != 2 {
+			return nil, errors.New("ss: invalid user info")
+		}
+		method, password = fields[0], fields[1]
+	}
+
+	ciph, err := newSSCipher(method, password)
+	if err != nil {
+		return nil, err
+	}
+	return &ssDialer{
+		addr:    u.Host,
+		cipher:  ciph,
+		forward: forward,
+	}, nil
+}
+
+func (d *ssDialer) Dial(network, addr string) (net.Conn, error) {
+	target, err := socksAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := newSSConn(c, d.cipher)
+	if _, err := sc.Write(target); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return sc, nil
+}
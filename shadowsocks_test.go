@@ -0,0 +1,114 @@
+package transocks
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSSKDF(t *testing.T) {
+	t.Parallel()
+
+	// MD5("password")
+	expected := "5f4dcc3b5aa765d61d8327deb882cf99"
+	for _, n := range []int{16, 32} {
+		key := ssKDF("password", n)
+		if len(key) != n {
+			t.Fatal("unexpected key length:", len(key))
+		}
+		if hex.EncodeToString(key[:16]) != expected {
+			t.Error("unexpected key:", hex.EncodeToString(key))
+		}
+	}
+}
+
+// serveSS accepts a Shadowsocks connection on l and relays it.
+func serveSS(t *testing.T, l net.Listener, ciph *ssCipher) {
+	c, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+
+	sc := newSSConn(c, ciph)
+	hdr := make([]byte, 7)
+	if _, err := io.ReadFull(sc, hdr); err != nil {
+		t.Error(err)
+		return
+	}
+	if hdr[0] != 1 {
+		t.Error("unexpected address type:", hdr[0])
+		return
+	}
+	addr := net.JoinHostPort(net.IP(hdr[1:5]).String(), strconv.Itoa(int(hdr[5])<<8|int(hdr[6])))
+	dst, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer dst.Close()
+
+	go io.Copy(dst, sc)
+	io.Copy(sc, dst)
+}
+
+func TestSSDialer(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	for _, method := range []string{"aes-128-gcm", "aes-256-gcm", "chacha20-ietf-poly1305"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ciph, err := newSSCipher(method, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveSS(t, l, ciph)
+
+		userinfo := base64.RawURLEncoding.EncodeToString([]byte(method + ":secret"))
+		u, err := url.Parse("ss://" + userinfo + "@" + l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := ssDialType(u, &net.Dialer{Timeout: 5 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := d.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		testEcho(t, c)
+
+		// larger than the maximum payload size
+		data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+		go c.Write(data)
+		buf := make([]byte, len(data))
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Error("data corrupted with", method)
+		}
+		c.Close()
+		l.Close()
+	}
+
+	u, _ := url.Parse("ss://rc4-md5:secret@127.0.0.1:8388")
+	if _, err := ssDialType(u, &net.Dialer{}); err == nil {
+		t.Error("unsupported method should be rejected")
+	}
+}
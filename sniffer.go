@@ -0,0 +1,113 @@
+package transocks
+
+import (
+	"io"
+	"net"
+)
+
+// Sniffer finds the destination host name from the beginning of
+// client streams.
+//
+// Detect reads r and returns the host name and the name of the
+// protocol found.  The returned reader must reproduce all bytes read
+// from r followed by the rest of r, even if an error is returned,
+// because it is relayed to the destination in place of r.  An error
+// means the protocol is not recognized; the next sniffer is tried.
+//
+// Detect should read as little as possible, or clients of other
+// protocols that wait for servers to speak first are delayed until
+// Config.PeekTimeout passes.
+type Sniffer interface {
+	Detect(r io.Reader) (host, proto string, rest io.Reader, err error)
+}
+
+// SnifferFunc is an adapter to use ordinary functions as Sniffer.
+type SnifferFunc func(r io.Reader) (host, proto string, rest io.Reader, err error)
+
+// Detect calls f(r).
+func (f SnifferFunc) Detect(r io.Reader) (string, string, io.Reader, error) {
+	return f(r)
+}
+
+var (
+	sniffers     = make(map[string]Sniffer)
+	snifferNames []string
+)
+
+// RegisterSniffer registers a sniffer for protocol name.
+//
+// Registered sniffers are tried in the order of registration after
+// the built-in ones for TLS and HTTP.  name can also be used in
+// Config.PeekProtocols to try only the sniffer for the port.
+//
+// RegisterSniffer is not safe for concurrent use.  Call it from init
+// functions or before creating servers.
+func RegisterSniffer(name string, s Sniffer) {
+	if _, ok := sniffers[name]; !ok {
+		snifferNames = append(snifferNames, name)
+	}
+	sniffers[name] = s
+}
+
+// isSniffer returns true if a sniffer is registered for name.
+func isSniffer(name string) bool {
+	_, ok := sniffers[name]
+	return ok
+}
+
+func sniffTLS(r io.Reader) (string, string, io.Reader, error) {
+	hello, r, err := peekClientHello(r)
+	if err != nil {
+		return "", "", r, err
+	}
+	return hello.ServerName, PeekTLS, r, nil
+}
+
+func sniffHTTP(r io.Reader) (string, string, io.Reader, error) {
+	authority, r, err := peekHTTP2(r)
+	if err != nil {
+		authority, r, err = peekHTTP(r)
+	}
+	if err != nil {
+		return "", "", r, err
+	}
+	host, _, err := net.SplitHostPort(authority)
+	if err != nil {
+		host = authority
+	}
+	return host, PeekHTTP, r, nil
+}
+
+func init() {
+	RegisterSniffer(PeekTLS, SnifferFunc(sniffTLS))
+	RegisterSniffer(PeekHTTP, SnifferFunc(sniffHTTP))
+}
+
+// peekHost finds the destination host name from the beginning of
+// the client stream r by the sniffer registered for protocol, or by
+// all sniffers if protocol is empty.
+//
+// This returns the host name and the protocol, or empty strings if no
+// sniffer recognizes r.  The returned reader should be used in place
+// of r afterwards.
+func peekHost(r io.Reader, protocol string) (string, string, io.Reader) {
+	names := snifferNames
+	if len(protocol) > 0 {
+		names = []string{protocol}
+	}
+	for _, name := range names {
+		s, ok := sniffers[name]
+		if !ok {
+			continue
+		}
+		host, proto, rest, err := s.Detect(r)
+		r = rest
+		if err == nil {
+			if len(proto) == 0 {
+				proto = name
+			}
+			return host, proto, r
+		}
+	}
+	return "", "", r
+}
@@ -0,0 +1,123 @@
+// This file provides a dialer type of "socks4://" and "socks4a://" schemes
+// for golang.org/x/net/proxy package.
+//
+// The dialer type will be automatically registered by init().
+//
+// Since SOCKS4 can handle only IPv4 addresses, host names are sent to
+// the proxy by SOCKS4a extension.  IPv6 destinations are not supported.
+
+package transocks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	socks4Version    = 4
+	socks4CmdConnect = 1
+	socks4Granted    = 90
+)
+
+var socks4Errors = map[byte]string{
+	91: "request rejected or failed",
+	92: "request rejected because SOCKS server cannot connect to identd on the client",
+	93: "request rejected because the client program and identd report different user-ids",
+}
+
+func init() {
+	proxy.RegisterDialerType("socks4", socks4DialType)
+	proxy.RegisterDialerType("socks4a", socks4DialType)
+}
+
+type socks4Dialer struct {
+	addr    string
+	userID  string
+	forward proxy.Dialer
+}
+
+func socks4DialType(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	d := &socks4Dialer{
+		addr:    u.Host,
+		forward: forward,
+	}
+	if u.User != nil {
+		d.userID = u.User.Username()
+	}
+	return d, nil
+}
+
+func (d *socks4Dialer) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, errors.New("socks4: unsupported network " + network)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.New("socks4: invalid port " + portStr)
+	}
+
+	req := []byte{socks4Version, socks4CmdConnect, byte(port >> 8), byte(port)}
+	var hostname string
+	if ip := net.ParseIP(host); ip != nil {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil, errors.New("socks4: IPv6 address is not supported: " + host)
+		}
+		req = append(req, ip4...)
+	} else {
+		// SOCKS4a: 0.0.0.x (x != 0) tells the server to resolve the name.
+		req = append(req, 0, 0, 0, 1)
+		hostname = host
+	}
+	req = append(req, d.userID...)
+	req = append(req, 0)
+	if len(hostname) > 0 {
+		req = append(req, hostname...)
+		req = append(req, 0)
+	}
+
+	c, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = c.Write(req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	var resp [8]byte
+	_, err = io.ReadFull(c, resp[:])
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if resp[1] != socks4Granted {
+		c.Close()
+		msg, ok := socks4Errors[resp[1]]
+		if !ok {
+			msg = fmt.Sprintf("unknown reply code %d", resp[1])
+		}
+		return nil, errors.New("socks4: " + msg)
+	}
+
+	var zero time.Time
+	c.SetDeadline(zero)
+	return c, nil
+}
@@ -0,0 +1,91 @@
+package transocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSOCKS4Dialer(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	u, err := url.Parse("socks4://alice@" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := socks4DialType(u, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		addr     string
+		request  []byte
+		code     byte
+		expectOK bool
+	}{
+		{
+			"192.0.2.1:80",
+			[]byte("\x04\x01\x00\x50\xc0\x00\x02\x01alice\x00"),
+			90, true,
+		},
+		{
+			"www.example.com:443",
+			[]byte("\x04\x01\x01\xbb\x00\x00\x00\x01alice\x00www.example.com\x00"),
+			90, true,
+		},
+		{
+			"192.0.2.1:22",
+			[]byte("\x04\x01\x00\x16\xc0\x00\x02\x01alice\x00"),
+			91, false,
+		},
+	}
+
+	for _, tc := range testCases {
+		ch := make(chan []byte, 1)
+		go func(code byte, n int) {
+			c, err := l.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(c, buf); err != nil {
+				t.Error(err)
+				return
+			}
+			ch <- buf
+			c.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+		}(tc.code, len(tc.request))
+
+		conn, err := d.Dial("tcp", tc.addr)
+		req := <-ch
+		if !bytes.Equal(req, tc.request) {
+			t.Errorf("unexpected request for %s: %q", tc.addr, req)
+		}
+		if tc.expectOK {
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			conn.Close()
+		} else if err == nil {
+			t.Errorf("dial to %s should fail", tc.addr)
+		}
+	}
+
+	_, err = d.Dial("tcp", "[2001:db8::1]:80")
+	if err == nil {
+		t.Error("IPv6 should not be supported")
+	}
+}
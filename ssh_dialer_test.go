@@ -0,0 +1,175 @@
+package transocks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// serveSSH accepts SSH connections on l and handles direct-tcpip channels.
+func serveSSH(t *testing.T, l net.Listener, config *ssh.ServerConfig) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				t.Log(err)
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for nc := range chans {
+				if nc.ChannelType() != "direct-tcpip" {
+					nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+					continue
+				}
+				data := nc.ExtraData()
+				n := binary.BigEndian.Uint32(data)
+				host := string(data[4 : 4+n])
+				port := binary.BigEndian.Uint32(data[4+n:])
+				dst, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+				if err != nil {
+					nc.Reject(ssh.ConnectionFailed, err.Error())
+					continue
+				}
+				ch, creqs, err := nc.Accept()
+				if err != nil {
+					dst.Close()
+					continue
+				}
+				go ssh.DiscardRequests(creqs)
+				go func() {
+					io.Copy(ch, dst)
+					ch.Close()
+				}()
+				go func() {
+					io.Copy(dst, ch)
+					dst.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func TestSSHDialer(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "transocks-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := filepath.Join(dir, "id_ecdsa")
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	if err := ioutil.WriteFile(identity, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshClientPub, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "alice" && string(key.Marshal()) == string(sshClientPub.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveSSH(t, l, config)
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{l.Addr().String()}, hostSigner.PublicKey())
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	u, err := url.Parse("ssh://alice@" + l.Addr().String() +
+		"?identity=" + url.QueryEscape(identity) + "&known_hosts=" + url.QueryEscape(knownHosts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := sshDialType(u, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		c, err := d.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		testEcho(t, c)
+		c.Close()
+	}
+
+	// the destination is unreachable.
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2.Close()
+	_, err = d.Dial("tcp", l2.Addr().String())
+	if err == nil {
+		t.Fatal("dial should fail")
+	}
+	if isUpstreamError(err) {
+		t.Error("error from the destination should not be an upstream error:", err)
+	}
+
+	// unknown host key
+	ioutil.WriteFile(knownHosts, nil, 0600)
+	d, err = sshDialType(u, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Dial("tcp", echo.Addr().String())
+	if !isUpstreamError(err) {
+		t.Error("host key should be verified:", err)
+	}
+}
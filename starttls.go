@@ -0,0 +1,224 @@
+package transocks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// This file finds TLS server names of mail protocols upgraded by
+// STARTTLS.
+//
+// The ClientHello is sent only after the server accepts STARTTLS, so
+// transocks speaks to the client on behalf of the server until then.
+// After connecting to the upstream, the commands answered by transocks
+// are sent to the real server and its responses are discarded.  Then
+// the rest of the client stream, the ClientHello or a command that
+// transocks does not answer, is relayed as usual.
+
+// Protocols of Config.PeekProtocols upgraded by STARTTLS.
+const (
+	// PeekSMTP looks for TLS server name after SMTP STARTTLS.
+	PeekSMTP = "smtp"
+
+	// PeekIMAP looks for TLS server name after IMAP STARTTLS.
+	PeekIMAP = "imap"
+
+	// PeekPOP3 looks for TLS server name after POP3 STLS.
+	PeekPOP3 = "pop3"
+)
+
+const maxMailLineSize = 1024
+
+// isStartTLS returns true if protocol is upgraded by STARTTLS.
+func isStartTLS(protocol string) bool {
+	switch protocol {
+	case PeekSMTP, PeekIMAP, PeekPOP3:
+		return true
+	}
+	return false
+}
+
+// readMailLine reads a line including the terminating LF from r.
+// r is read byte by byte so that the data following the line remains
+// unread.
+func readMailLine(r io.Reader) (string, error) {
+	buf := make([]byte, 0, 128)
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		buf = append(buf, b[0])
+		if b[0] == '\n' {
+			return string(buf), nil
+		}
+		if len(buf) == maxMailLineSize {
+			return "", errors.New("too long line")
+		}
+	}
+}
+
+// mailCommand splits a command line into the IMAP tag and the
+// upper-cased verb.
+func mailCommand(protocol, line string) (string, string) {
+	fields := strings.Fields(line)
+	var tag string
+	if protocol == PeekIMAP && len(fields) > 0 {
+		tag, fields = fields[0], fields[1:]
+	}
+	if len(fields) == 0 {
+		return tag, ""
+	}
+	return tag, strings.ToUpper(fields[0])
+}
+
+// mailGreeting returns the greeting sent to clients.
+func mailGreeting(protocol string) string {
+	switch protocol {
+	case PeekSMTP:
+		return "220 transocks ESMTP\r\n"
+	case PeekIMAP:
+		return "* OK [CAPABILITY IMAP4rev1 STARTTLS] transocks ready\r\n"
+	}
+	return "+OK transocks ready\r\n"
+}
+
+// mailAnswer returns the response to a client command line.
+// starttls is true if the command starts TLS.  If transocks does not
+// answer the command, ok is false.
+func mailAnswer(protocol, line string) (resp string, starttls, ok bool) {
+	tag, verb := mailCommand(protocol, line)
+	switch protocol {
+	case PeekSMTP:
+		switch verb {
+		case "EHLO":
+			return "250-transocks\r\n250 STARTTLS\r\n", false, true
+		case "STARTTLS":
+			return "220 Ready to start TLS\r\n", true, true
+		}
+	case PeekIMAP:
+		switch verb {
+		case "CAPABILITY":
+			return "* CAPABILITY IMAP4rev1 STARTTLS\r\n" + tag + " OK CAPABILITY completed\r\n", false, true
+		case "STARTTLS":
+			return tag + " OK Begin TLS negotiation now\r\n", true, true
+		}
+	case PeekPOP3:
+		switch verb {
+		case "CAPA":
+			return "+OK\r\nSTLS\r\n.\r\n", false, true
+		case "STLS":
+			return "+OK Begin TLS negotiation\r\n", true, true
+		}
+	}
+	return "", false, false
+}
+
+// peekStartTLS speaks protocol with the client rw until it starts TLS,
+// and returns the server name in its ClientHello.  Command lines
+// answered by transocks are returned to be replayed by replayStartTLS.
+// Bytes read from rw and not answered are written to rest.
+//
+// If no server name is found, this returns an empty string.
+func peekStartTLS(rw io.ReadWriter, protocol string, rest io.Writer) (string, []string) {
+	if _, err := io.WriteString(rw, mailGreeting(protocol)); err != nil {
+		return "", nil
+	}
+
+	var answered []string
+	for {
+		line, err := readMailLine(rw)
+		if err != nil {
+			return "", answered
+		}
+		resp, starttls, ok := mailAnswer(protocol, line)
+		if !ok {
+			io.WriteString(rest, line)
+			return "", answered
+		}
+		answered = append(answered, line)
+		if _, err := io.WriteString(rw, resp); err != nil {
+			return "", answered
+		}
+		if starttls {
+			break
+		}
+	}
+
+	hello, err := readClientHello(io.TeeReader(rw, rest))
+	if err != nil {
+		return "", answered
+	}
+	return hello.ServerName, answered
+}
+
+// readMailResponse reads the response of a server to line, or the
+// greeting if line is empty.  It returns an error if the response
+// is negative.
+func readMailResponse(r io.Reader, protocol, line string) error {
+	tag, verb := mailCommand(protocol, line)
+	resp, err := readMailLine(r)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	switch protocol {
+	case PeekSMTP:
+		// Lines of multi-line responses but the last have "-" after
+		// the reply code.
+		for len(resp) > 3 && resp[3] == '-' {
+			if resp, err = readMailLine(r); err != nil {
+				return err
+			}
+		}
+		ok = strings.HasPrefix(resp, "2")
+	case PeekIMAP:
+		// Untagged responses precede the tagged one.
+		prefix := "* "
+		if len(line) > 0 {
+			prefix = tag + " "
+			for !strings.HasPrefix(resp, prefix) {
+				if resp, err = readMailLine(r); err != nil {
+					return err
+				}
+			}
+		}
+		ok = strings.HasPrefix(resp, prefix+"OK")
+	case PeekPOP3:
+		ok = strings.HasPrefix(resp, "+OK")
+		// The positive response to CAPA continues until a line of ".".
+		for ok && verb == "CAPA" {
+			l, err := readMailLine(r)
+			if err != nil {
+				return err
+			}
+			if strings.TrimRight(l, "\r\n") == "." {
+				break
+			}
+		}
+	}
+	if !ok {
+		return fmt.Errorf("negative response: %q", strings.TrimRight(resp, "\r\n"))
+	}
+	return nil
+}
+
+// replayStartTLS sends command lines answered by peekStartTLS to the
+// server rw, and discards the greeting and responses.
+func replayStartTLS(rw io.ReadWriter, protocol string, answered []string) error {
+	if err := readMailResponse(rw, protocol, ""); err != nil {
+		return err
+	}
+	for _, line := range answered {
+		if _, err := io.WriteString(rw, line); err != nil {
+			return err
+		}
+		if err := readMailResponse(rw, protocol, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
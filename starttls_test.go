@@ -0,0 +1,131 @@
+package transocks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPeekStartTLS(t *testing.T) {
+	t.Parallel()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		defer c2.Close()
+		r := bufio.NewReader(c2)
+		// reads a possibly multi-line reply
+		readReply := func() {
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil || len(l) < 4 || l[3] != '-' {
+					return
+				}
+			}
+		}
+		readReply()
+		fmt.Fprint(c2, "EHLO client.example.com\r\n")
+		readReply()
+		fmt.Fprint(c2, "STARTTLS\r\n")
+		readReply()
+		tls.Client(c2, &tls.Config{ServerName: "smtp.example.com"}).Handshake()
+	}()
+
+	rest := new(bytes.Buffer)
+	host, answered := peekStartTLS(c1, PeekSMTP, rest)
+	if host != "smtp.example.com" {
+		t.Error("unexpected server name:", host)
+	}
+	if len(answered) != 2 || answered[1] != "STARTTLS\r\n" {
+		t.Errorf("unexpected answered commands: %q", answered)
+	}
+	if rest.Len() == 0 || rest.Bytes()[0] != 22 {
+		t.Error("ClientHello should be kept")
+	}
+}
+
+func TestPeekStartTLSUnanswered(t *testing.T) {
+	t.Parallel()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		defer c2.Close()
+		r := bufio.NewReader(c2)
+		r.ReadString('\n')
+		fmt.Fprint(c2, "a1 CAPABILITY\r\n")
+		r.ReadString('\n')
+		r.ReadString('\n')
+		fmt.Fprint(c2, "a2 LOGIN user pass\r\n")
+	}()
+
+	rest := new(bytes.Buffer)
+	host, answered := peekStartTLS(c1, PeekIMAP, rest)
+	if host != "" {
+		t.Error("unexpected server name:", host)
+	}
+	if len(answered) != 1 || answered[0] != "a1 CAPABILITY\r\n" {
+		t.Errorf("unexpected answered commands: %q", answered)
+	}
+	if rest.String() != "a2 LOGIN user pass\r\n" {
+		t.Errorf("unexpected rest: %q", rest.String())
+	}
+}
+
+// mailServer is a ReadWriter that reads responses from a string and
+// records written commands.
+type mailServer struct {
+	*strings.Reader
+	bytes.Buffer
+}
+
+func (s *mailServer) Read(p []byte) (int, error) {
+	return s.Reader.Read(p)
+}
+
+func TestReplayStartTLS(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		protocol  string
+		answered  []string
+		responses string
+		ok        bool
+	}{
+		{PeekSMTP, []string{"EHLO c\r\n", "STARTTLS\r\n"},
+			"220-mail\r\n220 ESMTP\r\n250-mail\r\n250-SIZE 100\r\n250 STARTTLS\r\n220 go ahead\r\n", true},
+		{PeekSMTP, []string{"EHLO c\r\n", "STARTTLS\r\n"},
+			"220 ESMTP\r\n250 mail\r\n454 TLS not available\r\n", false},
+		{PeekIMAP, []string{"a1 CAPABILITY\r\n", "a2 STARTTLS\r\n"},
+			"* OK ready\r\n* CAPABILITY IMAP4rev1 STARTTLS\r\na1 OK done\r\na2 OK begin\r\n", true},
+		{PeekIMAP, []string{"a1 STARTTLS\r\n"},
+			"* OK ready\r\na1 BAD no\r\n", false},
+		{PeekPOP3, []string{"CAPA\r\n", "STLS\r\n"},
+			"+OK ready\r\n+OK\r\nSTLS\r\nUSER\r\n.\r\n+OK begin\r\n", true},
+		{PeekPOP3, []string{"STLS\r\n"},
+			"+OK ready\r\n-ERR no\r\n", false},
+	}
+
+	for _, tc := range testCases {
+		s := &mailServer{Reader: strings.NewReader(tc.responses)}
+		err := replayStartTLS(s, tc.protocol, tc.answered)
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", tc.protocol, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: negative response should be an error", tc.protocol)
+		}
+		if tc.ok {
+			if s.Buffer.String() != strings.Join(tc.answered, "") {
+				t.Errorf("%s: unexpected commands: %q", tc.protocol, s.Buffer.String())
+			}
+			if s.Reader.Len() != 0 {
+				t.Errorf("%s: responses remain", tc.protocol)
+			}
+		}
+	}
+}
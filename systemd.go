@@ -0,0 +1,62 @@
+package transocks
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+)
+
+// This file implements systemd socket activation.
+// See sd_listen_fds(3).
+
+const (
+	// listenFDsStart is the first file descriptor passed by systemd.
+	listenFDsStart = 3
+)
+
+// listenFDs returns the number of sockets passed by systemd.
+// It returns zero if the sockets are passed to another process.
+func listenFDs(getenv func(string) string, pid int) (int, error) {
+	p := getenv("LISTEN_PID")
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if p != strconv.Itoa(pid) {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid LISTEN_FDS: " + getenv("LISTEN_FDS"))
+	}
+	return n, nil
+}
+
+// systemdListeners returns listeners passed by systemd socket activation.
+// It returns nil if transocks is not socket-activated.
+func systemdListeners() ([]net.Listener, error) {
+	n, err := listenFDs(os.Getenv, os.Getpid())
+	if err != nil || n == 0 {
+		return nil, err
+	}
+
+	// Child processes should not use the sockets.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	lns := make([]net.Listener, 0, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
@@ -0,0 +1,31 @@
+package transocks
+
+import "testing"
+
+func TestListenFDs(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		env      map[string]string
+		expect   int
+		expectOK bool
+	}{
+		{map[string]string{}, 0, true},
+		{map[string]string{"LISTEN_PID": "100", "LISTEN_FDS": "2"}, 2, true},
+		{map[string]string{"LISTEN_PID": "101", "LISTEN_FDS": "2"}, 0, true},
+		{map[string]string{"LISTEN_PID": "100", "LISTEN_FDS": "x"}, 0, false},
+		{map[string]string{"LISTEN_PID": "100"}, 0, false},
+	}
+
+	for _, tc := range testCases {
+		getenv := func(key string) string { return tc.env[key] }
+		n, err := listenFDs(getenv, 100)
+		if tc.expectOK != (err == nil) {
+			t.Errorf("unexpected error for %v: %v", tc.env, err)
+			continue
+		}
+		if n != tc.expect {
+			t.Errorf("unexpected number for %v: %d", tc.env, n)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package transocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// This file implements throttling by token buckets, for bandwidth of
+// connections from the same client and for new connections.
+
+// tokenBucket allows rate tokens per second with bursts of up to
+// burst tokens.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// take removes n tokens from b and returns the time to wait before
+// using them.
+func (b *tokenBucket) take(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	b.tokens -= float64(n)
+	return b.wait()
+}
+
+// takeWithin is like take, but removes no tokens and returns false
+// if the time to wait would exceed max.
+func (b *tokenBucket) takeWithin(n int, max time.Duration, now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	b.tokens -= float64(n)
+	d := b.wait()
+	if d > max {
+		b.tokens += float64(n)
+		return 0, false
+	}
+	return d, true
+}
+
+// sleep waits for d or until ctx is canceled.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads from r as fast as b allows.
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	b     *tokenBucket
+	burst int
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > tr.burst {
+		p = p[:tr.burst]
+	}
+	n, err := tr.r.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	if serr := sleep(tr.ctx, tr.b.take(n, time.Now())); serr != nil {
+		return n, serr
+	}
+	return n, err
+}
+
+// throttleReader returns r throttled by b.  If b is nil, r is returned
+// as is to keep splice(2) for TCP connections.
+func throttleReader(ctx context.Context, r io.Reader, b *tokenBucket) io.Reader {
+	if b == nil {
+		return r
+	}
+	burst := int(b.burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &throttledReader{ctx: ctx, r: r, b: b, burst: burst}
+}
+
+// clientBuckets are buckets for bytes sent and received by a client.
+type clientBuckets struct {
+	up, down *tokenBucket
+	refs     int
+}
+
+// throttle keeps buckets of clients for Rule.RateLimit.
+// Buckets are kept while clients have connections.
+type throttle struct {
+	rate    int64
+	prefix4 net.IPMask
+	prefix6 net.IPMask
+
+	mu      sync.Mutex
+	buckets map[string]*clientBuckets
+}
+
+func newThrottle(rate int64, prefix4, prefix6 int) (*throttle, error) {
+	if prefix4 == 0 {
+		prefix4 = 8 * net.IPv4len
+	}
+	if prefix6 == 0 {
+		prefix6 = 8 * net.IPv6len
+	}
+	if prefix4 < 0 || prefix4 > 8*net.IPv4len {
+		return nil, fmt.Errorf("invalid rate limit prefix: %d", prefix4)
+	}
+	if prefix6 < 0 || prefix6 > 8*net.IPv6len {
+		return nil, fmt.Errorf("invalid rate limit prefix for IPv6: %d", prefix6)
+	}
+	return &throttle{
+		rate:    rate,
+		prefix4: net.CIDRMask(prefix4, 8*net.IPv4len),
+		prefix6: net.CIDRMask(prefix6, 8*net.IPv6len),
+		buckets: make(map[string]*clientBuckets),
+	}, nil
+}
+
+// key returns the key of the client at ip.  Clients of unknown
+// addresses share a key.
+func (t *throttle) key(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(t.prefix4).String()
+	}
+	return ip.Mask(t.prefix6).String()
+}
+
+// acquire returns the buckets for the client at ip.
+// Call release with the returned key after relaying.
+func (t *throttle) acquire(ip net.IP) (string, *clientBuckets) {
+	key := t.key(ip)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cb, ok := t.buckets[key]
+	if !ok {
+		now := time.Now()
+		rate := float64(t.rate)
+		cb = &clientBuckets{
+			up:   newTokenBucket(rate, rate, now),
+			down: newTokenBucket(rate, rate, now),
+		}
+		t.buckets[key] = cb
+	}
+	cb.refs++
+	return key, cb
+}
+
+func (t *throttle) release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cb, ok := t.buckets[key]
+	if !ok {
+		return
+	}
+	cb.refs--
+	if cb.refs <= 0 {
+		delete(t.buckets, key)
+	}
+}
+
+// connLimiter limits the rate of new connections.
+type connLimiter struct {
+	bucket *tokenBucket
+	queue  time.Duration
+}
+
+func newConnLimiter(rate float64, burst int, queue time.Duration) *connLimiter {
+	if burst <= 0 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &connLimiter{
+		bucket: newTokenBucket(rate, float64(burst), time.Now()),
+		queue:  queue,
+	}
+}
+
+// accept returns nil if a new connection can be handled, possibly
+// after waiting for up to the queue time.  l may be nil.
+func (l *connLimiter) accept(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	d, ok := l.bucket.takeWithin(1, l.queue, time.Now())
+	if !ok {
+		return errors.New("connection rate limit exceeded")
+	}
+	return sleep(ctx, d)
+}
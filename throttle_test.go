@@ -0,0 +1,121 @@
+package transocks
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	b := newTokenBucket(1000, 1000, now)
+	if d := b.take(1000, now); d != 0 {
+		t.Error("burst of a second should not wait:", d)
+	}
+	if d := b.take(500, now); d != 500*time.Millisecond {
+		t.Error("unexpected wait:", d)
+	}
+	// tokens are refilled up to the rate.
+	now = now.Add(10 * time.Second)
+	if d := b.take(1000, now); d != 0 {
+		t.Error("refilled bucket should not wait:", d)
+	}
+	if d := b.take(100, now); d != 100*time.Millisecond {
+		t.Error("unexpected wait:", d)
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("a"), 3000)
+	b := newTokenBucket(10000, 10000, time.Now())
+	b.take(10000, time.Now())
+
+	st := time.Now()
+	got, err := ioutil.ReadAll(throttleReader(context.Background(), bytes.NewReader(data), b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data is not relayed as is")
+	}
+	if elapsed := time.Since(st); elapsed < 250*time.Millisecond {
+		t.Error("reading is not throttled:", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.take(10000, time.Now())
+	if _, err := ioutil.ReadAll(throttleReader(ctx, bytes.NewReader(data), b)); err != context.Canceled {
+		t.Error("reading should be canceled:", err)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	t.Parallel()
+
+	th, err := newThrottle(1000, 24, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k1, cb1 := th.acquire(net.ParseIP("192.0.2.1"))
+	k2, cb2 := th.acquire(net.ParseIP("192.0.2.2"))
+	k3, cb3 := th.acquire(net.ParseIP("2001:db8::1"))
+	k4, cb4 := th.acquire(net.ParseIP("2001:db8::2"))
+	if cb1 != cb2 {
+		t.Error("clients in the same network should share buckets")
+	}
+	if cb3 == cb4 {
+		t.Error("IPv6 clients should have their own buckets")
+	}
+	if cb1.up == cb1.down {
+		t.Error("directions should have their own buckets")
+	}
+
+	th.release(k1)
+	th.release(k3)
+	th.release(k4)
+	if len(th.buckets) != 1 {
+		t.Error("buckets of clients with connections should be kept")
+	}
+	th.release(k2)
+	if len(th.buckets) != 0 {
+		t.Error("buckets should be removed")
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	t.Parallel()
+
+	var l *connLimiter
+	if err := l.accept(context.Background()); err != nil {
+		t.Error("nil limiter should accept all:", err)
+	}
+
+	l = newConnLimiter(10, 2, 0)
+	for i := 0; i < 2; i++ {
+		if err := l.accept(context.Background()); err != nil {
+			t.Fatal("burst should be accepted:", err)
+		}
+	}
+	if err := l.accept(context.Background()); err == nil {
+		t.Error("connection over the limit should be rejected")
+	}
+
+	l = newConnLimiter(10, 1, time.Second)
+	l.accept(context.Background())
+	st := time.Now()
+	if err := l.accept(context.Background()); err != nil {
+		t.Fatal("connection should be queued:", err)
+	}
+	if elapsed := time.Since(st); elapsed < 50*time.Millisecond {
+		t.Error("connection should wait:", elapsed)
+	}
+}
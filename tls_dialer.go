@@ -0,0 +1,53 @@
+package transocks
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// tlsDialer is a proxy.Dialer that establishes TLS sessions over
+// connections created by forward.
+type tlsDialer struct {
+	forward proxy.Dialer
+	config  *tls.Config
+}
+
+func (d *tlsDialer) Dial(network, addr string) (net.Conn, error) {
+	c, err := d.forward.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg *tls.Config
+	if d.config != nil {
+		cfg = d.config.Clone()
+	} else {
+		cfg = new(tls.Config)
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+
+	tc := tls.Client(c, cfg)
+	c.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err = tc.Handshake()
+	if err != nil {
+		c.Close()
+		return nil, &upstreamError{err}
+	}
+	var zero time.Time
+	c.SetDeadline(zero)
+	return tc, nil
+}
@@ -0,0 +1,134 @@
+package transocks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHTTPSProxy(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" || r.Host != "www.example.com:443" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forward := &net.Dialer{Timeout: 5 * time.Second}
+
+	d, err := newProxyDialer(u, forward, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Dial("tcp", "www.example.com:443")
+	if err == nil {
+		t.Error("certificate of the proxy should not be trusted")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	d, err = newProxyDialer(u, forward, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", "www.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	d, err = newProxyDialer(u, forward, &tls.Config{RootCAs: pool, ServerName: "www.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Dial("tcp", "www.example.com:443")
+	if err == nil {
+		t.Error("server name should be verified")
+	}
+}
+
+func TestSOCKS5OverTLS(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := ts.Certificate()
+	cfg := &tls.Config{Certificates: ts.TLS.Certificates}
+	ts.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		// method selection: accept "no authentication"
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Error(err)
+			return
+		}
+		c.Write([]byte{5, 0})
+
+		// CONNECT request with a domain name
+		buf = make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Error(err)
+			return
+		}
+		host := make([]byte, int(buf[4])+2)
+		if _, err := io.ReadFull(c, host); err != nil {
+			t.Error(err)
+			return
+		}
+		if string(host[:len(host)-2]) != "www.example.com" {
+			t.Error("unexpected host:", string(host[:len(host)-2]))
+		}
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		c.Write([]byte("hello"))
+	}()
+
+	u, err := url.Parse("socks5s://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	d, err := newProxyDialer(u, &net.Dialer{Timeout: 5 * time.Second}, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", "www.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Error("unexpected data:", string(buf))
+	}
+}
@@ -0,0 +1,33 @@
+// +build freebsd
+
+package transocks
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setBindAny sets IP_BINDANY and IPV6_BINDANY to fd.
+func setBindAny(fd int, network string) error {
+	if network == "tcp6" {
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_BINDANY, 1)
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_BINDANY, 1); err != nil {
+		return err
+	}
+	if network == "tcp4" {
+		return nil
+	}
+	// IPV6_BINDANY fails for IPv4 only sockets.
+	unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_BINDANY, 1)
+	return nil
+}
+
+// listenTransparent creates a listener with IP_BINDANY and IPV6_BINDANY
+// socket options to accept connections diverted by pf divert-to or
+// ipfw fwd.  The original destination is the local address of accepted
+// connections.  opts are also set.  transocks must run as root.
+func listenTransparent(addr string, opts ...socketOption) (net.Listener, error) {
+	return listenTCP(addr, append(opts, setBindAny)...)
+}
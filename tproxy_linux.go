@@ -0,0 +1,35 @@
+// +build linux
+
+package transocks
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setTransparent sets IP_TRANSPARENT and IPV6_TRANSPARENT to fd.
+func setTransparent(fd int, network string) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+		return err
+	}
+	switch network {
+	case "tcp4", "udp4":
+		return nil
+	}
+	// IPV6_TRANSPARENT fails for IPv4 only sockets.
+	err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+	switch network {
+	case "tcp6", "udp6":
+		return err
+	}
+	return nil
+}
+
+// listenTransparent creates a listener with IP_TRANSPARENT and
+// IPV6_TRANSPARENT socket options for TPROXY.  opts are also set.
+//
+// CAP_NET_ADMIN capability is required.
+func listenTransparent(addr string, opts ...socketOption) (net.Listener, error) {
+	return listenTCP(addr, append(opts, setTransparent)...)
+}
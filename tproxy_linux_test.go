@@ -0,0 +1,59 @@
+// +build linux
+
+package transocks
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestListenTransparent(t *testing.T) {
+	t.Parallel()
+
+	if os.Geteuid() != 0 {
+		t.Skip("CAP_NET_ADMIN is required")
+	}
+
+	l, err := listenTransparent("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.LocalAddr().String() != l.Addr().String() {
+		t.Error("unexpected local address:", c.LocalAddr())
+	}
+}
+
+func TestListenTransparentUDP(t *testing.T) {
+	t.Parallel()
+
+	if os.Geteuid() != 0 {
+		t.Skip("CAP_NET_ADMIN is required")
+	}
+
+	pc, err := listenTransparentUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// A new process listens on the address during graceful restart.
+	pc2, err := listenTransparentUDP(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal("address should be reusable:", err)
+	}
+	pc2.Close()
+}
@@ -0,0 +1,14 @@
+// +build !linux,!freebsd
+
+package transocks
+
+import (
+	"errors"
+	"net"
+)
+
+var errTPROXYUnsupported = errors.New("tproxy mode is supported only on Linux and FreeBSD")
+
+func listenTransparent(addr string, opts ...socketOption) (net.Listener, error) {
+	return nil, errTPROXYUnsupported
+}
@@ -0,0 +1,360 @@
+package transocks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// This file exports spans of connections to an OpenTelemetry collector
+// by OTLP over HTTP with JSON encoding.  A connection has a span with
+// child spans for reading client streams, dialing, and relaying.
+
+const (
+	traceBatchSize     = 512
+	traceQueueSize     = 4096
+	traceFlushInterval = 5 * time.Second
+	traceExportTimeout = 10 * time.Second
+	traceServiceName   = "transocks"
+)
+
+// Kinds of spans in OTLP.
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+// span is a span of a trace.  Methods of a nil span do nothing, so that
+// callers need not check whether tracing is enabled.
+type span struct {
+	tracer *tracer
+	root   *span
+	parent []byte
+	id     []byte
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+
+	// traceID and remote are set only in the root span.
+	traceID []byte
+	remote  []byte
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	err   string
+}
+
+func randomID(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// start starts a root span.  t may be nil.
+func (t *tracer) start(name string, kind int) *span {
+	if t == nil {
+		return nil
+	}
+	sp := &span{
+		tracer:  t,
+		id:      randomID(8),
+		name:    name,
+		kind:    kind,
+		start:   time.Now(),
+		traceID: randomID(16),
+		attrs:   make(map[string]interface{}),
+	}
+	sp.root = sp
+	return sp
+}
+
+// child starts a child span of sp.
+func (sp *span) child(name string, kind int) *span {
+	if sp == nil {
+		return nil
+	}
+	return &span{
+		tracer: sp.tracer,
+		root:   sp.root,
+		parent: sp.id,
+		id:     randomID(8),
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  make(map[string]interface{}),
+	}
+}
+
+// adopt makes the trace of sp a part of the trace in traceparent, the
+// W3C Trace Context header sent by the client.  This must be called
+// before any span of the trace finishes.
+func (sp *span) adopt(traceparent string) {
+	if sp == nil {
+		return
+	}
+	// version "-" trace-id "-" parent-id "-" flags
+	if len(traceparent) < 55 || traceparent[2] != '-' || traceparent[35] != '-' || traceparent[52] != '-' {
+		return
+	}
+	traceID, err1 := hex.DecodeString(traceparent[3:35])
+	parent, err2 := hex.DecodeString(traceparent[36:52])
+	if err1 != nil || err2 != nil || bytes.Equal(traceID, make([]byte, 16)) {
+		return
+	}
+	sp.root.traceID = traceID
+	sp.root.remote = parent
+}
+
+func (sp *span) set(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	sp.attrs[key] = value
+	sp.mu.Unlock()
+}
+
+// fail sets the status of sp to error.
+func (sp *span) fail(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.mu.Lock()
+	sp.err = err.Error()
+	sp.mu.Unlock()
+}
+
+// finish ends sp and queues it for export.  fields of access logs are
+// added as attributes prefixed by "transocks.".
+func (sp *span) finish(fields map[string]interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	for k, v := range fields {
+		if k == log.FnType {
+			continue
+		}
+		sp.attrs["transocks."+k] = v
+	}
+	sp.end = time.Now()
+	sp.mu.Unlock()
+
+	select {
+	case sp.tracer.queue <- sp:
+	default:
+		// spans are dropped rather than blocking connections.
+	}
+}
+
+// tracer exports spans to Config.TracingEndpoint.
+type tracer struct {
+	endpoint string
+	client   *http.Client
+	logger   *log.Logger
+	queue    chan *span
+}
+
+func newTracer(u *url.URL, logger *log.Logger) *tracer {
+	return &tracer{
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: traceExportTimeout},
+		logger:   logger,
+		queue:    make(chan *span, traceQueueSize),
+	}
+}
+
+// run exports queued spans in batches until ctx is done.
+func (t *tracer) run(ctx context.Context) {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case <-ctx.Done():
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			// ctx cannot be used to export the rest.
+			t.export(context.Background(), batch)
+			return
+		case sp := <-t.queue:
+			batch = append(batch, sp)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		t.export(ctx, batch)
+		batch = nil
+	}
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+func otlpAttributeOf(key string, v interface{}) otlpAttribute {
+	var value otlpValue
+	switch v := v.(type) {
+	case string:
+		value.StringValue = &v
+	case bool:
+		value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		value.IntValue = &s
+	case float64:
+		value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		value.StringValue = &s
+	}
+	return otlpAttribute{key, value}
+}
+
+func (sp *span) otlp() otlpSpan {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	parent := sp.parent
+	if sp.root == sp {
+		parent = sp.remote
+	}
+	s := otlpSpan{
+		TraceID:      hex.EncodeToString(sp.root.traceID),
+		SpanID:       hex.EncodeToString(sp.id),
+		ParentSpanID: hex.EncodeToString(parent),
+		Name:         sp.name,
+		Kind:         sp.kind,
+		Start:        strconv.FormatInt(sp.start.UnixNano(), 10),
+		End:          strconv.FormatInt(sp.end.UnixNano(), 10),
+	}
+	keys := make([]string, 0, len(sp.attrs))
+	for k := range sp.attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.Attributes = append(s.Attributes, otlpAttributeOf(k, sp.attrs[k]))
+	}
+	if len(sp.err) > 0 {
+		s.Status = &otlpStatus{Code: 2, Message: sp.err}
+	}
+	return s
+}
+
+// otlpRequest returns an ExportTraceServiceRequest of spans in JSON.
+func otlpRequest(spans []*span) ([]byte, error) {
+	converted := make([]otlpSpan, len(spans))
+	for i, sp := range spans {
+		converted[i] = sp.otlp()
+	}
+	req := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{otlpAttributeOf("service.name", traceServiceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": traceServiceName},
+						"spans": converted,
+					},
+				},
+			},
+		},
+	}
+	return json.Marshal(req)
+}
+
+func (t *tracer) export(ctx context.Context, spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+	err := t.post(ctx, spans)
+	if err != nil {
+		t.logger.Error("failed to export spans", map[string]interface{}{
+			"endpoint":  t.endpoint,
+			"spans":     len(spans),
+			log.FnError: err.Error(),
+		})
+	}
+}
+
+func (t *tracer) post(ctx context.Context, spans []*span) error {
+	body, err := otlpRequest(spans)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// traceParent returns traceparent header of the HTTP request in data,
+// or an empty string.
+func traceParent(data []byte) string {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return ""
+	}
+	return req.Header.Get("Traceparent")
+}
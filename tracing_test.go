@@ -0,0 +1,157 @@
+package transocks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+func TestSpan(t *testing.T) {
+	t.Parallel()
+
+	var nilSpan *span
+	nilSpan.child("peek", spanInternal).finish(nil)
+	var nilTracer *tracer
+	if nilTracer.start("connection", spanServer) != nil {
+		t.Error("nil tracer should not start spans")
+	}
+
+	u, _ := url.Parse("http://127.0.0.1:4318/v1/traces")
+	tr := newTracer(u, log.NewLogger())
+	sp := tr.start("connection", spanServer)
+	dsp := sp.child("dial", spanClient)
+	sp.adopt("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	dsp.fail(errors.New("refused"))
+	dsp.finish(nil)
+	sp.finish(map[string]interface{}{
+		log.FnType:  "access",
+		"dest_addr": "10.0.0.1:443",
+		"verdict":   verdictAllow,
+		"elapsed":   1.5,
+	})
+
+	if len(tr.queue) != 2 {
+		t.Fatal("unexpected queued spans:", len(tr.queue))
+	}
+	child := (<-tr.queue).otlp()
+	root := (<-tr.queue).otlp()
+	if root.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || child.TraceID != root.TraceID {
+		t.Error("trace ID should be adopted:", root.TraceID, child.TraceID)
+	}
+	if root.ParentSpanID != "00f067aa0ba902b7" {
+		t.Error("root span should be a child of the client:", root.ParentSpanID)
+	}
+	if child.ParentSpanID != root.SpanID {
+		t.Error("unexpected parent:", child.ParentSpanID)
+	}
+	if child.Status == nil || child.Status.Code != 2 || child.Status.Message != "refused" {
+		t.Errorf("unexpected status: %+v", child.Status)
+	}
+	if root.Status != nil || root.Kind != spanServer || child.Kind != spanClient {
+		t.Errorf("unexpected root span: %+v", root)
+	}
+
+	expected := []string{
+		`{"key":"transocks.dest_addr","value":{"stringValue":"10.0.0.1:443"}}`,
+		`{"key":"transocks.elapsed","value":{"doubleValue":1.5}}`,
+		`{"key":"transocks.verdict","value":{"stringValue":"allow"}}`,
+	}
+	if len(root.Attributes) != len(expected) {
+		t.Fatalf("unexpected attributes: %+v", root.Attributes)
+	}
+	for i, a := range root.Attributes {
+		data, err := json.Marshal(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected[i] {
+			t.Errorf("attribute %d should be %s, but %s", i, expected[i], data)
+		}
+	}
+}
+
+func TestSpanAdoptInvalid(t *testing.T) {
+	t.Parallel()
+
+	u, _ := url.Parse("http://127.0.0.1:4318/v1/traces")
+	tr := newTracer(u, log.NewLogger())
+	for _, tp := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		sp := tr.start("connection", spanServer)
+		traceID := sp.traceID
+		sp.adopt(tp)
+		if string(sp.traceID) != string(traceID) || sp.remote != nil {
+			t.Errorf("%q should not be adopted", tp)
+		}
+	}
+}
+
+func TestTraceParent(t *testing.T) {
+	t.Parallel()
+
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n" +
+		"traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n\r\n"
+	if tp := traceParent([]byte(req)); tp != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Error("unexpected traceparent:", tp)
+	}
+	if tp := traceParent([]byte("\x16\x03\x01")); tp != "" {
+		t.Error("unexpected traceparent:", tp)
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		var req map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- req
+	}))
+	defer collector.Close()
+
+	u, _ := url.Parse(collector.URL + "/v1/traces")
+	logger := log.NewLogger()
+	logger.SetOutput(ioutil.Discard)
+	tr := newTracer(u, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tr.run(ctx)
+		close(done)
+	}()
+	tr.start("connection", spanServer).finish(nil)
+	cancel()
+
+	select {
+	case req := <-received:
+		rs := req["resourceSpans"].([]interface{})[0].(map[string]interface{})
+		ss := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})
+		spans := ss["spans"].([]interface{})
+		if len(spans) != 1 || spans[0].(map[string]interface{})["name"] != "connection" {
+			t.Errorf("unexpected spans: %v", spans)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("spans are not exported")
+	}
+	<-done
+}
@@ -0,0 +1,699 @@
+package transocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"golang.org/x/net/proxy"
+)
+
+// This file implements UDP relay through SOCKS5 servers.
+//
+// Datagrams redirected by TPROXY are received by a UDP socket with
+// IP_RECVORIGDSTADDR option to know their original destinations.
+// For each pair of client and destination addresses, a session is
+// created with UDP ASSOCIATE command defined in RFC 1928.
+// Replies are sent back to clients from sockets bound to the original
+// destination addresses so that clients accept them.
+//
+// Sessions are routed by the rules of the server.  Host names are
+// taken from QUIC Initial packets sent to port 443.
+
+const (
+	defaultUDPIdleTimeout = 1 * time.Minute
+	udpBufferSize         = 64 << 10
+	socks5DialTimeout     = 10 * time.Second
+
+	// udpPendingDatagrams limits datagrams queued while a session
+	// is being created.
+	udpPendingDatagrams = 16
+
+	// udpDeniedTTL is the time datagrams are dropped silently after
+	// a session is denied by access control lists.
+	udpDeniedTTL = 10 * time.Second
+)
+
+var (
+	errTooManyUDPSessions = errors.New("too many UDP sessions")
+	errUDPSessionPending  = errors.New("too many datagrams for a pending UDP session")
+	errUDPSessionDenied   = errors.New("UDP session denied")
+)
+
+// UDPStats is a snapshot of counters of UDP sessions.
+type UDPStats struct {
+	// Active is the number of sessions in the session table.
+	Active int
+
+	// Total is the number of sessions created so far.
+	Total int64
+
+	// Expired is the number of sessions removed by UDPIdleTimeout
+	// or UDPSessionTimeout.
+	Expired int64
+
+	// Dropped is the number of datagrams dropped because sessions
+	// could not be created, including those over UDPMaxSessions.
+	Dropped int64
+}
+
+// ListenUDP creates a UDP socket to receive datagrams redirected by
+// TPROXY on c.Addr.  This works only on Linux with ModeTPROXY.
+func ListenUDP(c *Config) (*net.UDPConn, error) {
+	if c.Mode != ModeTPROXY {
+		return nil, errors.New("UDP relay requires tproxy mode")
+	}
+	return listenTransparentUDP(c.Addr)
+}
+
+// socks5UDPAssociate sends UDP ASSOCIATE request to the SOCKS5 server
+// at u.  It returns the TCP connection that keeps the association and
+// the address of the UDP relay.
+func socks5UDPAssociate(u *url.URL, forward proxy.Dialer) (net.Conn, *net.UDPAddr, error) {
+	c, err := forward.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, nil, &upstreamError{err}
+	}
+	c.SetDeadline(time.Now().Add(socks5DialTimeout))
+
+	relay, err := func() (*net.UDPAddr, error) {
+		methods := []byte{5, 1, 0}
+		if u.User != nil {
+			methods = []byte{5, 2, 0, 2}
+		}
+		if _, err := c.Write(methods); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 262)
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return nil, err
+		}
+		switch {
+		case buf[0] != 5:
+			return nil, errors.New("not a SOCKS5 server")
+		case buf[1] == 2 && u.User != nil:
+			// RFC 1929 username/password authentication.
+			user := u.User.Username()
+			passwd, _ := u.User.Password()
+			req := append([]byte{1, byte(len(user))}, user...)
+			req = append(append(req, byte(len(passwd))), passwd...)
+			if _, err := c.Write(req); err != nil {
+				return nil, err
+			}
+			if _, err := io.ReadFull(c, buf[:2]); err != nil {
+				return nil, err
+			}
+			if buf[1] != 0 {
+				return nil, errors.New("SOCKS5 authentication failed")
+			}
+		case buf[1] != 0:
+			return nil, errors.New("no acceptable SOCKS5 authentication method")
+		}
+
+		// The client address is not known in advance.
+		if _, err := c.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(c, buf[:4]); err != nil {
+			return nil, err
+		}
+		if buf[1] != 0 {
+			return nil, fmt.Errorf("SOCKS5 UDP ASSOCIATE failed: %d", buf[1])
+		}
+		var ipLen int
+		switch buf[3] {
+		case 1:
+			ipLen = net.IPv4len
+		case 4:
+			ipLen = net.IPv6len
+		default:
+			return nil, errors.New("unsupported SOCKS5 relay address type")
+		}
+		if _, err := io.ReadFull(c, buf[:ipLen+2]); err != nil {
+			return nil, err
+		}
+		addr := &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), buf[:ipLen]...)),
+			Port: int(buf[ipLen])<<8 | int(buf[ipLen+1]),
+		}
+		// Many servers reply an unspecified address meaning the
+		// address of the server itself.
+		if addr.IP.IsUnspecified() {
+			if ta, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+				addr.IP = ta.IP
+			}
+		}
+		return addr, nil
+	}()
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+
+	c.SetDeadline(time.Time{})
+	return c, relay, nil
+}
+
+// parseUDPReply returns the payload of a datagram from a SOCKS5 UDP relay.
+// Fragmented datagrams are not supported.
+func parseUDPReply(b []byte) ([]byte, error) {
+	if len(b) < 4 || b[2] != 0 {
+		return nil, errors.New("invalid or fragmented SOCKS5 UDP datagram")
+	}
+	var n int
+	switch b[3] {
+	case 1:
+		n = 4 + net.IPv4len + 2
+	case 4:
+		n = 4 + net.IPv6len + 2
+	case 3:
+		if len(b) < 5 {
+			return nil, errors.New("short SOCKS5 UDP datagram")
+		}
+		n = 5 + int(b[4]) + 2
+	default:
+		return nil, errors.New("invalid SOCKS5 address type")
+	}
+	if len(b) < n {
+		return nil, errors.New("short SOCKS5 UDP datagram")
+	}
+	return b[n:], nil
+}
+
+// udpSession relays datagrams between a client and a destination.
+type udpSession struct {
+	// last is accessed atomically and needs to be 64-bit aligned.
+	last int64
+
+	key      string
+	start    time.Time
+	client   *net.UDPAddr
+	dst      *net.UDPAddr
+	host     string
+	upstream string
+	tag      string
+	audited  string // upstream chosen by rules in audit-only mode
+	header   []byte
+	ctrl     net.Conn // nil for DIRECT sessions
+	relay    *net.UDPConn
+	reply    *net.UDPConn
+	once     sync.Once
+}
+
+func (ss *udpSession) touch() {
+	atomic.StoreInt64(&ss.last, time.Now().UnixNano())
+}
+
+func (ss *udpSession) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&ss.last))
+}
+
+func (ss *udpSession) send(p []byte) error {
+	ss.touch()
+	_, err := ss.relay.Write(append(ss.header[:len(ss.header):len(ss.header)], p...))
+	return err
+}
+
+func (ss *udpSession) close() {
+	ss.once.Do(func() {
+		if ss.ctrl != nil {
+			ss.ctrl.Close()
+		}
+		ss.relay.Close()
+		ss.reply.Close()
+	})
+}
+
+// udpRelay manages UDP sessions.
+type udpRelay struct {
+	// counters are accessed atomically and need to be 64-bit aligned.
+	total   int64
+	expired int64
+	dropped int64
+
+	idleTimeout    time.Duration
+	sessionTimeout time.Duration
+	maxSessions    int
+
+	proxyURL *url.URL
+	forward  proxy.Dialer
+	logger   *log.Logger
+	reset    bool
+	audit    bool
+
+	// route returns the upstream for a session, and the tag of the
+	// matching rule.
+	route func(host string, dst *net.UDPAddr) (string, string)
+
+	// allows returns false if a session is denied by access control
+	// lists.  Denied sessions are logged by allows.
+	allows func(client, dst *net.UDPAddr, host string) bool
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	closed   bool
+
+	// pending has datagrams for sessions being created in background,
+	// so that a slow proxy does not stall datagrams of other clients.
+	pending map[string][][]byte
+
+	// denied has the expiration time of sessions denied by access
+	// control lists, so that each datagram of a denied client does
+	// not create a session and a log.
+	denied map[string]time.Time
+}
+
+// newSession creates a session for client and dst.  first is the
+// first datagram from client, which is examined to find the host name.
+func (r *udpRelay) newSession(client, dst *net.UDPAddr, first []byte) (*udpSession, error) {
+	ss := &udpSession{
+		key:      client.String() + "-" + dst.String(),
+		start:    time.Now(),
+		client:   client,
+		dst:      dst,
+		upstream: UpstreamDefault,
+	}
+	if dst.Port == 443 {
+		ss.host, _ = quicServerName(first)
+	}
+	if r.allows != nil && !r.allows(client, dst, ss.host) {
+		return nil, errUDPSessionDenied
+	}
+	if r.route != nil {
+		ss.upstream, ss.tag = r.route(ss.host, dst)
+	}
+	if r.audit && ss.upstream != UpstreamDefault {
+		// Sessions are not rerouted by rules in audit-only mode.
+		ss.audited = ss.upstream
+		ss.upstream = UpstreamDefault
+	}
+
+	switch ss.upstream {
+	case UpstreamDirect:
+		relay, err := net.DialUDP("udp", nil, dst)
+		if err != nil {
+			return nil, err
+		}
+		ss.relay = relay
+	case UpstreamDefault:
+		header, err := socksAddr(dst.String())
+		if err != nil {
+			return nil, err
+		}
+		ctrl, relayAddr, err := socks5UDPAssociate(r.proxyURL, r.forward)
+		if err != nil {
+			return nil, err
+		}
+		relay, err := net.DialUDP("udp", nil, relayAddr)
+		if err != nil {
+			ctrl.Close()
+			return nil, err
+		}
+		ss.header = append([]byte{0, 0, 0}, header...)
+		ss.ctrl = ctrl
+		ss.relay = relay
+	case UpstreamBlock:
+		return nil, errors.New("blocked by rule")
+	default:
+		return nil, fmt.Errorf("upstream %s does not support UDP", ss.upstream)
+	}
+
+	reply, err := dialTransparentUDP(dst, client)
+	if err != nil {
+		if ss.ctrl != nil {
+			ss.ctrl.Close()
+		}
+		ss.relay.Close()
+		return nil, err
+	}
+	ss.reply = reply
+	ss.touch()
+	return ss, nil
+}
+
+// run starts goroutines for ss.  ss is removed when any of them ends.
+func (r *udpRelay) run(ss *udpSession) {
+	// The association terminates when the TCP connection closes.
+	if ss.ctrl != nil {
+		go func() {
+			io.Copy(ioutil.Discard, ss.ctrl)
+			r.remove(ss)
+		}()
+	}
+
+	// from the destination to the client.
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, err := ss.relay.Read(buf)
+			if err != nil {
+				r.remove(ss)
+				return
+			}
+			p := buf[:n]
+			if ss.ctrl != nil {
+				p, err = parseUDPReply(p)
+				if err != nil {
+					continue
+				}
+			}
+			ss.touch()
+			ss.reply.Write(p)
+		}
+	}()
+
+	// The socket bound to the destination may also receive datagrams
+	// from the client.
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, err := ss.reply.Read(buf)
+			if err != nil {
+				r.remove(ss)
+				return
+			}
+			ss.send(buf[:n])
+		}
+	}()
+}
+
+func (r *udpRelay) remove(ss *udpSession) {
+	r.mu.Lock()
+	found := r.sessions[ss.key] == ss
+	if found {
+		delete(r.sessions, ss.key)
+	}
+	r.mu.Unlock()
+
+	ss.close()
+	if found {
+		r.logger.Info("udp session ends", map[string]interface{}{
+			"client_addr": ss.client.String(),
+			"dest_addr":   ss.dst.String(),
+		})
+	}
+}
+
+// isExpired returns true if ss should be removed by timeouts.
+func (r *udpRelay) isExpired(ss *udpSession) bool {
+	if ss.idle() >= r.idleTimeout {
+		return true
+	}
+	return r.sessionTimeout > 0 && time.Since(ss.start) >= r.sessionTimeout
+}
+
+func (r *udpRelay) removeExpired() {
+	var expired []*udpSession
+	now := time.Now()
+	r.mu.Lock()
+	for _, ss := range r.sessions {
+		if r.isExpired(ss) {
+			expired = append(expired, ss)
+		}
+	}
+	for key, t := range r.denied {
+		if !now.Before(t) {
+			delete(r.denied, key)
+		}
+	}
+	r.mu.Unlock()
+
+	atomic.AddInt64(&r.expired, int64(len(expired)))
+	for _, ss := range expired {
+		r.remove(ss)
+	}
+}
+
+func (r *udpRelay) stats() UDPStats {
+	r.mu.Lock()
+	active := len(r.sessions)
+	r.mu.Unlock()
+	return UDPStats{
+		Active:  active,
+		Total:   atomic.LoadInt64(&r.total),
+		Expired: atomic.LoadInt64(&r.expired),
+		Dropped: atomic.LoadInt64(&r.dropped),
+	}
+}
+
+func (r *udpRelay) removeAll() {
+	var all []*udpSession
+	r.mu.Lock()
+	r.closed = true
+	for _, ss := range r.sessions {
+		all = append(all, ss)
+	}
+	r.mu.Unlock()
+
+	for _, ss := range all {
+		r.remove(ss)
+	}
+}
+
+// session returns the session for client and dst.  If the session
+// does not exist, session queues p and returns nil, and the session is
+// created in background.  This is called only from serve.
+func (r *udpRelay) session(client, dst *net.UDPAddr, p []byte) (*udpSession, error) {
+	key := client.String() + "-" + dst.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ss := r.sessions[key]; ss != nil {
+		return ss, nil
+	}
+	if t, ok := r.denied[key]; ok {
+		if time.Now().Before(t) {
+			return nil, errUDPSessionDenied
+		}
+		delete(r.denied, key)
+	}
+	p = append([]byte(nil), p...)
+	if queue, ok := r.pending[key]; ok {
+		if len(queue) >= udpPendingDatagrams {
+			return nil, errUDPSessionPending
+		}
+		r.pending[key] = append(queue, p)
+		return nil, nil
+	}
+	if r.maxSessions > 0 && len(r.sessions)+len(r.pending) >= r.maxSessions {
+		return nil, errTooManyUDPSessions
+	}
+	r.pending[key] = [][]byte{p}
+	go r.create(key, client, dst, p)
+	return nil, nil
+}
+
+// create creates the session for client and dst, and sends datagrams
+// queued in the meantime.
+func (r *udpRelay) create(key string, client, dst *net.UDPAddr, first []byte) {
+	ss, err := r.newSession(client, dst, first)
+	if err != nil {
+		r.mu.Lock()
+		queue := r.pending[key]
+		delete(r.pending, key)
+		if err == errUDPSessionDenied {
+			r.denied[key] = time.Now().Add(udpDeniedTTL)
+		}
+		r.mu.Unlock()
+		atomic.AddInt64(&r.dropped, int64(len(queue)))
+		if err != errUDPSessionDenied {
+			r.logger.Error("failed to create udp session", map[string]interface{}{
+				"client_addr": client.String(),
+				"dest_addr":   dst.String(),
+				log.FnError:   err.Error(),
+			})
+		}
+		if r.reset {
+			r.unreachable(client, dst)
+		}
+		return
+	}
+
+	// Datagrams are sent in order until the session becomes visible
+	// to serve.
+	for {
+		r.mu.Lock()
+		queue := r.pending[key]
+		if r.closed {
+			delete(r.pending, key)
+			r.mu.Unlock()
+			ss.close()
+			return
+		}
+		if len(queue) == 0 {
+			delete(r.pending, key)
+			r.sessions[key] = ss
+			r.mu.Unlock()
+			break
+		}
+		r.pending[key] = queue[:0:0]
+		r.mu.Unlock()
+		for _, p := range queue {
+			ss.send(p)
+		}
+	}
+	atomic.AddInt64(&r.total, 1)
+	r.run(ss)
+
+	fields := map[string]interface{}{
+		"client_addr": client.String(),
+		"dest_addr":   dst.String(),
+		"upstream":    ss.upstream,
+	}
+	if len(ss.host) > 0 {
+		fields["dest_host"] = ss.host
+	}
+	if len(ss.tag) > 0 {
+		fields["rule"] = ss.tag
+	}
+	if len(ss.audited) > 0 {
+		fields["audit_upstream"] = ss.audited
+	}
+	r.logger.Info("udp session starts", fields)
+}
+
+// unreachable tells client that datagrams to dst are not relayed.
+func (r *udpRelay) unreachable(client, dst *net.UDPAddr) {
+	if err := sendUDPUnreachable(client, dst); err != nil {
+		r.logger.Warn("failed to send ICMP unreachable", map[string]interface{}{
+			"client_addr": client.String(),
+			log.FnError:   err.Error(),
+		})
+	}
+}
+
+func (r *udpRelay) serve(ctx context.Context, conn *net.UDPConn) {
+	go func() {
+		interval := r.idleTimeout
+		if r.sessionTimeout > 0 && r.sessionTimeout < interval {
+			interval = r.sessionTimeout
+		}
+		ticker := time.NewTicker(interval / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-ticker.C:
+				r.removeExpired()
+			}
+		}
+	}()
+	defer r.removeAll()
+
+	buf := make([]byte, udpBufferSize)
+	oob := make([]byte, 1024)
+	for {
+		n, client, dst, err := readUDPWithDst(conn, buf, oob)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			r.logger.Error("failed to read UDP datagram", map[string]interface{}{
+				log.FnError: err.Error(),
+			})
+			return
+		}
+
+		ss, err := r.session(client, dst, buf[:n])
+		if err != nil {
+			// Not logged for each datagram over the limit.
+			atomic.AddInt64(&r.dropped, 1)
+			if err == errTooManyUDPSessions && r.reset {
+				r.unreachable(client, dst)
+			}
+			continue
+		}
+		if ss != nil {
+			ss.send(buf[:n])
+		}
+	}
+}
+
+// ServeUDP relays datagrams received by conn through the SOCKS5 server
+// in Config.ProxyURL.  conn should be created by ListenUDP.
+//
+// Access control lists and routing rules are applied with host names
+// found in QUIC Initial packets.  Upstreams other than the default and DIRECT are not
+// supported.  Failover and proxy chains are not applied to UDP.
+// ServeUDP returns immediately and relays datagrams in background
+// until the environment of the server is canceled.
+func (s *Server) ServeUDP(conn *net.UDPConn) {
+	idle := s.udpIdle
+	if idle == 0 {
+		idle = defaultUDPIdleTimeout
+	}
+	r := &udpRelay{
+		idleTimeout:    idle,
+		sessionTimeout: s.udpLifetime,
+		maxSessions:    s.udpMax,
+		proxyURL:       s.udpProxy,
+		forward:        s.direct,
+		logger:         s.logger,
+		reset:          s.reset,
+		audit:          s.audit,
+		route: func(host string, dst *net.UDPAddr) (string, string) {
+			p := s.ruleset().profile
+			c := &connInfo{host: host, ip: dst.IP, port: dst.Port}
+			if p.geoip != nil {
+				c.country = p.geoip.country(dst.IP)
+			}
+			if p.asnDB != nil {
+				c.asn = p.asnDB.asn(dst.IP)
+			}
+			return p.route(c)
+		},
+		allows: func(client, dst *net.UDPAddr, host string) bool {
+			a := s.ruleset().profile.acl
+			if a.allowsClient(client.IP) && a.allows(host, dst.IP, dst.Port) {
+				return true
+			}
+			fields := map[string]interface{}{
+				"client_addr": client.String(),
+				"dest_addr":   dst.String(),
+			}
+			if len(host) > 0 {
+				fields["dest_host"] = host
+			}
+			return !s.denyPacket(fields, "udp session denied")
+		},
+		sessions: make(map[string]*udpSession),
+		pending:  make(map[string][][]byte),
+		denied:   make(map[string]time.Time),
+	}
+	s.udpMu.Lock()
+	s.udpRelays = append(s.udpRelays, r)
+	s.udpMu.Unlock()
+	s.goBackground(func(ctx context.Context) {
+		r.serve(ctx, conn)
+	})
+}
+
+// UDPStats returns counters of UDP sessions of all sockets passed
+// to ServeUDP.
+func (s *Server) UDPStats() UDPStats {
+	s.udpMu.Lock()
+	relays := s.udpRelays
+	s.udpMu.Unlock()
+
+	var stats UDPStats
+	for _, r := range relays {
+		st := r.stats()
+		stats.Active += st.Active
+		stats.Total += st.Total
+		stats.Expired += st.Expired
+		stats.Dropped += st.Dropped
+	}
+	return stats
+}
@@ -0,0 +1,84 @@
+// +build linux
+
+package transocks
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenTransparentUDP creates a UDP socket to receive datagrams
+// redirected by TPROXY.  The original destinations are available
+// by readUDPWithDst.  SO_REUSEPORT is set so that a new process can
+// listen on the address while the old one stops in graceful restart.
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	return listenUDP(addr, setTransparent, setRecvOrigDst, setReusePort)
+}
+
+func setRecvOrigDst(fd int, network string) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_IP, IP_RECVORIGDSTADDR, 1); err != nil {
+		return err
+	}
+	if network == "udp4" {
+		return nil
+	}
+	err := unix.SetsockoptInt(fd, unix.SOL_IPV6, IPV6_RECVORIGDSTADDR, 1)
+	if network == "udp6" {
+		return err
+	}
+	return nil
+}
+
+// readUDPWithDst reads a datagram from conn created by listenTransparentUDP.
+// It returns the client address and the original destination address.
+func readUDPWithDst(conn *net.UDPConn, b, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	n, oobn, _, client, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, m := range msgs {
+		h := m.Header
+		switch {
+		case h.Level == unix.SOL_IP && h.Type == IP_ORIGDSTADDR && len(m.Data) >= 8:
+			// struct sockaddr_in
+			return n, client, &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[4:8]...)),
+				Port: int(m.Data[2])<<8 | int(m.Data[3]),
+			}, nil
+		case h.Level == unix.SOL_IPV6 && h.Type == IPV6_ORIGDSTADDR && len(m.Data) >= 24:
+			// struct sockaddr_in6
+			return n, client, &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[8:24]...)),
+				Port: int(m.Data[2])<<8 | int(m.Data[3]),
+			}, nil
+		}
+	}
+	return 0, nil, nil, errors.New("no original destination address")
+}
+
+// dialTransparentUDP creates a UDP socket bound to laddr, which may be
+// a non-local address, and connected to raddr.  This is used to send
+// replies to clients from the original destination addresses.
+func dialTransparentUDP(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	d := &net.Dialer{
+		LocalAddr: laddr,
+		Control: controlFunc(func(fd int, network string) error {
+			if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+				return err
+			}
+			return setTransparent(fd, network)
+		}),
+	}
+	c, err := d.Dial("udp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
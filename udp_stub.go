@@ -0,0 +1,22 @@
+// +build !linux
+
+package transocks
+
+import (
+	"errors"
+	"net"
+)
+
+var errUDPUnsupported = errors.New("UDP relay is supported only on Linux")
+
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	return nil, errUDPUnsupported
+}
+
+func readUDPWithDst(conn *net.UDPConn, b, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, errUDPUnsupported
+}
+
+func dialTransparentUDP(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errUDPUnsupported
+}
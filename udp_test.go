@@ -0,0 +1,236 @@
+package transocks
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	u, err := url.Parse("socks5://alice:secret@" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan []byte, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+
+		// methods, authentication, and UDP ASSOCIATE request
+		buf := make([]byte, 28)
+		if _, err := io.ReadFull(c, buf[:4]); err != nil {
+			t.Error(err)
+			return
+		}
+		c.Write([]byte{5, 2})
+		if _, err := io.ReadFull(c, buf[4:18]); err != nil {
+			t.Error(err)
+			return
+		}
+		c.Write([]byte{1, 0})
+		if _, err := io.ReadFull(c, buf[18:]); err != nil {
+			t.Error(err)
+			return
+		}
+		ch <- buf
+
+		// relay at 0.0.0.0:5353
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0x14, 0xe9})
+		io.Copy(ioutil.Discard, c)
+	}()
+
+	c, relay, err := socks5UDPAssociate(u, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := <-ch
+	if string(req) != "\x05\x02\x00\x02\x01\x05alice\x06secret\x05\x03\x00\x01\x00\x00\x00\x00\x00\x00" {
+		t.Errorf("unexpected request: %q", req)
+	}
+	if relay.String() != "127.0.0.1:5353" {
+		t.Errorf("unexpected relay address: %s", relay)
+	}
+}
+
+func TestParseUDPReply(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		datagram []byte
+		payload  []byte
+		expectOK bool
+	}{
+		{[]byte("\x00\x00\x00\x01\xc0\x00\x02\x01\x00\x35hello"), []byte("hello"), true},
+		{[]byte("\x00\x00\x00\x04\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x35hello"), []byte("hello"), true},
+		{[]byte("\x00\x00\x00\x03\x0bexample.com\x00\x35hello"), []byte("hello"), true},
+		{[]byte("\x00\x00\x01\x01\xc0\x00\x02\x01\x00\x35hello"), nil, false},
+		{[]byte("\x00\x00\x00\x01\xc0\x00"), nil, false},
+		{[]byte("\x00\x00\x00\x05\xc0\x00\x02\x01\x00\x35"), nil, false},
+	}
+
+	for _, tc := range testCases {
+		p, err := parseUDPReply(tc.datagram)
+		if !tc.expectOK {
+			if err == nil {
+				t.Errorf("%q should be invalid", tc.datagram)
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(p, tc.payload) {
+			t.Errorf("unexpected payload of %q: %q", tc.datagram, p)
+		}
+	}
+}
+
+func TestUDPSessionTable(t *testing.T) {
+	t.Parallel()
+
+	r := &udpRelay{
+		idleTimeout:    time.Minute,
+		sessionTimeout: time.Hour,
+		maxSessions:    2,
+		logger:         log.NewLogger(),
+		sessions:       make(map[string]*udpSession),
+		pending:        make(map[string][][]byte),
+	}
+	newSession := func(port int, start, last time.Time) *udpSession {
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}
+		dst := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}
+		ss := &udpSession{
+			last:   last.UnixNano(),
+			key:    client.String() + "-" + dst.String(),
+			start:  start,
+			client: client,
+			dst:    dst,
+			relay:  relay,
+			reply:  reply,
+		}
+		r.sessions[ss.key] = ss
+		return ss
+	}
+
+	now := time.Now()
+	active := newSession(10001, now, now)
+	newSession(10002, now, now.Add(-2*time.Minute))
+	if _, err := r.session(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 10003}, active.dst, nil); err != errTooManyUDPSessions {
+		t.Error("sessions over the limit should not be created:", err)
+	}
+	if ss, err := r.session(active.client, active.dst, nil); err != nil || ss != active {
+		t.Error("existing session should be returned:", err)
+	}
+
+	newSession(10004, now.Add(-2*time.Hour), now)
+	r.removeExpired()
+	st := r.stats()
+	if st.Active != 1 || st.Expired != 2 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+
+	// Datagrams are queued while the session is being created, and
+	// pending sessions count toward the limit.
+	pending := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 10005}
+	key := pending.String() + "-" + active.dst.String()
+	r.pending[key] = nil
+	for i := 0; i < udpPendingDatagrams; i++ {
+		if ss, err := r.session(pending, active.dst, []byte{byte(i)}); ss != nil || err != nil {
+			t.Fatal("datagram should be queued:", ss, err)
+		}
+	}
+	if _, err := r.session(pending, active.dst, []byte("x")); err != errUDPSessionPending {
+		t.Error("datagrams over the queue should be dropped:", err)
+	}
+	if len(r.pending[key]) != udpPendingDatagrams || r.pending[key][1][0] != 1 {
+		t.Error("unexpected queue:", r.pending[key])
+	}
+	if _, err := r.session(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 10006}, active.dst, nil); err != errTooManyUDPSessions {
+		t.Error("pending sessions should count toward the limit:", err)
+	}
+	if _, ok := r.sessions[active.key]; !ok {
+		t.Error("active session should not be removed")
+	}
+	r.removeAll()
+}
+
+func TestUDPSessionDenied(t *testing.T) {
+	t.Parallel()
+
+	var denied atomic.Value
+	var calls int32
+	r := &udpRelay{
+		logger: log.NewLogger(),
+		allows: func(client, dst *net.UDPAddr, host string) bool {
+			denied.Store(client.String())
+			atomic.AddInt32(&calls, 1)
+			return false
+		},
+		sessions: make(map[string]*udpSession),
+		pending:  make(map[string][][]byte),
+		denied:   make(map[string]time.Time),
+	}
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 10000}
+	dst := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}
+	if _, err := r.newSession(client, dst, []byte("query")); err != errUDPSessionDenied {
+		t.Error("session should be denied:", err)
+	}
+	if denied.Load() != client.String() {
+		t.Error("access control lists should be applied")
+	}
+
+	// Denied sessions are remembered, and their datagrams are dropped
+	// without creating sessions.
+	key := client.String() + "-" + dst.String()
+	r.pending[key] = [][]byte{[]byte("query")}
+	r.create(key, client, dst, []byte("query"))
+	if atomic.LoadInt32(&calls) != 2 || len(r.pending) != 0 {
+		t.Fatal("session should be denied")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := r.session(client, dst, []byte("query")); err != errUDPSessionDenied {
+			t.Error("denied session should be remembered:", err)
+		}
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Error("access control lists should not be applied again")
+	}
+
+	r.mu.Lock()
+	r.denied[key] = time.Now().Add(-time.Second)
+	r.mu.Unlock()
+	if ss, err := r.session(client, dst, []byte("query")); ss != nil || err != nil {
+		t.Error("session should be created again after expiration:", ss, err)
+	}
+}
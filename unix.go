@@ -0,0 +1,66 @@
+package transocks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// This file implements listeners on unix domain sockets.
+//
+// SO_ORIGINAL_DST does not apply to unix domain sockets.  Clients,
+// such as local stub redirectors, send the destination in a header
+// line before the data to be relayed:
+//
+//	HOST:PORT\n
+//
+// HOST is an IP address or a host name.  IPv6 addresses are enclosed
+// in square brackets.
+
+const (
+	// maxDestHeaderSize is the maximum length of the header line
+	// including the terminating LF.
+	maxDestHeaderSize = 262
+)
+
+// listenUnix listens on a unix domain socket at path.
+// A socket file left by the previous process is removed.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// readDestHeader reads the header line from r.  r is read byte by byte
+// so that the data following the header remains unread.
+func readDestHeader(r io.Reader) (string, int, error) {
+	buf := make([]byte, 0, maxDestHeaderSize)
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", 0, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(buf) == maxDestHeaderSize-1 {
+			return "", 0, errors.New("too long destination header")
+		}
+		buf = append(buf, b[0])
+	}
+
+	line := strings.TrimSuffix(string(buf), "\r")
+	host, p, err := net.SplitHostPort(line)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 || len(host) == 0 {
+		return "", 0, errors.New("invalid destination: " + line)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,49 @@
+package transocks
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReadDestHeader(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		input string
+		host  string
+		port  int
+		valid bool
+	}{
+		{"10.20.30.40:443\nGET /", "10.20.30.40", 443, true},
+		{"[2001:db8::1]:80\r\n", "2001:db8::1", 80, true},
+		{"www.example.com:8080\n", "www.example.com", 8080, true},
+		{"www.example.com\n", "", 0, false},
+		{"www.example.com:0\n", "", 0, false},
+		{":80\n", "", 0, false},
+		{"10.20.30.40:443", "", 0, false},
+		{strings.Repeat("a", 300) + ":80\n", "", 0, false},
+	}
+
+	for _, tc := range testCases {
+		r := strings.NewReader(tc.input)
+		host, port, err := readDestHeader(r)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%q should be invalid", tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.input, err)
+			continue
+		}
+		if host != tc.host || port != tc.port {
+			t.Errorf("%q: unexpected destination %s %d", tc.input, host, port)
+		}
+		rest, _ := ioutil.ReadAll(r)
+		if !strings.HasSuffix(tc.input, string(rest)) || strings.Contains(string(rest), "\n") {
+			t.Errorf("%q: header should not be left: %q", tc.input, rest)
+		}
+	}
+}
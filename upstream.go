@@ -0,0 +1,510 @@
+package transocks
+
+import (
+	"crypto/tls"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	maxDialBackoff = 5 * time.Second
+)
+
+// newProxyDialer creates a proxy.Dialer for u.
+//
+// Connections to the proxy are made by forward.  tlsConfig is used
+// for schemes that connect to the proxy over TLS.
+func newProxyDialer(u *url.URL, forward proxy.Dialer, tlsConfig *tls.Config) (proxy.Dialer, error) {
+	switch u.Scheme {
+	case "https":
+		hu := *u
+		hu.Scheme = "http"
+		return httpDialType(&hu, &tlsDialer{forward: forward, config: tlsConfig})
+	case "socks5s":
+		su := *u
+		su.Scheme = "socks5"
+		return proxy.FromURL(&su, &tlsDialer{forward: forward, config: tlsConfig})
+	}
+	return proxy.FromURL(u, forward)
+}
+
+// newChainDialer creates a proxy.Dialer that tunnels through proxies
+// in chain in order, then connects to u.
+//
+// Errors in connecting to u are reported as *upstreamError.
+func newChainDialer(chain []*url.URL, u *url.URL, forward proxy.Dialer, tlsConfig *tls.Config) (proxy.Dialer, error) {
+	forward, err := newChainForwarder(chain, forward, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newProxyDialer(u, upstreamForwarder{forward}, tlsConfig)
+}
+
+// newChainForwarder creates a proxy.Dialer that tunnels through proxies
+// in chain in order.
+func newChainForwarder(chain []*url.URL, forward proxy.Dialer, tlsConfig *tls.Config) (proxy.Dialer, error) {
+	for _, hop := range chain {
+		d, err := newProxyDialer(hop, forward, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		forward = d
+	}
+	return forward, nil
+}
+
+// closeDialer releases resources of d such as pooled connections.
+func closeDialer(d proxy.Dialer) {
+	if c, ok := d.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// upstreamError is an error that happened before talking to the
+// upstream proxy, i.e., the proxy is unreachable.
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+// isUpstreamError returns true if err is or wraps *upstreamError.
+func isUpstreamError(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *upstreamError:
+			return true
+		case *net.OpError:
+			err = e.Err
+		default:
+			return false
+		}
+	}
+}
+
+// upstreamForwarder marks errors of the underlying dialer as *upstreamError.
+type upstreamForwarder struct {
+	forward proxy.Dialer
+}
+
+func (d upstreamForwarder) Dial(network, addr string) (net.Conn, error) {
+	c, err := d.forward.Dial(network, addr)
+	if err != nil {
+		return nil, &upstreamError{err}
+	}
+	return c, nil
+}
+
+// upstream is an upstream proxy.
+type upstream struct {
+	// int64 fields are accessed atomically and need to be 64-bit aligned.
+	active   int64
+	total    int64
+	failures int64
+
+	// int32 fields are also accessed atomically.
+	ejected int32
+	probing int32
+
+	url     string
+	src     *url.URL
+	forward proxy.Dialer
+	breaker circuitBreaker
+
+	mu     sync.RWMutex
+	dialer proxy.Dialer
+}
+
+func (u *upstream) proxyDialer() proxy.Dialer {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.dialer
+}
+
+func (u *upstream) setDialer(d proxy.Dialer) {
+	u.mu.Lock()
+	u.dialer = d
+	u.mu.Unlock()
+}
+
+func (u *upstream) dial(network, addr string) (net.Conn, error) {
+	c, err := u.proxyDialer().Dial(network, addr)
+	if err != nil {
+		atomic.AddInt64(&u.failures, 1)
+		return nil, err
+	}
+	atomic.AddInt64(&u.total, 1)
+	atomic.AddInt64(&u.active, 1)
+	return &upstreamConn{Conn: c, u: u}, nil
+}
+
+// down returns true if u failed the last health check, or its circuit
+// breaker does not let connections through.
+func (u *upstream) down() bool {
+	return atomic.LoadInt32(&u.ejected) != 0 || u.breaker.blocked()
+}
+
+func (u *upstream) stats() UpstreamStats {
+	return UpstreamStats{
+		URL:         u.url,
+		Active:      atomic.LoadInt64(&u.active),
+		Total:       atomic.LoadInt64(&u.total),
+		Failures:    atomic.LoadInt64(&u.failures),
+		Ejected:     atomic.LoadInt32(&u.ejected) != 0,
+		CircuitOpen: u.breaker.open(),
+	}
+}
+
+// upstreamConn decrements the active connection counter of u when closed.
+type upstreamConn struct {
+	net.Conn
+	u    *upstream
+	once sync.Once
+}
+
+func (c *upstreamConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.u.active, -1)
+	})
+	return c.Conn.Close()
+}
+
+func (c *upstreamConn) CloseRead() error {
+	if hc, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
+
+func (c *upstreamConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+// rawConn returns the connection wrapped by c if c is *upstreamConn.
+// The wrapper hides ReadFrom of *net.TCPConn, so data must be copied
+// to and from the returned connection to be relayed by splice(2).
+func rawConn(c net.Conn) net.Conn {
+	if uc, ok := c.(*upstreamConn); ok {
+		return uc.Conn
+	}
+	return c
+}
+
+// UpstreamStats is a snapshot of counters of an upstream proxy.
+type UpstreamStats struct {
+	// Upstream is the name of the upstream that the proxy belongs to.
+	Upstream string
+
+	// URL is the URL of the proxy.  The password is redacted.
+	URL string
+
+	// Active is the number of connections in use.
+	Active int64
+
+	// Total is the number of connections established so far.
+	Total int64
+
+	// Failures is the number of failed connection attempts.
+	Failures int64
+
+	// Ejected is true if the proxy failed the last health check.
+	Ejected bool
+
+	// CircuitOpen is true if the circuit breaker for the proxy is open.
+	CircuitOpen bool
+}
+
+// upstreamGroup is a proxy.Dialer that distributes connections among
+// upstream proxies.
+//
+// In failover mode, once a fallback proxy is chosen, it is used until
+// failback interval passes.  After that, proxies are tried from the
+// first one again.
+type upstreamGroup struct {
+	name      string
+	upstreams []*upstream
+	balance   BalanceMode
+	failback  time.Duration
+	retries   int
+	backoff   time.Duration
+	logger    *log.Logger
+	build     func(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error)
+
+	// for round-robin mode
+	next uint32
+
+	// for failover mode
+	mu      sync.Mutex
+	current int
+	since   time.Time
+}
+
+func (g *upstreamGroup) start() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.current != 0 && g.failback > 0 && time.Since(g.since) >= g.failback {
+		g.current = 0
+	}
+	return g.current
+}
+
+func (g *upstreamGroup) use(i int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.current != i {
+		g.current = i
+		g.since = time.Now()
+	}
+}
+
+// order returns indices of upstreams in the order to be tried.
+func (g *upstreamGroup) order(addr string) []int {
+	n := len(g.upstreams)
+	idx := make([]int, n)
+
+	switch g.balance {
+	case BalanceRoundRobin:
+		start := int((atomic.AddUint32(&g.next, 1) - 1) % uint32(n))
+		for i := range idx {
+			idx[i] = (start + i) % n
+		}
+	case BalanceLeastConn:
+		active := make([]int64, n)
+		for i, u := range g.upstreams {
+			idx[i] = i
+			active[i] = atomic.LoadInt64(&u.active)
+		}
+		sort.SliceStable(idx, func(i, j int) bool {
+			return active[idx[i]] < active[idx[j]]
+		})
+	case BalanceHash:
+		// Rendezvous hashing keeps most destinations on the same proxy
+		// when proxies are added or removed.
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		scores := make([]uint64, n)
+		for i, u := range g.upstreams {
+			idx[i] = i
+			h := fnv.New64a()
+			h.Write([]byte(u.url))
+			h.Write([]byte(host))
+			scores[i] = h.Sum64()
+		}
+		sort.SliceStable(idx, func(i, j int) bool {
+			return scores[idx[i]] > scores[idx[j]]
+		})
+	default:
+		start := g.start()
+		for i := range idx {
+			idx[i] = (start + i) % n
+		}
+	}
+
+	// Ejected proxies are tried only after all others.
+	sort.SliceStable(idx, func(i, j int) bool {
+		return atomic.LoadInt32(&g.upstreams[idx[i]].ejected) <
+			atomic.LoadInt32(&g.upstreams[idx[j]].ejected)
+	})
+	return idx
+}
+
+// Dial connects to addr through one of the upstream proxies.
+// If all proxies are unreachable, it retries with exponential backoff.
+func (g *upstreamGroup) Dial(network, addr string) (net.Conn, error) {
+	backoff := g.backoff
+	for i := 0; ; i++ {
+		c, err := g.dial(network, addr)
+		if err == nil || i >= g.retries || !isUpstreamError(err) {
+			return c, err
+		}
+
+		if backoff > 0 {
+			// sleep for a random duration between backoff/2 and backoff
+			// so that clients do not retry at the same moment.
+			half := int64(backoff / 2)
+			time.Sleep(time.Duration(half + rand.Int63n(half+1)))
+			backoff *= 2
+			if backoff > maxDialBackoff {
+				backoff = maxDialBackoff
+			}
+		}
+	}
+}
+
+func (g *upstreamGroup) dial(network, addr string) (net.Conn, error) {
+	var lastErr error
+	for _, i := range g.order(addr) {
+		u := g.upstreams[i]
+		if !u.breaker.allow() {
+			if lastErr == nil {
+				lastErr = &upstreamError{errCircuitOpen}
+			}
+			continue
+		}
+
+		c, err := u.dial(network, addr)
+		if err == nil {
+			u.breaker.success()
+			if g.balance == BalanceFailover {
+				g.use(i)
+			}
+			return c, nil
+		}
+		if !isUpstreamError(err) {
+			// the proxy is working.
+			u.breaker.success()
+			return nil, err
+		}
+
+		fields := map[string]interface{}{
+			"upstream":  g.name,
+			"proxy_url": u.url,
+			log.FnError: err.Error(),
+		}
+		g.logger.Warn("upstream proxy is unreachable", fields)
+		if u.breaker.failure() {
+			delete(fields, log.FnError)
+			g.logger.Warn("circuit breaker opened", fields)
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// usesCredentials returns true if the user information of u is
+// "USER:PASSWORD" that can be replaced by ProxyCredentialsFile.
+func usesCredentials(u *url.URL) bool {
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5s":
+		return true
+	}
+	return false
+}
+
+// buildCredentials builds dialers of proxies with user information
+// replaced by user.  The dialer is nil for proxies not using credentials.
+// The dialers are closed if an error happens.
+func (g *upstreamGroup) buildCredentials(user *url.Userinfo) ([]proxy.Dialer, error) {
+	dialers := make([]proxy.Dialer, len(g.upstreams))
+	for i, up := range g.upstreams {
+		if !usesCredentials(up.src) {
+			continue
+		}
+		u := *up.src
+		u.User = user
+		err := validateProxyURL(&u)
+		if err == nil {
+			dialers[i], err = g.build(&u, up.forward)
+		}
+		if err != nil {
+			closeDialers(dialers)
+			return nil, err
+		}
+	}
+	return dialers, nil
+}
+
+// setDialers replaces dialers of proxies with those built by
+// buildCredentials, and closes the old ones.
+func (g *upstreamGroup) setDialers(dialers []proxy.Dialer) {
+	for i, up := range g.upstreams {
+		if dialers[i] == nil {
+			continue
+		}
+		old := up.proxyDialer()
+		up.setDialer(dialers[i])
+		closeDialer(old)
+	}
+}
+
+func closeDialers(dialers []proxy.Dialer) {
+	for _, d := range dialers {
+		if d != nil {
+			closeDialer(d)
+		}
+	}
+}
+
+// down returns true if all proxies of g are down.
+func (g *upstreamGroup) down() bool {
+	for _, u := range g.upstreams {
+		if !u.down() {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *upstreamGroup) stats() []UpstreamStats {
+	stats := make([]UpstreamStats, len(g.upstreams))
+	for i, u := range g.upstreams {
+		stats[i] = u.stats()
+		stats[i].Upstream = g.name
+	}
+	return stats
+}
+
+// newUpstreamGroup creates an upstreamGroup for proxies in urls.
+// Other parameters are taken from c.
+func newUpstreamGroup(name string, urls []*url.URL, balance BalanceMode, c *Config, forward proxy.Dialer, logger *log.Logger) (*upstreamGroup, error) {
+	build := func(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+		return newProxyDialer(u, upstreamForwarder{forward}, c.ProxyTLSConfig)
+	}
+
+	var upstreams []*upstream
+	for _, u := range urls {
+		// Proxies in ProxyChain are built once for each proxy, and kept
+		// when the dialer is rebuilt with new credentials.
+		f, err := newChainForwarder(c.ProxyChain, forward, c.ProxyTLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		d, err := build(u, f)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, &upstream{
+			url:     redactURL(u),
+			src:     u,
+			forward: f,
+			dialer:  d,
+			breaker: circuitBreaker{
+				threshold: c.CircuitBreakerThreshold,
+				timeout:   c.CircuitBreakerTimeout,
+			},
+		})
+	}
+
+	if balance == "" {
+		balance = BalanceFailover
+	}
+	return &upstreamGroup{
+		name:      name,
+		upstreams: upstreams,
+		balance:   balance,
+		failback:  c.FailbackInterval,
+		retries:   c.DialRetries,
+		backoff:   c.DialRetryBackoff,
+		logger:    logger,
+		build:     build,
+	}, nil
+}
@@ -0,0 +1,298 @@
+package transocks
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// newConnectProxy starts an HTTP proxy that only handles CONNECT.
+func newConnectProxy(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer dst.Close()
+
+		w.WriteHeader(http.StatusOK)
+		c, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		bufrw.Flush()
+
+		go io.Copy(dst, bufrw)
+		io.Copy(c, dst)
+	}))
+}
+
+// newEchoServer starts a TCP server that echoes back received data.
+func newEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func testEcho(t *testing.T, c net.Conn) {
+	msg := []byte("hello")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(msg) {
+		t.Errorf("unexpected echo: %q", buf)
+	}
+}
+
+func TestChainDialer(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	hop1 := newConnectProxy(t)
+	defer hop1.Close()
+	hop2 := newConnectProxy(t)
+	defer hop2.Close()
+
+	u1, err := url.Parse(hop1.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2, err := url.Parse(hop2.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := newChainDialer([]*url.URL{u1}, u2, &net.Dialer{Timeout: 5 * time.Second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testEcho(t, c)
+}
+
+func TestUpstreamGroupFailover(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	good := newConnectProxy(t)
+	defer good.Close()
+
+	// a closed listener gives an unreachable address.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := "http://" + l.Addr().String()
+	l.Close()
+
+	c := NewConfig()
+	c.ProxyURL, _ = url.Parse(bad)
+	u, _ := url.Parse(good.URL)
+	c.ProxyURLs = []*url.URL{u}
+	c.FailbackInterval = time.Hour
+
+	d, err := newUpstreamGroup(UpstreamDefault, append([]*url.URL{c.ProxyURL}, c.ProxyURLs...), c.Balance, c, &net.Dialer{Timeout: 5 * time.Second}, log.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+	if d.start() != 1 {
+		t.Error("fallback proxy should be in use")
+	}
+
+	// the destination is unreachable, but the proxy is reachable.
+	_, err = d.Dial("tcp", bad[len("http://"):])
+	if err == nil {
+		t.Fatal("dial should fail")
+	}
+	if isUpstreamError(err) {
+		t.Error("error from the destination should not be an upstream error:", err)
+	}
+
+	d.failback = time.Nanosecond
+	if d.start() != 0 {
+		t.Error("primary proxy should be tried after failback interval")
+	}
+}
+
+func TestUpstreamConnRaw(t *testing.T) {
+	t.Parallel()
+
+	echo := newEchoServer(t)
+	defer echo.Close()
+	p := newConnectProxy(t)
+	defer p.Close()
+
+	c := NewConfig()
+	c.ProxyURL, _ = url.Parse(p.URL)
+	g, err := newUpstreamGroup(UpstreamDefault, []*url.URL{c.ProxyURL}, c.Balance, c, &net.Dialer{Timeout: 5 * time.Second}, log.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := g.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*upstreamConn); !ok {
+		t.Fatalf("unexpected connection: %T", conn)
+	}
+
+	// io.CopyBuffer uses splice(2) only if both ends are *net.TCPConn.
+	if _, ok := rawConn(conn).(*net.TCPConn); !ok {
+		t.Errorf("upstream connection is not *net.TCPConn: %T", rawConn(conn))
+	}
+	client, err := net.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, ok := rawConn(client).(*net.TCPConn); !ok {
+		t.Errorf("client connection is not *net.TCPConn: %T", rawConn(client))
+	}
+	testEcho(t, rawConn(conn))
+}
+
+func TestUpstreamGroupOrder(t *testing.T) {
+	t.Parallel()
+
+	newGroup := func(balance BalanceMode) *upstreamGroup {
+		g := &upstreamGroup{balance: balance}
+		for _, u := range []string{"http://a:3128", "http://b:3128", "http://c:3128"} {
+			g.upstreams = append(g.upstreams, &upstream{url: u})
+		}
+		return g
+	}
+
+	g := newGroup(BalanceRoundRobin)
+	for i := 0; i < 6; i++ {
+		idx := g.order("www.example.com:443")
+		if idx[0] != i%3 || idx[1] != (i+1)%3 || idx[2] != (i+2)%3 {
+			t.Errorf("unexpected round-robin order at %d: %v", i, idx)
+		}
+	}
+
+	g = newGroup(BalanceLeastConn)
+	g.upstreams[0].active = 3
+	g.upstreams[1].active = 1
+	g.upstreams[2].active = 2
+	idx := g.order("www.example.com:443")
+	if idx[0] != 1 || idx[1] != 2 || idx[2] != 0 {
+		t.Error("unexpected least-connections order:", idx)
+	}
+
+	g = newGroup(BalanceHash)
+	idx1 := g.order("www.example.com:443")
+	idx2 := g.order("www.example.com:80")
+	for i := range idx1 {
+		if idx1[i] != idx2[i] {
+			t.Error("the same host should be mapped to the same proxy:", idx1, idx2)
+		}
+	}
+	g.upstreams = append(g.upstreams[:idx1[1]], g.upstreams[idx1[1]+1:]...)
+	if g.upstreams[g.order("www.example.com:443")[0]].url != newGroup(BalanceHash).upstreams[idx1[0]].url {
+		t.Error("removing another proxy should not change the mapping")
+	}
+}
+
+func TestUpstreamGroupDown(t *testing.T) {
+	t.Parallel()
+
+	g := &upstreamGroup{}
+	for _, u := range []string{"http://a:3128", "http://b:3128"} {
+		g.upstreams = append(g.upstreams, &upstream{
+			url:     u,
+			breaker: circuitBreaker{threshold: 1, timeout: time.Hour},
+		})
+	}
+	if g.down() {
+		t.Error("group should not be down")
+	}
+
+	g.upstreams[0].ejected = 1
+	if g.down() {
+		t.Error("group with a working proxy should not be down")
+	}
+	g.upstreams[1].breaker.failure()
+	if !g.down() {
+		t.Error("group should be down")
+	}
+	g.upstreams[0].ejected = 0
+	if g.down() {
+		t.Error("group with a restored proxy should not be down")
+	}
+}
+
+func TestUpstreamGroupRetry(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := "http://" + l.Addr().String()
+	l.Close()
+
+	c := NewConfig()
+	c.ProxyURL, _ = url.Parse(bad)
+	c.DialRetries = 2
+	c.DialRetryBackoff = time.Millisecond
+
+	g, err := newUpstreamGroup(UpstreamDefault, []*url.URL{c.ProxyURL}, c.Balance, c, &net.Dialer{Timeout: 5 * time.Second}, log.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.Dial("tcp", "www.example.com:443")
+	if err == nil {
+		t.Fatal("dial should fail")
+	}
+	if n := g.stats()[0].Failures; n != 3 {
+		t.Error("dial should be tried 3 times:", n)
+	}
+}